@@ -0,0 +1,72 @@
+package bitcask_go
+
+import "time"
+
+// startAutoMerge 启动后台自动 merge 的协程
+func (db *DB) startAutoMerge() {
+	if db.options.AutoMergeInterval <= 0 {
+		return
+	}
+	db.autoMergeStop = make(chan struct{})
+	db.autoMergeDone = make(chan struct{})
+	go db.autoMerge()
+}
+
+// stopAutoMerge 停止后台自动 merge 的协程，并等待正在进行的 merge 完成
+func (db *DB) stopAutoMerge() {
+	if db.autoMergeStop == nil {
+		return
+	}
+	close(db.autoMergeStop)
+	<-db.autoMergeDone
+	db.autoMergeStop = nil
+}
+
+func (db *DB) autoMerge() {
+	defer close(db.autoMergeDone)
+	ticker := time.NewTicker(db.options.AutoMergeInterval)
+	defer ticker.Stop()
+	var lastMerge time.Time
+	for {
+		select {
+		case <-db.autoMergeStop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(lastMerge) < db.options.AutoMergeMinInterval {
+				continue
+			}
+			if db.isQuietHour(now) || !db.needAutoMerge() {
+				continue
+			}
+			// 未达到 merge 条件或者正在 merge 时会返回错误，等待下一次检查即可
+			if err := db.Merge(); err == nil {
+				lastMerge = now
+			}
+		}
+	}
+}
+
+// needAutoMerge 判断数据文件数量和可回收空间的比例是否达到自动 merge 的条件
+func (db *DB) needAutoMerge() bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if len(db.olderFiles)+1 < db.options.AutoMergeMinFiles {
+		return false
+	}
+	return db.reachMergeCondition()
+}
+
+// isQuietHour 判断当前是否处于静默时段
+func (db *DB) isQuietHour(now time.Time) bool {
+	start, end := db.options.AutoMergeQuietHours[0], db.options.AutoMergeQuietHours[1]
+	hour := now.Hour()
+	switch {
+	case start == end:
+		return false
+	case start < end:
+		return hour >= start && hour < end
+	default:
+		// 静默时段跨越零点，例如 [22, 6)
+		return hour >= start || hour < end
+	}
+}
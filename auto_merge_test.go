@@ -0,0 +1,70 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_AutoMerge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-auto-merge")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(32*1024*1024), WithSyncWrite(false),
+		WithDataFileMergeRatio(0.3), WithAutoMergeInterval(50*time.Millisecond), WithAutoMergeMinFiles(1))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 8000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// 达到 merge 比例之后后台会自动进行 merge
+	mergeFinFile := filepath.Join(dir, data.MergeFinishedName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(mergeFinFile)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// 关闭时会停止后台协程，重启之后数据依然正确
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(32*1024*1024), WithSyncWrite(false))
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 2000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(9000))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
+
+func TestDB_isQuietHour(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	db := &DB{}
+	assert.False(t, db.isQuietHour(at(3)))
+
+	db.options.AutoMergeQuietHours = [2]int{9, 18}
+	assert.True(t, db.isQuietHour(at(9)))
+	assert.True(t, db.isQuietHour(at(17)))
+	assert.False(t, db.isQuietHour(at(18)))
+	assert.False(t, db.isQuietHour(at(3)))
+
+	// 跨越零点
+	db.options.AutoMergeQuietHours = [2]int{22, 6}
+	assert.True(t, db.isQuietHour(at(23)))
+	assert.True(t, db.isQuietHour(at(0)))
+	assert.False(t, db.isQuietHour(at(6)))
+	assert.False(t, db.isQuietHour(at(12)))
+}
@@ -1,6 +1,7 @@
 package bitcask_go
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/rbongIO/bitcask-go/data"
 	"github.com/rbongIO/bitcask-go/index"
@@ -17,6 +18,7 @@ type WriteBatch struct {
 	mu            *sync.Mutex
 	db            *DB
 	pendingWrites map[string]*data.LogRecord //暂存用户写入的数据
+	pendingRanges []*data.LogRecord          //暂存的范围删除，提交时在其他数据之前写入
 }
 
 func (db *DB) NewWriteBatch(opts ...WriteBatchOption) *WriteBatch {
@@ -76,26 +78,72 @@ func (wb *WriteBatch) Delete(key []byte) error {
 	return nil
 }
 
+// DeleteRange 删除 [start, end) 范围内的所有 key，end 为空表示没有上界
+// 之前暂存的范围内的写入会被丢弃，之后暂存的写入不受影响
+func (wb *WriteBatch) DeleteRange(start, end []byte) error {
+	if len(end) != 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for key := range wb.pendingWrites {
+		if bytes.Compare([]byte(key), start) >= 0 && (len(end) == 0 || bytes.Compare([]byte(key), end) < 0) {
+			delete(wb.pendingWrites, key)
+		}
+	}
+	wb.pendingRanges = append(wb.pendingRanges, &data.LogRecord{
+		Key:   start,
+		Value: end,
+		Type:  data.LogRecordRangeDeleted,
+	})
+	return nil
+}
+
+// DeletePrefix 删除所有以 prefix 为前缀的 key
+func (wb *WriteBatch) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyIsEmpty
+	}
+	start, end := prefixRange(prefix)
+	return wb.DeleteRange(start, end)
+}
+
 func (wb *WriteBatch) Commit() error {
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
 
-	if len(wb.pendingWrites) == 0 {
+	if len(wb.pendingWrites) == 0 && len(wb.pendingRanges) == 0 {
 		return nil
 	}
-	if uint(len(wb.pendingWrites)) > wb.options.MaxBatchNum {
+	if uint(len(wb.pendingWrites)+len(wb.pendingRanges)) > wb.options.MaxBatchNum {
 		return ErrBatchNumExceeded
 	}
 	// 加锁保证事务提交的串行化
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
+	if err := wb.db.update(wb.options.SyncWrites, func() error {
+		return wb.db.commitPendingWrites(wb.pendingRanges, wb.pendingWrites)
+	}); err != nil {
+		return err
+	}
+
+	//清空暂存数据
+	wb.pendingWrites = make(map[string]*data.LogRecord)
+	wb.pendingRanges = nil
+	return nil
+}
+
+// commitPendingWrites 以事务的方式写入暂存的数据，并更新内存索引，是否持久化由调用方决定
+// 范围删除在其他数据之前写入和生效，暂存的写入都发生在范围删除之后
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) commitPendingWrites(pendingRanges []*data.LogRecord, pendingWrites map[string]*data.LogRecord) error {
 	// 写入数据
 	// 1. 获取当前最新的序列号
-	seqNum := atomic.AddUint64(&wb.db.seqNum, 1)
+	seqNum := atomic.AddUint64(&db.seqNum, 1)
 	positions := make(map[string]*data.LogRecordPos)
 	// 2. 开始写数据到数据文件当中
-	for _, record := range wb.pendingWrites {
-		pos, err := wb.db.appendLogRecord(&data.LogRecord{
+	var rangeSize int64
+	for _, record := range pendingRanges {
+		pos, err := db.appendLogRecord(&data.LogRecord{
 			Key:   logRecordKeyWithSeqNum(record.Key, seqNum),
 			Value: record.Value,
 			Type:  record.Type,
@@ -103,6 +151,18 @@ func (wb *WriteBatch) Commit() error {
 		if err != nil {
 			return err
 		}
+		rangeSize += int64(pos.Size)
+	}
+	for _, record := range pendingWrites {
+		pos, err := db.appendLogRecord(&data.LogRecord{
+			Key:    logRecordKeyWithSeqNum(record.Key, seqNum),
+			Value:  record.Value,
+			Type:   record.Type,
+			Expire: record.Expire,
+		})
+		if err != nil {
+			return err
+		}
 		positions[string(record.Key)] = pos
 	}
 
@@ -111,34 +171,30 @@ func (wb *WriteBatch) Commit() error {
 		Key:  logRecordKeyWithSeqNum(txnFinKey, seqNum),
 		Type: data.LogRecordTxnFinished,
 	}
-	if _, err := wb.db.appendLogRecord(finRecord); err != nil {
+	if _, err := db.appendLogRecord(finRecord); err != nil {
 		return err
 	}
-	//根据配置进行持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.Sync(); err != nil {
-			return err
-		}
-	}
 	// 更新内存索引
-	for _, rec := range wb.pendingWrites {
+	db.reclaimSize += rangeSize
+	for _, rec := range pendingRanges {
+		db.deleteIndexRange(rec.Key, rec.Value)
+	}
+	for _, rec := range pendingWrites {
 		pos := positions[string(rec.Key)]
+		db.recordWrite(rec.Key)
 		var oldPos *data.LogRecordPos
 		switch rec.Type {
 		case data.LogRecordNormal:
-			oldPos = wb.db.index.Put(rec.Key, pos)
+			oldPos = db.index.Put(rec.Key, pos)
 		case data.LogRecordDeleted:
-			oldPos, _ = wb.db.index.Delete(rec.Key)
+			oldPos, _ = db.index.Delete(rec.Key)
 		default:
 			panic("unhandled default case")
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			db.reclaimSize += int64(oldPos.Size)
 		}
 	}
-
-	//清空暂存数据
-	wb.pendingWrites = make(map[string]*data.LogRecord)
 	return nil
 }
 
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/assert"
 	"log"
 	"math/rand"
+	"os"
 	"testing"
 )
 
@@ -34,3 +35,41 @@ func TestDB_NewWriteBatch(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, value1, val)
 }
+
+func TestWriteBatch_DeleteRange(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-delete-range")
+	db, err := Open(WithDirPath(dir))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(rangeTestKey(i), utils.GetTestValue(24)))
+	}
+
+	wb := db.NewWriteBatch()
+	// 范围删除之前暂存的写入会被删除，之后暂存的写入会保留
+	assert.Nil(t, wb.Put(rangeTestKey(200), []byte("before")))
+	assert.Nil(t, wb.DeletePrefix([]byte("range-key-0002")))
+	assert.Nil(t, wb.DeleteRange(rangeTestKey(10), rangeTestKey(20)))
+	assert.Nil(t, wb.Put(rangeTestKey(15), []byte("after")))
+	assert.Equal(t, ErrInvalidRange, wb.DeleteRange(rangeTestKey(20), rangeTestKey(20)))
+	// 提交之前不会生效
+	assert.Equal(t, 100, len(db.ListKeys()))
+	assert.Nil(t, wb.Commit())
+
+	check := func(db *DB) {
+		assert.Equal(t, 91, len(db.ListKeys()))
+		_, err := db.Get(rangeTestKey(200))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(rangeTestKey(10))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db.Get(rangeTestKey(15))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("after"), val)
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+	db2, err := Open(WithDirPath(dir))
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.Close())
+}
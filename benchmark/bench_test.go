@@ -2,6 +2,7 @@ package benchmark
 
 import (
 	"errors"
+	"fmt"
 	bitcask "github.com/rbongIO/bitcask-go"
 	"github.com/rbongIO/bitcask-go/utils"
 	"log"
@@ -83,3 +84,33 @@ func BenchmarkDelete(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkSmallValue 比较标准 IO 和文件映射读写小 value 的耗时
+func BenchmarkSmallValue(b *testing.B) {
+	for _, ioType := range []bitcask.IOType{bitcask.IOTypeStandard, bitcask.IOTypeMMap} {
+		dir, _ := os.MkdirTemp("/tmp", "bitcask-go")
+		smallDB, err := bitcask.Open(bitcask.WithDirPath(dir), bitcask.WithIndexType(bitcask.ART), bitcask.WithIOType(ioType))
+		if err != nil {
+			b.Fatal(err)
+		}
+		value := utils.GetTestValue(64)
+		b.Run(fmt.Sprintf("Put-%d", ioType), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := smallDB.Put(utils.GetTestKey(i), value); err != nil {
+					b.Fatalf("Put() error = %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Get-%d", ioType), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := smallDB.Get(utils.GetTestKey(i % 10000)); err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
+					b.Fatalf("Get() error = %v", err)
+				}
+			}
+		})
+		_ = smallDB.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
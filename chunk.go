@@ -0,0 +1,284 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// defaultChunkSize 没有设置 ChunkSize 时 PutReader 使用的分块大小
+const defaultChunkSize = 4 * 1024 * 1024
+
+// 分块存储的大 value
+// value 被拆分为多个分块记录按顺序写入，最后写入记录了所有分块位置的清单记录，
+// 分块和清单使用同一个事务序列号，写入事务完成标识之后才生效，内存索引中只保存清单的位置
+
+// PutReader 从 r 中读取 value 并分块写入，写入完成之前读取到的是 key 原来的数据
+// 每个分块单独加锁写入，读取 r 的过程不会阻塞其他读写，写入期间不能 merge
+func (db *DB) PutReader(key []byte, r io.Reader) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	db.mu.Lock()
+	db.chunkWriters++
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		db.chunkWriters--
+		db.mu.Unlock()
+	}()
+
+	seqNum := atomic.AddUint64(&db.seqNum, 1)
+	manifest := &data.ChunkManifest{}
+	// 写入失败时已经写入的分块不会被引用，计入可回收空间
+	abort := func(err error) error {
+		db.mu.Lock()
+		db.reclaimSize += int64(manifest.ChunkedSize(0))
+		db.mu.Unlock()
+		return err
+	}
+	buf := make([]byte, db.chunkSize())
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			// 分块不需要单独持久化，提交清单时会一起持久化
+			db.mu.Lock()
+			err := db.appendChunk(key, seqNum, manifest, buf[:n])
+			db.mu.Unlock()
+			if err != nil {
+				return abort(err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return abort(err)
+		}
+	}
+	return db.update(false, func() error {
+		return db.commitChunkManifest(key, seqNum, manifest, 0)
+	})
+}
+
+// chunkSize 返回分块的大小
+func (db *DB) chunkSize() int64 {
+	if db.options.ChunkSize > 0 {
+		return db.options.ChunkSize
+	}
+	return defaultChunkSize
+}
+
+// putChunkedRecord 将 value 拆分为多个分块写入并更新内存索引
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) putChunkedRecord(key []byte, value []byte, expire int64) error {
+	seqNum := atomic.AddUint64(&db.seqNum, 1)
+	manifest := &data.ChunkManifest{}
+	chunkSize := db.chunkSize()
+	for start := int64(0); start < int64(len(value)); start += chunkSize {
+		end := min(start+chunkSize, int64(len(value)))
+		if err := db.appendChunk(key, seqNum, manifest, value[start:end]); err != nil {
+			return err
+		}
+	}
+	return db.commitChunkManifest(key, seqNum, manifest, expire)
+}
+
+// appendChunk 写入一个分块，并将其位置添加到清单中
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) appendChunk(key []byte, seqNum uint64, manifest *data.ChunkManifest, chunk []byte) error {
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeqNum(key, seqNum),
+		Value: chunk,
+		Type:  data.LogRecordChunk,
+	})
+	if err != nil {
+		return err
+	}
+	manifest.Size += int64(len(chunk))
+	manifest.Chunks = append(manifest.Chunks, pos)
+	return nil
+}
+
+// commitChunkManifest 写入清单和事务完成标识，并更新内存索引
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) commitChunkManifest(key []byte, seqNum uint64, manifest *data.ChunkManifest, expire int64) error {
+	pos, err := db.appendLogRecord(&data.LogRecord{
+		Key:    logRecordKeyWithSeqNum(key, seqNum),
+		Value:  manifest.Encode(),
+		Type:   data.LogRecordChunkManifest,
+		Expire: expire,
+	})
+	if err != nil {
+		return err
+	}
+	finRecord := &data.LogRecord{
+		Key:  logRecordKeyWithSeqNum(txnFinKey, seqNum),
+		Type: data.LogRecordTxnFinished,
+	}
+	if _, err := db.appendLogRecord(finRecord); err != nil {
+		return err
+	}
+	pos.Chunked = true
+	pos.Size = manifest.ChunkedSize(int64(pos.Size))
+	db.recordWrite(key)
+	if oldPos := db.index.Put(key, pos); oldPos != nil {
+		db.reclaimSize += int64(oldPos.Size)
+	}
+	return nil
+}
+
+// GetReader 返回读取 key 对应数据的 io.ReadCloser，分块存储的数据在读取时才逐个读取分块
+// 读取期间引用的数据文件不会被 merge 关闭，使用完毕后需要调用 Close
+func (db *DB) GetReader(key []byte) (io.ReadCloser, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	// 引用数据文件需要持有写锁
+	db.lockSynced(true, key)
+	defer db.mu.Unlock()
+	recordPos := db.index.Get(key)
+	if recordPos == nil || recordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	dataFile := db.dataFile(recordPos.Fid)
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	record, err := dataFile.ReadLogRecord(recordPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if record.Type != data.LogRecordChunkManifest {
+		value, err := recordValue(db.dataFile, record)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(value)), nil
+	}
+	manifest, err := data.DecodeChunkManifest(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[uint32]*data.DataFile)
+	for _, pos := range manifest.Chunks {
+		if files[pos.Fid] = db.dataFile(pos.Fid); files[pos.Fid] == nil {
+			return nil, ErrDataFileNotFound
+		}
+	}
+	db.pinFileSet(files)
+	return &chunkReader{db: db, files: files, chunks: manifest.Chunks}, nil
+}
+
+// chunkReader 按顺序读取分块存储的 value
+// 引用的数据文件在 Close 之前不会被关闭，数据文件又是追加写入的，读取时不需要持有锁
+type chunkReader struct {
+	db     *DB
+	files  map[uint32]*data.DataFile
+	chunks []*data.LogRecordPos // 还没有读取的分块
+	cur    []byte               // 当前分块中还没有读取的数据
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if cr.files == nil {
+		return 0, os.ErrClosed
+	}
+	for len(cr.cur) == 0 {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		chunk, err := readChunk(filesByID(cr.files), cr.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		cr.cur, cr.chunks = chunk, cr.chunks[1:]
+	}
+	n := copy(p, cr.cur)
+	cr.cur = cr.cur[n:]
+	return n, nil
+}
+
+// Close 释放对数据文件的引用，可以重复调用
+func (cr *chunkReader) Close() error {
+	if cr.files == nil {
+		return nil
+	}
+	cr.db.mu.Lock()
+	cr.db.unpinFiles(cr.files)
+	cr.db.mu.Unlock()
+	cr.files = nil
+	return nil
+}
+
+// readChunk 读取一个分块的数据
+func readChunk(files func(fid uint32) *data.DataFile, pos *data.LogRecordPos) ([]byte, error) {
+	dataFile := files(pos.Fid)
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	record, err := dataFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if record.Type != data.LogRecordChunk {
+		return nil, ErrInvalidChunk
+	}
+	return record.Value, nil
+}
+
+// readChunkedValue 读取清单中的所有分块并拼接为完整的 value
+func readChunkedValue(files func(fid uint32) *data.DataFile, manifestValue []byte) ([]byte, error) {
+	manifest, err := data.DecodeChunkManifest(manifestValue)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, 0, manifest.Size)
+	for _, pos := range manifest.Chunks {
+		chunk, err := readChunk(files, pos)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, chunk...)
+	}
+	return value, nil
+}
+
+// rewriteChunkedRecord merge 时将清单引用的所有分块和清单本身写入 mergeDB，返回清单新的位置
+func rewriteChunkedRecord(mergeDB *DB, files func(fid uint32) *data.DataFile, key []byte, record *data.LogRecord) (*data.LogRecordPos, error) {
+	manifest, err := data.DecodeChunkManifest(record.Value)
+	if err != nil {
+		return nil, err
+	}
+	newManifest := &data.ChunkManifest{}
+	for _, pos := range manifest.Chunks {
+		chunk, err := readChunk(files, pos)
+		if err != nil {
+			return nil, err
+		}
+		if err := mergeDB.appendChunk(key, nonTransactionSeqNum, newManifest, chunk); err != nil {
+			return nil, err
+		}
+	}
+	pos, err := mergeDB.appendLogRecord(&data.LogRecord{
+		Key:    logRecordKeyWithSeqNum(key, nonTransactionSeqNum),
+		Value:  newManifest.Encode(),
+		Type:   data.LogRecordChunkManifest,
+		Expire: record.Expire,
+	})
+	if err != nil {
+		return nil, err
+	}
+	pos.Chunked = true
+	pos.Size = newManifest.ChunkedSize(int64(pos.Size))
+	return pos, nil
+}
+
+// filesByID 根据文件 id 在 files 中查找数据文件
+func filesByID(files map[uint32]*data.DataFile) func(fid uint32) *data.DataFile {
+	return func(fid uint32) *data.DataFile {
+		return files[fid]
+	}
+}
@@ -0,0 +1,156 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"errors"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingReader 读取 n 个字节之后返回错误
+type failingReader struct {
+	r io.Reader
+	n int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.n <= 0 {
+		return 0, errors.New("read failed")
+	}
+	if len(p) > fr.n {
+		p = p[:fr.n]
+	}
+	n, err := fr.r.Read(p)
+	fr.n -= n
+	return n, err
+}
+
+func readAll(t *testing.T, db *DB, key []byte) []byte {
+	r, err := db.GetReader(key)
+	assert.Nil(t, err)
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return value
+}
+
+func TestDB_PutReader(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-put-reader")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithChunkSize(64 * 1024),
+			WithMaxDataFileSize(256 * 1024), WithDataFileMergeRatio(0)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+
+		// 跨越多个数据文件的大 value
+		large := utils.RandomValue(1024*1024 + 100)
+		assert.Nil(t, db.PutReader(utils.GetTestKey(1), bytes.NewReader(large)))
+		assert.Greater(t, len(db.olderFiles), 2)
+		assert.True(t, db.index.Get(utils.GetTestKey(1)).Chunked)
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+		assert.Equal(t, large, readAll(t, db, utils.GetTestKey(1)))
+
+		// 超过 ChunkSize 的 Put 同样分块存储，没有超过的不分块
+		large2 := utils.RandomValue(200 * 1024)
+		assert.Nil(t, db.Put(utils.GetTestKey(2), large2))
+		assert.True(t, db.index.Get(utils.GetTestKey(2)).Chunked)
+		assert.Nil(t, db.Put(utils.GetTestKey(3), []byte("small")))
+		assert.False(t, db.index.Get(utils.GetTestKey(3)).Chunked)
+		assert.Equal(t, []byte("small"), readAll(t, db, utils.GetTestKey(3)))
+		_, err = db.GetReader(utils.GetTestKey(4))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 空的 value
+		assert.Nil(t, db.PutReader(utils.GetTestKey(5), bytes.NewReader(nil)))
+		val, err = db.Get(utils.GetTestKey(5))
+		assert.Nil(t, err)
+		assert.Empty(t, val)
+
+		values, errs := db.MultiGet([][]byte{utils.GetTestKey(2), utils.GetTestKey(3), utils.GetTestKey(1)})
+		assert.Equal(t, []error{nil, nil, nil}, errs)
+		assert.Equal(t, [][]byte{large2, []byte("small"), large}, values)
+
+		// 覆盖之后所有的分块都可以回收
+		reclaimSize := db.Stat().ReclaimableSize
+		assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("small")))
+		assert.Greater(t, db.Stat().ReclaimableSize-reclaimSize, int64(len(large2)))
+
+		// 设置过期时间之后依然分块存储
+		assert.Nil(t, db.Expire(utils.GetTestKey(1), time.Hour))
+		assert.True(t, db.index.Get(utils.GetTestKey(1)).Chunked)
+
+		// 读取中途 merge，已经打开的 reader 依然可以读取
+		r, err := db.GetReader(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		head := make([]byte, 100)
+		_, err = io.ReadFull(r, head)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge())
+		rest, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, large, append(head, rest...))
+		assert.Nil(t, r.Close())
+		assert.Nil(t, r.Close())
+
+		// 写入失败时保留原来的数据，已经写入的分块可以回收
+		reclaimSize = db.Stat().ReclaimableSize
+		err = db.PutReader(utils.GetTestKey(1), &failingReader{r: bytes.NewReader(large2), n: 100 * 1024})
+		assert.NotNil(t, err)
+		assert.Greater(t, db.Stat().ReclaimableSize-reclaimSize, int64(64*1024))
+		assert.Equal(t, large, readAll(t, db, utils.GetTestKey(1)))
+
+		// 重启之后分块存储的数据依然可以读取，没有完成的写入被忽略
+		assert.Nil(t, db.Close())
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, large, readAll(t, db, utils.GetTestKey(1)))
+		val, err = db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+		ttl, err := db.TTL(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, time.Duration(0))
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		assert.True(t, db.index.Get(utils.GetTestKey(1)).Chunked)
+		assert.Equal(t, large, readAll(t, db, utils.GetTestKey(1)))
+		destroyDB(db)
+	}
+}
+
+func TestDB_PutReaderMerge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-reader-merge")
+	db, err := Open(WithDirPath(dir), WithChunkSize(1024), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- db.PutReader(utils.GetTestKey(1), pr)
+	}()
+	value := utils.RandomValue(10 * 1024)
+	_, err = pw.Write(value[:5*1024])
+	assert.Nil(t, err)
+
+	// 写入过程中不能 merge，写入的分块还没有被索引引用
+	assert.Equal(t, ErrChunkedWriteInProgress, db.Merge())
+	// 写入过程中读取到的是原来的数据
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	_, err = pw.Write(value[5*1024:])
+	assert.Nil(t, err)
+	assert.Nil(t, pw.Close())
+	assert.Nil(t, <-done)
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, value, readAll(t, db, utils.GetTestKey(1)))
+}
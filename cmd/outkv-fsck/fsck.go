@@ -0,0 +1,527 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/fio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 和 bitcask 包中的定义保持一致
+	mergeDirName        = "-merge"
+	bptreeIndexFileName = "bptree-index"
+	fileLockName        = "flock"
+	// 最多输出多少条 hint 文件和数据文件不一致的详情
+	maxHintMismatchReports = 10
+)
+
+// dataFileInfo 一个数据文件的检查结果
+type dataFileInfo struct {
+	fid        uint32
+	path       string // 数据文件路径，merge 没有完成替换时可能在 merge 目录中
+	size       int64  // 不包含文件头的长度
+	validSize  int64  // 最后一条完整记录之后的位置
+	headerSize int64  // 文件头的长度，旧格式的文件没有文件头
+}
+
+// checker 检查数据目录中的所有文件，记录发现的问题
+type checker struct {
+	dir        string
+	issues     []string
+	dataFiles  []*dataFileInfo
+	hintPath   string // hint 文件路径，为空表示不存在
+	finPath    string // merge 完成标识文件路径，为空表示不存在
+	seqNumPath string // 事务序列号文件路径，为空表示不存在
+	// 以下文件检查出问题之后修复时不会复制
+	hintBroken   bool
+	seqNumBroken bool
+	// merge 目录中有尚未替换完成的 merge，打开数据库时会继续完成
+	pendingMerge bool
+	// 读取加密的数据文件和 hint 文件使用的密钥
+	cipher *data.Cipher
+}
+
+func newChecker(dir string, cipher *data.Cipher) *checker {
+	return &checker{dir: dir, cipher: cipher}
+}
+
+// openDataFile 打开数据文件或者 hint 文件并校验文件头，设置了密钥时会解密读取的记录
+// 没有文件头的旧格式文件从文件开头读取记录
+func (c *checker) openDataFile(path string, fid uint32) (*data.DataFile, error) {
+	dataFile, err := data.NewDataFile(fio.OSFileSystem, path, fid, fio.StandardFIO)
+	if err != nil {
+		return nil, err
+	}
+	if err := dataFile.ReadHeader(); err != nil && err != data.ErrLegacyFileFormat {
+		_ = dataFile.Close()
+		return nil, err
+	}
+	dataFile.Cipher = c.cipher
+	return dataFile, nil
+}
+
+// isFileHeaderError 判断打开文件时的错误是否是因为文件头无法识别
+func isFileHeaderError(err error) bool {
+	return err == data.ErrUnsupportedFileFormat || err == data.ErrInvalidFileHeader
+}
+
+// reportLegacyFile 旧格式的文件可以检查，但是打开数据库之前需要先升级
+func (c *checker) reportLegacyFile(path string, dataFile *data.DataFile, size int64) {
+	if dataFile.Header == nil && size > 0 {
+		c.report("%s: %v", path, data.ErrLegacyFileFormat)
+	}
+}
+
+func (c *checker) report(format string, args ...any) {
+	c.issues = append(c.issues, fmt.Sprintf(format, args...))
+}
+
+// check 依次检查 merge 目录、数据文件、hint 文件和事务序列号文件
+func (c *checker) check() error {
+	if err := c.collectFiles(); err != nil {
+		return err
+	}
+	if err := c.checkDataFiles(); err != nil {
+		return err
+	}
+	if err := c.checkHintFile(); err != nil {
+		return err
+	}
+	return c.checkSeqNumFile()
+}
+
+// collectFiles 找出打开数据库时会使用的文件
+// merge 目录中有完成标识时，打开数据库会用其中的文件替换旧文件，这里按照同样的规则处理
+func (c *checker) collectFiles() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	files := make(map[uint32]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, data.DataFileNameSuffix):
+			fid, err := strconv.ParseUint(strings.TrimSuffix(name, data.DataFileNameSuffix), 10, 32)
+			if err != nil {
+				c.report("%s: invalid data file name", name)
+				continue
+			}
+			files[uint32(fid)] = filepath.Join(c.dir, name)
+		case name == data.HintFileName:
+			c.hintPath = filepath.Join(c.dir, name)
+		case name == data.MergeFinishedName:
+			c.finPath = filepath.Join(c.dir, name)
+		case name == data.SeqNumFileName:
+			c.seqNumPath = filepath.Join(c.dir, name)
+		}
+	}
+
+	mergePath := filepath.Join(filepath.Dir(filepath.Clean(c.dir)), filepath.Base(c.dir)+mergeDirName)
+	if info, err := os.Stat(mergePath); err == nil && info.IsDir() {
+		if err := c.collectMergeFiles(mergePath, files); err != nil {
+			return err
+		}
+	}
+
+	for fid, path := range files {
+		c.dataFiles = append(c.dataFiles, &dataFileInfo{fid: fid, path: path})
+	}
+	sort.Slice(c.dataFiles, func(i, j int) bool {
+		return c.dataFiles[i].fid < c.dataFiles[j].fid
+	})
+	return nil
+}
+
+func (c *checker) collectMergeFiles(mergePath string, files map[uint32]string) error {
+	finPath := filepath.Join(mergePath, data.MergeFinishedName)
+	if _, err := os.Stat(finPath); err != nil {
+		c.report("%s: leftover merge directory without %s, it will be discarded on open", mergePath, data.MergeFinishedName)
+		return nil
+	}
+	nonMergeFileID, mergedFileNum, err := readMergeFinished(finPath)
+	if err != nil {
+		c.report("%s: leftover merge directory with a broken %s: %v", mergePath, data.MergeFinishedName, err)
+		return nil
+	}
+	c.report("%s: leftover merge directory, the merge will be applied on open", mergePath)
+	c.pendingMerge = true
+	c.finPath = finPath
+	entries, err := os.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == data.HintFileName {
+			c.hintPath = filepath.Join(mergePath, name)
+			continue
+		}
+		if !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+		fid, err := strconv.ParseUint(strings.TrimSuffix(name, data.DataFileNameSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		files[uint32(fid)] = filepath.Join(mergePath, name)
+	}
+	// merge 之后这部分旧文件会被删除
+	for fid := mergedFileNum; fid < nonMergeFileID; fid++ {
+		delete(files, fid)
+	}
+	return nil
+}
+
+// checkDataFiles 读取所有数据文件中的记录，检查损坏的记录和没有完成的事务
+func (c *checker) checkDataFiles() error {
+	// 事务序列号 -> 还没有遇到事务完成标识的记录数量
+	txns := make(map[uint64]int)
+	for _, info := range c.dataFiles {
+		dataFile, err := c.openDataFile(info.path, info.fid)
+		if isFileHeaderError(err) {
+			// 文件头无法识别时整个文件都无法读取
+			c.report("%s: %v", info.path, err)
+			if stat, err := os.Stat(info.path); err == nil {
+				info.size = stat.Size()
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		info.headerSize = dataFile.HeaderSize()
+		info.size, err = dataFile.Size()
+		if err != nil {
+			_ = dataFile.Close()
+			return err
+		}
+		c.reportLegacyFile(info.path, dataFile, info.size)
+		var offset int64
+		for {
+			rec, size, err := dataFile.ReadLogRecordWithSize(offset)
+			if err != nil {
+				if err := c.reportReadError(info, offset, err); err != nil {
+					_ = dataFile.Close()
+					return err
+				}
+				break
+			}
+			seqNum, n := binary.Uvarint(rec.Key)
+			if n > 0 && seqNum != 0 {
+				if rec.Type == data.LogRecordTxnFinished {
+					delete(txns, seqNum)
+				} else {
+					txns[seqNum]++
+				}
+			}
+			offset += size
+		}
+		info.validSize = offset
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+	}
+	seqNums := make([]uint64, 0, len(txns))
+	for seqNum := range txns {
+		seqNums = append(seqNums, seqNum)
+	}
+	sort.Slice(seqNums, func(i, j int) bool { return seqNums[i] < seqNums[j] })
+	for _, seqNum := range seqNums {
+		c.report("transaction %d: %d records without a txn finished marker, they are ignored on open", seqNum, txns[seqNum])
+	}
+	return nil
+}
+
+// reportReadError 记录数据文件在 offset 处无法继续读取的原因，不是记录损坏导致的错误直接返回
+func (c *checker) reportReadError(info *dataFileInfo, offset int64, err error) error {
+	switch {
+	case err == io.EOF && offset < info.size:
+		c.report("%s: %d unreadable bytes at offset %d", info.path, info.size-offset, offset)
+	case err == data.ErrInvalidCRC:
+		c.report("%s: bad crc at offset %d, %d bytes after it are unreadable", info.path, offset, info.size-offset)
+	case err == data.ErrIncompleteRecord:
+		c.report("%s: truncated record at offset %d, %d bytes after it are unreadable", info.path, offset, info.size-offset)
+	case err != io.EOF:
+		return err
+	}
+	return nil
+}
+
+// checkHintFile 检查 hint 文件中的每条索引是否指向 merge 之后数据文件中对应的记录
+func (c *checker) checkHintFile() error {
+	if c.hintPath == "" {
+		return nil
+	}
+	var nonMergeFileID uint32
+	if c.finPath == "" {
+		c.report("%s: hint file exists without %s", c.hintPath, data.MergeFinishedName)
+		c.hintBroken = true
+	} else {
+		var err error
+		if nonMergeFileID, _, err = readMergeFinished(c.finPath); err != nil {
+			c.report("%s: %v", c.finPath, err)
+			c.hintBroken = true
+		}
+	}
+
+	hintFile, err := c.openDataFile(c.hintPath, 0)
+	if isFileHeaderError(err) {
+		c.report("%s: %v", c.hintPath, err)
+		c.hintBroken = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer hintFile.Close()
+	hintSize, err := hintFile.Size()
+	if err != nil {
+		return err
+	}
+	c.reportLegacyFile(c.hintPath, hintFile, hintSize)
+	dataFiles := make(map[uint32]*data.DataFile)
+	defer func() {
+		for _, dataFile := range dataFiles {
+			_ = dataFile.Close()
+		}
+	}()
+	infos := make(map[uint32]*dataFileInfo)
+	for _, info := range c.dataFiles {
+		infos[info.fid] = info
+	}
+
+	var offset int64
+	var mismatches int
+	for {
+		rec, size, err := hintFile.ReadLogRecordWithSize(offset)
+		if err == io.EOF {
+			break
+		}
+		if data.IsCorruptedRecord(err) {
+			c.report("%s: %v at offset %d", c.hintPath, err, offset)
+			c.hintBroken = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+
+		pos := data.DecodeLogRecordPos(rec.Value)
+		msg, err := c.checkHintRecord(rec.Key, pos, nonMergeFileID, infos, dataFiles)
+		if err != nil {
+			return err
+		}
+		if msg == "" {
+			continue
+		}
+		mismatches++
+		if mismatches <= maxHintMismatchReports {
+			c.report("%s: key %q: %s", c.hintPath, rec.Key, msg)
+		}
+	}
+	if mismatches > 0 {
+		c.hintBroken = true
+		if mismatches > maxHintMismatchReports {
+			c.report("%s: %d entries do not match the data files in total", c.hintPath, mismatches)
+		}
+	}
+	return nil
+}
+
+// checkHintRecord 返回 hint 文件中的一条索引和数据文件不一致的原因，一致时返回空字符串
+func (c *checker) checkHintRecord(key []byte, pos *data.LogRecordPos, nonMergeFileID uint32,
+	infos map[uint32]*dataFileInfo, dataFiles map[uint32]*data.DataFile) (string, error) {
+	if c.finPath != "" && pos.Fid >= nonMergeFileID {
+		return fmt.Sprintf("points to file %d which was not merged", pos.Fid), nil
+	}
+	info, ok := infos[pos.Fid]
+	if !ok {
+		return fmt.Sprintf("points to missing file %d", pos.Fid), nil
+	}
+	// 分块存储的位置信息的大小包含了所有的分块，读取清单之后再检查
+	if !pos.Chunked && pos.Offset+int64(pos.Size) > info.validSize {
+		return fmt.Sprintf("points past the valid end of file %d", pos.Fid), nil
+	}
+	dataFile, ok := dataFiles[pos.Fid]
+	if !ok {
+		var err error
+		if dataFile, err = c.openDataFile(info.path, info.fid); isFileHeaderError(err) {
+			return fmt.Sprintf("points to unreadable file %d: %v", pos.Fid, err), nil
+		} else if err != nil {
+			return "", err
+		}
+		dataFiles[pos.Fid] = dataFile
+	}
+	rec, size, err := dataFile.ReadLogRecordWithSize(pos.Offset)
+	if err != nil {
+		return fmt.Sprintf("no valid record at file %d offset %d: %v", pos.Fid, pos.Offset, err), nil
+	}
+	if _, n := binary.Uvarint(rec.Key); n <= 0 || string(rec.Key[n:]) != string(key) {
+		return fmt.Sprintf("record at file %d offset %d has a different key", pos.Fid, pos.Offset), nil
+	}
+	if pos.Chunked {
+		if pos.Offset+size > info.validSize {
+			return fmt.Sprintf("points past the valid end of file %d", pos.Fid), nil
+		}
+		if rec.Type == data.LogRecordChunkManifest {
+			manifest, err := data.DecodeChunkManifest(rec.Value)
+			if err != nil {
+				return fmt.Sprintf("record at file %d offset %d has an invalid chunk manifest", pos.Fid, pos.Offset), nil
+			}
+			size = int64(manifest.ChunkedSize(size))
+		}
+	}
+	wantType := data.LogRecordNormal
+	if pos.Chunked {
+		wantType = data.LogRecordChunkManifest
+	}
+	if size != int64(pos.Size) || rec.Type != wantType {
+		return fmt.Sprintf("record at file %d offset %d does not match the hint", pos.Fid, pos.Offset), nil
+	}
+	return "", nil
+}
+
+// checkSeqNumFile 检查事务序列号文件中的记录
+func (c *checker) checkSeqNumFile() error {
+	if c.seqNumPath == "" {
+		return nil
+	}
+	seqNumFile, err := data.NewDataFile(fio.OSFileSystem, c.seqNumPath, 0, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	defer seqNumFile.Close()
+	var offset int64
+	for {
+		rec, size, err := seqNumFile.ReadLogRecordWithSize(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if data.IsCorruptedRecord(err) {
+			c.report("%s: %v at offset %d", c.seqNumPath, err, offset)
+			c.seqNumBroken = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.ParseUint(string(rec.Value), 10, 64); err != nil {
+			c.report("%s: invalid sequence number %q at offset %d", c.seqNumPath, rec.Value, offset)
+			c.seqNumBroken = true
+			return nil
+		}
+		offset += size
+	}
+}
+
+// readMergeFinished 读取 merge 完成标识文件中没有参与 merge 的第一个文件 id 和 merge 生成的文件数量
+func readMergeFinished(path string) (uint32, uint32, error) {
+	finFile, err := data.NewDataFile(fio.OSFileSystem, path, 0, fio.StandardFIO)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer finFile.Close()
+	var values [2]uint32
+	var offset int64
+	for i := range values {
+		rec, size, err := finFile.ReadLogRecordWithSize(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		v, err := strconv.ParseUint(string(rec.Value), 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		values[i] = uint32(v)
+		offset += size
+	}
+	if values[1] > values[0] {
+		return 0, 0, fmt.Errorf("merged file num %d exceeds non merge file id %d", values[1], values[0])
+	}
+	return values[0], values[1], nil
+}
+
+// repair 将数据目录中可以读取的部分复制到 outDir
+// 数据文件只保留最后一条完整记录之前的数据，损坏的 hint 文件和序列号文件不会复制，打开数据库时会从数据文件重建索引
+func (c *checker) repair(outDir string) ([]string, error) {
+	if entries, err := os.ReadDir(outDir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("%s is not empty", outDir)
+	}
+	if err := os.MkdirAll(outDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	var notes []string
+	var truncated bool
+	for _, info := range c.dataFiles {
+		if info.validSize < info.size {
+			truncated = true
+		}
+		if err := copyFile(info.path, data.GetDataFileName(outDir, info.fid), info.headerSize+info.validSize); err != nil {
+			return nil, err
+		}
+	}
+	if c.hintPath != "" && !c.hintBroken {
+		if err := copyFile(c.hintPath, filepath.Join(outDir, data.HintFileName), -1); err != nil {
+			return nil, err
+		}
+		if err := copyFile(c.finPath, filepath.Join(outDir, data.MergeFinishedName), -1); err != nil {
+			return nil, err
+		}
+	} else if c.hintPath != "" {
+		notes = append(notes, "hint file dropped, the index will be rebuilt from the data files")
+	}
+	if c.seqNumPath != "" && !c.seqNumBroken {
+		if err := copyFile(c.seqNumPath, filepath.Join(outDir, data.SeqNumFileName), -1); err != nil {
+			return nil, err
+		}
+	} else if c.seqNumPath != "" {
+		notes = append(notes, "sequence number file dropped")
+	}
+	// B+ 树索引记录的位置只有在数据文件没有变化时才有效
+	bptreePath := filepath.Join(c.dir, bptreeIndexFileName)
+	if _, err := os.Stat(bptreePath); err == nil {
+		if truncated || c.pendingMerge {
+			notes = append(notes, "bptree index dropped, open the copy with a memory index")
+		} else if err := copyFile(bptreePath, filepath.Join(outDir, bptreeIndexFileName), -1); err != nil {
+			return nil, err
+		}
+	}
+	return notes, nil
+}
+
+// copyFile 复制文件的前 n 个字节，n 小于 0 时复制整个文件
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
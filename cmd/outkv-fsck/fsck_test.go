@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	bitcask "github.com/rbongIO/bitcask-go"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func createTestDB(t *testing.T, dir string) map[string][]byte {
+	db, err := bitcask.Open(bitcask.WithDirPath(dir), bitcask.WithMaxDataFileSize(32*1024), bitcask.WithDataFileMergeRatio(0))
+	assert.Nil(t, err)
+	expected := make(map[string][]byte)
+	for i := 0; i < 1000; i++ {
+		val := utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	for i := 1000; i < 1200; i++ {
+		val := utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	assert.Nil(t, db.Close())
+	return expected
+}
+
+func lastDataFile(t *testing.T, dir string) string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	assert.Nil(t, err)
+	return matches[len(matches)-1]
+}
+
+func appendFile(t *testing.T, path string, b []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(b)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func TestChecker_Clean(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	createTestDB(t, dir)
+
+	c := newChecker(dir, nil)
+	assert.Nil(t, c.check())
+	assert.Empty(t, c.issues)
+	assert.NotEmpty(t, c.hintPath)
+}
+
+func TestChecker_Repair(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	expected := createTestDB(t, dir)
+
+	// 没有事务完成标识的事务记录
+	seq := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(seq, 99)
+	txnRec, _ := data.EncodeLogRecord(&data.LogRecord{Key: append(seq[:n], "txn-key"...), Value: []byte("value")})
+	appendFile(t, lastDataFile(t, dir), txnRec)
+	// 写入了一半的记录
+	tornRec, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("\x00torn"), Value: utils.GetTestValue(64)})
+	appendFile(t, lastDataFile(t, dir), tornRec[:len(tornRec)/2])
+	// hint 文件中指向错误记录的索引
+	hintFile, err := data.OpenHintFile(fio.OSFileSystem, dir)
+	assert.Nil(t, err)
+	assert.Nil(t, hintFile.WriteHintRecord([]byte("missing"), &data.LogRecordPos{Fid: 0, Offset: 0, Size: 10}))
+	assert.Nil(t, hintFile.Close())
+	// 默认无法打开
+	_, err = bitcask.Open(bitcask.WithDirPath(dir))
+	assert.NotNil(t, err)
+	// 没有完成的 merge 目录
+	assert.Nil(t, os.MkdirAll(dir+mergeDirName, os.ModePerm))
+	defer os.RemoveAll(dir + mergeDirName)
+
+	c := newChecker(dir, nil)
+	assert.Nil(t, c.check())
+	issues := strings.Join(c.issues, "\n")
+	assert.Contains(t, issues, "truncated record")
+	assert.Contains(t, issues, "transaction 99")
+	assert.Contains(t, issues, "leftover merge directory")
+	assert.Contains(t, issues, `key "missing"`)
+
+	out := dir + "-repaired"
+	defer os.RemoveAll(out)
+	notes, err := c.repair(out)
+	assert.Nil(t, err)
+	assert.Contains(t, strings.Join(notes, "\n"), "hint file dropped")
+
+	// 修复之后的目录没有问题，并且可以正常打开
+	c = newChecker(out, nil)
+	assert.Nil(t, c.check())
+	assert.Len(t, c.issues, 1)
+	assert.Contains(t, c.issues[0], "transaction 99")
+
+	db, err := bitcask.Open(bitcask.WithDirPath(out))
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, len(expected), len(db.ListKeys()))
+	for key, val := range expected {
+		v, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, val, v)
+	}
+
+	// 原目录没有被修改，修复的目标目录不能为空
+	_, err = c.repair(out)
+	assert.NotNil(t, err)
+}
+
+func TestChecker_Encrypted(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	key := []byte("0123456789abcdef")
+	db, err := bitcask.Open(bitcask.WithDirPath(dir), bitcask.WithEncryptionKey(key), bitcask.WithDataFileMergeRatio(0))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 没有密钥时无法检查
+	assert.NotNil(t, newChecker(dir, nil).check())
+
+	cipher, err := data.NewCipher(key)
+	assert.Nil(t, err)
+	c := newChecker(dir, cipher)
+	assert.Nil(t, c.check())
+	assert.Empty(t, c.issues)
+	assert.NotEmpty(t, c.hintPath)
+}
+
+func TestChecker_Chunked(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	db, err := bitcask.Open(bitcask.WithDirPath(dir), bitcask.WithChunkSize(4*1024),
+		bitcask.WithMaxDataFileSize(32*1024), bitcask.WithDataFileMergeRatio(0))
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(20*1024)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Close())
+
+	// 分块存储的数据在 hint 文件中的位置信息包含了所有分块的大小
+	c := newChecker(dir, nil)
+	assert.Nil(t, c.check())
+	assert.Empty(t, c.issues)
+	assert.NotEmpty(t, c.hintPath)
+}
+
+func TestChecker_LegacyFormat(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-fsck")
+	defer os.RemoveAll(dir)
+	createTestDB(t, dir)
+
+	// 去掉最后一个数据文件的文件头，得到旧格式的文件
+	path := lastDataFile(t, dir)
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, b[data.FileHeaderSize:], 0644))
+
+	// 旧格式的文件依然可以检查，修复时完整复制
+	c := newChecker(dir, nil)
+	assert.Nil(t, c.check())
+	assert.Len(t, c.issues, 1)
+	assert.Contains(t, c.issues[0], "outkv-migrate")
+
+	out := dir + "-repaired"
+	defer os.RemoveAll(out)
+	_, err = c.repair(out)
+	assert.Nil(t, err)
+	copied, err := os.ReadFile(filepath.Join(out, filepath.Base(path)))
+	assert.Nil(t, err)
+	assert.Equal(t, b[data.FileHeaderSize:], copied)
+}
@@ -0,0 +1,75 @@
+// outkv-fsck 离线检查 bitcask 数据目录，数据库无法打开时用来定位损坏的文件
+//
+//	outkv-fsck [-repair] [-out dir] [-key-file file] <data dir>
+//
+// 加密的数据目录需要通过 -key-file 指定密钥文件，文件内容为原始的 16、24 或 32 字节密钥
+// 发现问题时退出码为 1，检查过程出错时退出码为 2
+// 指定 -repair 时会将可以读取的部分复制到 -out 目录（默认为 <data dir>-repaired），原目录不会被修改
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/data"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	repair := flag.Bool("repair", false, "rewrite a clean copy of the data directory")
+	out := flag.String("out", "", "directory for the repaired copy, defaults to <dir>-repaired")
+	keyFile := flag.String("key-file", "", "file containing the raw encryption key of an encrypted data directory")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-repair] [-out dir] [-key-file file] <data dir>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	dir := flag.Arg(0)
+	var cipher *data.Cipher
+	if *keyFile != "" {
+		key, err := os.ReadFile(*keyFile)
+		if err == nil {
+			cipher, err = data.NewCipher(key)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "key file %s: %v\n", *keyFile, err)
+			os.Exit(2)
+		}
+	}
+	os.Exit(run(dir, *repair, *out, cipher))
+}
+
+func run(dir string, repair bool, out string, cipher *data.Cipher) int {
+	c := newChecker(dir, cipher)
+	if err := c.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "fsck %s: %v\n", dir, err)
+		return 2
+	}
+	for _, issue := range c.issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("checked %d data files, %d problems found\n", len(c.dataFiles), len(c.issues))
+
+	if repair {
+		if out == "" {
+			out = filepath.Clean(dir) + "-repaired"
+		}
+		notes, err := c.repair(out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "repair %s: %v\n", dir, err)
+			return 2
+		}
+		for _, note := range notes {
+			fmt.Println(note)
+		}
+		fmt.Printf("clean copy written to %s\n", out)
+	}
+	if len(c.issues) > 0 {
+		return 1
+	}
+	return 0
+}
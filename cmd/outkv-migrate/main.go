@@ -0,0 +1,40 @@
+// outkv-migrate 将旧版本的 bitcask 数据目录原地升级为当前的文件格式
+//
+//	outkv-migrate <data dir>
+//
+// 升级之前需要关闭数据库，升级中途失败时可以重新执行，已经升级的文件会被跳过
+// 升级完成时退出码为 0，升级过程出错时退出码为 2
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s <data dir>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	os.Exit(run(flag.Arg(0)))
+}
+
+func run(dir string) int {
+	migrated, err := migrate(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migrate %s: %v\n", dir, err)
+		return 2
+	}
+	for _, path := range migrated {
+		fmt.Printf("upgraded %s\n", path)
+	}
+	fmt.Printf("%d files upgraded\n", len(migrated))
+	return 0
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gofrs/flock"
+	bitcask "github.com/rbongIO/bitcask-go"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/fio"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 和 bitcask 包中的定义保持一致
+	mergeDirName     = "-merge"
+	fileLockName     = "flock"
+	mergedFileNumKey = "MergedFileNum"
+	// 和 index 包中的定义保持一致
+	bptreeIndexFileName = "bptree-index"
+	// 升级过程中写入的临时文件的后缀
+	migrateTempSuffix = ".migrate"
+)
+
+var (
+	indexBucketName = []byte("bitcask-index")
+	metaBucketName  = []byte("bitcask-meta")
+	// B+ 树索引中的位置信息已经升级的标识，升级中途失败之后重新执行时不会重复修改位置信息
+	formatVersionName = []byte("format-version")
+)
+
+// recordPos 旧格式的记录重新编码之后的位置
+type recordPos struct {
+	oldOffset int64
+	offset    int64
+	size      uint32
+}
+
+// fileMapping 一个数据文件中所有记录重新编码前后的位置，按照旧的 offset 排序
+type fileMapping []recordPos
+
+// lookup 查找旧的 offset 处的记录重新编码之后的位置
+func (m fileMapping) lookup(oldOffset int64) (recordPos, bool) {
+	i := sort.Search(len(m), func(i int) bool { return m[i].oldOffset >= oldOffset })
+	if i < len(m) && m[i].oldOffset == oldOffset {
+		return m[i], true
+	}
+	return recordPos{}, false
+}
+
+// migrate 将数据目录和 merge 目录中旧格式（版本 0）的文件升级为当前的格式
+// 旧格式的记录中没有过期时间，所有记录都会重新编码，hint 文件和 B+ 树索引中的位置信息也会随之更新
+// 每个文件先写入临时文件再替换原文件，中途失败时可以重新执行，已经升级的文件会被跳过
+// 返回升级的文件路径
+func migrate(dir string) ([]string, error) {
+	fileLock := flock.New(filepath.Join(dir, fileLockName))
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, bitcask.ErrDatabaseIsUsing
+	}
+	defer fileLock.Unlock()
+
+	migrated, err := migrateDir(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	mergePath := filepath.Join(filepath.Dir(filepath.Clean(dir)), filepath.Base(dir)+mergeDirName)
+	if info, err := os.Stat(mergePath); err == nil && info.IsDir() {
+		files, err := migrateDir(mergePath, true)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, files...)
+	}
+	return migrated, nil
+}
+
+// migrateDir 升级一个目录中的文件，数据文件的替换放在索引更新之后
+//  1. 将旧格式的数据文件重新编码到临时文件中，记录每条记录新的位置
+//  2. 更新 hint 文件和 B+ 树索引中的位置信息
+//  3. 用临时文件替换旧的数据文件
+//  4. 重新编码没有文件头的 merge 完成标识文件和事务序列号文件
+//
+// 还有旧格式的数据文件时，索引中的位置信息一定还没有更新，或者已经带有升级的标识
+func migrateDir(dir string, isMergeDir bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	var dataFiles []string
+	var mergedFileNum uint32
+	mappings := make(map[uint32]fileMapping)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, data.DataFileNameSuffix) {
+			continue
+		}
+		fileID, err := strconv.Atoi(strings.TrimSuffix(name, data.DataFileNameSuffix))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		mergedFileNum = max(mergedFileNum, uint32(fileID)+1)
+		path := filepath.Join(dir, name)
+		legacy, err := isLegacyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !legacy {
+			continue
+		}
+		mapping, err := rewriteFile(path, path+migrateTempSuffix, true, nil)
+		if err != nil {
+			_ = os.Remove(path + migrateTempSuffix)
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		mappings[uint32(fileID)] = mapping
+		dataFiles = append(dataFiles, path)
+	}
+
+	// hint 文件中的位置信息指向同一个目录中的数据文件
+	hintPath := filepath.Join(dir, data.HintFileName)
+	if legacy, err := isLegacyFile(hintPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", hintPath, err)
+	} else if legacy {
+		remap := func(rec *data.LogRecord) error {
+			pos, err := remapPos(mappings, data.DecodeLogRecordPos(rec.Value))
+			if err != nil {
+				return fmt.Errorf("key %q: %w", rec.Key, err)
+			}
+			rec.Value = pos.Marshal()
+			return nil
+		}
+		if err := replaceFile(hintPath, true, remap); err != nil {
+			return nil, fmt.Errorf("%s: %w", hintPath, err)
+		}
+		migrated = append(migrated, hintPath)
+	}
+	// merge 目录中的 B+ 树索引不会被使用，不需要升级
+	if !isMergeDir && len(mappings) > 0 {
+		indexPath := filepath.Join(dir, bptreeIndexFileName)
+		ok, err := migrateBPTreeIndex(indexPath, mappings)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", indexPath, err)
+		}
+		if ok {
+			migrated = append(migrated, indexPath)
+		}
+	}
+
+	for _, path := range dataFiles {
+		if err := os.Rename(path+migrateTempSuffix, path); err != nil {
+			_ = os.Remove(path + migrateTempSuffix)
+			return nil, err
+		}
+		migrated = append(migrated, path)
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+
+	// merge 完成标识文件和事务序列号文件没有文件头，记录按照当前的格式编码
+	// 旧版本的 merge 完成标识文件中只有没有参与 merge 的文件 id，还需要加上 merge 生成的文件数量
+	for _, name := range []string{data.MergeFinishedName, data.SeqNumFileName} {
+		path := filepath.Join(dir, name)
+		legacy, err := isLegacyUnversionedFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if !legacy {
+			continue
+		}
+		var extra []*data.LogRecord
+		if isMergeDir && name == data.MergeFinishedName {
+			extra = append(extra, &data.LogRecord{Key: []byte(mergedFileNumKey), Value: []byte(strconv.Itoa(int(mergedFileNum)))})
+		}
+		if err := replaceFile(path, false, nil, extra...); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		migrated = append(migrated, path)
+	}
+	if err := syncDir(dir); err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// isLegacyFile 判断数据文件或 hint 文件是否是没有文件头的旧格式，空文件不需要升级
+func isLegacyFile(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	dataFile, err := data.NewDataFile(fio.OSFileSystem, path, 0, fio.StandardFIO)
+	if err != nil {
+		return false, err
+	}
+	defer dataFile.Close()
+	err = dataFile.ReadHeader()
+	if err != data.ErrLegacyFileFormat {
+		return false, err
+	}
+	size, err := dataFile.IOManager.Size()
+	return size > 0, err
+}
+
+// isLegacyUnversionedFile 判断没有文件头的文件中的记录是否是旧格式
+// 这些文件每次都会整体重写，只需要检查第一条记录，无法读取的文件已经损坏
+func isLegacyUnversionedFile(path string) (bool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	if !data.IsLegacyLogRecord(b) {
+		return false, nil
+	}
+	dataFile, err := data.NewDataFile(fio.OSFileSystem, path, 0, fio.StandardFIO)
+	if err != nil {
+		return false, err
+	}
+	defer dataFile.Close()
+	if err := readAll(dataFile); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// readAll 读取文件中的所有记录
+func readAll(dataFile *data.DataFile) error {
+	var offset int64
+	for {
+		_, size, err := dataFile.ReadLogRecordWithSize(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+	}
+}
+
+// replaceFile 重新编码 path 中的记录，写入临时文件之后替换原文件
+func replaceFile(path string, withHeader bool, convert func(rec *data.LogRecord) error, extra ...*data.LogRecord) error {
+	tmpPath := path + migrateTempSuffix
+	if _, err := rewriteFile(path, tmpPath, withHeader, convert, extra...); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// rewriteFile 读取 src 中旧格式的记录，经过 convert 转换之后按照当前的格式写入 dst，最后写入 extra 中的记录
+// withHeader 为 true 时在 dst 的开头写入文件头，返回每条记录在 dst 中的位置
+func rewriteFile(src, dst string, withHeader bool, convert func(rec *data.LogRecord) error, extra ...*data.LogRecord) (fileMapping, error) {
+	in, err := data.NewDataFile(fio.OSFileSystem, src, 0, fio.StandardFIO)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+	if withHeader {
+		if _, err := w.Write(data.NewFileHeader().Encode()); err != nil {
+			return nil, err
+		}
+	}
+
+	var mapping fileMapping
+	var oldOffset, offset int64
+	for {
+		rec, size, err := in.ReadLogRecordWithSize(oldOffset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read record at offset %d: %w", oldOffset, err)
+		}
+		if convert != nil {
+			if err := convert(rec); err != nil {
+				return nil, err
+			}
+		}
+		encRec, n := data.EncodeLogRecord(rec)
+		if _, err := w.Write(encRec); err != nil {
+			return nil, err
+		}
+		mapping = append(mapping, recordPos{oldOffset: oldOffset, offset: offset, size: uint32(n)})
+		oldOffset += size
+		offset += n
+	}
+	for _, rec := range extra {
+		encRec, _ := data.EncodeLogRecord(rec)
+		if _, err := w.Write(encRec); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return mapping, out.Sync()
+}
+
+// remapPos 将指向旧格式记录的位置信息转换为重新编码之后的位置
+func remapPos(mappings map[uint32]fileMapping, pos *data.LogRecordPos) (*data.LogRecordPos, error) {
+	mapping, ok := mappings[pos.Fid]
+	if !ok {
+		return nil, fmt.Errorf("data file %d is not in the legacy format", pos.Fid)
+	}
+	newPos, ok := mapping.lookup(pos.Offset)
+	if !ok {
+		return nil, fmt.Errorf("no record at offset %d of data file %d", pos.Offset, pos.Fid)
+	}
+	return &data.LogRecordPos{Fid: pos.Fid, Offset: newPos.offset, Size: newPos.size, Expire: pos.Expire}, nil
+}
+
+// migrateBPTreeIndex 更新 B+ 树索引中的位置信息，并写入升级的标识
+// 没有索引文件或者索引已经升级过时返回 false
+func migrateBPTreeIndex(path string, mappings map[uint32]fileMapping) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	tree, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return false, err
+	}
+	var migrated bool
+	err = tree.Update(func(tx *bolt.Tx) error {
+		if meta := tx.Bucket(metaBucketName); meta != nil && meta.Get(formatVersionName) != nil {
+			return nil
+		}
+		if bucket := tx.Bucket(indexBucketName); bucket != nil {
+			var keys, items [][]byte
+			if err := bucket.ForEach(func(k, v []byte) error {
+				pos, err := remapPos(mappings, data.DecodeLogRecordPos(v))
+				if err != nil {
+					return fmt.Errorf("key %q: %w", k, err)
+				}
+				keys = append(keys, append([]byte(nil), k...))
+				items = append(items, pos.Marshal())
+				return nil
+			}); err != nil {
+				return err
+			}
+			for i, key := range keys {
+				if err := bucket.Put(key, items[i]); err != nil {
+					return err
+				}
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		migrated = true
+		return meta.Put(formatVersionName, []byte(strconv.Itoa(int(data.FileFormatVersion))))
+	})
+	if closeErr := tree.Close(); err == nil {
+		err = closeErr
+	}
+	return migrated && err == nil, err
+}
+
+// syncDir 持久化目录项，保证替换之后的文件在崩溃之后依然存在
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		_ = d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	bitcask "github.com/rbongIO/bitcask-go"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testdata/baseline 中的目录是用升级之前的版本写入的，文件没有文件头，记录中没有过期时间
+//   - btree: key-00 ~ key-19 写入 v1，删除 key-00 ~ key-04，key-10 ~ key-14 写入 v2，
+//     WriteBatch 写入 key-20 ~ key-24 并删除 key-05，merge 之后 key-15 写入 v3 并删除 key-16
+//     btree-merge 是还没有替换到数据目录中的 merge 结果
+//   - bptree: B+ 树索引，key-00 ~ key-09 写入 v1，删除 key-00，
+//     WriteBatch 写入 key-10 ~ key-12 并删除 key-01，key-02 写入 v2
+const baselineDir = "testdata/baseline"
+
+// copyBaseline 将 testdata 中的旧版本目录复制到临时目录中，返回复制之后的数据目录
+func copyBaseline(t *testing.T, names ...string) string {
+	tmp := t.TempDir()
+	for _, name := range names {
+		src, dst := filepath.Join(baselineDir, name), filepath.Join(tmp, name)
+		assert.Nil(t, os.MkdirAll(dst, os.ModePerm))
+		entries, err := os.ReadDir(src)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			b, err := os.ReadFile(filepath.Join(src, entry.Name()))
+			assert.Nil(t, err)
+			assert.Nil(t, os.WriteFile(filepath.Join(dst, entry.Name()), b, 0644))
+		}
+	}
+	return filepath.Join(tmp, names[0])
+}
+
+func testKey(i int) []byte {
+	return []byte(fmt.Sprintf("key-%02d", i))
+}
+
+// checkValues 检查数据库中的数据和 expected 完全一致
+func checkValues(t *testing.T, db *bitcask.DB, expected map[string]string) {
+	for key, val := range expected {
+		actual, err := db.Get([]byte(key))
+		assert.Nil(t, err, key)
+		assert.Equal(t, val, string(actual), key)
+	}
+	assert.Equal(t, len(expected), len(db.ListKeys()))
+}
+
+func TestMigrate(t *testing.T) {
+	dir := copyBaseline(t, "btree", "btree-merge")
+	mergePath := dir + mergeDirName
+	opts := []bitcask.OptionFunc{bitcask.WithDirPath(dir)}
+
+	migrated, err := migrate(dir)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "000000000.data"),
+		filepath.Join(dir, "000000001.data"),
+		filepath.Join(dir, data.SeqNumFileName),
+		filepath.Join(mergePath, "000000000.data"),
+		filepath.Join(mergePath, data.HintFileName),
+		filepath.Join(mergePath, data.MergeFinishedName),
+		filepath.Join(mergePath, data.SeqNumFileName),
+	}, migrated)
+	// 已经升级的文件不会重复升级
+	migrated, err = migrate(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, migrated)
+
+	expected := make(map[string]string)
+	for i := 5; i < 20; i++ {
+		expected[string(testKey(i))] = fmt.Sprintf("v1-%02d", i)
+	}
+	for i := 10; i < 15; i++ {
+		expected[string(testKey(i))] = fmt.Sprintf("v2-%02d", i)
+	}
+	for i := 20; i < 25; i++ {
+		expected[string(testKey(i))] = fmt.Sprintf("batch-%02d", i)
+	}
+	delete(expected, string(testKey(5)))
+	expected[string(testKey(15))] = "v3-15"
+	delete(expected, string(testKey(16)))
+
+	// 打开时会完成旧版本留下的 merge
+	db, err := bitcask.Open(opts...)
+	assert.Nil(t, err)
+	checkValues(t, db, expected)
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, data.MergeFinishedName))
+	assert.Nil(t, err)
+	// 数据库打开时不能升级
+	_, err = migrate(dir)
+	assert.Equal(t, bitcask.ErrDatabaseIsUsing, err)
+
+	// 升级之后可以继续写入带过期时间的数据
+	assert.Nil(t, db.PutWithTTL(testKey(30), []byte("ttl"), time.Hour))
+	assert.Nil(t, db.Put(testKey(6), []byte("v4-06")))
+	expected[string(testKey(30))] = "ttl"
+	expected[string(testKey(6))] = "v4-06"
+	assert.Nil(t, db.Close())
+
+	db, err = bitcask.Open(opts...)
+	assert.Nil(t, err)
+	defer db.Close()
+	checkValues(t, db, expected)
+}
+
+func bptreeExpected() map[string]string {
+	expected := make(map[string]string)
+	for i := 3; i < 10; i++ {
+		expected[string(testKey(i))] = fmt.Sprintf("v1-%02d", i)
+	}
+	for i := 10; i < 13; i++ {
+		expected[string(testKey(i))] = fmt.Sprintf("batch-%02d", i)
+	}
+	expected[string(testKey(2))] = "v2-02"
+	return expected
+}
+
+func TestMigrate_BPTree(t *testing.T) {
+	dir := copyBaseline(t, "bptree")
+	opts := []bitcask.OptionFunc{bitcask.WithDirPath(dir), bitcask.WithIndexType(bitcask.BPTree)}
+	_, err := bitcask.Open(opts...)
+	assert.True(t, errors.Is(err, data.ErrLegacyFileFormat))
+
+	migrated, err := migrate(dir)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		filepath.Join(dir, "000000000.data"),
+		filepath.Join(dir, bptreeIndexFileName),
+		filepath.Join(dir, data.SeqNumFileName),
+	}, migrated)
+
+	db, err := bitcask.Open(opts...)
+	assert.Nil(t, err)
+	checkValues(t, db, bptreeExpected())
+	assert.Nil(t, db.Close())
+}
+
+// 更新 B+ 树索引之后、替换数据文件之前中断，重新执行时不会重复更新索引中的位置信息
+func TestMigrate_Resume(t *testing.T) {
+	dir := copyBaseline(t, "bptree")
+	path := filepath.Join(dir, "000000000.data")
+	mapping, err := rewriteFile(path, path+migrateTempSuffix, true, nil)
+	assert.Nil(t, err)
+	ok, err := migrateBPTreeIndex(filepath.Join(dir, bptreeIndexFileName), map[uint32]fileMapping{0: mapping})
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	migrated, err := migrate(dir)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{path, filepath.Join(dir, data.SeqNumFileName)}, migrated)
+	_, err = os.Stat(path + migrateTempSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	db, err := bitcask.Open(bitcask.WithDirPath(dir), bitcask.WithIndexType(bitcask.BPTree))
+	assert.Nil(t, err)
+	defer db.Close()
+	checkValues(t, db, bptreeExpected())
+}
@@ -0,0 +1,256 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// crashOp 崩溃测试中执行的一次写入，Put、Delete 和 WriteBatch 都作为一个整体生效
+type crashOp struct {
+	keys   []string
+	values [][]byte // 为空表示删除
+	// 返回了错误，崩溃之后可能生效也可能没有生效，但是不能只有一部分生效
+	uncertain bool
+}
+
+// crashModel 记录崩溃之前的数据和之后执行的写入
+// 崩溃之后的数据必须等于按顺序执行一部分写入之后的结果，并且包含所有已经持久化的写入
+type crashModel struct {
+	base    map[string][]byte
+	ops     []*crashOp
+	durable int // 前 durable 个写入已经持久化
+}
+
+func (m *crashModel) apply(state map[string][]byte, op *crashOp) {
+	for i, key := range op.keys {
+		if op.values[i] == nil {
+			delete(state, key)
+		} else {
+			state[key] = op.values[i]
+		}
+	}
+}
+
+// matches 判断崩溃之后的数据是否是一个合法的结果
+func (m *crashModel) matches(actual map[string][]byte) bool {
+	var uncertain []int
+	for i, op := range m.ops {
+		if op.uncertain {
+			uncertain = append(uncertain, i)
+		}
+	}
+	// 每个返回了错误的写入都分别考虑生效和没有生效的情况
+	for mask := 0; mask < 1<<len(uncertain); mask++ {
+		skipped := make(map[int]bool)
+		for bit, i := range uncertain {
+			skipped[i] = mask&(1<<bit) != 0
+		}
+		state := make(map[string][]byte, len(m.base))
+		for key, val := range m.base {
+			state[key] = val
+		}
+		for n := 0; n <= len(m.ops); n++ {
+			if n >= m.durable && equalCrashState(state, actual) {
+				return true
+			}
+			if n < len(m.ops) && !skipped[n] {
+				m.apply(state, m.ops[n])
+			}
+		}
+	}
+	return false
+}
+
+func equalCrashState(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, val := range a {
+		if !bytes.Equal(val, b[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+// crashRounds 崩溃测试中崩溃并重新打开的次数
+const crashRounds = 200
+
+// crashDefaultSeed 默认使用固定的随机数种子，保证每次运行执行的操作和注入的故障都相同
+const crashDefaultSeed = 20240101
+
+// TestDB_CrashConsistency 随机执行 Put、Delete、WriteBatch 和 Merge，在随机的位置注入故障或者崩溃，
+// 重新打开之后检查已经持久化的数据都存在，没有提交的 WriteBatch 都不可见
+// 设置 BITCASK_CRASH_SEED 可以重现失败的测试，设置为 random 时使用当前时间作为种子随机运行
+func TestDB_CrashConsistency(t *testing.T) {
+	var seed int64 = crashDefaultSeed
+	switch s := os.Getenv("BITCASK_CRASH_SEED"); s {
+	case "":
+	case "random":
+		seed = time.Now().UnixNano()
+	default:
+		var err error
+		seed, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			t.Fatalf("invalid BITCASK_CRASH_SEED %q: %v", s, err)
+		}
+	}
+	t.Logf("seed: %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	ffs := newFaultFileSystem(fio.NewMemoryFileSystem())
+	dir := filepath.Join(os.TempDir(), "bitcask-go-crash")
+	opts := []OptionFunc{WithDirPath(dir), WithFileSystem(ffs), WithMaxDataFileSize(4 * 1024),
+		WithSyncWrite(false), WithDataFileMergeRatio(0)}
+	model := &crashModel{base: make(map[string][]byte)}
+	for round := 0; ; round++ {
+		db := openCrashDB(t, ffs, rnd, opts)
+		actual := make(map[string][]byte)
+		for _, key := range db.ListKeys() {
+			val, err := db.Get(key)
+			if err != nil {
+				t.Fatalf("round %d: get %s: %v", round, key, err)
+			}
+			actual[string(key)] = val
+		}
+		if !model.matches(actual) {
+			t.Fatalf("round %d: data after crash does not match any prefix of the writes", round)
+		}
+		if round == crashRounds {
+			assert.Nil(t, db.Close())
+			return
+		}
+		model = &crashModel{base: actual}
+
+		runCrashWorkload(t, db, ffs, rnd, model, round)
+		if err := ffs.crash(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// openCrashDB 重新打开数据库，一部分情况下在 merge 替换文件时注入 Rename 错误
+// 打开失败时保留 merge 目录，再次打开可以继续完成替换
+func openCrashDB(t *testing.T, ffs *faultFileSystem, rnd *rand.Rand, opts []OptionFunc) *DB {
+	if rnd.Intn(2) == 0 {
+		ffs.inject(faultRenameError, rnd.Intn(3))
+	}
+	db, err := Open(opts...)
+	if err != nil {
+		if !ffs.injected() || !errors.Is(err, errInjectedFault) {
+			t.Fatalf("open: %v", err)
+		}
+		ffs.inject(faultNone, 0)
+		if db, err = Open(opts...); err != nil {
+			t.Fatalf("reopen: %v", err)
+		}
+	}
+	ffs.inject(faultNone, 0)
+	return db
+}
+
+// runCrashWorkload 执行随机的写入，注入一个故障之后继续执行，直到注入的崩溃发生或者执行完所有写入
+func runCrashWorkload(t *testing.T, db *DB, ffs *faultFileSystem, rnd *rand.Rand, model *crashModel, round int) {
+	kinds := []faultKind{faultWriteError, faultShortWrite, faultSyncError, faultCrash, faultCrashOnRename}
+	kind := kinds[rnd.Intn(len(kinds))]
+	// 在 Rename 时崩溃只在 merge 替换文件时注入，merge 完成之后重新打开需要继续完成替换
+	if kind != faultCrashOnRename {
+		ffs.inject(kind, rnd.Intn(100))
+	}
+
+	value := func(i int) []byte {
+		return []byte(fmt.Sprintf("%d-%d-%s", round, i, bytes.Repeat([]byte{'v'}, rnd.Intn(128))))
+	}
+	for i := 0; i < 100; i++ {
+		op := &crashOp{}
+		var err error
+		durable := false
+		switch p := rnd.Intn(100); {
+		case p < 40:
+			key, val := utils.GetTestKey(rnd.Intn(64)), value(i)
+			op.keys, op.values = []string{string(key)}, [][]byte{val}
+			err = db.Put(key, val)
+		case p < 55:
+			key := utils.GetTestKey(rnd.Intn(64))
+			op.keys, op.values = []string{string(key)}, [][]byte{nil}
+			err = db.Delete(key)
+		case p < 80:
+			sync := rnd.Intn(2) == 0
+			wb := db.NewWriteBatch(WithSyncWrites(sync))
+			for j := rnd.Intn(8); j >= 0; j-- {
+				key := utils.GetTestKey(rnd.Intn(64))
+				op.keys = append(op.keys, string(key))
+				if rnd.Intn(4) == 0 {
+					op.values = append(op.values, nil)
+					if err = wb.Delete(key); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					val := value(i)
+					op.values = append(op.values, val)
+					if err = wb.Put(key, val); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			// 只删除了不存在的 key 时没有写入任何数据，不会持久化
+			durable = sync && len(wb.pendingWrites) > 0
+			err = wb.Commit()
+		case p < 85:
+			// 没有提交的 WriteBatch 不会写入任何数据
+			wb := db.NewWriteBatch()
+			for j := rnd.Intn(8); j >= 0; j-- {
+				if err := wb.Put(utils.GetTestKey(rnd.Intn(64)), value(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			continue
+		case p < 93:
+			if db.activeFile == nil {
+				continue
+			}
+			op = nil
+			err = db.Sync()
+			durable = true
+		default:
+			// merge 之前会持久化活跃文件
+			op = nil
+			if kind == faultCrashOnRename {
+				ffs.inject(kind, rnd.Intn(4))
+				kind = faultNone
+			}
+			err = db.Merge()
+			if err == ErrMergeRatioUnreached {
+				continue
+			}
+			durable = true
+		}
+		if op != nil {
+			op.uncertain = err != nil
+			model.ops = append(model.ops, op)
+		}
+		if err != nil {
+			if !errors.Is(err, errInjectedFault) && !errors.Is(err, errInjectedCrash) {
+				t.Fatalf("round %d: unexpected error: %v", round, err)
+			}
+			// fsync 失败之后数据库拒绝所有的写入，需要重新打开
+			if errors.Is(err, errInjectedCrash) || db.groupCommit.failed() != nil {
+				return
+			}
+			continue
+		}
+		if durable {
+			model.durable = len(model.ops)
+		}
+	}
+}
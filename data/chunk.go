@@ -0,0 +1,81 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var ErrInvalidChunkManifest = errors.New("invalid chunk manifest")
+
+// ChunkManifest 分块存储的大 value 的清单
+// 分块记录按顺序写入数据文件，清单记录每个分块的位置，读取时按顺序拼接所有分块
+type ChunkManifest struct {
+	Size   int64           // value 的总长度
+	Chunks []*LogRecordPos // 所有分块的位置
+}
+
+// Encode 编码分块清单
+// +-------------+-------------+-----------------------------------------+
+// ｜size 变长    ｜分块数量 变长 ｜fid 变长 + offset 变长 + size 变长 ... ｜
+// +-------------+-------------+-----------------------------------------+
+func (m *ChunkManifest) Encode() []byte {
+	buf := make([]byte, binary.MaxVarintLen64*2+len(m.Chunks)*(binary.MaxVarintLen32*2+binary.MaxVarintLen64))
+	index := binary.PutUvarint(buf, uint64(m.Size))
+	index += binary.PutUvarint(buf[index:], uint64(len(m.Chunks)))
+	for _, pos := range m.Chunks {
+		index += binary.PutUvarint(buf[index:], uint64(pos.Fid))
+		index += binary.PutUvarint(buf[index:], uint64(pos.Offset))
+		index += binary.PutUvarint(buf[index:], uint64(pos.Size))
+	}
+	return buf[:index]
+}
+
+// DecodeChunkManifest 解码分块清单
+func DecodeChunkManifest(b []byte) (*ChunkManifest, error) {
+	var index int
+	next := func() (uint64, error) {
+		v, n := binary.Uvarint(b[index:])
+		if n <= 0 {
+			return 0, ErrInvalidChunkManifest
+		}
+		index += n
+		return v, nil
+	}
+	size, err := next()
+	if err != nil {
+		return nil, err
+	}
+	num, err := next()
+	if err != nil {
+		return nil, err
+	}
+	// 每个分块至少占用 3 个字节，避免损坏的数据导致分配过大的内存
+	if num > uint64(len(b)) {
+		return nil, ErrInvalidChunkManifest
+	}
+	m := &ChunkManifest{Size: int64(size), Chunks: make([]*LogRecordPos, 0, num)}
+	for i := uint64(0); i < num; i++ {
+		var fields [3]uint64
+		for j := range fields {
+			if fields[j], err = next(); err != nil {
+				return nil, err
+			}
+		}
+		m.Chunks = append(m.Chunks, &LogRecordPos{Fid: uint32(fields[0]), Offset: int64(fields[1]), Size: uint32(fields[2])})
+	}
+	return m, nil
+}
+
+// ChunkedSize 返回分块存储的 value 在磁盘上的总大小，包含清单记录本身的大小 manifestSize
+// 超出 uint32 范围时取最大值
+func (m *ChunkManifest) ChunkedSize(manifestSize int64) uint32 {
+	total := manifestSize
+	for _, pos := range m.Chunks {
+		total += int64(pos.Size)
+	}
+	if total > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(total)
+}
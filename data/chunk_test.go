@@ -0,0 +1,39 @@
+package data
+
+import (
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+func TestChunkManifest_Encode(t *testing.T) {
+	m := &ChunkManifest{
+		Size: 3 << 20,
+		Chunks: []*LogRecordPos{
+			{Fid: 1, Offset: 0, Size: 1<<20 + 30},
+			{Fid: 1, Offset: 1<<20 + 30, Size: 1<<20 + 30},
+			{Fid: 2, Offset: 0, Size: 1<<20 + 30},
+		},
+	}
+	m2, err := DecodeChunkManifest(m.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, m, m2)
+	assert.Equal(t, uint32(3*(1<<20+30)+20), m.ChunkedSize(20))
+
+	// 空的 value 没有分块
+	empty := &ChunkManifest{Chunks: []*LogRecordPos{}}
+	m2, err = DecodeChunkManifest(empty.Encode())
+	assert.Nil(t, err)
+	assert.Equal(t, empty, m2)
+
+	// 数据不完整
+	enc := m.Encode()
+	_, err = DecodeChunkManifest(enc[:len(enc)-1])
+	assert.Equal(t, ErrInvalidChunkManifest, err)
+	_, err = DecodeChunkManifest(nil)
+	assert.Equal(t, ErrInvalidChunkManifest, err)
+
+	// 总大小超出 uint32 时取最大值
+	big := &ChunkManifest{Chunks: []*LogRecordPos{{Size: math.MaxUint32}, {Size: 10}}}
+	assert.Equal(t, uint32(math.MaxUint32), big.ChunkedSize(10))
+}
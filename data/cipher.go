@@ -0,0 +1,106 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrEncryptionKeyRequired = errors.New("the data is encrypted, an encryption key is required")
+	ErrUnknownEncryptionKey  = errors.New("the data is encrypted with an unknown key")
+	ErrDecryptFailed         = errors.New("failed to decrypt the data")
+)
+
+// 加密之后的数据格式
+// +-------------+----------+------------------------------------------------+
+// ｜keyID(4byte)｜nonce(12)｜AES-GCM(keySize 变长 + key + value) + tag(16)｜
+// +-------------+----------+------------------------------------------------+
+const keyIDSize = 4
+
+// Cipher 使用 AES-GCM 加密记录的 key 和 value
+// 加密时使用当前的密钥，解密时根据数据中的密钥 id 选择当前或者轮换之前的密钥
+type Cipher struct {
+	keyID uint32
+	aeads map[uint32]cipher.AEAD
+}
+
+// NewCipher 创建 Cipher，key 的长度必须是 16、24 或 32 字节，oldKeys 只用于解密
+func NewCipher(key []byte, oldKeys ...[]byte) (*Cipher, error) {
+	c := &Cipher{
+		keyID: encryptionKeyID(key),
+		aeads: make(map[uint32]cipher.AEAD),
+	}
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads[encryptionKeyID(k)] = aead
+	}
+	return c, nil
+}
+
+// encryptionKeyID 密钥 id 为密钥 sha256 摘要的前 4 个字节
+func encryptionKeyID(key []byte) uint32 {
+	sum := sha256.Sum256(key)
+	return binary.LittleEndian.Uint32(sum[:keyIDSize])
+}
+
+// Seal 使用当前的密钥加密 key 和 value，aad 是需要校验但不需要加密的数据
+func (c *Cipher) Seal(key, value, aad []byte) ([]byte, error) {
+	aead := c.aeads[c.keyID]
+	plaintext := make([]byte, binary.MaxVarintLen32+len(key)+len(value))
+	n := binary.PutUvarint(plaintext, uint64(len(key)))
+	n += copy(plaintext[n:], key)
+	n += copy(plaintext[n:], value)
+
+	payload := make([]byte, keyIDSize+aead.NonceSize(), keyIDSize+aead.NonceSize()+n+aead.Overhead())
+	binary.LittleEndian.PutUint32(payload, c.keyID)
+	if _, err := rand.Read(payload[keyIDSize:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(payload, payload[keyIDSize:], plaintext[:n], aad), nil
+}
+
+// Open 解密 Seal 生成的数据，返回 key 和 value
+func (c *Cipher) Open(payload, aad []byte) ([]byte, []byte, error) {
+	if len(payload) < keyIDSize {
+		return nil, nil, ErrDecryptFailed
+	}
+	aead, ok := c.aeads[binary.LittleEndian.Uint32(payload)]
+	if !ok {
+		return nil, nil, ErrUnknownEncryptionKey
+	}
+	payload = payload[keyIDSize:]
+	if len(payload) < aead.NonceSize() {
+		return nil, nil, ErrDecryptFailed
+	}
+	plaintext, err := aead.Open(nil, payload[:aead.NonceSize()], payload[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, nil, ErrDecryptFailed
+	}
+	keySize, n := binary.Uvarint(plaintext)
+	if n <= 0 || keySize > uint64(len(plaintext)-n) {
+		return nil, nil, ErrDecryptFailed
+	}
+	key := plaintext[n : n+int(keySize)]
+	return key, plaintext[n+int(keySize):], nil
+}
+
+// KeyID 返回当前密钥的 id
+func (c *Cipher) KeyID() uint32 {
+	return c.keyID
+}
+
+// IsCurrent 判断数据是否是使用当前的密钥加密的
+func (c *Cipher) IsCurrent(payload []byte) bool {
+	return len(payload) >= keyIDSize && binary.LittleEndian.Uint32(payload) == c.keyID
+}
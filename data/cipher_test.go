@@ -0,0 +1,85 @@
+package data
+
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+var (
+	testEncryptionKey    = bytes.Repeat([]byte("k"), 32)
+	testOldEncryptionKey = bytes.Repeat([]byte("o"), 16)
+)
+
+func TestCipher_SealOpen(t *testing.T) {
+	_, err := NewCipher([]byte("short"))
+	assert.NotNil(t, err)
+
+	c, err := NewCipher(testEncryptionKey)
+	assert.Nil(t, err)
+	payload, err := c.Seal([]byte("key"), []byte("value"), []byte("aad"))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(payload, []byte("value")))
+	assert.True(t, c.IsCurrent(payload))
+
+	key, value, err := c.Open(payload, []byte("aad"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key"), key)
+	assert.Equal(t, []byte("value"), value)
+
+	// 附加数据或密文被修改
+	_, _, err = c.Open(payload, []byte("other"))
+	assert.Equal(t, ErrDecryptFailed, err)
+	payload[len(payload)-1] ^= 0xff
+	_, _, err = c.Open(payload, []byte("aad"))
+	assert.Equal(t, ErrDecryptFailed, err)
+
+	// 轮换密钥之后依然可以解密旧的数据
+	oldCipher, err := NewCipher(testOldEncryptionKey)
+	assert.Nil(t, err)
+	oldPayload, err := oldCipher.Seal([]byte("key"), []byte("value"), nil)
+	assert.Nil(t, err)
+	_, _, err = c.Open(oldPayload, nil)
+	assert.Equal(t, ErrUnknownEncryptionKey, err)
+	rotated, err := NewCipher(testEncryptionKey, testOldEncryptionKey)
+	assert.Nil(t, err)
+	assert.False(t, rotated.IsCurrent(oldPayload))
+	_, value, err = rotated.Open(oldPayload, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), value)
+}
+
+func TestDataFile_ReadEncryptedRecord(t *testing.T) {
+	c, err := NewCipher(testEncryptionKey)
+	assert.Nil(t, err)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1004, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer destroyDataFile(dataFile)
+	dataFile.Cipher = c
+
+	rec := &LogRecord{Key: []byte("customer-email"), Value: []byte("someone@example.com"), Type: LogRecordDeleted, Expire: 100}
+	encRecord, _, err := EncodeLogRecordWithCipher(rec, c)
+	assert.Nil(t, err)
+	assert.Nil(t, dataFile.Write(encRecord))
+	assert.Nil(t, dataFile.WriteHintRecord([]byte("customer-email"), &LogRecordPos{Fid: 1, Offset: 2, Size: 3}))
+
+	b, err := os.ReadFile(dataFile.Filepath)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(b, []byte("customer-email")))
+	assert.False(t, bytes.Contains(b, []byte("someone@example.com")))
+
+	read, size, err := dataFile.ReadLogRecordWithSize(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec, read)
+	hint, err := dataFile.ReadLogRecord(size)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("customer-email"), hint.Key)
+	assert.Equal(t, &LogRecordPos{Fid: 1, Offset: 2, Size: 3}, DecodeLogRecordPos(hint.Value))
+
+	// 没有密钥无法读取
+	dataFile.Cipher = nil
+	_, _, err = dataFile.ReadLogRecordWithSize(0)
+	assert.Equal(t, ErrEncryptionKeyRequired, err)
+}
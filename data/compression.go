@@ -0,0 +1,95 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"github.com/golang/snappy"
+	"io"
+	"sync"
+)
+
+// CompressionType value 的压缩算法，记录在 LogRecord 类型字节的第 5~7 位
+// 同一个数据文件中不同记录可以使用不同的压缩算法
+type CompressionType = byte
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionFlate
+	// CompressionSnappy snappy 的 block 格式，使用 github.com/golang/snappy 编码和解码
+	CompressionSnappy
+)
+
+var ErrUnknownCompression = errors.New("unknown compression type")
+
+// 类型字节中低 3 位是记录类型，第 4 位标识 key 和 value 是否加密，第 5~7 位是压缩算法，最高位是 expireFlag
+const (
+	recordTypeMask   = 0x07
+	encryptedFlag    = 0x08
+	compressionShift = 4
+	compressionMask  = 0x07
+)
+
+var flateWriterPool = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+var flateReaderPool = sync.Pool{
+	New: func() any {
+		return flate.NewReader(nil)
+	},
+}
+
+// compressValue 使用给定的算法压缩 value，返回实际使用的算法
+// 压缩之后没有变小的 value 不进行压缩，读取时也不需要解压
+func compressValue(c CompressionType, value []byte) ([]byte, CompressionType) {
+	if len(value) == 0 {
+		return value, CompressionNone
+	}
+	var compressed []byte
+	switch c {
+	case CompressionFlate:
+		var buf bytes.Buffer
+		w := flateWriterPool.Get().(*flate.Writer)
+		w.Reset(&buf)
+		_, err := w.Write(value)
+		if err == nil {
+			err = w.Close()
+		}
+		flateWriterPool.Put(w)
+		if err != nil {
+			return value, CompressionNone
+		}
+		compressed = buf.Bytes()
+	case CompressionSnappy:
+		compressed = snappy.Encode(nil, value)
+	default:
+		return value, CompressionNone
+	}
+	if len(compressed) >= len(value) {
+		return value, CompressionNone
+	}
+	return compressed, c
+}
+
+// decompressValue 解压使用给定算法压缩的 value
+func decompressValue(c CompressionType, value []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return value, nil
+	case CompressionFlate:
+		r := flateReaderPool.Get().(io.ReadCloser)
+		defer flateReaderPool.Put(r)
+		if err := r.(flate.Resetter).Reset(bytes.NewReader(value), nil); err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	case CompressionSnappy:
+		return snappy.Decode(nil, value)
+	default:
+		return nil, ErrUnknownCompression
+	}
+}
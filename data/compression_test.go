@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func testJSONValue(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, `{"id":%d,"name":"user-%d","email":"user-%d@example.com","active":true},`, i, i, i)
+	}
+	buf.WriteString("]")
+	return buf.Bytes()
+}
+
+func TestCompressValue(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.Read(random)
+	values := [][]byte{
+		[]byte("a"),
+		testJSONValue(10),
+		testJSONValue(5000), // 超过 snappy 的一个 block
+		random,
+	}
+	for _, c := range []CompressionType{CompressionNone, CompressionFlate, CompressionSnappy} {
+		for _, value := range values {
+			compressed, used := compressValue(c, value)
+			if c == CompressionNone || bytes.Equal(value, random) || len(value) == 1 {
+				// 不压缩或者压缩之后没有变小
+				assert.Equal(t, CompressionNone, used)
+				assert.Equal(t, value, compressed)
+				continue
+			}
+			assert.Equal(t, c, used)
+			assert.Less(t, len(compressed)*3, len(value))
+			decompressed, err := decompressValue(used, compressed)
+			assert.Nil(t, err)
+			assert.Equal(t, value, decompressed)
+		}
+	}
+	_, err := decompressValue(CompressionSnappy+1, []byte("abc"))
+	assert.Equal(t, ErrUnknownCompression, err)
+}
+
+func TestSnappyDecode(t *testing.T) {
+	// 其他 snappy 实现生成的数据，包括 1 字节偏移量的 copy 元素
+	value, err := decompressValue(CompressionSnappy, []byte{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x04})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcdabcdabcd"), value)
+	// 4 字节偏移量的 copy 元素
+	value, err = decompressValue(CompressionSnappy, []byte{0x06, 0x08, 'a', 'b', 'c', 0x0b, 0x03, 0x00, 0x00, 0x00})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abcabc"), value)
+	// 之前的版本内置的编码器写入的数据
+	value, err = decompressValue(CompressionSnappy, []byte{0x4a, 0x60, 0x7b, 0x22, 0x69, 0x64, 0x22, 0x3a, 0x31, 0x2c,
+		0x22, 0x6e, 0x61, 0x6d, 0x65, 0x22, 0x3a, 0x22, 0x75, 0x73, 0x65, 0x72, 0x2d, 0x31, 0x22, 0x7d, 0x2c, 0x16, 0x19,
+		0x0, 0x0, 0x32, 0x36, 0x19, 0x0, 0x0, 0x32, 0x22, 0x19, 0x0, 0x0, 0x33, 0x36, 0x19, 0x0, 0x8, 0x33, 0x22, 0x7d})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(`{"id":1,"name":"user-1"},{"id":2,"name":"user-2"},{"id":3,"name":"user-3"}`), value)
+
+	// 损坏的数据
+	for _, b := range [][]byte{
+		{},
+		{0x05, 0x0c, 'a'},
+		{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x05},
+		{0x03, 0x08, 'a', 'b', 'c', 'd'},
+	} {
+		_, err := decompressValue(CompressionSnappy, b)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestDataFile_ReadCompressedRecord(t *testing.T) {
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1003, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer destroyDataFile(dataFile)
+
+	value := testJSONValue(100)
+	var offsets []int64
+	// 同一个文件中混合使用不同的压缩算法
+	for _, c := range []CompressionType{CompressionSnappy, CompressionNone, CompressionFlate} {
+		encRecord, n := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: value, Type: LogRecordNormal, Compression: c})
+		if c != CompressionNone {
+			assert.Less(t, n*3, int64(len(value)))
+		}
+		assert.Equal(t, c, encRecord[4]>>compressionShift&compressionMask)
+		offsets = append(offsets, dataFile.WriteOffset)
+		assert.Nil(t, dataFile.Write(encRecord))
+	}
+	for i, c := range []CompressionType{CompressionSnappy, CompressionNone, CompressionFlate} {
+		rec, err := dataFile.ReadLogRecord(offsets[i])
+		assert.Nil(t, err)
+		assert.Equal(t, value, rec.Value)
+		assert.Equal(t, LogRecordNormal, rec.Type)
+		assert.Equal(t, c, rec.Compression)
+	}
+}
@@ -6,64 +6,175 @@ import (
 	"github.com/rbongIO/bitcask-go/fio"
 	"hash/crc32"
 	"io"
-	"os"
 	"path/filepath"
 )
 
-var ErrInvalidCRC = errors.New("invalid crc")
+var (
+	ErrInvalidCRC = errors.New("invalid crc")
+	// ErrIncompleteRecord 记录超出了文件末尾或 header 无法解析，通常是写入过程中进程崩溃导致的
+	ErrIncompleteRecord = errors.New("incomplete log record")
+)
+
+// IsCorruptedRecord 判断读取记录时的错误是否是因为记录损坏
+func IsCorruptedRecord(err error) bool {
+	return err == ErrInvalidCRC || err == ErrIncompleteRecord
+}
 
 const (
 	DataFileNameSuffix = ".data"
 	HintFileName       = "hint-index"
 	MergeFinishedName  = "hint-finished"
 	SeqNumFileName     = "sequence-num"
+	// OldKeyFilesName 关闭数据库时保存还有使用轮换之前的密钥加密的记录的数据文件，打开时读取之后删除
+	OldKeyFilesName = "old-key-files"
 )
 
 // DataFile 数据文件结构体
 type DataFile struct {
 	Filepath    string
-	FileID      uint32        // 文件 ID
-	WriteOffset int64         // 当前文件写入位置
-	IOManager   fio.IOManager // io 读写操作
+	FileID      uint32         // 文件 ID
+	FileSystem  fio.FileSystem // 文件所在的文件系统
+	WriteOffset int64          // 当前文件写入位置
+	IOManager   fio.IOManager  // io 读写操作
+	Cipher      *Cipher        // 加密记录使用的密钥，为空表示不加密
+	Header      *FileHeader    // 文件头，为空表示文件没有文件头，记录从文件开头开始
+	versioned   bool           // 文件是否需要文件头，新建的文件会写入文件头
 }
 
-// OpenDataFile 打开数据文件
-func OpenDataFile(dirPath string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
+// OpenDataFile 打开数据文件，新建的文件写入文件头，已有的文件校验文件头
+func OpenDataFile(fs fio.FileSystem, dirPath string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileID)
-	return NewDataFile(fileName, fileID, ioType)
+	return openVersionedFile(fs, fileName, fileID, ioType)
 }
 
-// OpenHintFile 打开 hint 文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+// OpenHintFile 打开 hint 文件，新建的文件写入文件头，已有的文件校验文件头
+func OpenHintFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return NewDataFile(fileName, 0, fio.StandardFIO)
+	return openVersionedFile(fs, fileName, 0, fio.StandardFIO)
+}
+
+func openVersionedFile(fs fio.FileSystem, fileName string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
+	dataFile, err := NewDataFile(fs, fileName, fileID, ioType)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.versioned = true
+	if err := dataFile.initHeader(); err != nil {
+		_ = dataFile.Close()
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return dataFile, nil
+}
+
+// initHeader 读取已有的文件头，空文件写入新的文件头
+// 内存映射方式打开的空文件无法写入，切换为标准文件 IO 之后再写入
+func (df *DataFile) initHeader() error {
+	if err := df.ReadHeader(); err != nil || df.Header != nil {
+		return err
+	}
+	header := NewFileHeader()
+	n, err := df.IOManager.Write(header.Encode())
+	if err != nil {
+		// 只写入了一部分文件头时清空文件，下次打开时重新写入
+		if n > 0 {
+			_ = df.IOManager.Truncate(0)
+		}
+		return err
+	}
+	if n == FileHeaderSize {
+		df.Header = header
+	}
+	return nil
+}
+
+// ReadHeader 读取并校验文件头，空文件没有文件头，Header 保持为空
+func (df *DataFile) ReadHeader() error {
+	size, err := df.IOManager.Size()
+	if err != nil || size == 0 {
+		return err
+	}
+	buf := make([]byte, min(size, FileHeaderSize))
+	if _, err := df.IOManager.Read(buf, 0); err != nil {
+		return err
+	}
+	header, err := DecodeFileHeader(buf)
+	if err != nil {
+		return err
+	}
+	df.Header = header
+	return nil
+}
+
+// HeaderSize 返回文件头的长度，记录的 offset 从文件头之后开始计算
+func (df *DataFile) HeaderSize() int64 {
+	if df.Header == nil {
+		return 0
+	}
+	return FileHeaderSize
+}
+
+// Size 返回文件中记录部分的长度，不包含文件头
+func (df *DataFile) Size() (int64, error) {
+	size, err := df.IOManager.Size()
+	if err != nil {
+		return 0, err
+	}
+	return size - df.HeaderSize(), nil
 }
 
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+// Truncate 将文件截断到 offset 处，offset 之后的记录都会被丢弃
+func (df *DataFile) Truncate(offset int64) error {
+	return df.IOManager.Truncate(df.HeaderSize() + offset)
+}
+
+// Reserved 返回预先分配但还没有写入数据的空间大小
+func (df *DataFile) Reserved() int64 {
+	if reserver, ok := df.IOManager.(fio.Reserver); ok {
+		return reserver.Reserved()
+	}
+	return 0
+}
+
+// Reserve 为 offset 之前的数据预先分配空间，只有可读写的文件映射需要预先分配
+func (df *DataFile) Reserve(offset int64) error {
+	if reserver, ok := df.IOManager.(fio.Reserver); ok {
+		return reserver.Reserve(df.HeaderSize() + offset)
+	}
+	return nil
+}
+
+func OpenMergeFinishedFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedName)
-	return NewDataFile(fileName, 0, fio.StandardFIO)
+	return NewDataFile(fs, fileName, 0, fio.StandardFIO)
 }
-func MergeFinished(dirPath string) error {
-	return os.Rename(filepath.Join(dirPath, HintFileName), filepath.Join(dirPath, MergeFinishedName))
+func MergeFinished(fs fio.FileSystem, dirPath string) error {
+	return fs.Rename(filepath.Join(dirPath, HintFileName), filepath.Join(dirPath, MergeFinishedName))
 }
 
-func OpenSeqNumFile(dirPath string) (*DataFile, error) {
+func OpenSeqNumFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
 	filename := filepath.Join(dirPath, SeqNumFileName)
-	return NewDataFile(filename, 0, fio.StandardFIO)
+	return NewDataFile(fs, filename, 0, fio.StandardFIO)
+}
+
+func OpenOldKeyFilesFile(fs fio.FileSystem, dirPath string) (*DataFile, error) {
+	filename := filepath.Join(dirPath, OldKeyFilesName)
+	return NewDataFile(fs, filename, 0, fio.StandardFIO)
 }
 
 func GetDataFileName(dirPath string, fileID uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileID, DataFileNameSuffix))
 }
 
-func NewDataFile(fileName string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
-	ioManager, err := fio.NewIOManager(fileName, ioType)
+// NewDataFile 打开 fs 中的文件，不读取和写入文件头
+func NewDataFile(fs fio.FileSystem, fileName string, fileID uint32, ioType fio.FileIOType) (*DataFile, error) {
+	ioManager, err := fs.OpenFile(fileName, ioType)
 	if err != nil {
 		return nil, err
 	}
 	return &DataFile{
 		Filepath:    fileName,
 		FileID:      fileID,
+		FileSystem:  fs,
 		WriteOffset: 0,
 		IOManager:   ioManager,
 	}, nil
@@ -76,19 +187,26 @@ func (df *DataFile) Sync() error {
 func (df *DataFile) Write(v []byte) error {
 	writeLen, err := df.IOManager.Write(v)
 	if err != nil {
+		// 只写入了一部分时截断掉，避免不完整的记录留在之后写入的记录之前
+		if writeLen > 0 {
+			_ = df.Truncate(df.WriteOffset)
+		}
 		return err
 	}
 	df.WriteOffset += int64(writeLen)
 	return nil
 }
 
-// WriteLogRecord 写入 索引信息 到Hint文件
+// WriteHintRecord 写入 索引信息 到Hint文件，设置了密钥时 key 和位置信息都会加密
 func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
 	rec := &LogRecord{
 		Key:   key,
 		Value: pos.Marshal(),
 	}
-	encRec, _ := EncodeLogRecord(rec)
+	encRec, _, err := EncodeLogRecordWithCipher(rec, df.Cipher)
+	if err != nil {
+		return err
+	}
 	return df.Write(encRec)
 }
 
@@ -96,51 +214,125 @@ func (df *DataFile) Read(offset int64) ([]byte, error) {
 	return nil, nil
 }
 func (df *DataFile) ReadLogRecordWithSize(offset int64) (*LogRecord, int64, error) {
-	fileSize, err := df.IOManager.Size()
+	fileSize, err := df.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+	return df.readLogRecord(offset, fileSize, df.readNBytes)
+}
+
+// ReadBytes 从 offset 开始读取 n 个字节，用于一次读取多条相邻的记录
+func (df *DataFile) ReadBytes(n int64, offset int64) ([]byte, error) {
+	return df.readNBytes(n, offset)
+}
+
+// DecodeLogRecordAt 从已经读取的数据 buf 中解析 offset 处的记录，buf 是数据文件从 bufOffset 开始的内容
+// 返回的 key 和 value 可能引用 buf 中的数据
+func (df *DataFile) DecodeLogRecordAt(buf []byte, bufOffset, offset int64) (*LogRecord, int64, error) {
+	if offset < bufOffset || offset >= bufOffset+int64(len(buf)) {
+		return nil, 0, ErrIncompleteRecord
+	}
+	read := func(n int64, off int64) ([]byte, error) {
+		start := off - bufOffset
+		return buf[start : start+n : start+n], nil
+	}
+	return df.readLogRecord(offset, bufOffset+int64(len(buf)), read)
+}
+
+// readLogRecord 通过 read 读取 offset 处的记录，fileSize 是可以读取的数据末尾
+func (df *DataFile) readLogRecord(offset, fileSize int64, read func(n int64, offset int64) ([]byte, error)) (*LogRecord, int64, error) {
+	record, header, rawType, recordSize, err := df.readRawLogRecord(offset, fileSize, read)
 	if err != nil {
 		return nil, 0, err
 	}
+	// crc 是根据加密和压缩之后的数据计算的，校验之后再解密和解压
+	if header.encrypted {
+		if df.Cipher == nil {
+			return nil, 0, ErrEncryptionKeyRequired
+		}
+		aad := logRecordAAD(rawType, header.expire)
+		if record.Key, record.Value, err = df.Cipher.Open(record.Key, aad); err != nil {
+			return nil, 0, err
+		}
+	}
+	if header.compression != CompressionNone {
+		if record.Value, err = decompressValue(header.compression, record.Value); err != nil {
+			return nil, 0, err
+		}
+		record.Compression = header.compression
+	}
+	return record, recordSize, nil
+}
+
+// readRawLogRecord 读取 offset 处的记录并校验 crc，不解密也不解压，同时返回记录头中类型字节的原始值
+func (df *DataFile) readRawLogRecord(offset, fileSize int64, read func(n int64, offset int64) ([]byte, error)) (*LogRecord, *logRecordHeader, byte, int64, error) {
 	//如果读取的最大 header 长度已经超过了文件长度，则只需要读取到文件的末尾即可
 	var headerBytes int64 = maxLogRecordHeaderSize
 	if offset+headerBytes > fileSize {
 		headerBytes = fileSize - offset
 	}
 	//读取 Header 信息
-	headerBuf, err := df.readNBytes(headerBytes, offset)
+	headerBuf, err := read(headerBytes, offset)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, 0, 0, err
 	}
 	//解析 Header 信息，获得 header 结构体和 header 实际大小
 	header, headerSize := decodeLogRecordHeader(headerBuf)
-	// header == nil 说明读取到文件末尾
+	// header == nil 说明读取到文件末尾，如果文件末尾还有剩余的字节则说明记录不完整
 	if header == nil {
-		return nil, 0, io.EOF
+		if headerBytes > 0 {
+			return nil, nil, 0, 0, ErrIncompleteRecord
+		}
+		return nil, nil, 0, 0, io.EOF
 	}
 	// header.crc == 0 && header.keySize == 0 && header.valueSize == 0 说明是空记录
 	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-		return nil, 0, io.EOF
+		return nil, nil, 0, 0, io.EOF
 	}
 	// 计算整个记录的大小
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	var recordSize = headerSize + keySize + valueSize
+	if offset+recordSize > fileSize {
+		return nil, nil, 0, 0, ErrIncompleteRecord
+	}
 	var record = &LogRecord{}
 	//开始读取用户实际存储的 key/value 数据
 	if keySize > 0 || valueSize > 0 {
-		kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
+		kvBuf, err := read(keySize+valueSize, offset+headerSize)
 		if err != nil {
-			return nil, 0, err
+			return nil, nil, 0, 0, err
 		}
 		//解析出 key 和 value
 		record.Key = kvBuf[:keySize]
 		record.Value = kvBuf[keySize:]
 		record.Type = header.recordType
+		record.Expire = header.expire
 	}
 	//校验 CRC 是否正确
 	crc := getLogRecordCRC(record, headerBuf[crc32.Size:headerSize])
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, nil, 0, 0, ErrInvalidCRC
 	}
-	return record, recordSize, nil
+	return record, header, headerBuf[4], recordSize, nil
+}
+
+// ReadLogRecordView 读取 offset 处的记录，使用文件映射时不拷贝数据
+// 没有加密和压缩的记录的 key 和 value 直接引用文件映射，在文件关闭之前有效，文件不再写入时才能使用
+// 不支持映射的文件和 ReadLogRecord 相同
+func (df *DataFile) ReadLogRecordView(offset int64) (*LogRecord, error) {
+	viewer, ok := df.IOManager.(fio.Viewer)
+	if !ok {
+		return df.ReadLogRecord(offset)
+	}
+	fileSize, err := df.Size()
+	if err != nil {
+		return nil, err
+	}
+	view := func(n int64, off int64) ([]byte, error) {
+		return viewer.View(df.HeaderSize()+off, int(n))
+	}
+	rec, _, err := df.readLogRecord(offset, fileSize, view)
+	return rec, err
 }
 
 // ReadLogRecord 根据 offset 从数据文件当中读取 LogRecord
@@ -149,9 +341,35 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, error) {
 	return rec, err
 }
 
+// HasOldKeyRecords 判断文件中是否有使用轮换之前的密钥加密的记录，只检查密钥 id，不解密数据
+// 损坏的记录之后的数据不会被读取，读到损坏的记录时停止检查
+func (df *DataFile) HasOldKeyRecords() (bool, error) {
+	if df.Cipher == nil {
+		return false, nil
+	}
+	fileSize, err := df.Size()
+	if err != nil {
+		return false, err
+	}
+	var offset int64
+	for {
+		record, header, _, size, err := df.readRawLogRecord(offset, fileSize, df.readNBytes)
+		if err == io.EOF || IsCorruptedRecord(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if header.encrypted && !df.Cipher.IsCurrent(record.Key) {
+			return true, nil
+		}
+		offset += size
+	}
+}
+
 func (df *DataFile) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
-	_, err = df.IOManager.Read(b, offset)
+	_, err = df.IOManager.Read(b, df.HeaderSize()+offset)
 	if err != nil {
 		return nil, err
 	}
@@ -166,10 +384,13 @@ func (df *DataFile) SetIOManager(ioType fio.FileIOType) error {
 	if err := df.IOManager.Close(); err != nil {
 		return nil
 	}
-	manager, err := fio.NewIOManager(df.Filepath, ioType)
+	manager, err := df.FileSystem.OpenFile(df.Filepath, ioType)
 	if err != nil {
 		return err
 	}
 	df.IOManager = manager
+	if df.versioned && df.Header == nil {
+		return df.initHeader()
+	}
 	return nil
 }
@@ -18,22 +18,22 @@ func destroyDataFile(dataFile *DataFile) {
 }
 
 func TestOpenDataFile(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	defer destroyDataFile(dataFile)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
-	dataFile1, err := OpenDataFile(os.TempDir(), 110, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 110, fio.StandardFIO)
 	defer destroyDataFile(dataFile1)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
-	dataFile2, err := OpenDataFile(os.TempDir(), 210, fio.StandardFIO)
+	dataFile2, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 210, fio.StandardFIO)
 	defer destroyDataFile(dataFile2)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile2)
 }
 
 func TestDataFile_Write(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 	defer destroyDataFile(dataFile)
@@ -45,7 +45,7 @@ func TestDataFile_Write(t *testing.T) {
 	assert.Nil(t, err)
 }
 func TestDataFile_Close(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 	defer destroyDataFile(dataFile)
@@ -56,7 +56,7 @@ func TestDataFile_Close(t *testing.T) {
 }
 
 func TestDataFile_Sync(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 0, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 0, fio.StandardFIO)
 	defer destroyDataFile(dataFile)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
@@ -70,7 +70,7 @@ func TestDataFile_Sync(t *testing.T) {
 }
 
 func TestDataFile_Write2(t *testing.T) {
-	dataFile, err := OpenDataFile(os.TempDir(), 1001, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1001, fio.StandardFIO)
 	defer destroyDataFile(dataFile)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
@@ -89,7 +89,7 @@ func TestDataFile_Write2(t *testing.T) {
 
 func TestDataFile_ReadLogRecord(t *testing.T) {
 
-	dataFile, err := OpenDataFile(os.TempDir(), 1001, fio.StandardFIO)
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1001, fio.StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 	defer destroyDataFile(dataFile)
@@ -107,7 +107,7 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	record1, n1, err := dataFile.ReadLogRecordWithSize(index)
 	assert.Nil(t, err)
 	assert.Equal(t, rec1, record1)
-	assert.Equal(t, int64(5+2+8+7), n1)
+	assert.Equal(t, int64(5+3+8+7), n1)
 	index += n1
 	rec2 := &LogRecord{
 		Key:   []byte("testKey2"),
@@ -122,5 +122,100 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	record, n, err := dataFile.ReadLogRecordWithSize(index)
 	assert.Nil(t, err)
 	assert.Equal(t, rec2, record)
-	assert.Equal(t, int64(5+2+8+5), n)
+	assert.Equal(t, int64(5+3+8+5), n)
+}
+
+// legacyRecords 之前版本（header 中没有过期时间）EncodeLogRecord 编码的两条记录
+// key1/bitcask 的普通记录和 key2 的删除记录
+var legacyRecords = [][]byte{
+	{0xdf, 0xaf, 0xa1, 0xb2, 0x0, 0x8, 0xe, 0x6b, 0x65, 0x79, 0x31, 0x62, 0x69, 0x74, 0x63, 0x61, 0x73, 0x6b},
+	{0x51, 0xbc, 0x59, 0x43, 0x1, 0x8, 0x0, 0x6b, 0x65, 0x79, 0x32},
+}
+
+func TestDataFile_ReadLegacyLogRecord(t *testing.T) {
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1002, fio.StandardFIO)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer destroyDataFile(dataFile)
+	for _, rec := range legacyRecords {
+		assert.Nil(t, dataFile.Write(rec))
+	}
+	// 之前版本的记录之后可以继续写入当前版本的记录
+	rec3 := &LogRecord{Key: []byte("key3"), Value: []byte("ttl"), Type: LogRecordNormal, Expire: 1700000000000000000}
+	encRecord3, _ := EncodeLogRecord(rec3)
+	assert.Nil(t, dataFile.Write(encRecord3))
+
+	record, n, err := dataFile.ReadLogRecordWithSize(0)
+	assert.Nil(t, err)
+	assert.Equal(t, &LogRecord{Key: []byte("key1"), Value: []byte("bitcask"), Type: LogRecordNormal}, record)
+	assert.Equal(t, int64(len(legacyRecords[0])), n)
+	index := n
+	record, n, err = dataFile.ReadLogRecordWithSize(index)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key2"), record.Key)
+	assert.Equal(t, LogRecordDeleted, record.Type)
+	assert.Equal(t, int64(len(legacyRecords[1])), n)
+	index += n
+	record, _, err = dataFile.ReadLogRecordWithSize(index)
+	assert.Nil(t, err)
+	assert.Equal(t, rec3, record)
+}
+
+func TestDataFile_ReadIncompleteRecord(t *testing.T) {
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1002, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer destroyDataFile(dataFile)
+	encRecord, n := EncodeLogRecord(&LogRecord{Key: []byte("testKey1"), Value: []byte("bitcask")})
+	err = dataFile.Write(encRecord)
+	assert.Nil(t, err)
+	// 只写入了一部分 kv
+	err = dataFile.Write(encRecord[:n-3])
+	assert.Nil(t, err)
+
+	_, size, err := dataFile.ReadLogRecordWithSize(0)
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLogRecordWithSize(size)
+	assert.Equal(t, ErrIncompleteRecord, err)
+	// header 也不完整
+	_, _, err = dataFile.ReadLogRecordWithSize(size + n - 6)
+	assert.Equal(t, ErrIncompleteRecord, err)
+	assert.True(t, IsCorruptedRecord(err))
+}
+
+func TestDataFile_DecodeLogRecordAt(t *testing.T) {
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1003, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer destroyDataFile(dataFile)
+	rec1 := &LogRecord{Key: []byte("testKey1"), Value: []byte("bitcask"), Type: LogRecordNormal}
+	rec2 := &LogRecord{Key: []byte("testKey2"), Value: []byte("mongo"), Type: LogRecordNormal}
+	encRecord1, n1 := EncodeLogRecord(rec1)
+	encRecord2, n2 := EncodeLogRecord(rec2)
+	assert.Nil(t, dataFile.Write(encRecord1))
+	assert.Nil(t, dataFile.Write(encRecord2))
+
+	// 一次读取两条相邻的记录再分别解析
+	buf, err := dataFile.ReadBytes(n1+n2, 0)
+	assert.Nil(t, err)
+	record1, size, err := dataFile.DecodeLogRecordAt(buf, 0, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, record1)
+	assert.Equal(t, n1, size)
+	record2, size, err := dataFile.DecodeLogRecordAt(buf, 0, n1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, record2)
+	assert.Equal(t, n2, size)
+
+	// 修改返回的 value 不会覆盖相邻的记录
+	record1.Value = append(record1.Value, 'x')
+	record2, _, err = dataFile.DecodeLogRecordAt(buf, 0, n1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, record2)
+
+	// 读取的数据不包含完整的记录
+	buf, err = dataFile.ReadBytes(n2-1, n1)
+	assert.Nil(t, err)
+	_, _, err = dataFile.DecodeLogRecordAt(buf, n1, n1)
+	assert.Equal(t, ErrIncompleteRecord, err)
+	_, _, err = dataFile.DecodeLogRecordAt(buf, n1, 0)
+	assert.Equal(t, ErrIncompleteRecord, err)
 }
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	// FileHeaderSize 文件头的长度，记录的位置信息不包含文件头
+	FileHeaderSize = 24
+	// FileFormatVersion 当前的文件格式版本，记录的编码方式发生变化时需要增加
+	FileFormatVersion uint16 = 1
+	// ChecksumCRC32IEEE 记录使用 IEEE 多项式的 crc32 校验
+	ChecksumCRC32IEEE uint8 = 1
+)
+
+// fileMagic 文件头开头的魔数
+var fileMagic = []byte("OKVF")
+
+var (
+	// ErrLegacyFileFormat 文件是没有文件头的旧格式，需要使用 outkv-migrate 升级
+	ErrLegacyFileFormat = errors.New("file has no format header, run outkv-migrate to upgrade the data directory")
+	// ErrUnsupportedFileFormat 文件的格式版本或校验算法无法识别，通常是由更新的版本写入的
+	ErrUnsupportedFileFormat = errors.New("unsupported file format version or checksum algorithm")
+	ErrInvalidFileHeader     = errors.New("invalid file header")
+)
+
+// FileHeader 数据文件和 hint 文件的文件头
+type FileHeader struct {
+	Version   uint16 // 文件格式版本
+	Checksum  uint8  // 记录使用的校验算法
+	CreatedAt int64  // 文件创建的时间，unix 纳秒
+}
+
+// NewFileHeader 创建当前格式版本的文件头
+func NewFileHeader() *FileHeader {
+	return &FileHeader{
+		Version:   FileFormatVersion,
+		Checksum:  ChecksumCRC32IEEE,
+		CreatedAt: time.Now().UnixNano(),
+	}
+}
+
+// Encode 编码文件头
+// +--------+-----------+-----------+--------+------------+--------+--------+
+// ｜magic 4 ｜version 2  ｜checksum 1 ｜保留 1  ｜created at 8 ｜保留 4  ｜crc 4   ｜
+// +--------+-----------+-----------+--------+------------+--------+--------+
+func (h *FileHeader) Encode() []byte {
+	buf := make([]byte, FileHeaderSize)
+	copy(buf, fileMagic)
+	binary.LittleEndian.PutUint16(buf[4:], h.Version)
+	buf[6] = h.Checksum
+	binary.LittleEndian.PutUint64(buf[8:], uint64(h.CreatedAt))
+	binary.LittleEndian.PutUint32(buf[20:], crc32.ChecksumIEEE(buf[:20]))
+	return buf
+}
+
+// DecodeFileHeader 解码并校验文件头，b 是文件开头的内容
+// 开头不是魔数的文件是旧格式的文件，格式版本比当前版本新的文件无法读取
+func DecodeFileHeader(b []byte) (*FileHeader, error) {
+	if len(b) < len(fileMagic) || !bytes.Equal(b[:len(fileMagic)], fileMagic) {
+		return nil, ErrLegacyFileFormat
+	}
+	if len(b) < FileHeaderSize {
+		return nil, ErrInvalidFileHeader
+	}
+	if binary.LittleEndian.Uint32(b[20:]) != crc32.ChecksumIEEE(b[:20]) {
+		return nil, ErrInvalidFileHeader
+	}
+	h := &FileHeader{
+		Version:   binary.LittleEndian.Uint16(b[4:]),
+		Checksum:  b[6],
+		CreatedAt: int64(binary.LittleEndian.Uint64(b[8:])),
+	}
+	if h.Version == 0 || h.Version > FileFormatVersion || h.Checksum != ChecksumCRC32IEEE {
+		return nil, ErrUnsupportedFileFormat
+	}
+	return h, nil
+}
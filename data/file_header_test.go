@@ -0,0 +1,75 @@
+package data
+
+import (
+	"encoding/binary"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestFileHeader_EncodeDecode(t *testing.T) {
+	header := NewFileHeader()
+	buf := header.Encode()
+	assert.Equal(t, FileHeaderSize, len(buf))
+	decoded, err := DecodeFileHeader(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, header, decoded)
+
+	// 没有魔数的是旧格式的文件
+	rec, _ := EncodeLogRecord(&LogRecord{Key: []byte("key"), Value: []byte("value")})
+	_, err = DecodeFileHeader(rec)
+	assert.Equal(t, ErrLegacyFileFormat, err)
+
+	// crc 校验失败
+	buf[10]++
+	_, err = DecodeFileHeader(buf)
+	assert.Equal(t, ErrInvalidFileHeader, err)
+	_, err = DecodeFileHeader(buf[:10])
+	assert.Equal(t, ErrInvalidFileHeader, err)
+
+	// 更新的格式版本无法读取
+	header.Version = FileFormatVersion + 1
+	_, err = DecodeFileHeader(header.Encode())
+	assert.Equal(t, ErrUnsupportedFileFormat, err)
+}
+
+func TestDataFile_Header(t *testing.T) {
+	dataFile, err := OpenDataFile(fio.OSFileSystem, os.TempDir(), 1005, fio.StandardFIO)
+	assert.Nil(t, err)
+	defer destroyDataFile(dataFile)
+	assert.NotNil(t, dataFile.Header)
+	encRecord, n := EncodeLogRecord(&LogRecord{Key: []byte("testKey1"), Value: []byte("bitcask")})
+	assert.Nil(t, dataFile.Write(encRecord))
+	assert.Nil(t, dataFile.Close())
+
+	// 记录的 offset 不包含文件头
+	dataFile, err = OpenDataFile(fio.OSFileSystem, os.TempDir(), 1005, fio.StandardFIO)
+	assert.Nil(t, err)
+	size, err := dataFile.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	_, size, err = dataFile.ReadLogRecordWithSize(0)
+	assert.Nil(t, err)
+	assert.Equal(t, n, size)
+	assert.Nil(t, dataFile.Close())
+
+	// 格式版本无法识别的文件不能打开
+	b, err := os.ReadFile(dataFile.Filepath)
+	assert.Nil(t, err)
+	future := NewFileHeader()
+	future.Version = FileFormatVersion + 1
+	copy(b, future.Encode())
+	assert.Nil(t, os.WriteFile(dataFile.Filepath, b, 0644))
+	_, err = OpenDataFile(fio.OSFileSystem, os.TempDir(), 1005, fio.StandardFIO)
+	assert.ErrorIs(t, err, ErrUnsupportedFileFormat)
+	binary.LittleEndian.PutUint16(b[4:], FileFormatVersion)
+	assert.Nil(t, os.WriteFile(dataFile.Filepath, b, 0644))
+	_, err = OpenDataFile(fio.OSFileSystem, os.TempDir(), 1005, fio.StandardFIO)
+	assert.ErrorIs(t, err, ErrInvalidFileHeader)
+
+	// 没有文件头的旧格式文件不能打开
+	assert.Nil(t, os.WriteFile(dataFile.Filepath, encRecord, 0644))
+	_, err = OpenDataFile(fio.OSFileSystem, os.TempDir(), 1005, fio.StandardFIO)
+	assert.ErrorIs(t, err, ErrLegacyFileFormat)
+}
@@ -0,0 +1,160 @@
+package data
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/fio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// FileHintNameSuffix 数据文件对应的 hint 文件的后缀
+	FileHintNameSuffix = ".hint"
+	// fileHintTempSuffix 写入 hint 文件时使用的临时文件后缀，写入完成之后再重命名
+	fileHintTempSuffix = ".tmp"
+)
+
+var ErrInvalidFileHint = errors.New("invalid file hint")
+
+// FileHintEntry 数据文件中一条记录的索引信息，不包含 value
+// 数据文件中的每条记录按顺序对应一条 FileHintEntry，按顺序回放和读取数据文件得到的索引一致
+type FileHintEntry struct {
+	Key   []byte        // 记录中的 key，包含事务序列号
+	Type  LogRecordType // 记录类型
+	Pos   *LogRecordPos // 记录的位置，分块清单的大小包含所有分块
+	Value []byte        // 只有范围删除记录需要 value，即范围的结束 key
+}
+
+// FileHint 一个数据文件的 hint 文件的内容
+type FileHint struct {
+	DataSize int64 // 生成 hint 文件时数据文件的长度，数据文件长度不一致时 hint 文件无效
+	Entries  []*FileHintEntry
+}
+
+// GetFileHintName 返回数据文件对应的 hint 文件路径
+func GetFileHintName(dirPath string, fileID uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d%s", fileID, FileHintNameSuffix))
+}
+
+// WriteFileHint 写入数据文件对应的 hint 文件，已经存在的 hint 文件会被替换
+// 先写入临时文件并持久化，再重命名为 hint 文件，hint 文件存在时内容一定是完整的
+func WriteFileHint(fs fio.FileSystem, dirPath string, fileID uint32, hint *FileHint, cipher *Cipher) error {
+	fileName := GetFileHintName(dirPath, fileID)
+	tmpName := fileName + fileHintTempSuffix
+	if err := fs.Remove(tmpName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := openVersionedFile(fs, tmpName, fileID, fio.StandardFIO)
+	if err != nil {
+		return err
+	}
+	hintFile.Cipher = cipher
+
+	// 第一条记录保存数据文件的长度，其余记录的 key 不会为空
+	sizeBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(sizeBuf, uint64(hint.DataSize))
+	buf, _, err := EncodeLogRecordWithCipher(&LogRecord{Value: sizeBuf[:n]}, cipher)
+	if err == nil {
+		for _, entry := range hint.Entries {
+			var encRec []byte
+			if encRec, _, err = EncodeLogRecordWithCipher(entry.encode(), cipher); err != nil {
+				break
+			}
+			buf = append(buf, encRec...)
+		}
+	}
+	if err == nil {
+		err = hintFile.Write(buf)
+	}
+	if err == nil {
+		err = hintFile.Sync()
+	}
+	if closeErr := hintFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tmpName)
+		return err
+	}
+	return fs.Rename(tmpName, fileName)
+}
+
+// ReadFileHint 读取数据文件对应的 hint 文件，hint 文件不存在时返回 os.ErrNotExist
+func ReadFileHint(fs fio.FileSystem, dirPath string, fileID uint32, cipher *Cipher) (*FileHint, error) {
+	fileName := GetFileHintName(dirPath, fileID)
+	if _, err := fs.Stat(fileName); err != nil {
+		return nil, err
+	}
+	hintFile, err := openVersionedFile(fs, fileName, fileID, fio.StandardFIO)
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.Close()
+	hintFile.Cipher = cipher
+
+	rec, offset, err := hintFile.ReadLogRecordWithSize(0)
+	if err != nil {
+		return nil, err
+	}
+	dataSize, n := binary.Uvarint(rec.Value)
+	if len(rec.Key) != 0 || n <= 0 {
+		return nil, ErrInvalidFileHint
+	}
+	hint := &FileHint{DataSize: int64(dataSize)}
+	for {
+		rec, size, err := hintFile.ReadLogRecordWithSize(offset)
+		if err == io.EOF {
+			return hint, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry, err := decodeFileHintEntry(rec)
+		if err != nil {
+			return nil, err
+		}
+		entry.Pos.Fid = fileID
+		hint.Entries = append(hint.Entries, entry)
+		offset += size
+	}
+}
+
+// RemoveFileHint 删除数据文件对应的 hint 文件
+func RemoveFileHint(fs fio.FileSystem, dirPath string, fileID uint32) error {
+	if err := fs.Remove(GetFileHintName(dirPath, fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// encode 将索引信息编码为 hint 文件中的一条记录
+// +-------------------+----------------+----------------+
+// ｜位置信息的长度 变长 ｜位置信息        ｜范围删除的结束 key ｜
+// +-------------------+----------------+----------------+
+func (e *FileHintEntry) encode() *LogRecord {
+	posBuf := e.Pos.Marshal()
+	value := make([]byte, binary.MaxVarintLen32, binary.MaxVarintLen32+len(posBuf)+len(e.Value))
+	n := binary.PutUvarint(value, uint64(len(posBuf)))
+	value = append(append(value[:n], posBuf...), e.Value...)
+	return &LogRecord{Key: e.Key, Value: value, Type: e.Type, Expire: e.Pos.Expire}
+}
+
+func decodeFileHintEntry(rec *LogRecord) (*FileHintEntry, error) {
+	posSize, n := binary.Uvarint(rec.Value)
+	if len(rec.Key) == 0 || n <= 0 || uint64(len(rec.Value)-n) < posSize {
+		return nil, ErrInvalidFileHint
+	}
+	posBuf := rec.Value[n : n+int(posSize)]
+	entry := &FileHintEntry{
+		Key:  rec.Key,
+		Type: rec.Type,
+		Pos:  DecodeLogRecordPos(posBuf),
+	}
+	if value := rec.Value[n+int(posSize):]; len(value) > 0 {
+		entry.Value = value
+	}
+	return entry, nil
+}
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestFileHint_WriteRead(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hint")
+	defer os.RemoveAll(dir)
+	_, err := ReadFileHint(fio.OSFileSystem, dir, 1, nil)
+	assert.True(t, os.IsNotExist(err))
+
+	hint := &FileHint{
+		DataSize: 1024,
+		Entries: []*FileHintEntry{
+			{Key: []byte("\x00key1"), Type: LogRecordNormal, Pos: &LogRecordPos{Fid: 1, Offset: 0, Size: 20, Expire: 100}},
+			{Key: []byte("\x00key2"), Type: LogRecordChunkManifest, Pos: &LogRecordPos{Fid: 1, Chunked: true, Offset: 20, Size: 4096}},
+			{Key: []byte("\x00a"), Type: LogRecordRangeDeleted, Pos: &LogRecordPos{Fid: 1, Offset: 40, Size: 10}, Value: []byte("b")},
+			{Key: []byte("\x02fin"), Type: LogRecordTxnFinished, Pos: &LogRecordPos{Fid: 1, Offset: 50, Size: 10}},
+		},
+	}
+	cipher, err := NewCipher([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	assert.Nil(t, WriteFileHint(fio.OSFileSystem, dir, 1, hint, cipher))
+	read, err := ReadFileHint(fio.OSFileSystem, dir, 1, cipher)
+	assert.Nil(t, err)
+	assert.Equal(t, hint, read)
+
+	// 重新写入会替换原来的 hint 文件
+	hint.DataSize = 2048
+	hint.Entries = hint.Entries[:1]
+	assert.Nil(t, WriteFileHint(fio.OSFileSystem, dir, 1, hint, cipher))
+	read, err = ReadFileHint(fio.OSFileSystem, dir, 1, cipher)
+	assert.Nil(t, err)
+	assert.Equal(t, hint, read)
+
+	assert.Nil(t, RemoveFileHint(fio.OSFileSystem, dir, 1))
+	assert.Nil(t, RemoveFileHint(fio.OSFileSystem, dir, 1))
+	_, err = ReadFileHint(fio.OSFileSystem, dir, 1, cipher)
+	assert.True(t, os.IsNotExist(err))
+}
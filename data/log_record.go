@@ -11,34 +11,54 @@ const (
 	LogRecordNormal LogRecordType = iota
 	LogRecordDeleted
 	LogRecordTxnFinished
+	// LogRecordRangeDeleted 范围删除记录，key 为范围的起始 key，value 为结束 key（不包含），value 为空表示没有上界
+	LogRecordRangeDeleted
+	// LogRecordChunk 大 value 的一个分块，不会被索引，只能通过分块清单读取
+	LogRecordChunk
+	// LogRecordChunkManifest 分块存储的大 value 的清单，value 为 ChunkManifest，和分块在同一个事务中提交
+	LogRecordChunkManifest
+	// LogRecordExpire 只修改过期时间的记录，value 为空，过期时间保存在 header 中，key 的 value 依然在之前的记录中
+	LogRecordExpire
 )
 
-// crc type keySize valSize
-// 4 + 1 + 5 + 5 = 15
+// crc type keySize valSize expire
+// 4 + 1 + 5 + 5 + 10 = 25
 const (
-	maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+	maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + binary.MaxVarintLen64 + 5
 )
 
+// expireFlag 类型字节的最高位，标识 header 中有过期时间
+// 之前版本写入的记录没有这个标识，header 中也没有过期时间，读取时按照旧的格式解析
+const expireFlag byte = 0x80
+
 // LogRecord 写入到数据文件中的记录
 // 之所以叫日志，是因为数据文件中的数据是追加写入的
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key    []byte
+	Value  []byte
+	Type   LogRecordType
+	Expire int64 // 过期时间戳（UnixNano），0 表示永不过期
+	// 写入时 value 使用的压缩算法，读取时为记录实际使用的压缩算法
+	Compression CompressionType
 }
 
 // LogRecordPos 数据内存索引，描述数据在磁盘上的位置
 type LogRecordPos struct {
-	Fid    uint32 // 文件 id，表示将数据存储到了哪个文件当中
-	Offset int64  // 偏移，表示将数据存储到了数据文件中的哪个位置
-	Size   uint32 // 在磁盘上的大小
+	Fid     uint32 // 文件 id，表示将数据存储到了哪个文件当中
+	Chunked bool   // 是否指向分块清单，为 true 时 Size 包含所有分块的大小
+	Offset  int64  // 偏移，表示将数据存储到了数据文件中的哪个位置
+	Size    uint32 // 在磁盘上的大小
+	Expire  int64  // 过期时间戳（UnixNano），0 表示永不过期
 }
 
 type logRecordHeader struct {
-	crc        uint32        // crc 校验码
-	recordType LogRecordType // 记录类型
-	keySize    uint32        // key 的长度
-	valueSize  uint32        // value 的长度
+	crc         uint32          // crc 校验码
+	recordType  LogRecordType   // 记录类型
+	compression CompressionType // value 的压缩算法
+	encrypted   bool            // key 和 value 是否加密
+	keySize     uint32          // key 的长度
+	valueSize   uint32          // value 的长度
+	expire      int64           // 过期时间戳
 }
 
 // TransactionRecord 事务记录结构体
@@ -53,31 +73,58 @@ func (lr *LogRecord) Marshal() ([]byte, error) {
 }
 
 // EncodeLogRecord 对 LogRecord 进行编码，返回字节数组及长度
-// +-----------+------------------+-------+----------+---------+----------+
-// ｜crc(4byte)｜recordType(1byte)｜keySize｜valueSize｜keyBytes｜valueBytes｜
-// +-----------+------------------+-------+----------+---------+----------+
-// ｜  4byte   ｜       1byte      ｜ 变长（最大5byte）｜ 变长 （最大5byte）  ｜ 变长｜ 变长｜
+// +-----------+------------------+-------+----------+------+---------+----------+
+// ｜crc(4byte)｜recordType(1byte)｜keySize｜valueSize｜expire｜keyBytes｜valueBytes｜
+// +-----------+------------------+-------+----------+------+---------+----------+
+// ｜  4byte   ｜       1byte      ｜ 变长（最大5byte）｜ 变长 （最大5byte）  ｜ 变长（最大10byte）｜ 变长｜ 变长｜
+// recordType 的最高位是 expireFlag，第 5~7 位是 value 的压缩算法，valueSize 是压缩之后的长度
 func EncodeLogRecord(lr *LogRecord) ([]byte, int64) {
+	encBytes, size, _ := EncodeLogRecordWithCipher(lr, nil)
+	return encBytes, size
+}
+
+// EncodeLogRecordWithCipher 对 LogRecord 进行编码，c 不为空时加密 key 和 value
+// 加密之后 keyBytes 为 Seal 生成的数据，valueBytes 为空，recordType 和 expire 作为附加数据参与校验
+func EncodeLogRecordWithCipher(lr *LogRecord, c *Cipher) ([]byte, int64, error) {
 	header := make([]byte, maxLogRecordHeaderSize)
+	key := lr.Key
+	value, compression := compressValue(lr.Compression, lr.Value)
 
 	//从第五个字节开始写
-	header[4] = lr.Type
+	header[4] = lr.Type | compression<<compressionShift | expireFlag
+	if c != nil {
+		header[4] |= encryptedFlag
+		payload, err := c.Seal(key, value, logRecordAAD(header[4], lr.Expire))
+		if err != nil {
+			return nil, 0, err
+		}
+		key, value = payload, nil
+	}
 	var index = 5
 	// 5字节之后，存储的是 key 和 value 的长度信息
 	//使用变长类型，节省空间
-	index += binary.PutVarint(header[index:], int64(len(lr.Key)))
-	index += binary.PutVarint(header[index:], int64(len(lr.Value)))
-	var size = index + len(lr.Key) + len(lr.Value)
+	index += binary.PutVarint(header[index:], int64(len(key)))
+	index += binary.PutVarint(header[index:], int64(len(value)))
+	index += binary.PutVarint(header[index:], lr.Expire)
+	var size = index + len(key) + len(value)
 	encBytes := make([]byte, size)
 	//将 header 部分的内容拷贝过来
 	copy(encBytes[:index], header[:index])
 	// 将 key/value 的部分拷贝过来
-	copy(encBytes[index:], lr.Key)
-	copy(encBytes[index+len(lr.Key):], lr.Value)
+	copy(encBytes[index:], key)
+	copy(encBytes[index+len(key):], value)
 
 	crc := crc32.ChecksumIEEE(encBytes[4:])
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
-	return encBytes, int64(size)
+	return encBytes, int64(size), nil
+}
+
+// logRecordAAD 加密记录时作为附加数据的 recordType 和 expire
+func logRecordAAD(recordType byte, expire int64) []byte {
+	aad := make([]byte, 1+binary.MaxVarintLen64)
+	aad[0] = recordType
+	n := binary.PutVarint(aad[1:], expire)
+	return aad[:1+n]
 }
 
 func decodeLogRecordHeader(b []byte) (*logRecordHeader, int64) {
@@ -85,20 +132,42 @@ func decodeLogRecordHeader(b []byte) (*logRecordHeader, int64) {
 		return nil, 0
 	}
 	header := &logRecordHeader{
-		crc:        binary.LittleEndian.Uint32(b[:4]),
-		recordType: b[4],
+		crc:         binary.LittleEndian.Uint32(b[:4]),
+		recordType:  b[4] & recordTypeMask,
+		compression: b[4] >> compressionShift & compressionMask,
+		encrypted:   b[4]&encryptedFlag != 0,
 	}
 	var index = 5
-	// 读取 key 和 value 的长度
+	// 读取 key 和 value 的长度，n <= 0 说明 header 不完整或已损坏
 	keySize, n := binary.Varint(b[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.keySize = uint32(keySize)
 	index += n
 	valueSize, n := binary.Varint(b[index:])
+	if n <= 0 {
+		return nil, 0
+	}
 	header.valueSize = uint32(valueSize)
 	index += n
+	// 读取过期时间，旧版本的记录没有过期时间
+	if b[4]&expireFlag != 0 {
+		expire, n := binary.Varint(b[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.expire = expire
+		index += n
+	}
 	return header, int64(index)
 }
 
+// IsLegacyLogRecord 判断 b 开头的记录是否是之前版本写入的，之前版本的 header 中没有过期时间
+func IsLegacyLogRecord(b []byte) bool {
+	return len(b) > 4 && b[4]&expireFlag == 0
+}
+
 func DecodeLogRecord(b []byte) (*LogRecord, error) {
 	// 0. 校验 crc
 
@@ -120,11 +189,17 @@ func getLogRecordCRC(lr *LogRecord, header []byte) (crc uint32) {
 }
 
 func (p *LogRecordPos) Marshal() []byte {
-	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64+binary.MaxVarintLen32)
+	buf := make([]byte, binary.MaxVarintLen32+binary.MaxVarintLen64+binary.MaxVarintLen32+binary.MaxVarintLen64)
 	var index = 0
 	index += binary.PutUvarint(buf[index:], uint64(p.Fid))
 	index += binary.PutUvarint(buf[index:], uint64(p.Offset))
 	index += binary.PutUvarint(buf[index:], uint64(p.Size))
+	index += binary.PutVarint(buf[index:], p.Expire)
+	// 只有分块存储的位置信息才会写入标识，普通的位置信息和旧版本一致
+	if p.Chunked {
+		buf = append(buf[:index], 1)
+		index++
+	}
 	return buf[:index]
 }
 func DecodeLogRecordPos(b []byte) *LogRecordPos {
@@ -134,9 +209,23 @@ func DecodeLogRecordPos(b []byte) *LogRecordPos {
 	offset, n := binary.Uvarint(b[index:])
 	index += n
 	size, n := binary.Uvarint(b[index:])
+	index += n
+	// 旧版本的位置信息中没有过期时间
+	var expire int64
+	if index < len(b) {
+		expire, n = binary.Varint(b[index:])
+		index += n
+	}
 	return &LogRecordPos{
-		Fid:    uint32(fid),
-		Offset: int64(offset),
-		Size:   uint32(size),
+		Fid:     uint32(fid),
+		Chunked: index < len(b) && b[index] == 1,
+		Offset:  int64(offset),
+		Size:    uint32(size),
+		Expire:  expire,
 	}
 }
+
+// IsExpired 判断该位置对应的数据在 now 时刻是否已经过期
+func (p *LogRecordPos) IsExpired(now int64) bool {
+	return p.Expire > 0 && p.Expire <= now
+}
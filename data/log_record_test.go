@@ -49,7 +49,7 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 	assert.NotNil(t, res1)
 	assert.Greater(t, n1, int64(5))
 
-	header, headerSize := decodeLogRecordHeader(res1[:maxLogRecordHeaderSize])
+	header, headerSize := decodeLogRecordHeader(res1)
 	assert.NotNil(t, header)
 	assert.Greater(t, headerSize, int64(5))
 	assert.Equal(t, header.recordType, LogRecordNormal)
@@ -65,7 +65,7 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 		res1, n1 := EncodeLogRecord(rec1)
 		assert.NotNil(t, res1)
 		assert.Greater(t, n1, int64(5))
-		assert.Equal(t, n1, int64(4+1+1+4+1))
+		assert.Equal(t, n1, int64(4+1+1+1+4+1))
 
 		header, headerSize := decodeLogRecordHeader(res1)
 		assert.NotNil(t, header)
@@ -75,6 +75,20 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 		assert.Equal(t, header.valueSize, uint32(0))
 		assert.Equal(t, header.crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
 	}
+	{
+		// 带过期时间的记录
+		rec1 := &LogRecord{
+			Key:    []byte("key1"),
+			Value:  []byte("bitcask"),
+			Type:   LogRecordNormal,
+			Expire: 1700000000000000000,
+		}
+		res1, _ := EncodeLogRecord(rec1)
+		header, _ := decodeLogRecordHeader(res1)
+		assert.NotNil(t, header)
+		assert.Equal(t, header.expire, rec1.Expire)
+		assert.Equal(t, header.crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
+	}
 	{
 		rec1 := &LogRecord{
 			Key:   []byte("key1"),
@@ -85,7 +99,7 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 		assert.NotNil(t, res1)
 		assert.Greater(t, n1, int64(5))
 
-		header, headerSize := decodeLogRecordHeader(res1[:maxLogRecordHeaderSize])
+		header, headerSize := decodeLogRecordHeader(res1)
 		assert.NotNil(t, header)
 		assert.Greater(t, headerSize, int64(5))
 		assert.Equal(t, header.recordType, LogRecordDeleted)
@@ -96,6 +110,26 @@ func TestDecodeLogRecordHeader(t *testing.T) {
 
 }
 
+// 之前版本的记录类型字节中没有 expireFlag，header 中没有过期时间
+func TestDecodeLogRecordHeader_Legacy(t *testing.T) {
+	legacy := []byte{0xdf, 0xaf, 0xa1, 0xb2, 0x0, 0x8, 0xe, 0x6b, 0x65, 0x79, 0x31, 0x62, 0x69, 0x74, 0x63, 0x61, 0x73, 0x6b}
+	header, headerSize := decodeLogRecordHeader(legacy)
+	assert.NotNil(t, header)
+	assert.Equal(t, int64(7), headerSize)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, uint32(4), header.keySize)
+	assert.Equal(t, uint32(7), header.valueSize)
+	assert.Equal(t, int64(0), header.expire)
+	assert.Equal(t, crc32.ChecksumIEEE(legacy[crc32.Size:]), header.crc)
+
+	// 当前版本的记录总是带有过期时间
+	res, _ := EncodeLogRecord(&LogRecord{Key: []byte("key1"), Value: []byte("bitcask"), Type: LogRecordNormal})
+	assert.Equal(t, LogRecordNormal|expireFlag, res[4])
+	header, headerSize = decodeLogRecordHeader(res)
+	assert.Equal(t, int64(8), headerSize)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+}
+
 func TestDecodeLogRecord(t *testing.T) {
 
 }
@@ -107,12 +141,12 @@ func TestGetLogRecordCrc(t *testing.T) {
 		Type:  LogRecordNormal,
 	}
 	res1, n1 := EncodeLogRecord(rec1)
-	header, headerSize := decodeLogRecordHeader(res1[:maxLogRecordHeaderSize])
+	header, headerSize := decodeLogRecordHeader(res1)
 	headerBuf := res1[:headerSize]
 	crc := getLogRecordCRC(rec1, headerBuf[crc32.Size:])
 	assert.Equal(t, crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
 	assert.Equal(t, header.crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
-	assert.Equal(t, n1, int64(7+4+7))
+	assert.Equal(t, n1, int64(8+4+7))
 	{
 		rec1 := &LogRecord{
 			Key:  []byte("key1"),
@@ -124,7 +158,7 @@ func TestGetLogRecordCrc(t *testing.T) {
 		crc := getLogRecordCRC(rec1, headerBuf[crc32.Size:])
 		assert.Equal(t, crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
 		assert.Equal(t, header.crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
-		assert.Equal(t, n1, int64(7+4))
+		assert.Equal(t, n1, int64(8+4))
 	}
 	{
 		rec1 := &LogRecord{
@@ -133,12 +167,29 @@ func TestGetLogRecordCrc(t *testing.T) {
 			Type:  LogRecordDeleted,
 		}
 		res1, n1 := EncodeLogRecord(rec1)
-		header, headerSize := decodeLogRecordHeader(res1[:maxLogRecordHeaderSize])
+		header, headerSize := decodeLogRecordHeader(res1)
 		headerBuf := res1[:headerSize]
 		crc := getLogRecordCRC(rec1, headerBuf[crc32.Size:])
 		assert.Equal(t, crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
 		assert.Equal(t, header.crc, crc32.ChecksumIEEE(res1[crc32.Size:]))
 		assert.Equal(t, header.recordType, LogRecordDeleted)
-		assert.Equal(t, n1, int64(7+4+7))
+		assert.Equal(t, n1, int64(8+4+7))
 	}
 }
+
+func TestLogRecordPos_Marshal(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 1024, Size: 64, Expire: 1700000000000000000}
+	assert.Equal(t, pos, DecodeLogRecordPos(pos.Marshal()))
+	assert.False(t, pos.IsExpired(pos.Expire-1))
+	assert.True(t, pos.IsExpired(pos.Expire))
+
+	// 永不过期
+	pos2 := &LogRecordPos{Fid: 1, Offset: 10, Size: 20}
+	assert.Equal(t, pos2, DecodeLogRecordPos(pos2.Marshal()))
+	assert.False(t, pos2.IsExpired(pos.Expire))
+
+	// 分块存储的位置信息
+	pos3 := &LogRecordPos{Fid: 1, Chunked: true, Offset: 10, Size: 20}
+	assert.Equal(t, pos3, DecodeLogRecordPos(pos3.Marshal()))
+	assert.Equal(t, len(pos2.Marshal())+1, len(pos3.Marshal()))
+}
@@ -1,8 +1,8 @@
 package bitcask_go
 
 import (
+	"encoding/binary"
 	"fmt"
-	"github.com/gofrs/flock"
 	"github.com/rbongIO/bitcask-go/data"
 	"github.com/rbongIO/bitcask-go/fio"
 	"github.com/rbongIO/bitcask-go/index"
@@ -24,19 +24,38 @@ type DB struct {
 	olderFiles       map[uint32]*data.DataFile //已经关闭的数据文件，用于读取
 	options          Options
 	index            index.Indexer
-	seqNum           uint64 //十五序列号
-	isMerging        bool   //是否正在合并数据文件
+	cipher           *data.Cipher        // 加密数据使用的密钥，为空表示不加密
+	seqNum           uint64              //十五序列号
+	isMerging        bool                //是否正在合并数据文件
+	mergeUnapplied   bool                // merge 生成的文件已经开始替换但是没有完成，merge 目录保留到重新打开数据库时继续替换
+	oldKeyFiles      map[uint32]struct{} // 包含使用轮换之前的密钥加密的记录的数据文件，merge 时需要重新加密
 	seqNumFileExists bool
 	isInitial        bool
-	fileLock         *flock.Flock //文件锁保证多进程之间的互斥访问
-	bytesWrite       uint64       // 当前累计写了多少
+	fileLock         fio.FileLock    //文件锁保证多进程之间的互斥访问
+	bytesWrite       uint64          // 当前累计写了多少
+	writeSeq         uint64          // 写入数据文件的记录序号，用于判断记录是否已经持久化
+	groupCommit      *groupCommit    // 合并并发写入的持久化操作
+	txns             *txnTracker     // 读写事务开始之后修改过的 key，用于冲突检测
+	unsynced         *unsyncedWrites // 需要持久化的写入在持久化完成之前对索引的修改
 	reclaimSize      int64
+	droppedBytes     int64                  // 打开数据库时因为记录损坏而丢弃的字节数
+	snapshots        map[*Snapshot]struct{} // 当前未释放的快照
+	pinnedFiles      map[*data.DataFile]int // 被快照和迭代器引用的数据文件及引用计数
+	views            int                    // 没有释放的 View 数量，不为 0 时不能关闭数据库
+	mergeWg          sync.WaitGroup         // 等待正在进行的 merge 完成
+	closed           bool
+	chunkWriters     int                   // 正在进行的 PutReader 数量，期间不能 merge
+	activeHints      []*data.FileHintEntry // 活跃文件中所有记录的索引信息，活跃文件写满或关闭数据库时写入 hint 文件
+	autoMergeStop    chan struct{}         // 通知后台自动 merge 协程退出
+	autoMergeDone    chan struct{}         // 后台自动 merge 协程已经退出
+	mergeCrashHook   func(step string)     // 在 merge 替换文件的各个步骤之间调用，只用于测试中模拟进程崩溃
 }
 type Stat struct {
 	KeyNum          uint  //键的数量
 	DataFileNum     uint  //数据文件数量
 	ReclaimableSize int64 //可回收的大小
 	DiskSize        int64 //磁盘大小
+	DroppedBytes    int64 //打开数据库时因为记录损坏而丢弃的字节数
 }
 
 // Stat 返回数据库的相关统计信息
@@ -49,7 +68,7 @@ func (db *DB) Stat() *Stat {
 		dataFiles += 1
 	}
 
-	dirSize, err := utils.DirSize(db.options.DirPath)
+	dirSize, err := db.dirSize()
 	if err != nil {
 		panic(fmt.Sprintf("failed to get dir size : %v", err))
 	}
@@ -58,6 +77,7 @@ func (db *DB) Stat() *Stat {
 		DataFileNum:     dataFiles,
 		ReclaimableSize: db.reclaimSize,
 		DiskSize:        dirSize,
+		DroppedBytes:    db.droppedBytes,
 	}
 }
 
@@ -70,86 +90,281 @@ func Open(opts ...OptionFunc) (*DB, error) {
 	for _, opt := range opts {
 		opt(&o)
 	}
+	// B+ 树索引保存在磁盘上的 bolt 文件中，只能使用磁盘上的文件系统
+	if o.IndexType == BPTree && o.FileSystem != fio.OSFileSystem {
+		return nil, ErrIndexNotSupported
+	}
 	var isInitial bool
 	//判断目录是否存在，如果不存在需要去创建目录
-	if _, err := os.Stat(o.DirPath); os.IsNotExist(err) {
+	if _, err := o.FileSystem.Stat(o.DirPath); os.IsNotExist(err) {
 		isInitial = true
-		if err := os.MkdirAll(o.DirPath, os.ModePerm); err != nil {
+		if err := o.FileSystem.MkdirAll(o.DirPath); err != nil {
 			return nil, err
 		}
 	}
 
-	fileLock := flock.New(filepath.Join(o.DirPath, fileLockName))
-	hold, err := fileLock.TryLock()
+	fileLock, err := o.FileSystem.Lock(filepath.Join(o.DirPath, fileLockName))
+	if err == fio.ErrLocked {
+		return nil, ErrDatabaseIsUsing
+	}
 	if err != nil {
 		return nil, err
 	}
-	if !hold {
-		return nil, ErrDatabaseIsUsing
-	}
 
-	entries, err := os.ReadDir(o.DirPath)
+	entries, err := o.FileSystem.ReadDir(o.DirPath)
 	if err != nil {
+		_ = fileLock.Unlock()
 		return nil, err
 	}
-	//如果目录下没有文件，说明数据库是空的
-	if len(entries) == 0 {
+	//如果目录下除了文件锁没有其他文件，说明数据库是空的
+	if len(entries) == 0 || (len(entries) == 1 && entries[0].Name() == fileLockName) {
 		isInitial = true
 	}
+	var cipher *data.Cipher
+	if o.EncryptionKey != nil {
+		if cipher, err = data.NewCipher(o.EncryptionKey, o.OldEncryptionKeys...); err != nil {
+			_ = fileLock.Unlock()
+			return nil, err
+		}
+	}
+	indexer, err := newIndexer(o, cipher)
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, err
+	}
 	//初始化 DB 实例结构体
 	db := &DB{
-		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
-		options:    o,
-		index:      index.NewIndexer(o.IndexType, o.DirPath, o.SyncWrite),
-		isInitial:  isInitial,
-		fileLock:   fileLock,
+		mu:          new(sync.RWMutex),
+		olderFiles:  make(map[uint32]*data.DataFile),
+		snapshots:   make(map[*Snapshot]struct{}),
+		pinnedFiles: make(map[*data.DataFile]int),
+		groupCommit: newGroupCommit(),
+		txns:        newTxnTracker(),
+		unsynced:    newUnsyncedWrites(),
+		options:     o,
+		index:       indexer,
+		cipher:      cipher,
+		isInitial:   isInitial,
+		fileLock:    fileLock,
+	}
+	if err := db.load(); err != nil {
+		// 打开失败时释放已经打开的数据文件、索引和文件锁
+		db.closeDataFiles()
+		_ = db.index.Close()
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	db.startAutoMerge()
+	return db, nil
+}
+
+// newIndexer 根据配置创建索引，B+ 树索引在设置了密钥时会加密
+func newIndexer(o Options, cipher *data.Cipher) (index.Indexer, error) {
+	if o.IndexType == index.BPTree {
+		return index.OpenBPlusTree(o.DirPath, o.SyncWrite, cipher)
 	}
+	return index.NewIndexer(o.IndexType, o.DirPath, o.SyncWrite), nil
+}
+
+// openDataFile 打开数据文件，设置了密钥时读写的记录都会加密
+func (db *DB) openDataFile(dirPath string, fileID uint32, ioType fio.FileIOType) (*data.DataFile, error) {
+	dataFile, err := data.OpenDataFile(db.options.FileSystem, dirPath, fileID, ioType)
+	if err != nil {
+		return nil, err
+	}
+	dataFile.Cipher = db.cipher
+	return dataFile, nil
+}
+
+// openHintFile 打开 hint 文件，设置了密钥时读写的记录都会加密
+func (db *DB) openHintFile(dirPath string) (*data.DataFile, error) {
+	hintFile, err := data.OpenHintFile(db.options.FileSystem, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	hintFile.Cipher = db.cipher
+	return hintFile, nil
+}
+
+// load 加载 merge 文件、数据文件和索引
+func (db *DB) load() error {
 	// 加载 merge 数据目录
 	if err := db.loadMergeFiles(); err != nil {
-		return nil, err
+		return err
 	}
 
 	//加载数据文件
 	if err := db.loadDataFiles(); err != nil {
-		return nil, err
+		return err
 	}
 
 	//B+树中不需要从文件中加载索引
-	if o.IndexType != index.BPTree {
+	if db.options.IndexType != index.BPTree {
 		//从 hint 文件中加载索引
 		if err := db.loadIndexFromHintFile(); err != nil {
-			return nil, err
+			return err
 		}
 		//从数据文件中加载索引
 		if err := db.loadIndexFromDataFiles(); err != nil {
-			return nil, err
+			return err
 		}
-		//重置 MMAP 为标准 IO
-		if o.MMapAtStartup {
-			if err := db.resetIOType(); err != nil {
-				return nil, err
+	}
+	if db.options.IndexType == index.BPTree {
+		if err := db.loadActiveFileOffset(); err != nil {
+			return err
+		}
+		if err := db.loadSeqNum(); err != nil {
+			return err
+		}
+	}
+	if err := db.loadOldKeyFiles(); err != nil {
+		return err
+	}
+	//重置 MMAP 为标准 IO
+	if db.options.MMapAtStartup && db.dataFileIOType() == fio.StandardFIO {
+		if err := db.resetIOType(); err != nil {
+			return err
+		}
+	}
+	return db.activeFile.Reserve(db.options.MaxDataFileSize)
+}
+
+// loadOldKeyFiles 设置了轮换之前的密钥时，找出还有使用旧密钥加密的记录的数据文件
+// 运行时写入的记录都使用当前的密钥，上次关闭时使用同一个密钥保存的结果可以直接使用，
+// 没有保存的结果（例如进程崩溃）或者当前的密钥变化时才需要检查已有的文件
+func (db *DB) loadOldKeyFiles() error {
+	db.oldKeyFiles = make(map[uint32]struct{})
+	saved, err := db.readOldKeyFiles()
+	if err != nil {
+		return err
+	}
+	if len(db.options.OldEncryptionKeys) == 0 {
+		return nil
+	}
+	if saved != nil {
+		for _, fid := range saved {
+			if _, ok := db.olderFiles[fid]; ok || fid == db.activeFile.FileID {
+				db.oldKeyFiles[fid] = struct{}{}
 			}
 		}
+		return nil
 	}
-	if o.IndexType == index.BPTree {
-		if err := db.loadSeqNum(); err != nil {
-			return nil, err
+	files := []*data.DataFile{db.activeFile}
+	for _, file := range db.olderFiles {
+		files = append(files, file)
+	}
+	for _, file := range files {
+		ok, err := file.HasOldKeyRecords()
+		if err != nil {
+			return err
 		}
-		if db.activeFile != nil {
-			size, err := db.activeFile.IOManager.Size()
-			if err != nil {
-				return nil, err
+		if ok {
+			db.oldKeyFiles[file.FileID] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// readOldKeyFiles 读取上次关闭时保存的使用旧密钥的数据文件，读取之后删除，之后的写入不会再更新这个文件
+// 文件不存在或者保存时使用的是另一个密钥时返回 nil
+func (db *DB) readOldKeyFiles() ([]uint32, error) {
+	filename := filepath.Join(db.options.DirPath, data.OldKeyFilesName)
+	if _, err := db.options.FileSystem.Stat(filename); os.IsNotExist(err) {
+		return nil, nil
+	}
+	oldKeyFile, err := data.OpenOldKeyFilesFile(db.options.FileSystem, db.options.DirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer oldKeyFile.Close()
+	var offset int64
+	var last *data.LogRecord
+	for {
+		rec, size, err := oldKeyFile.ReadLogRecordWithSize(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
 			}
-			db.activeFile.WriteOffset = size
+			return nil, err
 		}
+		last = rec
+		offset += size
+	}
+	if err := db.options.FileSystem.Remove(filename); err != nil {
+		return nil, err
+	}
+	if last == nil || db.cipher == nil || string(last.Key) != strconv.FormatUint(uint64(db.cipher.KeyID()), 10) {
+		return nil, nil
+	}
+	// 没有使用旧密钥的文件时返回空的切片，和没有保存的结果区分开
+	fids := make([]uint32, 0)
+	for b := last.Value; len(b) > 0; {
+		fid, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, nil
+		}
+		fids = append(fids, uint32(fid))
+		b = b[n:]
+	}
+	return fids, nil
+}
+
+// writeOldKeyFiles 保存使用旧密钥的数据文件和当前密钥的 id，下次使用同一个密钥打开时不需要再检查数据文件
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) writeOldKeyFiles() error {
+	if len(db.options.OldEncryptionKeys) == 0 || db.cipher == nil {
+		return nil
+	}
+	var value []byte
+	for fid := range db.oldKeyFiles {
+		value = binary.AppendUvarint(value, uint64(fid))
+	}
+	oldKeyFile, err := data.OpenOldKeyFilesFile(db.options.FileSystem, db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	defer oldKeyFile.Close()
+	record := &data.LogRecord{
+		Key:   []byte(strconv.FormatUint(uint64(db.cipher.KeyID()), 10)),
+		Value: value,
+	}
+	encRec, _ := data.EncodeLogRecord(record)
+	if err := oldKeyFile.Write(encRec); err != nil {
+		return err
+	}
+	return oldKeyFile.Sync()
+}
+
+// dataFileIOType 返回读写数据文件使用的 IO 类型
+func (db *DB) dataFileIOType() fio.FileIOType {
+	if db.options.IOType == IOTypeMMap {
+		return fio.MemoryMapRWIO
+	}
+	return fio.StandardFIO
+}
+
+// olderFileIOType 返回读取旧数据文件使用的 IO 类型，旧数据文件不再写入，可以使用只读的文件映射
+func (db *DB) olderFileIOType() fio.FileIOType {
+	ioType := db.dataFileIOType()
+	if db.options.MMapOlderFiles && ioType == fio.StandardFIO {
+		return fio.MemoryMapIO
+	}
+	return ioType
+}
+
+// closeDataFiles 关闭所有已经打开的数据文件，忽略关闭时的错误
+func (db *DB) closeDataFiles() {
+	for _, file := range db.olderFiles {
+		_ = file.Close()
+	}
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
 	}
-	return db, nil
 }
 
 // 加载数据文件的方法
 func (db *DB) loadDataFiles() error {
-	dirEntry, err := os.ReadDir(db.options.DirPath)
+	dirEntry, err := db.options.FileSystem.ReadDir(db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -175,7 +390,7 @@ func (db *DB) loadDataFiles() error {
 		}
 	}
 	if len(fileIds) == 0 {
-		file, err := data.OpenDataFile(db.options.DirPath, 0, fio.StandardFIO)
+		file, err := db.openDataFile(db.options.DirPath, 0, db.dataFileIOType())
 		if err != nil {
 			return err
 		}
@@ -186,12 +401,17 @@ func (db *DB) loadDataFiles() error {
 	//对文件进行排序，从小到大一次加载数据文件
 	sort.Ints(fileIds)
 	db.fileIds = fileIds
-	var ioType fio.FileIOType = fio.StandardFIO
-	if db.options.MMapAtStartup {
+	ioType := db.dataFileIOType()
+	if db.options.MMapAtStartup && ioType == fio.StandardFIO {
 		ioType = fio.MemoryMapIO
 	}
 	for i, fileId := range fileIds {
-		dataFile, err := data.OpenDataFile(db.options.DirPath, uint32(fileId), ioType)
+		fileIOType := ioType
+		// 旧数据文件在运行时保持映射
+		if i < len(fileIds)-1 && db.olderFileIOType() == fio.MemoryMapIO {
+			fileIOType = fio.MemoryMapIO
+		}
+		dataFile, err := db.openDataFile(db.options.DirPath, uint32(fileId), fileIOType)
 		if err != nil {
 			return err
 		}
@@ -211,7 +431,7 @@ func (db *DB) Sync() error {
 }
 
 // 从数据文件中加载索引
-// 遍历文件中所有记录并更新到内存索引中
+// 多个文件中的记录并发读取，再按照文件的顺序更新到内存索引中
 func (db *DB) loadIndexFromDataFiles() error {
 	//没有文件，说明数据库是空的直接返回
 	if len(db.fileIds) == 0 {
@@ -220,9 +440,9 @@ func (db *DB) loadIndexFromDataFiles() error {
 	// 查看是否发生过 merge
 	hasMerge, nonMergeFileID := false, uint32(0)
 	mergeFinFileName := filepath.Join(db.options.DirPath, data.MergeFinishedName)
-	if _, err := os.Stat(mergeFinFileName); err == nil {
+	if _, err := db.options.FileSystem.Stat(mergeFinFileName); err == nil {
 		hasMerge = true
-		nonMergeFileID, err = db.getNonMergeFileID(mergeFinFileName)
+		nonMergeFileID, err = db.getNonMergeFileID(db.options.DirPath)
 		if err != nil {
 			return err
 		}
@@ -230,99 +450,209 @@ func (db *DB) loadIndexFromDataFiles() error {
 	// 暂存事务的集合
 	var curSeqNum = nonTransactionSeqNum
 	var txns = make(map[uint64][]*data.TransactionRecord)
-	// 遍历所有文件 id，处理文件中的记录
-	for i, fid := range db.fileIds {
-		// 如果发生过 merge，只加载 merge 之后的文件
+	// 按照写入的顺序回放一条记录，更新内存索引
+	replay := func(rec *data.LogRecord, logRecPos *data.LogRecordPos) {
+		// 解析 key，拿到事务序列号
+		key, seqNum := parseLogRecordKey(rec.Key)
+		//更新事务序列号
+		curSeqNum = max(curSeqNum, seqNum)
+		// 分块只通过清单读取，不需要更新索引，也不需要暂存到事务中
+		if rec.Type == data.LogRecordChunk {
+			return
+		}
+		if seqNum == nonTransactionSeqNum {
+			// 非事务操作，直接更新内存索引
+			ok := db.updateIndex(key, rec, logRecPos)
+			if !ok {
+				//return ErrIndexUpdateFailed
+				panic(ErrIndexUpdateFailed)
+			}
+
+		} else {
+			// 事务完成，对应的 seqNUm 的数据可以更新到内存索引中
+			if rec.Type == data.LogRecordTxnFinished {
+				for _, txnRec := range txns[seqNum] {
+					ok := db.updateIndex(txnRec.Record.Key, txnRec.Record, txnRec.Pos)
+					if !ok {
+						//return ErrIndexUpdateFailed
+						panic(ErrIndexUpdateFailed)
+					}
+
+				}
+				delete(txns, seqNum)
+			} else {
+				//事务未结束
+				rec.Key = key
+				txns[seqNum] = append(txns[seqNum], &data.TransactionRecord{
+					Record: rec,
+					Pos:    logRecPos,
+				})
+			}
+		}
+	}
+	// 如果发生过 merge，只加载 merge 之后的文件
+	var dataFiles []*data.DataFile
+	for _, fid := range db.fileIds {
 		if hasMerge && uint32(fid) < nonMergeFileID {
 			continue
 		}
-		var dataFile *data.DataFile
-		var fileId = uint32(fid)
-		if fileId == db.activeFile.FileID {
-			dataFile = db.activeFile
+		if uint32(fid) == db.activeFile.FileID {
+			dataFiles = append(dataFiles, db.activeFile)
 		} else {
-			dataFile = db.olderFiles[fileId]
+			dataFiles = append(dataFiles, db.olderFiles[uint32(fid)])
 		}
-		var offset int64 = 0
-		for {
-			rec, size, err := dataFile.ReadLogRecordWithSize(offset)
-
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
+	}
+	// 并发读取所有文件中的记录，再按照文件的顺序回放，保证后写入的记录覆盖之前的记录
+	err := db.readDataFiles(dataFiles, func(lf *loadedFile) error {
+		for _, entry := range lf.entries {
+			rec := &data.LogRecord{Key: entry.Key, Value: entry.Value, Type: entry.Type, Expire: entry.Pos.Expire}
+			replay(rec, entry.Pos)
+		}
+		if lf.err == io.EOF || data.IsCorruptedRecord(lf.err) {
+			if err := db.recoverDataFile(lf.dataFile, lf.offset, lf.err); err != nil {
 				return err
 			}
-			rec.Value = nil
-			//构建内存索引并保存
-			logRecPos := &data.LogRecordPos{
-				Fid:    fileId,
-				Offset: offset,
-				Size:   uint32(size),
+		} else if lf.err != nil {
+			return lf.err
+		}
+		//如果是当前活跃文件，更新这个文件的 Write offset
+		if lf.dataFile == db.activeFile {
+			db.activeFile.WriteOffset = lf.offset
+			if db.fileHintsEnabled() {
+				db.activeHints = lf.entries
 			}
-			// 解析 key，拿到事务序列号
-			key, seqNum := parseLogRecordKey(rec.Key)
-			if seqNum == nonTransactionSeqNum {
-				// 非事务操作，直接更新内存索引
-				ok := db.updateIndex(key, rec.Type, logRecPos)
-				if !ok {
-					//return ErrIndexUpdateFailed
-					panic(ErrIndexUpdateFailed)
-				}
-
-			} else {
-				// 事务完成，对应的 seqNUm 的数据可以更新到内存索引中
-				if rec.Type == data.LogRecordTxnFinished {
-					for _, txnRec := range txns[seqNum] {
-						ok := db.updateIndex(txnRec.Record.Key, txnRec.Record.Type, txnRec.Pos)
-						if !ok {
-							//return ErrIndexUpdateFailed
-							panic(ErrIndexUpdateFailed)
-						}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	//更新序列号到 db 中
+	db.seqNum = curSeqNum
+	return nil
+}
 
-					}
-					delete(txns, seqNum)
-				} else {
-					//事务未结束
-					rec.Key = key
-					txns[seqNum] = append(txns[seqNum], &data.TransactionRecord{
-						Record: rec,
-						Pos:    logRecPos,
-					})
+// loadActiveFileOffset 读取活跃文件中的记录，得到下一次写入的位置
+// B+ 树索引不需要从数据文件中加载索引，但仍然需要处理活跃文件末尾不完整的记录
+func (db *DB) loadActiveFileOffset() error {
+	var offset int64
+	for {
+		_, size, err := db.activeFile.ReadLogRecordWithSize(offset)
+		if err != nil {
+			if err == io.EOF || data.IsCorruptedRecord(err) {
+				if err := db.recoverDataFile(db.activeFile, offset, err); err != nil {
+					return err
 				}
+				break
 			}
-			//更新事务序列号
-			curSeqNum = max(curSeqNum, seqNum)
-			//更新 offset，继续读取下一个记录
-			offset += size
+			return err
 		}
-		//如果是当前活跃文件，更新这个文件的 Write offset
-		if i == len(db.fileIds)-1 {
-			db.activeFile.WriteOffset = offset
+		offset += size
+	}
+	db.activeFile.WriteOffset = offset
+	return nil
+}
+
+// recoverDataFile 处理数据文件在 offset 处无法继续读取的情况
+// 文件末尾全部是 0 的空数据不是损坏的记录，活跃文件会被截断到最后一条有效记录，之后从这里继续写入
+// 活跃文件末尾损坏的数据只有开启 TruncateTornTail 时才会被截断，旧数据文件中损坏的记录只有开启 SkipCorruptedRecords 时才会被跳过
+func (db *DB) recoverDataFile(dataFile *data.DataFile, offset int64, cause error) error {
+	fileSize, err := dataFile.Size()
+	if err != nil {
+		return err
+	}
+	// 正常读取到文件末尾
+	if offset >= fileSize {
+		return nil
+	}
+	isActive := dataFile == db.activeFile
+	if cause == io.EOF {
+		// 文件映射预先分配的空间或者文件系统扩展了文件大小但没有写入数据，异常退出之后末尾都是 0
+		zeroTail, err := isZeroTail(dataFile, offset, fileSize)
+		if err != nil {
+			return err
+		}
+		if zeroTail {
+			if isActive {
+				return dataFile.Truncate(offset)
+			}
+			return nil
 		}
+		// 空的记录之后还有数据，说明文件中间的数据被破坏
+		cause = data.ErrIncompleteRecord
 	}
-	//更新序列号到 db 中
-	db.seqNum = curSeqNum
+	switch {
+	case isActive && db.options.TruncateTornTail:
+		if err := dataFile.Truncate(offset); err != nil {
+			return err
+		}
+	case !isActive && db.options.SkipCorruptedRecords:
+	default:
+		return cause
+	}
+	db.droppedBytes += fileSize - offset
 	return nil
 }
 
+// zeroTailChunkSize 检查文件末尾是否全部是 0 时每次读取的长度
+const zeroTailChunkSize = 64 * 1024
+
+// isZeroTail 判断数据文件从 offset 开始到 fileSize 的内容是否全部是 0
+func isZeroTail(dataFile *data.DataFile, offset, fileSize int64) (bool, error) {
+	for offset < fileSize {
+		n := min(fileSize-offset, zeroTailChunkSize)
+		b, err := dataFile.ReadBytes(n, offset)
+		if err != nil {
+			return false, err
+		}
+		for _, c := range b {
+			if c != 0 {
+				return false, nil
+			}
+		}
+		offset += n
+	}
+	return true, nil
+}
+
 func (db *DB) Close() error {
+	// View 直接引用文件映射，解除映射之后再访问会导致进程崩溃，还有没有释放的 View 时拒绝关闭
+	db.mu.Lock()
+	if db.views > 0 {
+		db.mu.Unlock()
+		return ErrViewNotReleased
+	}
+	db.closed = true
+	db.mu.Unlock()
 	defer func() {
 		if err := db.fileLock.Unlock(); err != nil {
 			panic(fmt.Sprintf("failed to unlock the directory,file lock: %v", err))
 		}
 	}()
+	// 停止后台 merge，并等待正在进行的 merge 完成
+	db.stopAutoMerge()
+	db.mergeWg.Wait()
 	if db.activeFile == nil {
 		return nil
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	// 数据文件即将关闭，释放所有未释放的快照
+	for snap := range db.snapshots {
+		snap.release()
+	}
+	// 关闭 merge 之后仍被迭代器引用的旧数据文件
+	for file := range db.pinnedFiles {
+		if db.isFileRetired(file) {
+			_ = file.Close()
+		}
+	}
 	if err := db.index.Close(); err != nil {
 		return err
 	}
 	//保存当前事务序列号
-	seqNoFile, err := data.OpenSeqNumFile(db.options.DirPath)
+	seqNoFile, err := data.OpenSeqNumFile(db.options.FileSystem, db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -337,6 +667,9 @@ func (db *DB) Close() error {
 	if err := seqNoFile.Sync(); err != nil {
 		return err
 	}
+	if err := db.writeOldKeyFiles(); err != nil {
+		return err
+	}
 
 	//关闭所有数据文件
 	for _, file := range db.olderFiles {
@@ -348,6 +681,12 @@ func (db *DB) Close() error {
 	if err != nil {
 		return err
 	}
+	// 活跃文件的 hint 文件在下次打开时如果和数据文件一致就可以直接使用
+	if err := db.writeActiveFileHint(); err != nil {
+		return err
+	}
+	// 先唤醒等待持久化的写入，再关闭活跃文件
+	db.markSynced(db.writeSeq)
 	return db.activeFile.Close()
 }
 
@@ -355,10 +694,13 @@ func (db *DB) Size() int64 {
 	return db.index.Size()
 }
 
-func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) (ok bool) {
+func (db *DB) updateIndex(key []byte, rec *data.LogRecord, pos *data.LogRecordPos) (ok bool) {
 	var oldPos *data.LogRecordPos
-	switch typ {
-	case data.LogRecordNormal:
+	if rec.Type != data.LogRecordRangeDeleted {
+		db.recordWrite(key)
+	}
+	switch rec.Type {
+	case data.LogRecordNormal, data.LogRecordChunkManifest:
 		oldPos = db.index.Put(key, pos)
 		ok = true
 		if oldPos != nil {
@@ -366,8 +708,26 @@ func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecor
 		}
 	case data.LogRecordDeleted:
 		db.reclaimSize += int64(pos.Size)
-		oldPos, ok = db.index.Delete(key)
-		db.reclaimSize += int64(oldPos.Size)
+		// 索引中不存在该 key 也是合法的，例如删除一个不存在的 key
+		oldPos, _ = db.index.Delete(key)
+		ok = true
+		if oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	case data.LogRecordRangeDeleted:
+		// 按照写入的顺序回放，只会删除在这条记录之前写入的 key
+		db.reclaimSize += int64(pos.Size)
+		db.deleteIndexRange(key, rec.Value)
+		ok = true
+	case data.LogRecordExpire:
+		// 只修改过期时间，索引依然指向 value 所在的记录，key 不存在时忽略
+		db.reclaimSize += int64(pos.Size)
+		if curPos := db.index.Get(key); curPos != nil {
+			newPos := *curPos
+			newPos.Expire = pos.Expire
+			db.index.Put(key, &newPos)
+		}
+		ok = true
 	default:
 		panic("unknown rec type")
 	}
@@ -377,11 +737,11 @@ func (db *DB) updateIndex(key []byte, typ data.LogRecordType, pos *data.LogRecor
 func (db *DB) loadIndexFromHintFile() error {
 	// 查看是否存在 Hint 文件
 	hintFile := filepath.Join(db.options.DirPath, data.HintFileName)
-	if _, err := os.Stat(hintFile); os.IsNotExist(err) {
+	if _, err := db.options.FileSystem.Stat(hintFile); os.IsNotExist(err) {
 		return nil
 	}
 	// 打开 Hint 文件
-	hintDataFile, err := data.OpenHintFile(db.options.DirPath)
+	hintDataFile, err := db.openHintFile(db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -404,11 +764,11 @@ func (db *DB) loadIndexFromHintFile() error {
 
 func (db *DB) loadSeqNum() error {
 	filename := filepath.Join(db.options.DirPath, data.SeqNumFileName)
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
+	if _, err := db.options.FileSystem.Stat(filename); os.IsNotExist(err) {
 		return nil
 	}
 
-	seqNumFile, err := data.OpenSeqNumFile(db.options.DirPath)
+	seqNumFile, err := data.OpenSeqNumFile(db.options.FileSystem, db.options.DirPath)
 	if err != nil {
 		return err
 	}
@@ -432,7 +792,7 @@ func (db *DB) loadSeqNum() error {
 	}
 	db.seqNum = seqNum
 	db.seqNumFileExists = true
-	return os.Remove(filename)
+	return db.options.FileSystem.Remove(filename)
 }
 
 // 将启动时的 mmap 读取文件，转换为标准 IO
@@ -444,6 +804,10 @@ func (db *DB) resetIOType() error {
 	if err != nil {
 		return err
 	}
+	// 运行时保持映射的旧数据文件不需要重置
+	if db.olderFileIOType() == fio.MemoryMapIO {
+		return nil
+	}
 	for _, dataFile := range db.olderFiles {
 		err := dataFile.SetIOManager(fio.StandardFIO)
 		if err != nil {
@@ -454,7 +818,7 @@ func (db *DB) resetIOType() error {
 }
 
 func (db *DB) reachMergeCondition() bool {
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dirSize()
 	if err != nil {
 		return false
 	}
@@ -464,8 +828,25 @@ func (db *DB) reachMergeCondition() bool {
 	return false
 }
 
+// dirSize 返回数据目录中所有文件的大小之和，活跃文件的文件映射预先分配的空间不计算在内
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) dirSize() (int64, error) {
+	size, err := fio.DirSize(db.options.FileSystem, db.options.DirPath)
+	if err != nil {
+		return 0, err
+	}
+	if db.activeFile != nil {
+		size -= db.activeFile.Reserved()
+	}
+	return size, nil
+}
+
+// Backup 将数据目录中的文件拷贝到磁盘上的 destDir，内存中的数据库也会备份到磁盘上
 func (db *DB) Backup(destDir string) error {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	return utils.CopyDir(db.options.DirPath, destDir, []string{fileLockName})
+	if db.options.FileSystem == fio.OSFileSystem {
+		return utils.CopyDir(db.options.DirPath, destDir, []string{fileLockName})
+	}
+	return fio.CopyDir(db.options.FileSystem, db.options.DirPath, destDir, []string{fileLockName})
 }
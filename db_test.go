@@ -1,13 +1,22 @@
 package bitcask_go
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/fio"
 	"github.com/rbongIO/bitcask-go/utils"
 	"github.com/stretchr/testify/assert"
 	"log"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -203,6 +212,126 @@ func TestDB_Get(t *testing.T) {
 	assert.Equal(t, ErrKeyNotFound, err)
 }
 
+func TestDB_ConcurrentGet(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-concurrent-get")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(32*1024), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestKey(i)))
+	}
+
+	// 读取只需要共享锁，其他读取持有锁时不会被阻塞
+	db.mu.RLock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(1), val)
+		val, err = db.GetValueByPosition(db.index.Get(utils.GetTestKey(2)))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(2), val)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get blocked by a shared lock")
+	}
+	db.mu.RUnlock()
+
+	// 并发读取的同时写入和 merge，迭代器读取数据时不需要加锁
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := (g*131 + n) % 1000
+				val, err := db.Get(utils.GetTestKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, utils.GetTestKey(i), val)
+				if n%100 == 0 {
+					it := db.NewIterator(WithPrefix(utils.GetTestKey(i)))
+					for it.Rewind(); it.Valid(); it.Next() {
+						assert.Equal(t, it.Key(), it.Value())
+					}
+					it.Close()
+				}
+			}
+		}(g)
+	}
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i%1000), utils.GetTestKey(i%1000)))
+		if i%1000 == 999 {
+			assert.Nil(t, db.Merge())
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestDB_MultiGet(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-multi-get")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024), WithCompression(CompressionSnappy), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 写入多个数据文件，并且打乱写入顺序
+	for i := 0; i < 1000; i++ {
+		key := utils.GetTestKey((i * 7) % 1000)
+		assert.Nil(t, db.Put(key, append(key, utils.GetTestValue(128)...)))
+	}
+	assert.Greater(t, len(db.olderFiles), 1)
+	assert.Nil(t, db.Delete(utils.GetTestKey(10)))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(20), []byte("expired"), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	check := func(db *DB) {
+		keys := [][]byte{utils.GetTestKey(999), nil, utils.GetTestKey(10), utils.GetTestKey(20), []byte("unknown")}
+		for i := 0; i < 1000; i += 3 {
+			keys = append(keys, utils.GetTestKey(i))
+		}
+		// 重复的 key
+		keys = append(keys, utils.GetTestKey(999))
+		values, errs := db.MultiGet(keys)
+		assert.Equal(t, len(keys), len(values))
+		assert.Equal(t, len(keys), len(errs))
+		for i, key := range keys {
+			val, err := db.Get(key)
+			assert.Equal(t, err, errs[i])
+			assert.Equal(t, val, values[i])
+		}
+		assert.Equal(t, ErrKeyIsEmpty, errs[1])
+		assert.Equal(t, ErrKeyNotFound, errs[2])
+		assert.Equal(t, ErrKeyNotFound, errs[3])
+		assert.Equal(t, ErrKeyNotFound, errs[4])
+		assert.Equal(t, values[0], values[len(values)-1])
+		assert.True(t, bytes.HasPrefix(values[0], utils.GetTestKey(999)))
+
+		values, errs = db.MultiGet(nil)
+		assert.Empty(t, values)
+		assert.Empty(t, errs)
+	}
+	check(db)
+
+	// merge 之后相邻的记录来自同一个数据文件
+	assert.Nil(t, db.Merge())
+	check(db)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024), WithCompression(CompressionSnappy))
+	assert.Nil(t, err)
+	check(db2)
+	assert.Nil(t, db2.Close())
+}
+
 func TestDB_Delete(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "bitcask-go-delete")
 	//opts.DirPath = dir
@@ -255,6 +384,97 @@ func TestDB_Delete(t *testing.T) {
 	assert.Equal(t, val1, val2)
 }
 
+// rangeTestKey 生成按照数字顺序排序的 key
+func rangeTestKey(i int) []byte {
+	return []byte(fmt.Sprintf("range-key-%06d", i))
+}
+
+func TestDB_DeleteRange(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-delete-range")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(32 * 1024),
+			WithDataFileMergeRatio(0)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(rangeTestKey(i), utils.GetTestValue(64)))
+		}
+		assert.Equal(t, ErrInvalidRange, db.DeleteRange(rangeTestKey(20), rangeTestKey(10)))
+
+		// 删除 [range-key-000100, range-key-000200)
+		stat := db.Stat()
+		assert.Nil(t, db.DeleteRange(rangeTestKey(100), rangeTestKey(200)))
+		assert.Equal(t, 900, len(db.ListKeys()))
+		_, err = db.Get(rangeTestKey(100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(rangeTestKey(199))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.Get(rangeTestKey(200))
+		assert.Nil(t, err)
+		assert.Greater(t, db.Stat().ReclaimableSize, stat.ReclaimableSize)
+		// 范围删除之后重新写入的 key 不受影响
+		assert.Nil(t, db.Put(rangeTestKey(150), []byte("rewritten")))
+		// 范围内没有 key 时不会写入记录
+		size := db.activeFile.WriteOffset
+		assert.Nil(t, db.DeleteRange(rangeTestKey(100), rangeTestKey(150)))
+		assert.Equal(t, size, db.activeFile.WriteOffset)
+		// 没有上界
+		assert.Nil(t, db.DeleteRange(rangeTestKey(900), nil))
+		assert.Equal(t, 801, len(db.ListKeys()))
+
+		check := func(db *DB) {
+			assert.Equal(t, 801, len(db.ListKeys()))
+			val, err := db.Get(rangeTestKey(150))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("rewritten"), val)
+			_, err = db.Get(rangeTestKey(151))
+			assert.Equal(t, ErrKeyNotFound, err)
+			_, err = db.Get(rangeTestKey(999))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		// 重启之后按照写入顺序回放范围删除记录
+		assert.Nil(t, db.Close())
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		check(db)
+
+		// merge 会丢弃范围删除记录以及被删除的数据
+		assert.Nil(t, db.Merge())
+		check(db)
+		assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+		assert.Nil(t, db.Close())
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		check(db)
+		destroyDB(db)
+	}
+}
+
+func TestDB_DeletePrefix(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-prefix")
+	db, err := Open(WithDirPath(dir))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	keys := [][]byte{[]byte("tenant-1/a"), []byte("tenant-1/b"), []byte("tenant-10/a"), []byte("tenant-2/a"),
+		{0xff, 0xff, 0x01}, {0xff, 0xff}, {0xff, 0xfe}}
+	for _, key := range keys {
+		assert.Nil(t, db.Put(key, key))
+	}
+	assert.Equal(t, ErrKeyIsEmpty, db.DeletePrefix(nil))
+
+	assert.Nil(t, db.DeletePrefix([]byte("tenant-1/")))
+	assert.Nil(t, db.DeletePrefix([]byte{0xff, 0xff}))
+	var remaining [][]byte
+	for _, key := range db.ListKeys() {
+		remaining = append(remaining, key)
+	}
+	assert.Equal(t, [][]byte{[]byte("tenant-10/a"), []byte("tenant-2/a"), {0xff, 0xfe}}, remaining)
+
+	start, end := prefixRange([]byte{0x01, 0xff})
+	assert.Equal(t, []byte{0x01, 0xff}, start)
+	assert.Equal(t, []byte{0x02}, end)
+}
+
 func TestDB_ListKeys(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "bitcask-go-list-keys")
 	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
@@ -446,3 +666,552 @@ func TestDB_OpenMMap(t *testing.T) {
 	assert.Nil(t, err)
 	assert.NotNil(t, db)
 }
+
+func TestDB_MMapIO(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-mmap-io")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithIOType(IOTypeMMap), WithMaxDataFileSize(64 * 1024)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		assert.NotEmpty(t, db.olderFiles)
+		for i := 0; i < 1000; i += 100 {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+		// 活跃文件预先分配了空间，写满之后的旧文件长度和写入的数据一致
+		fid := db.activeFile.FileID
+		info, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(data.FileHeaderSize+64*1024), info.Size())
+		for _, file := range db.olderFiles {
+			info, err := os.Stat(file.Filepath)
+			assert.Nil(t, err)
+			assert.Equal(t, data.FileHeaderSize+file.WriteOffset, info.Size())
+		}
+		validSize := db.activeFile.WriteOffset
+		keyNum := len(db.ListKeys())
+		assert.Nil(t, db.Close())
+
+		// 关闭时截断到写入的数据的末尾
+		info, err = os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, data.FileHeaderSize+validSize, info.Size())
+
+		// 异常退出时预先分配的空间没有被截断，重新打开时不会被当作损坏的记录
+		appendToDataFile(t, dir, fid, make([]byte, 4096))
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), db.Stat().DroppedBytes)
+		assert.Equal(t, validSize, db.activeFile.WriteOffset)
+		assert.Equal(t, keyNum, len(db.ListKeys()))
+		assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+		assert.Nil(t, db.Close())
+
+		// 使用标准 IO 可以打开文件映射写入的数据
+		db, err = Open(WithDirPath(dir), WithIndexType(indexType))
+		assert.Nil(t, err)
+		val, err := db.Get([]byte("after"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+		assert.Equal(t, keyNum+1, len(db.ListKeys()))
+		destroyDB(db)
+	}
+}
+
+func TestDB_PutIfAbsent(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-if-absent")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ok, err := db.PutIfAbsent(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1"), val)
+
+	// 过期的 key 视为不存在
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v1"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	ok, err = db.PutIfAbsent(utils.GetTestKey(2), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// 并发写入时只有一个成功
+	var wg sync.WaitGroup
+	var succeed int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := db.PutIfAbsent([]byte("leader"), []byte(strconv.Itoa(i)))
+			assert.Nil(t, err)
+			if ok {
+				atomic.AddInt32(&succeed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), succeed)
+}
+
+func TestDB_CompareAndSwap(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// key 不存在
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), nil, []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v0"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(1), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+
+	// 并发自增计数器不会丢失更新
+	err = db.Put([]byte("counter"), []byte("0"))
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					cur, err := db.Get([]byte("counter"))
+					assert.Nil(t, err)
+					n, _ := strconv.Atoi(string(cur))
+					ok, err := db.CompareAndSwap([]byte("counter"), cur, []byte(strconv.Itoa(n+1)))
+					assert.Nil(t, err)
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	val, err = db.Get([]byte("counter"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+}
+
+func TestDB_CompareAndSwapWithTTL(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-cas-ttl")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// CompareAndSwap 保留 key 原有的过期时间
+	err = db.PutWithTTL(utils.GetTestKey(1), []byte("v1"), time.Hour)
+	assert.Nil(t, err)
+	ok, err := db.CompareAndSwap(utils.GetTestKey(1), []byte("v1"), []byte("v2"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+	assert.LessOrEqual(t, ttl, time.Hour)
+
+	// CompareAndSwapWithTTL 使用新的过期时间
+	ok, err = db.CompareAndSwapWithTTL(utils.GetTestKey(1), []byte("v2"), []byte("v3"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, ttl, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// ttl 为 0 时去掉过期时间
+	err = db.PutWithTTL(utils.GetTestKey(2), []byte("v1"), time.Hour)
+	assert.Nil(t, err)
+	ok, err = db.CompareAndSwapWithTTL(utils.GetTestKey(2), []byte("v1"), []byte("v2"), 0)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ttl, err = db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	_, err = db.CompareAndSwapWithTTL(utils.GetTestKey(2), []byte("v2"), []byte("v3"), -time.Second)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// PutIfAbsentWithTTL 写入的 key 会过期
+	ok, err = db.PutIfAbsentWithTTL(utils.GetTestKey(3), []byte("v1"), 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	time.Sleep(100 * time.Millisecond)
+	ok, err = db.PutIfAbsentWithTTL(utils.GetTestKey(3), []byte("v2"), time.Hour)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err := db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v2"), val)
+}
+
+func TestDB_DeleteIfEquals(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-delete-if-equals")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ok, err := db.DeleteIfEquals(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	err = db.Put(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v2"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfEquals(utils.GetTestKey(1), []byte("v1"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// appendToDataFile 直接向数据文件末尾追加字节，模拟写入过程中进程崩溃
+func appendToDataFile(t *testing.T, dir string, fid uint32, b []byte) {
+	f, err := os.OpenFile(data.GetDataFileName(dir, fid), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.Write(b)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+}
+
+func TestOpen_TornTail(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-torn-tail")
+		db, err := Open(WithDirPath(dir), WithIndexType(indexType))
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+		}
+		fid := db.activeFile.FileID
+		validSize := db.activeFile.WriteOffset
+		assert.Nil(t, db.Close())
+
+		// 只写入了一半的记录
+		encRec, _ := data.EncodeLogRecord(&data.LogRecord{Key: logRecordKeyWithSeqNum([]byte("torn"), nonTransactionSeqNum), Value: utils.GetTestValue(64)})
+		torn := encRec[:len(encRec)/2]
+		appendToDataFile(t, dir, fid, torn)
+
+		// 默认不处理损坏的记录
+		_, err = Open(WithDirPath(dir), WithIndexType(indexType))
+		assert.Equal(t, data.ErrIncompleteRecord, err)
+
+		db, err = Open(WithDirPath(dir), WithIndexType(indexType), WithTruncateTornTail(true))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(torn)), db.Stat().DroppedBytes)
+		assert.Equal(t, validSize, db.activeFile.WriteOffset)
+		info, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, data.FileHeaderSize+validSize, info.Size())
+		assert.Equal(t, 100, len(db.ListKeys()))
+		_, err = db.Get([]byte("torn"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		// 截断之后可以正常写入和重新打开
+		assert.Nil(t, db.Put([]byte("after"), []byte("value")))
+		assert.Nil(t, db.Close())
+		db, err = Open(WithDirPath(dir), WithIndexType(indexType))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), db.Stat().DroppedBytes)
+		val, err := db.Get([]byte("after"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), val)
+		destroyDB(db)
+	}
+}
+
+func TestOpen_ZeroTail(t *testing.T) {
+	for _, ioType := range []IOType{IOTypeStandard, IOTypeMMap} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-zero-tail")
+		db, err := Open(WithDirPath(dir), WithIOType(ioType), WithMaxDataFileSize(64*1024))
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+		fid := db.activeFile.FileID
+		validSize := db.activeFile.WriteOffset
+		assert.Nil(t, db.Close())
+
+		// 文件系统扩展了文件大小但数据没有写入，或者文件映射预先分配的空间在异常退出时没有被截断
+		// 末尾的空数据默认就会被截断，使用标准 IO 也可以打开
+		appendToDataFile(t, dir, fid, make([]byte, 32))
+		db, err = Open(WithDirPath(dir))
+		assert.Nil(t, err)
+		assert.Equal(t, int64(0), db.Stat().DroppedBytes)
+		assert.Equal(t, validSize, db.activeFile.WriteOffset)
+		info, err := os.Stat(data.GetDataFileName(dir, fid))
+		assert.Nil(t, err)
+		assert.Equal(t, data.FileHeaderSize+validSize, info.Size())
+		assert.Nil(t, db.Put([]byte("key2"), []byte("value2")))
+		assert.Nil(t, db.Close())
+
+		db, err = Open(WithDirPath(dir), WithIOType(ioType), WithMaxDataFileSize(64*1024))
+		assert.Nil(t, err)
+		for key, val := range map[string]string{"key": "value", "key2": "value2"} {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte(val), v)
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDB_StatMMap(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-stat-mmap")
+	db, err := Open(WithDirPath(dir), WithIOType(IOTypeMMap), WithMaxDataFileSize(64*1024*1024), WithDataFileMergeRatio(0.5))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 活跃文件预先分配的空间不计入数据目录的大小
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+	}
+	for i := 0; i < 60; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	stat := db.Stat()
+	assert.Less(t, stat.DiskSize, int64(64*1024))
+	assert.Equal(t, data.FileHeaderSize+db.activeFile.WriteOffset, stat.DiskSize-dirSizeExceptDataFiles(t, dir))
+	assert.True(t, db.reachMergeCondition())
+	assert.Nil(t, db.Merge())
+}
+
+// dirSizeExceptDataFiles 返回数据目录中数据文件以外的文件大小之和
+func dirSizeExceptDataFiles(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		assert.Nil(t, err)
+		size += info.Size()
+	}
+	return size
+}
+
+func TestOpen_ZeroedRecordInTheMiddle(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-zeroed-record")
+	db, err := Open(WithDirPath(dir))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	fid := db.activeFile.FileID
+	assert.Nil(t, db.Close())
+
+	// 空的记录之后还有数据，说明是文件中间的数据被破坏，不能当作文件末尾
+	encRec, _ := data.EncodeLogRecord(&data.LogRecord{Key: logRecordKeyWithSeqNum([]byte("key2"), nonTransactionSeqNum), Value: []byte("value2")})
+	appendToDataFile(t, dir, fid, append(make([]byte, 32), encRec...))
+	_, err = Open(WithDirPath(dir))
+	assert.Equal(t, data.ErrIncompleteRecord, err)
+
+	db, err = Open(WithDirPath(dir), WithTruncateTornTail(true))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(32+len(encRec)), db.Stat().DroppedBytes)
+	_, err = db.Get([]byte("key2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestOpen_CorruptedOlderFile(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-corrupted")
+	// 旧数据文件有 hint 文件时打开数据库不会读取其中的记录，这里测试从数据文件加载索引
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(32*1024), WithFileHints(false))
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.True(t, len(db.olderFiles) > 0)
+	assert.Nil(t, db.Close())
+
+	// 修改第一个数据文件中间的一个字节
+	fileName := data.GetDataFileName(dir, 0)
+	b, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	b[len(b)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, b, 0644))
+
+	// 旧数据文件损坏时只截断活跃文件不能打开
+	_, err = Open(WithDirPath(dir), WithMaxDataFileSize(32*1024), WithFileHints(false), WithTruncateTornTail(true))
+	assert.True(t, data.IsCorruptedRecord(err))
+
+	db, err = Open(WithDirPath(dir), WithMaxDataFileSize(32*1024), WithFileHints(false), WithSkipCorruptedRecords(true),
+		WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	dropped := db.Stat().DroppedBytes
+	assert.Greater(t, dropped, int64(0))
+	assert.Less(t, dropped, int64(len(b)))
+	// 损坏位置之前和其他文件中的数据依然可以读取
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	// 跳过的数据不影响 merge
+	assert.Nil(t, db.Merge())
+}
+
+func TestOpen_InMemory(t *testing.T) {
+	fs := fio.NewMemoryFileSystem()
+	dir := filepath.Join(os.TempDir(), "bitcask-go-in-memory")
+	opts := []OptionFunc{WithDirPath(dir), WithFileSystem(fs), WithMaxDataFileSize(32 * 1024), WithDataFileMergeRatio(0)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Greater(t, len(db.olderFiles), 1)
+	assert.Nil(t, db.Merge())
+	assert.Greater(t, db.Stat().DiskSize, int64(0))
+
+	// 同一个文件系统中的数据库只能被打开一次
+	_, err = Open(opts...)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+	// B+ 树索引需要写入磁盘
+	_, err = Open(WithInMemory(), WithIndexType(BPTree))
+	assert.Equal(t, ErrIndexNotSupported, err)
+	assert.Nil(t, db.Close())
+
+	// 数据目录、merge 目录和文件锁都不会写入磁盘
+	for _, path := range []string{dir, dir + mergeDirName} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// 使用同一个文件系统重新打开，数据从内存中的 hint 文件和数据文件中加载
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db.ListKeys()))
+	val, err := db.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 内存中的数据库可以备份到磁盘上
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-in-memory-backup")
+	assert.Nil(t, db.Backup(backupDir))
+	assert.Nil(t, db.Close())
+	backupDB, err := Open(WithDirPath(backupDir))
+	defer destroyDB(backupDB)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(backupDB.ListKeys()))
+	backupVal, err := backupDB.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, val, backupVal)
+
+	// 新的内存文件系统中没有数据
+	db, err = Open(WithDirPath(dir), WithInMemory())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
+
+func TestOpen_FileFormat(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-format")
+	db, err := Open(WithDirPath(dir))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put([]byte("key"), []byte("value")))
+	assert.NotNil(t, db.activeFile.Header)
+	assert.Nil(t, db.Close())
+
+	// 更新的版本写入的文件不能打开
+	fileName := data.GetDataFileName(dir, 0)
+	b, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	header := data.NewFileHeader()
+	header.Version = data.FileFormatVersion + 1
+	assert.Nil(t, os.WriteFile(fileName, append(header.Encode(), b[data.FileHeaderSize:]...), 0644))
+	_, err = Open(WithDirPath(dir))
+	assert.ErrorIs(t, err, data.ErrUnsupportedFileFormat)
+
+	// 没有文件头的旧格式文件需要先升级
+	assert.Nil(t, os.WriteFile(fileName, b[data.FileHeaderSize:], 0644))
+	_, err = Open(WithDirPath(dir))
+	assert.ErrorIs(t, err, data.ErrLegacyFileFormat)
+
+	assert.Nil(t, os.WriteFile(fileName, b, 0644))
+	db, err = Open(WithDirPath(dir))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+}
+
+func TestDB_Compression(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	value := func(i int) []byte {
+		return []byte(strings.Repeat(`{"id":`+strconv.Itoa(i)+`,"name":"bitcask","tags":["kv","log"]},`, 20))
+	}
+	// 每次打开使用不同的压缩算法，同一个数据文件中混合了多种压缩算法
+	codecs := []CompressionType{CompressionSnappy, CompressionFlate, CompressionNone}
+	for round, c := range codecs {
+		db, err := Open(WithDirPath(dir), WithCompression(c))
+		assert.Nil(t, err)
+		for i := round * 1000; i < (round+1)*1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), value(i)))
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	db, err := Open(WithDirPath(dir), WithCompression(CompressionSnappy), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	check := func() {
+		for i := 0; i < len(codecs)*1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value(i), val)
+		}
+	}
+	check()
+	sizeBefore := db.Stat().DiskSize
+
+	// merge 之后所有的数据都使用 snappy 压缩
+	assert.Nil(t, db.Merge())
+	check()
+	assert.Less(t, db.Stat().DiskSize, sizeBefore)
+	var total int64
+	var uncompressed int64
+	err = db.Fold(func(key []byte, val []byte) bool {
+		uncompressed += int64(len(val))
+		return true
+	})
+	assert.Nil(t, err)
+	for _, file := range db.olderFiles {
+		size, err := file.Size()
+		assert.Nil(t, err)
+		total += size
+	}
+	assert.Less(t, total*5, uncompressed)
+}
@@ -1,12 +1,50 @@
 package bitcask_go
 
-import "github.com/rbongIO/bitcask-go/data"
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/index"
+)
 
 // Delete 根据 key 删除对应数据
 func (db *DB) Delete(key []byte) error {
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	// 检查索引和写入墓碑记录需要在同一把锁内完成
+	return db.update(false, func() error {
+		return db.deleteRecord(key)
+	})
+}
+
+// DeleteIfEquals 只有在 key 当前的值等于 value 时才删除，返回是否删除成功
+func (db *DB) DeleteIfEquals(key []byte, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	var deleted bool
+	if err := db.update(false, func() error {
+		curValue, err := db.getValue(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(curValue, value) {
+			return nil
+		}
+		deleted = true
+		return db.deleteRecord(key)
+	}); err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// deleteRecord 写入一条删除记录并从内存索引中移除 key
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) deleteRecord(key []byte) error {
 	// 在内存索引中查找，如果不存在直接返回
 	if pos := db.index.Get(key); pos == nil {
 		return nil
@@ -15,11 +53,12 @@ func (db *DB) Delete(key []byte) error {
 	//构造 LogRecord，标识其被删除
 	record := &data.LogRecord{Key: logRecordKeyWithSeqNum(key, nonTransactionSeqNum), Type: data.LogRecordDeleted}
 	//写入数据文件中
-	pos, err := db.appendLogRecordWithLock(record)
+	pos, err := db.appendLogRecord(record)
 	if err != nil {
 		return err
 	}
 	db.reclaimSize += int64(pos.Size)
+	db.recordWrite(key)
 	pos, ok := db.index.Delete(key)
 
 	if !ok {
@@ -30,3 +69,88 @@ func (db *DB) Delete(key []byte) error {
 	}
 	return nil
 }
+
+// DeleteRange 删除 [start, end) 范围内的所有 key，end 为空表示没有上界
+// 只会写入一条范围删除记录，范围内的 key 会立即从内存索引中删除
+func (db *DB) DeleteRange(start, end []byte) error {
+	if len(end) != 0 && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	return db.update(false, func() error {
+		return db.deleteRangeRecord(start, end)
+	})
+}
+
+// DeletePrefix 删除所有以 prefix 为前缀的 key
+func (db *DB) DeletePrefix(prefix []byte) error {
+	if len(prefix) == 0 {
+		return ErrKeyIsEmpty
+	}
+	start, end := prefixRange(prefix)
+	return db.DeleteRange(start, end)
+}
+
+// deleteRangeRecord 写入一条范围删除记录并从内存索引中删除范围内的 key
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) deleteRangeRecord(start, end []byte) error {
+	// 范围内没有 key 时不需要写入
+	keys := db.indexKeysInRange(start, end)
+	if len(keys) == 0 {
+		return nil
+	}
+	record := &data.LogRecord{
+		Key:   logRecordKeyWithSeqNum(start, nonTransactionSeqNum),
+		Value: end,
+		Type:  data.LogRecordRangeDeleted,
+	}
+	pos, err := db.appendLogRecord(record)
+	if err != nil {
+		return err
+	}
+	db.reclaimSize += int64(pos.Size)
+	db.deleteIndexKeys(keys)
+	return nil
+}
+
+// deleteIndexRange 从内存索引中删除 [start, end) 范围内的 key
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) deleteIndexRange(start, end []byte) {
+	db.deleteIndexKeys(db.indexKeysInRange(start, end))
+}
+
+// indexKeysInRange 返回内存索引中 [start, end) 范围内的 key
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) indexKeysInRange(start, end []byte) [][]byte {
+	iterator := db.index.RangeIterator(index.IteratorOptions{LowerBound: start, UpperBound: end})
+	defer iterator.Close()
+	var keys [][]byte
+	for ; iterator.Valid(); iterator.Next() {
+		// B+ 树迭代器返回的 key 在迭代器关闭后失效，需要拷贝
+		keys = append(keys, append([]byte(nil), iterator.Key()...))
+	}
+	return keys
+}
+
+// deleteIndexKeys 从内存索引中删除 key，并将其占用的空间计入可回收空间
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) deleteIndexKeys(keys [][]byte) {
+	for _, key := range keys {
+		db.recordWrite(key)
+		if oldPos, _ := db.index.Delete(key); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	}
+}
+
+// prefixRange 返回以 prefix 为前缀的 key 所在的范围 [start, end)
+// prefix 全部为 0xff 时没有上界，end 为空
+func prefixRange(prefix []byte) ([]byte, []byte) {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return prefix, end[:i+1]
+		}
+	}
+	return prefix, nil
+}
@@ -0,0 +1,229 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+var (
+	testEncryptionKey    = bytes.Repeat([]byte("k"), 32)
+	testNewEncryptionKey = bytes.Repeat([]byte("n"), 32)
+)
+
+func testPIIKey(i int) []byte {
+	return []byte("customer-email-" + strconv.Itoa(i))
+}
+
+func testPIIValue(i int) []byte {
+	return []byte("someone-" + strconv.Itoa(i) + "@example.com")
+}
+
+// assertNoPlaintext 检查数据目录中的所有文件都不包含明文的 key 和 value
+func assertNoPlaintext(t *testing.T, dir string) {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(b, []byte("customer-email")), entry.Name())
+		assert.False(t, bytes.Contains(b, []byte("@example.com")), entry.Name())
+	}
+}
+
+func TestDB_Encryption(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(16 * 1024),
+			WithDataFileMergeRatio(0)}
+		db, err := Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+		}
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Delete(testPIIKey(i)))
+		}
+		// merge 生成的 hint 文件同样是加密的
+		assert.Nil(t, db.Merge())
+		for i := 1000; i < 1100; i++ {
+			assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+		}
+		assert.Nil(t, db.Close())
+		assertNoPlaintext(t, dir)
+
+		check := func(db *DB) {
+			assert.Equal(t, 1000, len(db.ListKeys()))
+			for i := 100; i < 1100; i++ {
+				val, err := db.Get(testPIIKey(i))
+				assert.Nil(t, err)
+				assert.Equal(t, testPIIValue(i), val)
+			}
+			// 加密之后迭代器依然按照 key 的顺序遍历
+			it := db.NewIterator(WithPrefix([]byte("customer-email-10")))
+			var keys [][]byte
+			for it.Rewind(); it.Valid(); it.Next() {
+				keys = append(keys, it.Key())
+			}
+			it.Close()
+			assert.Equal(t, 110, len(keys))
+			assert.Equal(t, []byte("customer-email-100"), keys[0])
+			assert.Equal(t, []byte("customer-email-1000"), keys[1])
+			assert.Equal(t, []byte("customer-email-1099"), keys[len(keys)-1])
+		}
+
+		// 没有密钥或者密钥错误时无法打开
+		_, err = Open(opts...)
+		assert.NotNil(t, err)
+		_, err = Open(append(opts, WithEncryptionKey(testNewEncryptionKey))...)
+		assert.NotNil(t, err)
+
+		// 轮换密钥，merge 之后旧的密钥不再需要
+		db, err = Open(append(opts, WithEncryptionKey(testNewEncryptionKey, testEncryptionKey))...)
+		assert.Nil(t, err)
+		check(db)
+		assert.Nil(t, db.Merge())
+		check(db)
+		assert.Nil(t, db.Close())
+		assertNoPlaintext(t, dir)
+
+		_, err = Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+		assert.NotNil(t, err)
+		db, err = Open(append(opts, WithEncryptionKey(testNewEncryptionKey))...)
+		assert.Nil(t, err)
+		check(db)
+		destroyDB(db)
+	}
+}
+
+func TestDB_EnableEncryption(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-enable-encryption")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithDataFileMergeRatio(0)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+		}
+		assert.Nil(t, db.Close())
+
+		// 已有的未加密数据可以读取，merge 之后全部加密
+		db, err = Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge())
+		assert.Nil(t, db.Close())
+		// 加密之前写入的数据文件已经被 merge 替换
+		assertNoPlaintext(t, dir)
+
+		db, err = Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			val, err := db.Get(testPIIKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, testPIIValue(i), val)
+		}
+		destroyDB(db)
+	}
+}
+
+func TestDB_EncryptionBackup(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption-backup")
+	db, err := Open(WithDirPath(dir), WithEncryptionKey(testEncryptionKey))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+	}
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-encryption-backup-dest")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+	assertNoPlaintext(t, backupDir)
+}
+
+// 只有还存在使用旧密钥加密的数据时 merge 才不检查 DataFileMergeRatio
+func TestDB_RotationMergeRatio(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-rotation-ratio")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(16 * 1024),
+			WithDataFileMergeRatio(0.9)}
+		db, err := Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+		assert.Nil(t, err)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+		}
+		assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+		assert.Nil(t, db.Close())
+
+		db, err = Open(append(opts, WithEncryptionKey(testNewEncryptionKey, testEncryptionKey))...)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge())
+		// 所有数据都已经使用新的密钥重新加密
+		assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+		assert.Nil(t, db.Close())
+
+		// 旧密钥没有移除时重新打开，也不会再次强制 merge
+		db, err = Open(append(opts, WithEncryptionKey(testNewEncryptionKey, testEncryptionKey))...)
+		assert.Nil(t, err)
+		assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+		for i := 0; i < 500; i++ {
+			val, err := db.Get(testPIIKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, testPIIValue(i), val)
+		}
+		destroyDB(db)
+	}
+}
+
+// 关闭时保存使用旧密钥的数据文件，使用同一个密钥重新打开时不需要再检查数据文件
+func TestDB_RotationOldKeyFilesSaved(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-rotation-saved")
+	opts := []OptionFunc{WithDirPath(dir), WithMaxDataFileSize(16 * 1024), WithDataFileMergeRatio(0.9)}
+	db, err := Open(append(opts, WithEncryptionKey(testEncryptionKey))...)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(testPIIKey(i), testPIIValue(i)))
+	}
+	assert.Nil(t, db.Close())
+	// 没有设置旧密钥时不保存
+	_, err = os.Stat(filepath.Join(dir, data.OldKeyFilesName))
+	assert.True(t, os.IsNotExist(err))
+
+	rotated := append(opts, WithEncryptionKey(testNewEncryptionKey, testEncryptionKey))
+	db, err = Open(rotated...)
+	assert.Nil(t, err)
+	oldKeyFiles := db.oldKeyFiles
+	assert.NotEmpty(t, oldKeyFiles)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, data.OldKeyFilesName))
+	assert.Nil(t, err)
+
+	// 重新打开时直接使用保存的结果，读取之后删除
+	db, err = Open(rotated...)
+	assert.Nil(t, err)
+	assert.Equal(t, oldKeyFiles, db.oldKeyFiles)
+	_, err = os.Stat(filepath.Join(dir, data.OldKeyFilesName))
+	assert.True(t, os.IsNotExist(err))
+	db.oldKeyFiles = make(map[uint32]struct{})
+	assert.Nil(t, db.Close())
+	db, err = Open(rotated...)
+	assert.Nil(t, err)
+	assert.Empty(t, db.oldKeyFiles)
+	db.oldKeyFiles = oldKeyFiles
+	assert.Nil(t, db.Close())
+
+	// merge 之后不再有使用旧密钥的文件
+	db, err = Open(rotated...)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Empty(t, db.oldKeyFiles)
+	assert.Nil(t, db.Close())
+	db, err = Open(rotated...)
+	assert.Nil(t, err)
+	assert.Empty(t, db.oldKeyFiles)
+	assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+	destroyDB(db)
+}
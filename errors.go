@@ -13,4 +13,16 @@ var (
 	ErrDatabaseIsUsing        = errors.New("database is using")
 	ErrMergeRatioUnreached    = errors.New("merge ratio unreached")
 	ErrDiskSpaceNotEnough     = errors.New("disk space not enough to merge ")
+	ErrInvalidTTL             = errors.New("the ttl is invalid")
+	ErrSnapshotReleased       = errors.New("the snapshot is released")
+	ErrTxnConflict            = errors.New("transaction conflict,the keys read have been modified")
+	ErrTxnClosed              = errors.New("the transaction is committed or rolled back")
+	ErrDatabaseClosed         = errors.New("database is closed")
+	ErrMergeNotApplied        = errors.New("files of the previous merge have not been applied, reopen the database")
+	ErrMergeFileOverflow      = errors.New("merged files overflow the file ids of unmerged files")
+	ErrInvalidRange           = errors.New("the start key must be less than the end key")
+	ErrChunkedWriteInProgress = errors.New("large values are being written,try again later")
+	ErrInvalidChunk           = errors.New("the chunk of the large value is invalid")
+	ErrIndexNotSupported      = errors.New("the index type is not supported by the file system")
+	ErrViewNotReleased        = errors.New("views are not released,release them before closing the database")
 )
@@ -0,0 +1,454 @@
+package bitcask_go
+
+import (
+	"errors"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	// errInjectedFault 注入的 Write、Sync 或者 Rename 错误
+	errInjectedFault = errors.New("injected fault")
+	// errInjectedCrash 模拟崩溃之后，崩溃之前打开的文件和文件系统的所有操作都返回这个错误
+	errInjectedCrash = errors.New("injected crash")
+)
+
+type faultKind int
+
+const (
+	faultNone faultKind = iota
+	// faultWriteError Write 返回错误，不写入任何数据
+	faultWriteError
+	// faultShortWrite Write 只写入一半的数据并返回错误
+	faultShortWrite
+	// faultSyncError Sync 返回错误，数据没有持久化
+	faultSyncError
+	// faultRenameError Rename 返回错误，文件没有移动
+	faultRenameError
+	// faultCrash 在执行任意一个修改文件的操作之前崩溃
+	faultCrash
+	// faultCrashOnRename 在执行 Rename 之前崩溃
+	faultCrashOnRename
+)
+
+// faultFileSystem 只用于测试的文件系统，包装另一个文件系统并按计划注入故障
+// 只有成功 Sync 过的数据才是持久化的，crash 模拟进程崩溃之后重启：
+// 所有文件都回退到最后一次成功 Sync 时的长度，之前打开的文件和文件锁都失效
+// 创建目录、重命名和删除文件都认为是立即持久化的
+type faultFileSystem struct {
+	fio.FileSystem
+	mu        sync.Mutex
+	gen       uint64                     // 每次崩溃之后递增，之前打开的文件都失效
+	files     map[string]*faultFileState // 打开过的文件的持久化状态，重命名时一起移动
+	locks     []*faultLock
+	fault     faultKind
+	countdown int  // 还需要跳过多少次符合条件的操作才注入故障
+	fired     bool // 计划的故障是否已经注入
+	crashed   bool // 已经崩溃，调用 crash 之前所有操作都返回 errInjectedCrash
+}
+
+// faultFileState 一个文件已经持久化的长度
+type faultFileState struct {
+	synced int64
+}
+
+func newFaultFileSystem(fs fio.FileSystem) *faultFileSystem {
+	return &faultFileSystem{FileSystem: fs, files: make(map[string]*faultFileState)}
+}
+
+// inject 计划在之后第 after+1 次符合条件的操作上注入故障，同时只有一个计划的故障
+func (ffs *faultFileSystem) inject(kind faultKind, after int) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	ffs.fault, ffs.countdown, ffs.fired = kind, after, false
+}
+
+// injected 返回计划的故障是否已经注入
+func (ffs *faultFileSystem) injected() bool {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	return ffs.fired
+}
+
+// crash 模拟进程崩溃之后重启，丢弃所有没有持久化的数据，释放所有文件锁并取消计划的故障
+func (ffs *faultFileSystem) crash() error {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	for name, state := range ffs.files {
+		file, err := ffs.FileSystem.OpenFile(name, fio.StandardFIO)
+		if err != nil {
+			return err
+		}
+		err = file.Truncate(state.synced)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, lock := range ffs.locks {
+		if err := lock.lock.Unlock(); err != nil {
+			return err
+		}
+	}
+	ffs.locks = nil
+	ffs.gen++
+	ffs.fault, ffs.fired, ffs.crashed = faultNone, false, false
+	return nil
+}
+
+// trigger 判断当前操作是否需要注入故障，kinds 是当前操作可以注入的故障
+// 注入崩溃时直接返回 errInjectedCrash，其他故障返回对应的类型，由调用方模拟
+// 调用方必须持有锁
+func (ffs *faultFileSystem) trigger(kinds ...faultKind) (faultKind, error) {
+	if ffs.crashed {
+		return faultNone, errInjectedCrash
+	}
+	if ffs.fired || ffs.fault == faultNone || !containsFault(kinds, ffs.fault) {
+		return faultNone, nil
+	}
+	if ffs.countdown > 0 {
+		ffs.countdown--
+		return faultNone, nil
+	}
+	ffs.fired = true
+	if ffs.fault == faultCrash || ffs.fault == faultCrashOnRename {
+		ffs.crashed = true
+		return faultNone, errInjectedCrash
+	}
+	return ffs.fault, nil
+}
+
+func containsFault(kinds []faultKind, kind faultKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// check 只检查是否已经崩溃，用于不会注入故障的操作
+// 调用方必须持有锁
+func (ffs *faultFileSystem) check() error {
+	if ffs.crashed {
+		return errInjectedCrash
+	}
+	return nil
+}
+
+func (ffs *faultFileSystem) OpenFile(name string, ioType fio.FileIOType) (fio.IOManager, error) {
+	name = filepath.Clean(name)
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if _, err := ffs.trigger(faultCrash); err != nil {
+		return nil, err
+	}
+	state, ok := ffs.files[name]
+	if !ok {
+		// 之前已经存在的文件认为已经持久化
+		state = &faultFileState{}
+		if info, err := ffs.FileSystem.Stat(name); err == nil {
+			state.synced = info.Size()
+		}
+	}
+	file, err := ffs.FileSystem.OpenFile(name, ioType)
+	if err != nil {
+		return nil, err
+	}
+	ffs.files[name] = state
+	return &faultIO{fs: ffs, file: file, state: state, gen: ffs.gen}, nil
+}
+
+func (ffs *faultFileSystem) Stat(name string) (os.FileInfo, error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if err := ffs.check(); err != nil {
+		return nil, err
+	}
+	return ffs.FileSystem.Stat(name)
+}
+
+func (ffs *faultFileSystem) ReadDir(dir string) ([]os.DirEntry, error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if err := ffs.check(); err != nil {
+		return nil, err
+	}
+	return ffs.FileSystem.ReadDir(dir)
+}
+
+func (ffs *faultFileSystem) MkdirAll(dir string) error {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if _, err := ffs.trigger(faultCrash); err != nil {
+		return err
+	}
+	return ffs.FileSystem.MkdirAll(dir)
+}
+
+func (ffs *faultFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if _, err := ffs.trigger(faultCrash); err != nil {
+		return err
+	}
+	if err := ffs.FileSystem.Remove(name); err != nil {
+		return err
+	}
+	delete(ffs.files, name)
+	return nil
+}
+
+func (ffs *faultFileSystem) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if _, err := ffs.trigger(faultCrash); err != nil {
+		return err
+	}
+	if err := ffs.FileSystem.RemoveAll(path); err != nil {
+		return err
+	}
+	prefix := path + string(filepath.Separator)
+	for name := range ffs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(ffs.files, name)
+		}
+	}
+	return nil
+}
+
+func (ffs *faultFileSystem) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	fault, err := ffs.trigger(faultCrash, faultCrashOnRename, faultRenameError)
+	if err != nil {
+		return err
+	}
+	if fault == faultRenameError {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errInjectedFault}
+	}
+	if err := ffs.FileSystem.Rename(oldName, newName); err != nil {
+		return err
+	}
+	// 被替换的文件和重命名之前的文件都不再存在
+	delete(ffs.files, newName)
+	if state, ok := ffs.files[oldName]; ok {
+		delete(ffs.files, oldName)
+		ffs.files[newName] = state
+	}
+	return nil
+}
+
+func (ffs *faultFileSystem) Lock(name string) (fio.FileLock, error) {
+	ffs.mu.Lock()
+	defer ffs.mu.Unlock()
+	if err := ffs.check(); err != nil {
+		return nil, err
+	}
+	lock, err := ffs.FileSystem.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	fl := &faultLock{fs: ffs, lock: lock, gen: ffs.gen}
+	ffs.locks = append(ffs.locks, fl)
+	return fl, nil
+}
+
+// faultLock 崩溃时会被释放的文件锁
+type faultLock struct {
+	fs   *faultFileSystem
+	lock fio.FileLock
+	gen  uint64
+}
+
+// Unlock 崩溃之前获取的文件锁已经在崩溃时释放，直接返回
+func (l *faultLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	if l.gen != l.fs.gen {
+		return nil
+	}
+	for i, lock := range l.fs.locks {
+		if lock == l {
+			l.fs.locks = append(l.fs.locks[:i], l.fs.locks[i+1:]...)
+			return l.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+// faultIO 注入故障的 IOManager，崩溃之前打开的文件的所有操作都返回 errInjectedCrash
+type faultIO struct {
+	fs    *faultFileSystem
+	file  fio.IOManager
+	state *faultFileState
+	gen   uint64
+}
+
+// trigger 和 faultFileSystem.trigger 相同，另外检查文件是否在崩溃之前打开
+// 调用方必须持有锁
+func (fi *faultIO) trigger(kinds ...faultKind) (faultKind, error) {
+	if fi.gen != fi.fs.gen {
+		return faultNone, errInjectedCrash
+	}
+	return fi.fs.trigger(kinds...)
+}
+
+func (fi *faultIO) Read(b []byte, offset int64) (int, error) {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	if _, err := fi.trigger(); err != nil {
+		return 0, err
+	}
+	return fi.file.Read(b, offset)
+}
+
+func (fi *faultIO) Write(b []byte) (int, error) {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	fault, err := fi.trigger(faultCrash, faultWriteError, faultShortWrite)
+	if err != nil {
+		return 0, err
+	}
+	switch fault {
+	case faultWriteError:
+		return 0, errInjectedFault
+	case faultShortWrite:
+		n, err := fi.file.Write(b[:len(b)/2])
+		if err != nil {
+			return n, err
+		}
+		return n, errInjectedFault
+	}
+	return fi.file.Write(b)
+}
+
+func (fi *faultIO) Sync() error {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	fault, err := fi.trigger(faultCrash, faultSyncError)
+	if err != nil {
+		return err
+	}
+	if fault == faultSyncError {
+		return errInjectedFault
+	}
+	if err := fi.file.Sync(); err != nil {
+		return err
+	}
+	size, err := fi.file.Size()
+	if err != nil {
+		return err
+	}
+	fi.state.synced = size
+	return nil
+}
+
+// Close 关闭文件不会持久化数据，崩溃之前打开的文件已经失效，直接返回
+func (fi *faultIO) Close() error {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	if fi.gen != fi.fs.gen {
+		return nil
+	}
+	return fi.file.Close()
+}
+
+func (fi *faultIO) Size() (int64, error) {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	if _, err := fi.trigger(); err != nil {
+		return 0, err
+	}
+	return fi.file.Size()
+}
+
+// Truncate 截断之后持久化的长度不会超过文件的长度
+func (fi *faultIO) Truncate(size int64) error {
+	fi.fs.mu.Lock()
+	defer fi.fs.mu.Unlock()
+	if _, err := fi.trigger(faultCrash); err != nil {
+		return err
+	}
+	if err := fi.file.Truncate(size); err != nil {
+		return err
+	}
+	fi.state.synced = min(fi.state.synced, size)
+	return nil
+}
+
+func TestFaultFileSystem(t *testing.T) {
+	ffs := newFaultFileSystem(fio.NewMemoryFileSystem())
+	dir := filepath.Join(os.TempDir(), "bitcask-go-fault-fs")
+	name := filepath.Join(dir, "a.data")
+	assert.Nil(t, ffs.MkdirAll(dir))
+	lock, err := ffs.Lock(filepath.Join(dir, fileLockName))
+	assert.Nil(t, err)
+
+	file, err := ffs.OpenFile(name, fio.StandardFIO)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+
+	// 注入的 Write 和 Sync 错误
+	ffs.inject(faultWriteError, 0)
+	_, err = file.Write([]byte("lost"))
+	assert.Equal(t, errInjectedFault, err)
+	assert.True(t, ffs.injected())
+	ffs.inject(faultShortWrite, 1)
+	_, err = file.Write([]byte("-more"))
+	assert.Nil(t, err)
+	n, err := file.Write([]byte("-half"))
+	assert.Equal(t, errInjectedFault, err)
+	assert.Equal(t, 2, n)
+	ffs.inject(faultSyncError, 0)
+	assert.Equal(t, errInjectedFault, file.Sync())
+	size, err := file.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), size)
+
+	// 注入的 Rename 错误不会移动文件
+	ffs.inject(faultRenameError, 0)
+	newName := filepath.Join(dir, "b.data")
+	assert.True(t, errors.Is(ffs.Rename(name, newName), errInjectedFault))
+	assert.Nil(t, ffs.Rename(name, newName))
+
+	// 崩溃之后所有操作都返回错误
+	ffs.inject(faultCrash, 0)
+	assert.Equal(t, errInjectedCrash, ffs.MkdirAll(dir))
+	_, err = ffs.Stat(newName)
+	assert.Equal(t, errInjectedCrash, err)
+	_, err = file.Write([]byte("!"))
+	assert.Equal(t, errInjectedCrash, err)
+
+	// 重启之后没有持久化的数据都被丢弃，之前打开的文件和文件锁都失效
+	assert.Nil(t, ffs.crash())
+	_, err = file.Size()
+	assert.Equal(t, errInjectedCrash, err)
+	assert.Nil(t, file.Close())
+	assert.Nil(t, lock.Unlock())
+	lock, err = ffs.Lock(filepath.Join(dir, fileLockName))
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Unlock())
+	info, err := ffs.Stat(newName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+	file, err = ffs.OpenFile(newName, fio.StandardFIO)
+	assert.Nil(t, err)
+	buf := make([]byte, 6)
+	_, err = file.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("synced"), buf)
+	assert.Nil(t, file.Close())
+}
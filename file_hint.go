@@ -0,0 +1,68 @@
+package bitcask_go
+
+import "github.com/rbongIO/bitcask-go/data"
+
+// 每个数据文件对应一个 hint 文件，按顺序记录文件中每条记录的 key、类型和位置，不包含 value
+// 活跃文件中记录的索引信息保存在内存中，活跃文件写满或者关闭数据库时写入 hint 文件
+// 打开数据库时优先从 hint 文件回放，启动时间只和记录的数量有关，和 value 的大小无关
+
+// fileHintsEnabled 是否需要生成 hint 文件，B+ 树索引是持久化的，不需要从数据文件加载索引
+func (db *DB) fileHintsEnabled() bool {
+	return db.options.FileHints && db.options.IndexType != BPTree
+}
+
+// addFileHint 记录写入活跃文件的一条记录的索引信息
+// 分块清单的位置在提交时才会设置大小，这里保存的是同一个位置信息
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) addFileHint(record *data.LogRecord, pos *data.LogRecordPos) {
+	if !db.fileHintsEnabled() {
+		return
+	}
+	entry := &data.FileHintEntry{Key: record.Key, Type: record.Type, Pos: pos}
+	if record.Type == data.LogRecordRangeDeleted {
+		entry.Value = append([]byte(nil), record.Value...)
+	}
+	db.activeHints = append(db.activeHints, entry)
+}
+
+// writeActiveFileHint 将活跃文件中所有记录的索引信息写入 hint 文件
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) writeActiveFileHint() error {
+	if db.activeFile == nil {
+		return nil
+	}
+	return db.writeFileHint(db.activeFile, db.activeFile.WriteOffset, db.activeHints)
+}
+
+// writeFileHint 将数据文件中 validSize 之前所有记录的索引信息写入 hint 文件
+// 数据文件末尾有无法读取的数据时不生成 hint 文件，下次打开时依然从数据文件中加载
+func (db *DB) writeFileHint(dataFile *data.DataFile, validSize int64, entries []*data.FileHintEntry) error {
+	if !db.fileHintsEnabled() {
+		return nil
+	}
+	size, err := dataFile.Size()
+	if err != nil {
+		return err
+	}
+	if size != validSize {
+		return nil
+	}
+	hint := &data.FileHint{DataSize: size, Entries: entries}
+	return data.WriteFileHint(db.options.FileSystem, db.options.DirPath, dataFile.FileID, hint, db.cipher)
+}
+
+// readFileHint 读取数据文件对应的 hint 文件，hint 文件不存在、已损坏或者和数据文件的长度不一致时返回 nil
+// hint 文件只是为了加快启动，无法使用时从数据文件中加载索引
+func (db *DB) readFileHint(dataFile *data.DataFile) *data.FileHint {
+	if !db.fileHintsEnabled() {
+		return nil
+	}
+	hint, err := data.ReadFileHint(db.options.FileSystem, db.options.DirPath, dataFile.FileID, db.cipher)
+	if err != nil {
+		return nil
+	}
+	if size, err := dataFile.Size(); err != nil || size != hint.DataSize {
+		return nil
+	}
+	return hint
+}
@@ -0,0 +1,113 @@
+package bitcask_go
+
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_FileHints(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-file-hints")
+	opts := []OptionFunc{WithDirPath(dir), WithMaxDataFileSize(32 * 1024), WithChunkSize(8 * 1024)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	// 事务、删除、范围删除、过期时间和分块存储的数据都可以从 hint 文件中恢复
+	wb := db.NewWriteBatch()
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte("batch")))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Nil(t, db.Delete(utils.GetTestKey(100)))
+	assert.Nil(t, db.DeleteRange(utils.GetTestKey(200), utils.GetTestKey(300)))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(400), []byte("ttl"), time.Hour))
+	large := utils.RandomValue(20 * 1024)
+	assert.Nil(t, db.PutReader(utils.GetTestKey(500), bytes.NewReader(large)))
+	for i := 1000; i < 1100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+	}
+	assert.Greater(t, len(db.olderFiles), 2)
+	keys := db.ListKeys()
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	// 每个数据文件都有对应的 hint 文件
+	dataFiles, err := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	assert.Nil(t, err)
+	hintFiles, err := filepath.Glob(filepath.Join(dir, "*"+data.FileHintNameSuffix))
+	assert.Nil(t, err)
+	assert.Equal(t, len(dataFiles), len(hintFiles))
+
+	check := func(db *DB) {
+		assert.Equal(t, keys, db.ListKeys())
+		assert.Equal(t, stat.ReclaimableSize, db.Stat().ReclaimableSize)
+		val, err := db.Get(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("batch"), val)
+		ttl, err := db.TTL(utils.GetTestKey(400))
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, time.Duration(0))
+		assert.True(t, db.index.Get(utils.GetTestKey(500)).Chunked)
+		val, err = db.Get(utils.GetTestKey(500))
+		assert.Nil(t, err)
+		assert.Equal(t, large, val)
+	}
+	// 从 hint 文件加载的索引和从数据文件加载的一致
+	db, err = Open(append(opts, WithFileHints(false))...)
+	assert.Nil(t, err)
+	check(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	check(db)
+	// 活跃文件从 hint 文件加载之后可以继续写入
+	assert.Nil(t, db.Put([]byte("after-reopen"), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	// 打开时不会读取旧数据文件中的记录，修改 value 不会被发现
+	fileName := data.GetDataFileName(dir, 1)
+	b, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	b[len(b)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, b, 0644))
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	val, err := db.Get([]byte("after-reopen"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Nil(t, db.Close())
+
+	// 数据文件和 hint 文件的长度不一致时从数据文件加载
+	fid := uint32(len(dataFiles) - 1)
+	rec, _ := data.EncodeLogRecord(&data.LogRecord{Key: logRecordKeyWithSeqNum([]byte("appended"), nonTransactionSeqNum), Value: []byte("value")})
+	appendToDataFile(t, dir, fid, rec)
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	val, err = db.Get([]byte("appended"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	assert.Nil(t, db.Close())
+
+	// merge 之后被 merge 的文件的 hint 文件都会被删除
+	b[len(b)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, b, 0644))
+	db, err = Open(append(opts, WithDataFileMergeRatio(0))...)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	hintFiles, err = filepath.Glob(filepath.Join(dir, "*"+data.FileHintNameSuffix))
+	assert.Nil(t, err)
+	assert.Empty(t, hintFiles)
+	keys = db.ListKeys()
+	assert.Nil(t, db.Close())
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	assert.Equal(t, keys, db.ListKeys())
+}
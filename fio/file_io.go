@@ -37,3 +37,7 @@ func (fio *FileIO) Size() (int64, error) {
 	}
 	return fStat.Size(), nil
 }
+
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
@@ -8,7 +8,7 @@ import (
 )
 
 func TestNewFileIOManager(t *testing.T) {
-	fio, err := NewIOManager(filepath.Join("/tmp", "a.data"))
+	fio, err := NewIOManager(filepath.Join("/tmp", "a.data"), StandardFIO)
 	assert.Nil(t, err)
 	assert.NotNil(t, fio)
 	writeLen, err := fio.Write([]byte("Welcome to China!"))
@@ -0,0 +1,149 @@
+package fio
+
+import (
+	"errors"
+	"github.com/gofrs/flock"
+	"github.com/rbongIO/bitcask-go/utils"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ErrLocked 文件锁已经被其他进程或者实例持有
+var ErrLocked = errors.New("file is locked")
+
+// FileLock 已经持有的文件锁
+type FileLock interface {
+	// Unlock 释放文件锁
+	Unlock() error
+}
+
+// FileSystem 数据目录的抽象，数据文件、hint 文件、merge 目录和文件锁都通过它访问
+// 目前支持磁盘上的文件系统和内存中的文件系统
+type FileSystem interface {
+	// OpenFile 打开文件，文件不存在时创建
+	OpenFile(name string, ioType FileIOType) (IOManager, error)
+	// Stat 获取文件或者目录的信息，不存在时返回的错误满足 os.IsNotExist
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir 按文件名的顺序返回目录下的所有文件和目录
+	ReadDir(dir string) ([]os.DirEntry, error)
+	// MkdirAll 创建目录以及所有不存在的上级目录
+	MkdirAll(dir string) error
+	// Remove 删除文件或者空目录
+	Remove(name string) error
+	// RemoveAll 删除文件或者目录以及目录下的所有文件，不存在时不返回错误
+	RemoveAll(path string) error
+	// Rename 重命名文件，目标文件已经存在时会被替换
+	Rename(oldName, newName string) error
+	// Lock 获取文件锁，已经被持有时返回 ErrLocked
+	Lock(name string) (FileLock, error)
+	// AvailableSpace 获取剩余的空间
+	AvailableSpace() (uint64, error)
+}
+
+// OSFileSystem 磁盘上的文件系统
+var OSFileSystem FileSystem = osFileSystem{}
+
+type osFileSystem struct{}
+
+func (osFileSystem) OpenFile(name string, ioType FileIOType) (IOManager, error) {
+	return NewIOManager(name, ioType)
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadDir(dir string) ([]os.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+func (osFileSystem) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFileSystem) Lock(name string) (FileLock, error) {
+	fileLock := flock.New(name)
+	hold, err := fileLock.TryLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrLocked
+	}
+	return fileLock, nil
+}
+
+func (osFileSystem) AvailableSpace() (uint64, error) {
+	return utils.AvailableSpace()
+}
+
+// DirSize 获取目录下所有文件的大小之和，不包含子目录
+func DirSize(fs FileSystem, dir string) (int64, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// CopyDir 将 fs 中 src 目录下的文件拷贝到磁盘上的 dest 目录，不拷贝子目录和 exclude 中的文件
+func CopyDir(fs FileSystem, src, dest string, exclude []string) error {
+	if err := os.MkdirAll(dest, os.ModePerm); err != nil {
+		return err
+	}
+	entries, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || slices.Contains(exclude, entry.Name()) {
+			continue
+		}
+		if err := copyFile(fs, filepath.Join(src, entry.Name()), filepath.Join(dest, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(fs FileSystem, src, dest string) error {
+	file, err := fs.OpenFile(src, StandardFIO)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := file.Read(buf, 0); err != nil && err != io.EOF {
+		return err
+	}
+	return os.WriteFile(dest, buf, DataFilePerm)
+}
@@ -5,12 +5,15 @@ type FileIOType = byte
 const (
 	// StandardFIO 标准文件 IO
 	StandardFIO FileIOType = iota
+	// MemoryMapIO 只读的文件映射，只用于启动时加载数据文件
 	MemoryMapIO
+	// MemoryMapRWIO 可读写的文件映射，写入直接拷贝到映射的内存中
+	MemoryMapRWIO
 )
 
 const DataFilePerm = 0644
 
-// IOManager 抽象 IO 管理接口，可以接入不同的 IO 类型，目前支持标准文件 IO
+// IOManager 抽象 IO 管理接口，可以接入不同的 IO 类型，目前支持标准文件 IO 和文件映射
 type IOManager interface {
 	// Read 从文件给定位置读取到对应的数据
 	Read([]byte, int64) (int, error)
@@ -22,15 +25,33 @@ type IOManager interface {
 	Close() error
 	// Size 获取文件大小
 	Size() (int64, error)
+	// Truncate 将文件截断到给定的大小
+	Truncate(int64) error
 }
 
-// NewIOManager 初始化 IOManager，目前仅支持 FileIO
+// Reserver 可以预先分配空间的 IOManager
+type Reserver interface {
+	// Reserve 预先分配 size 大小的空间，不影响文件的逻辑大小
+	Reserve(size int64) error
+	// Reserved 返回预先分配但还没有写入数据的空间大小
+	Reserved() int64
+}
+
+// Viewer 可以不拷贝直接读取数据的 IOManager
+type Viewer interface {
+	// View 返回从 offset 开始的 n 个字节，返回的数据直接引用文件映射，不能修改
+	View(offset int64, n int) ([]byte, error)
+}
+
+// NewIOManager 根据 IO 类型初始化 IOManager
 func NewIOManager(filename string, ioType FileIOType) (IOManager, error) {
 	switch ioType {
 	case StandardFIO:
 		return NewFileIOManager(filename)
 	case MemoryMapIO:
 		return NewMMapIOManager(filename)
+	case MemoryMapRWIO:
+		return NewMMapRWIOManager(filename)
 	default:
 		panic("unknown io type")
 	}
@@ -0,0 +1,311 @@
+package fio
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryFileSystem 内存中的文件系统，所有文件和目录都只保存在内存中，不会写入磁盘
+// 打开文件时忽略 IO 类型，都使用 MemoryIO 读写
+type MemoryFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memoryFile
+	dirs  map[string]time.Time // 目录及其创建时间
+	locks map[string]struct{}
+}
+
+// memoryFile 内存中的一个文件，重命名和删除之后已经打开的 MemoryIO 依然可以读写
+type memoryFile struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryFileSystem() *MemoryFileSystem {
+	return &MemoryFileSystem{
+		files: make(map[string]*memoryFile),
+		dirs:  make(map[string]time.Time),
+		locks: make(map[string]struct{}),
+	}
+}
+
+func (mfs *MemoryFileSystem) OpenFile(name string, ioType FileIOType) (IOManager, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if _, ok := mfs.dirs[name]; ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	file, ok := mfs.files[name]
+	if !ok {
+		if !mfs.dirExists(filepath.Dir(name)) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		file = &memoryFile{modTime: time.Now()}
+		mfs.files[name] = file
+	}
+	return &MemoryIO{file: file}, nil
+}
+
+func (mfs *MemoryFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if file, ok := mfs.files[name]; ok {
+		return file.stat(filepath.Base(name)), nil
+	}
+	if mfs.dirExists(name) {
+		return &memoryFileInfo{name: filepath.Base(name), modTime: mfs.dirs[name], dir: true}, nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (mfs *MemoryFileSystem) ReadDir(dir string) ([]os.DirEntry, error) {
+	dir = filepath.Clean(dir)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if !mfs.dirExists(dir) {
+		return nil, &fs.PathError{Op: "open", Path: dir, Err: fs.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for name, file := range mfs.files {
+		if filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(file.stat(filepath.Base(name))))
+		}
+	}
+	for name, modTime := range mfs.dirs {
+		if name != dir && filepath.Dir(name) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(&memoryFileInfo{name: filepath.Base(name), modTime: modTime, dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (mfs *MemoryFileSystem) MkdirAll(dir string) error {
+	dir = filepath.Clean(dir)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	for d := dir; !mfs.dirExists(d); d = filepath.Dir(d) {
+		if _, ok := mfs.files[d]; ok {
+			return &fs.PathError{Op: "mkdir", Path: d, Err: errors.New("not a directory")}
+		}
+		mfs.dirs[d] = time.Now()
+	}
+	return nil
+}
+
+func (mfs *MemoryFileSystem) Remove(name string) error {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if _, ok := mfs.files[name]; ok {
+		delete(mfs.files, name)
+		return nil
+	}
+	if _, ok := mfs.dirs[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	prefix := name + string(filepath.Separator)
+	for path := range mfs.files {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	for path := range mfs.dirs {
+		if strings.HasPrefix(path, prefix) {
+			return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(mfs.dirs, name)
+	return nil
+}
+
+func (mfs *MemoryFileSystem) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	prefix := path + string(filepath.Separator)
+	for name := range mfs.files {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(mfs.files, name)
+		}
+	}
+	for name := range mfs.dirs {
+		if name == path || strings.HasPrefix(name, prefix) {
+			delete(mfs.dirs, name)
+		}
+	}
+	return nil
+}
+
+// Rename 重命名文件，不支持重命名目录
+func (mfs *MemoryFileSystem) Rename(oldName, newName string) error {
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	file, ok := mfs.files[oldName]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	if !mfs.dirExists(filepath.Dir(newName)) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: fs.ErrNotExist}
+	}
+	if _, ok := mfs.dirs[newName]; ok {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errors.New("file exists")}
+	}
+	delete(mfs.files, oldName)
+	mfs.files[newName] = file
+	return nil
+}
+
+// Lock 获取内存中的文件锁，不会创建文件
+func (mfs *MemoryFileSystem) Lock(name string) (FileLock, error) {
+	name = filepath.Clean(name)
+	mfs.mu.Lock()
+	defer mfs.mu.Unlock()
+	if _, ok := mfs.locks[name]; ok {
+		return nil, ErrLocked
+	}
+	mfs.locks[name] = struct{}{}
+	return &memoryLock{fs: mfs, name: name}, nil
+}
+
+// AvailableSpace 内存中的文件系统不限制空间
+func (mfs *MemoryFileSystem) AvailableSpace() (uint64, error) {
+	return math.MaxUint64, nil
+}
+
+// dirExists 判断目录是否存在，根目录总是存在
+// 调用方必须持有锁
+func (mfs *MemoryFileSystem) dirExists(dir string) bool {
+	if dir == filepath.Dir(dir) {
+		return true
+	}
+	_, ok := mfs.dirs[dir]
+	return ok
+}
+
+type memoryLock struct {
+	fs   *MemoryFileSystem
+	name string
+}
+
+func (l *memoryLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+func (f *memoryFile) stat(name string) *memoryFileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &memoryFileInfo{name: name, size: int64(len(f.data)), modTime: f.modTime}
+}
+
+// memoryFileInfo 内存中的文件或者目录的信息
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *memoryFileInfo) Name() string       { return fi.name }
+func (fi *memoryFileInfo) Size() int64        { return fi.size }
+func (fi *memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memoryFileInfo) IsDir() bool        { return fi.dir }
+func (fi *memoryFileInfo) Sys() any           { return nil }
+func (fi *memoryFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | os.ModePerm
+	}
+	return DataFilePerm
+}
+
+// MemoryIO 内存文件的 IOManager，写入总是追加到文件末尾
+type MemoryIO struct {
+	file   *memoryFile
+	closed bool
+}
+
+func (mio *MemoryIO) Read(b []byte, offset int64) (int, error) {
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	if mio.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(len(mio.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mio.file.data[offset:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (mio *MemoryIO) Write(b []byte) (int, error) {
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	if mio.closed {
+		return 0, os.ErrClosed
+	}
+	mio.file.data = append(mio.file.data, b...)
+	mio.file.modTime = time.Now()
+	return len(b), nil
+}
+
+func (mio *MemoryIO) Sync() error {
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	if mio.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (mio *MemoryIO) Close() error {
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	mio.closed = true
+	return nil
+}
+
+func (mio *MemoryIO) Size() (int64, error) {
+	mio.file.mu.RLock()
+	defer mio.file.mu.RUnlock()
+	return int64(len(mio.file.data)), nil
+}
+
+func (mio *MemoryIO) Truncate(size int64) error {
+	mio.file.mu.Lock()
+	defer mio.file.mu.Unlock()
+	if mio.closed {
+		return os.ErrClosed
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	if size <= int64(len(mio.file.data)) {
+		mio.file.data = mio.file.data[:size]
+	} else {
+		mio.file.data = append(mio.file.data, make([]byte, size-int64(len(mio.file.data)))...)
+	}
+	mio.file.modTime = time.Now()
+	return nil
+}
@@ -0,0 +1,92 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryFileSystem(t *testing.T) {
+	fs := NewMemoryFileSystem()
+	dir := filepath.Join("/tmp", "bitcask-go-memory-fs")
+	name := filepath.Join(dir, "a.data")
+
+	// 目录不存在时不能创建文件
+	_, err := fs.OpenFile(name, StandardFIO)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, fs.MkdirAll(dir))
+	info, err := fs.Stat(dir)
+	assert.Nil(t, err)
+	assert.True(t, info.IsDir())
+
+	file, err := fs.OpenFile(name, MemoryMapIO)
+	assert.Nil(t, err)
+	assert.IsType(t, &MemoryIO{}, file)
+	n, err := file.Write([]byte("Welcome to China!"))
+	assert.Nil(t, err)
+	assert.Equal(t, 17, n)
+	buf := make([]byte, 8)
+	n, err = file.Read(buf, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, []byte("lcome to"), buf)
+	n, err = file.Read(buf, 12)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+	assert.Nil(t, file.Truncate(7))
+	_, err = file.Write([]byte(" home"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+	assert.Nil(t, file.Close())
+	_, err = file.Write([]byte("!"))
+	assert.Equal(t, os.ErrClosed, err)
+
+	// 重新打开可以读取之前写入的数据，磁盘上没有对应的文件
+	file, err = fs.OpenFile(name, StandardFIO)
+	assert.Nil(t, err)
+	size, err := file.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), size)
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+
+	// 重命名之后已经打开的文件依然可以读写
+	newName := filepath.Join(dir, "b.data")
+	assert.Nil(t, fs.Rename(name, newName))
+	_, err = fs.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+	_, err = file.Write([]byte("!"))
+	assert.Nil(t, err)
+	info, err = fs.Stat(newName)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), info.Size())
+
+	assert.Nil(t, fs.MkdirAll(filepath.Join(dir, "sub")))
+	entries, err := fs.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "b.data", entries[0].Name())
+	assert.True(t, entries[1].IsDir())
+	dirSize, err := DirSize(fs, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(13), dirSize)
+
+	// 文件锁只能被持有一次
+	lock, err := fs.Lock(filepath.Join(dir, "flock"))
+	assert.Nil(t, err)
+	_, err = fs.Lock(filepath.Join(dir, "flock"))
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock.Unlock())
+	lock, err = fs.Lock(filepath.Join(dir, "flock"))
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Unlock())
+
+	assert.NotNil(t, fs.Remove(dir))
+	assert.Nil(t, fs.RemoveAll(dir))
+	_, err = fs.Stat(newName)
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.ReadDir(dir)
+	assert.True(t, os.IsNotExist(err))
+}
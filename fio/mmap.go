@@ -1,17 +1,55 @@
 package fio
 
 import (
-	"golang.org/x/exp/mmap"
+	"io"
 	"os"
+	"sync"
+	"syscall"
 )
 
-// MMap IO 文件映射
+// MMap IO 只读的文件映射
+// 读取可能和 Close、Truncate 并发进行，解除映射之前需要等待正在进行的读取完成
 type MMap struct {
-	readerAt *mmap.ReaderAt
+	mu       sync.RWMutex
+	data     []byte
+	filename string
+	closed   bool
 }
 
 func (mm *MMap) Read(bytes []byte, offset int64) (int, error) {
-	return mm.readerAt.ReadAt(bytes, offset)
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.closed {
+		return 0, os.ErrClosed
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	if offset >= int64(len(mm.data)) {
+		return 0, io.EOF
+	}
+	n := copy(bytes, mm.data[offset:])
+	if n < len(bytes) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View 返回映射中从 offset 开始的 n 个字节，不进行拷贝，在 Close 之前有效
+func (mm *MMap) View(offset int64, n int) ([]byte, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.closed {
+		return nil, os.ErrClosed
+	}
+	if offset < 0 || n < 0 {
+		return nil, os.ErrInvalid
+	}
+	if offset+int64(n) > int64(len(mm.data)) {
+		return nil, io.EOF
+	}
+	end := offset + int64(n)
+	return mm.data[offset:end:end], nil
 }
 
 func (mm *MMap) Write(bytes []byte) (int, error) {
@@ -23,23 +61,68 @@ func (mm *MMap) Sync() error {
 }
 
 func (mm *MMap) Close() error {
-	return mm.readerAt.Close()
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.closed = true
+	if mm.data == nil {
+		return nil
+	}
+	data := mm.data
+	mm.data = nil
+	return syscall.Munmap(data)
 }
 
 func (mm *MMap) Size() (int64, error) {
-	return int64(mm.readerAt.Len()), nil
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return int64(len(mm.data)), nil
+}
+
+// Truncate 截断磁盘上的文件并重新映射，之前 View 返回的数据不再有效
+func (mm *MMap) Truncate(size int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.closed {
+		return os.ErrClosed
+	}
+	if mm.data != nil {
+		if err := syscall.Munmap(mm.data); err != nil {
+			return err
+		}
+		mm.data = nil
+	}
+	// 截断失败时恢复原来的映射
+	err := os.Truncate(mm.filename, size)
+	data, mapErr := mmapFile(mm.filename)
+	if err == nil {
+		err = mapErr
+	}
+	mm.data = data
+	return err
 }
 
 func NewMMapIOManager(filename string) (*MMap, error) {
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
+	data, err := mmapFile(filename)
+	if err != nil {
 		return nil, err
 	}
+	return &MMap{data: data, filename: filename}, nil
+}
 
-	readerAt, err := mmap.Open(filename)
+// mmapFile 以只读的方式映射整个文件
+// 空文件不能映射，返回空的映射，读取时直接返回 io.EOF
+func mmapFile(filename string) ([]byte, error) {
+	fd, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	return &MMap{
-		readerAt: readerAt,
-	}, nil
+	defer fd.Close()
+	stat, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, nil
+	}
+	return syscall.Mmap(int(fd.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
 }
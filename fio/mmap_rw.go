@@ -0,0 +1,222 @@
+package fio
+
+import (
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// MMapRW 可读写的文件映射，写入直接拷贝到映射的内存中
+// 文件会预先扩展到映射的大小，写入的逻辑大小单独记录，关闭时将文件截断到逻辑大小
+// 读取可能和写入并发进行，扩展映射时需要等待正在进行的读取完成
+type MMapRW struct {
+	mu       sync.RWMutex
+	fd       *os.File
+	data     []byte // 映射的内存，长度为映射的大小
+	size     int64  // 逻辑大小，即已经写入的数据的末尾
+	fileSize int64  // 文件在磁盘上的大小，不小于逻辑大小
+}
+
+func NewMMapRWIOManager(filename string) (*MMapRW, error) {
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, DataFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	mm := &MMapRW{fd: fd, size: stat.Size(), fileSize: stat.Size()}
+	if err := mm.remap(stat.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return mm, nil
+}
+
+func (mm *MMapRW) Read(b []byte, offset int64) (int, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.fd == nil {
+		return 0, os.ErrClosed
+	}
+	if offset >= mm.size {
+		return 0, io.EOF
+	}
+	n := copy(b, mm.data[offset:mm.size])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// View 返回映射中从 offset 开始的 n 个字节，不进行拷贝
+// 扩展映射、Truncate 和 Close 之后返回的数据不再有效，只能用于不再写入的文件
+func (mm *MMapRW) View(offset int64, n int) ([]byte, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.fd == nil {
+		return nil, os.ErrClosed
+	}
+	if offset < 0 || n < 0 {
+		return nil, os.ErrInvalid
+	}
+	end := offset + int64(n)
+	if end > mm.size {
+		return nil, io.EOF
+	}
+	return mm.data[offset:end:end], nil
+}
+
+func (mm *MMapRW) Write(b []byte) (int, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.fd == nil {
+		return 0, os.ErrClosed
+	}
+	// 空间不足时扩展为原来的两倍，没有预先分配空间时也只需要重新映射少数几次
+	end := mm.size + int64(len(b))
+	if end > mm.fileSize {
+		if err := mm.grow(max(end, 2*mm.fileSize)); err != nil {
+			return 0, err
+		}
+	}
+	copy(mm.data[mm.size:], b)
+	mm.size = end
+	return len(b), nil
+}
+
+// Reserve 预先将文件和映射扩展到 size，之后写入到 size 之前不需要重新映射
+func (mm *MMapRW) Reserve(size int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.fd == nil {
+		return os.ErrClosed
+	}
+	if size <= mm.fileSize {
+		return nil
+	}
+	return mm.grow(size)
+}
+
+func (mm *MMapRW) Reserved() int64 {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return mm.fileSize - mm.size
+}
+
+// Truncate 将逻辑大小设置为 size，文件也截断到 size，映射重新映射为截断之后的大小
+// 之后的写入会重新扩展文件和映射
+func (mm *MMapRW) Truncate(size int64) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.fd == nil {
+		return os.ErrClosed
+	}
+	if size > mm.fileSize {
+		if err := mm.grow(size); err != nil {
+			return err
+		}
+	}
+	if size < mm.fileSize {
+		// 先解除映射再截断文件，截断之后访问超出文件末尾的映射会触发 SIGBUS
+		if err := mm.remap(0); err != nil {
+			return err
+		}
+		err := mm.fd.Truncate(size)
+		if err == nil {
+			mm.fileSize = size
+		}
+		// 截断失败时恢复原来的映射
+		if remapErr := mm.remap(mm.fileSize); err == nil {
+			err = remapErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	mm.size = size
+	return nil
+}
+
+func (mm *MMapRW) Sync() error {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	if mm.fd == nil {
+		return os.ErrClosed
+	}
+	// 先将映射中已经写入的数据同步写回文件，再通过 fsync 持久化文件的大小等元数据
+	// POSIX 不保证 fsync 会持久化只通过映射修改的页
+	if mm.size > 0 {
+		if err := unix.Msync(mm.data[:mm.size], unix.MS_SYNC); err != nil {
+			return err
+		}
+	}
+	return mm.fd.Sync()
+}
+
+// Close 解除映射并将文件截断到逻辑大小，去掉预先分配的空间
+func (mm *MMapRW) Close() error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if mm.fd == nil {
+		return nil
+	}
+	var err error
+	if mm.data != nil {
+		err = syscall.Munmap(mm.data)
+		mm.data = nil
+	}
+	if mm.size != mm.fileSize {
+		if truncErr := mm.fd.Truncate(mm.size); err == nil {
+			err = truncErr
+		}
+	}
+	if closeErr := mm.fd.Close(); err == nil {
+		err = closeErr
+	}
+	mm.fd = nil
+	return err
+}
+
+func (mm *MMapRW) Size() (int64, error) {
+	mm.mu.RLock()
+	defer mm.mu.RUnlock()
+	return mm.size, nil
+}
+
+// grow 将文件扩展到 size，映射的空间不足时重新映射
+// 调用方必须持有写锁
+func (mm *MMapRW) grow(size int64) error {
+	if err := mm.fd.Truncate(size); err != nil {
+		return err
+	}
+	mm.fileSize = size
+	if size <= int64(len(mm.data)) {
+		return nil
+	}
+	return mm.remap(size)
+}
+
+// remap 解除原来的映射，重新映射文件的前 size 个字节
+// 调用方必须持有写锁
+func (mm *MMapRW) remap(size int64) error {
+	if mm.data != nil {
+		if err := syscall.Munmap(mm.data); err != nil {
+			return err
+		}
+		mm.data = nil
+	}
+	if size == 0 {
+		return nil
+	}
+	data, err := syscall.Mmap(int(mm.fd.Fd()), 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	mm.data = data
+	return nil
+}
@@ -0,0 +1,90 @@
+package fio
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMapRW(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "mmap-rw.data")
+	defer destroyFile(path)
+	mmapIO, err := NewIOManager(path, MemoryMapRWIO)
+	assert.Nil(t, err)
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), size)
+
+	// 写入超过映射大小时自动扩展
+	n, err := mmapIO.Write([]byte("Welcome to China!"))
+	assert.Nil(t, err)
+	assert.Equal(t, 17, n)
+	buf := make([]byte, 8)
+	n, err = mmapIO.Read(buf, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 8, n)
+	assert.Equal(t, []byte("lcome to"), buf)
+	n, err = mmapIO.Read(buf, 12)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 5, n)
+
+	// 预先分配的空间不影响逻辑大小
+	assert.Nil(t, mmapIO.(Reserver).Reserve(4*1024*1024))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4*1024*1024), info.Size())
+	size, err = mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(17), size)
+	_, err = mmapIO.Write([]byte(" Bye"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Sync())
+
+	// 截断之后映射的大小和文件一致，之后的写入从截断的位置开始
+	assert.Equal(t, int64(4*1024*1024-21), mmapIO.(Reserver).Reserved())
+	assert.Nil(t, mmapIO.Truncate(7))
+	assert.Equal(t, 7, len(mmapIO.(*MMapRW).data))
+	assert.Equal(t, int64(0), mmapIO.(Reserver).Reserved())
+	info, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), info.Size())
+	_, err = mmapIO.Write([]byte(" home"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Close())
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Welcome home"), b)
+
+	// 重新打开时逻辑大小为文件的大小
+	mmapIO, err = NewIOManager(path, MemoryMapRWIO)
+	assert.Nil(t, err)
+	size, err = mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(12), size)
+	_, err = mmapIO.Write([]byte("!"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Close())
+	b, err = os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("Welcome home!"), b)
+}
+
+func TestMMapRW_Sync(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "mmap-rw-sync.data")
+	defer destroyFile(path)
+	mmapIO, err := NewIOManager(path, MemoryMapRWIO)
+	assert.Nil(t, err)
+	defer mmapIO.Close()
+	// 没有映射任何数据时也可以同步
+	assert.Nil(t, mmapIO.Sync())
+
+	assert.Nil(t, mmapIO.(Reserver).Reserve(64*1024))
+	_, err = mmapIO.Write([]byte("synced through the mapping"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Sync())
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("synced through the mapping"), b[:26])
+}
@@ -5,16 +5,19 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
 )
 
 func TestNewMMapIOManager(t *testing.T) {
-	_, err := NewIOManager("/tmp/mmap-a.data", MemoryMapIO)
-	mmapIO, err := NewMMapIOManager("/tmp/mmap-a.data")
-
 	path := filepath.Join("/tmp", "mmap-a.data")
 	defer destroyFile(path)
-	mmapIO, err = NewMMapIOManager(path)
+	// 文件不存在时返回错误
+	_, err := NewIOManager(path, MemoryMapIO)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, os.WriteFile(path, nil, DataFilePerm))
+	mmapIO, err := NewMMapIOManager(path)
 	assert.Nil(t, err)
 	assert.NotNil(t, mmapIO)
 	t.Log(mmapIO.Size())
@@ -35,6 +38,59 @@ func TestNewMMapIOManager(t *testing.T) {
 
 }
 
+func TestMMap_Truncate(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "mmap-truncate.data")
+	defer destroyFile(path)
+	assert.Nil(t, os.WriteFile(path, []byte("Welcome to China!"), DataFilePerm))
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+
+	// 截断之后重新映射，映射的大小和文件一致
+	assert.Nil(t, mmapIO.Truncate(7))
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), size)
+	b := make([]byte, 8)
+	n, err := mmapIO.Read(b, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("Welcome"), b[:n])
+
+	// 截断为空文件之后读取直接返回 io.EOF
+	assert.Nil(t, mmapIO.Truncate(0))
+	_, err = mmapIO.Read(b, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, mmapIO.Close())
+}
+
+func TestMMap_CloseConcurrentRead(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "mmap-close.data")
+	defer destroyFile(path)
+	assert.Nil(t, os.WriteFile(path, make([]byte, 4096), DataFilePerm))
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+
+	// 解除映射等待正在进行的读取完成，之后的读取返回 os.ErrClosed
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 4096)
+			for {
+				if _, err := mmapIO.Read(b, 0); err != nil {
+					assert.Equal(t, os.ErrClosed, err)
+					return
+				}
+			}
+		}()
+	}
+	assert.Nil(t, mmapIO.Close())
+	wg.Wait()
+	_, err = mmapIO.View(0, 8)
+	assert.Equal(t, os.ErrClosed, err)
+	assert.Nil(t, mmapIO.Close())
+}
+
 func createFile(t *testing.T, filename string) {
 	fio, err := NewIOManager(filename, StandardFIO)
 	assert.Nil(t, err)
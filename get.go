@@ -2,35 +2,148 @@ package bitcask_go
 
 import (
 	"github.com/rbongIO/bitcask-go/data"
+	"sort"
+	"time"
 )
 
+// multiGetMaxReadSize MultiGet 合并相邻记录时一次读取的最大字节数
+const multiGetMaxReadSize = 1 << 20
+
 func (db *DB) Get(key []byte) ([]byte, error) {
-	//需要从 DataFile 中读取数据，Datafile 在此期间不能进行修改，所以需要加锁
-	db.mu.Lock()
-	defer db.mu.Unlock()
 	//判断 key 的有效
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	//读取数据期间数据文件不能被 merge 替换或关闭，读取本身不会修改数据文件，持有共享锁即可
+	db.lockSynced(false, key)
+	defer db.mu.RUnlock()
+	return db.getValue(key)
+}
+
+// getValue 根据 key 从内存索引和数据文件中读取数据
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) getValue(key []byte) ([]byte, error) {
 	//从内存索引中查找
 	recordPos := db.index.Get(key)
 	//如果内存索引中没有找到，说明 key 不存在
-	if recordPos == nil {
+	//已经过期的 key 同样视为不存在
+	if recordPos == nil || recordPos.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 	//从数据文件中获取具体的数据
-	return db.GetValueByPosition(recordPos)
+	return db.getValueByPosition(recordPos)
+}
+
+// MultiGet 批量读取多个 key 的数据，返回的 values 和 errs 与 keys 一一对应
+// 所有的 key 在一次加锁期间读取，读取之前按照数据文件和偏移排序，同一个文件中相邻的记录合并为一次读取
+func (db *DB) MultiGet(keys [][]byte) ([][]byte, []error) {
+	values := make([][]byte, len(keys))
+	errs := make([]error, len(keys))
+
+	db.lockSynced(false, keys...)
+	defer db.mu.RUnlock()
+	now := time.Now().UnixNano()
+	reads := make([]multiGetRead, 0, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			errs[i] = ErrKeyIsEmpty
+			continue
+		}
+		recordPos := db.index.Get(key)
+		if recordPos == nil || recordPos.IsExpired(now) {
+			errs[i] = ErrKeyNotFound
+			continue
+		}
+		reads = append(reads, multiGetRead{index: i, pos: recordPos})
+	}
+	sort.Slice(reads, func(i, j int) bool {
+		a, b := reads[i].pos, reads[j].pos
+		if a.Fid != b.Fid {
+			return a.Fid < b.Fid
+		}
+		return a.Offset < b.Offset
+	})
+
+	for start := 0; start < len(reads); {
+		// 找出从 start 开始可以合并读取的记录，重复的 key 对应同一条记录
+		// 分块存储的记录大小包含了所有的分块，不和其他记录合并读取
+		end, readEnd := start+1, reads[start].pos.Offset+int64(reads[start].pos.Size)
+		for end < len(reads) && !reads[start].pos.Chunked {
+			pos := reads[end].pos
+			if pos.Fid != reads[start].pos.Fid || pos.Size == 0 || pos.Chunked || pos.Offset > readEnd ||
+				pos.Offset+int64(pos.Size)-reads[start].pos.Offset > multiGetMaxReadSize {
+				break
+			}
+			if next := pos.Offset + int64(pos.Size); next > readEnd {
+				readEnd = next
+			}
+			end++
+		}
+		db.readMultiGetBatch(reads[start:end], readEnd, values, errs)
+		start = end
+	}
+	return values, errs
+}
+
+// multiGetRead MultiGet 中需要从数据文件读取的 key
+type multiGetRead struct {
+	index int // key 在参数中的下标
+	pos   *data.LogRecordPos
+}
+
+// readMultiGetBatch 一次读取同一个数据文件中从 reads[0] 到 readEnd 的数据，再分别解析每一条记录
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) readMultiGetBatch(reads []multiGetRead, readEnd int64, values [][]byte, errs []error) {
+	first := reads[0].pos
+	dataFile := db.dataFile(first.Fid)
+	// 只有一条记录或者没有记录大小时单独读取
+	if len(reads) == 1 || first.Size == 0 || first.Chunked || dataFile == nil {
+		for _, r := range reads {
+			values[r.index], errs[r.index] = getValueFromDataFile(db.dataFile, r.pos)
+		}
+		return
+	}
+	buf, err := dataFile.ReadBytes(readEnd-first.Offset, first.Offset)
+	for _, r := range reads {
+		if err != nil {
+			errs[r.index] = err
+			continue
+		}
+		record, _, err := dataFile.DecodeLogRecordAt(buf, first.Offset, r.pos.Offset)
+		if err != nil {
+			errs[r.index] = err
+			continue
+		}
+		values[r.index], errs[r.index] = recordValue(db.dataFile, record)
+	}
 }
 
-// GetValueByPosition 根据 LogRecordPos 获取具体的数据
+// GetValueByPosition 根据 LogRecordPos 获取具体的数据，可以并发调用
 func (db *DB) GetValueByPosition(recordPos *data.LogRecordPos) ([]byte, error) {
-	//根据文件 ID 找到数据文件
-	var dataFile *data.DataFile
-	if db.activeFile.FileID == recordPos.Fid {
-		dataFile = db.activeFile
-	} else {
-		dataFile = db.olderFiles[recordPos.Fid]
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getValueByPosition(recordPos)
+}
+
+// getValueByPosition 根据 LogRecordPos 获取具体的数据
+// 数据文件的读取都是按位置读取，持有共享锁时可以并发读取
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) getValueByPosition(recordPos *data.LogRecordPos) ([]byte, error) {
+	return getValueFromDataFile(db.dataFile, recordPos)
+}
+
+// dataFile 根据文件 ID 找到数据文件
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) dataFile(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileID == fid {
+		return db.activeFile
 	}
+	return db.olderFiles[fid]
+}
+
+// getValueFromDataFile 读取 LogRecordPos 对应的数据，files 根据文件 ID 查找数据文件
+func getValueFromDataFile(files func(fid uint32) *data.DataFile, recordPos *data.LogRecordPos) ([]byte, error) {
+	dataFile := files(recordPos.Fid)
 	//如果数据文件不存在
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
@@ -40,35 +153,52 @@ func (db *DB) GetValueByPosition(recordPos *data.LogRecordPos) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	if record.Type == data.LogRecordDeleted {
+	return recordValue(files, record)
+}
+
+// recordValue 返回记录中的数据，分块存储的数据需要读取所有的分块
+func recordValue(files func(fid uint32) *data.DataFile, record *data.LogRecord) ([]byte, error) {
+	switch record.Type {
+	case data.LogRecordDeleted:
 		return nil, nil
+	case data.LogRecordChunkManifest:
+		return readChunkedValue(files, record.Value)
 	}
 	return record.Value, nil
 }
 
 func (db *DB) ListKeys() [][]byte {
-	db.mu.RLock()
+	db.lockSynced(false)
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
 	size := db.Size()
 	db.mu.RUnlock()
-	keys := make([][]byte, size)
-	for i := 0; iterator.Valid(); iterator.Next() {
-		keys[i] = iterator.Key()
-		i++
+	now := time.Now().UnixNano()
+	keys := make([][]byte, 0, size)
+	for ; iterator.Valid(); iterator.Next() {
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		keys = append(keys, iterator.Key())
 	}
 	return keys
 }
 
 // Fold 获取所有的数据并执行用户指定的操作
 func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
-	db.mu.RLock()
+	db.lockSynced(false)
 	defer db.mu.RUnlock()
 
 	iterator := db.index.Iterator(false)
 	defer iterator.Close()
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		val, err := db.GetValueByPosition(iterator.Value())
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
+		val, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
 		}
@@ -5,11 +5,12 @@ go 1.22
 require (
 	github.com/cloudwego/hertz v0.9.1
 	github.com/gofrs/flock v0.12.0
+	github.com/golang/snappy v0.0.4
 	github.com/google/btree v1.1.2
-	github.com/plar/go-adaptive-radix-tree v1.0.5
 	github.com/stretchr/testify v1.9.0
+	github.com/tidwall/redcon v1.6.2
 	go.etcd.io/bbolt v1.3.10
-	golang.org/x/exp v0.0.0-20240707233637-46b078467d37
+	golang.org/x/sys v0.21.0
 )
 
 require (
@@ -32,10 +33,8 @@ require (
 	github.com/tidwall/gjson v1.14.4 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	github.com/tidwall/redcon v1.6.2 // indirect
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
-	golang.org/x/sys v0.21.0 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,319 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"sync"
+)
+
+// groupCommit 合并并发写入的持久化操作
+// 写入在持有 DB 锁时只追加到数据文件，需要持久化的写入释放锁之后排队等待，
+// 第一个等待的写入成为 leader 执行一次 fsync，覆盖在此之前写入的所有记录，完成之后唤醒所有等待的写入
+// fsync 失败之后数据文件中没有持久化的数据状态无法确定，重新 fsync 成功也不能保证之前的数据已经写入磁盘，
+// 因此所有等待的写入和之后的写入都返回这个错误，需要重新打开数据库
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	syncing bool   // 是否有 leader 正在持久化
+	synced  uint64 // 已经持久化的最大写入序号
+	syncs   uint64 // 执行 fsync 的次数
+	err     error  // fsync 失败的错误
+}
+
+// unsyncedWrites 需要持久化的写入在持久化完成之前对索引的修改
+// 写入在持有锁时就会更新索引，之后的写入可以看到之前的修改，读取时需要等待读取的 key 上的修改持久化完成，
+// 持久化失败时回滚这些修改，保证读取不到没有持久化的数据
+// 对共享的 DB实例的访问必须先持有锁
+type unsyncedWrites struct {
+	tracking bool              // 当前执行的写入是否需要持久化
+	writes   []*unsyncedWrite  // 按照写入序号排列
+	keys     map[string]uint64 // 修改过的 key -> 需要等待持久化的写入序号
+}
+
+// unsyncedWrite 一次需要持久化的写入对一个 key 的修改
+type unsyncedWrite struct {
+	seq    uint64             // 写入完成时的写入序号，为 0 表示写入还没有完成
+	key    []byte             // 修改的 key
+	oldPos *data.LogRecordPos // 修改之前的位置，为空表示 key 不存在
+	newPos *data.LogRecordPos // 修改之后的位置，为空表示 key 被删除
+}
+
+func newUnsyncedWrites() *unsyncedWrites {
+	return &unsyncedWrites{keys: make(map[string]uint64)}
+}
+
+func newGroupCommit() *groupCommit {
+	gc := &groupCommit{}
+	gc.cond = sync.NewCond(&gc.mu)
+	return gc
+}
+
+// markSynced 记录写入序号 seq 之前的所有记录都已经持久化
+func (gc *groupCommit) markSynced(seq uint64) {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if seq > gc.synced {
+		gc.synced = seq
+	}
+	gc.cond.Broadcast()
+}
+
+// update 在写锁内执行写入操作 fn，需要持久化时释放锁之后再通过 group commit 等待持久化完成
+// syncWrite 为 true 或者配置了 SyncWrite、写入量达到 BytePerSync 时需要持久化
+// 需要持久化的写入对索引的修改在持久化完成之前对读取不可见，持久化失败时回滚
+func (db *DB) update(syncWrite bool, fn func() error) error {
+	ticket, err := func() (uint64, error) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if err := db.groupCommit.failed(); err != nil {
+			return 0, err
+		}
+		db.unsynced.tracking = syncWrite || db.options.SyncWrite
+		err := fn()
+		db.finishUnsynced()
+		if err != nil {
+			return 0, err
+		}
+		return db.syncTicket(syncWrite), nil
+	}()
+	if err != nil {
+		return err
+	}
+	return db.waitForSync(ticket)
+}
+
+// syncTicket 返回本次写入需要等待持久化的写入序号，0 表示不需要等待
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) syncTicket(syncWrite bool) uint64 {
+	if !syncWrite && !db.options.SyncWrite &&
+		(db.options.BytePerSync == 0 || db.bytesWrite <= db.options.BytePerSync) {
+		return 0
+	}
+	db.bytesWrite = 0
+	return db.writeSeq
+}
+
+// waitForSync 等待写入序号 ticket 之前的记录持久化完成
+// 没有正在进行的持久化时由当前的写入作为 leader 执行，失败时等待的写入会重新选出 leader 重试
+func (db *DB) waitForSync(ticket uint64) error {
+	if ticket == 0 {
+		return nil
+	}
+	gc := db.groupCommit
+	gc.mu.Lock()
+	for gc.syncing && gc.synced < ticket {
+		gc.cond.Wait()
+	}
+	if gc.synced >= ticket {
+		gc.mu.Unlock()
+		return nil
+	}
+	if gc.err != nil {
+		gc.mu.Unlock()
+		return gc.err
+	}
+	gc.syncing = true
+	gc.syncs++
+	gc.mu.Unlock()
+
+	seq, err := db.syncActiveFile()
+
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	gc.syncing = false
+	if err == nil && seq > gc.synced {
+		gc.synced = seq
+	}
+	if err != nil && gc.err == nil {
+		gc.err = err
+	}
+	gc.cond.Broadcast()
+	// 数据库关闭时会持久化所有的数据，关闭文件导致的错误可以忽略
+	if gc.synced >= ticket {
+		return nil
+	}
+	return err
+}
+
+// syncActiveFile 持久化当前的活跃文件，返回已经持久化的写入序号
+// 旧的数据文件在切换活跃文件时已经持久化，只需要持久化活跃文件
+func (db *DB) syncActiveFile() (uint64, error) {
+	db.mu.Lock()
+	seq := db.writeSeq
+	if db.activeFile == nil {
+		db.mu.Unlock()
+		return seq, nil
+	}
+	// 持久化期间不持有锁，引用活跃文件保证其不会被 merge 关闭
+	activeFile := db.activeFile
+	files := map[uint32]*data.DataFile{activeFile.FileID: activeFile}
+	db.pinFileSet(files)
+	db.mu.Unlock()
+
+	err := activeFile.Sync()
+
+	db.mu.Lock()
+	db.unpinFiles(files)
+	if err == nil {
+		db.pruneUnsynced(seq)
+	} else if !db.closed {
+		// 数据库关闭时会持久化所有的数据并关闭文件，不需要回滚
+		db.rollbackUnsynced(err)
+	}
+	db.mu.Unlock()
+	return seq, err
+}
+
+// failed 返回之前 fsync 失败的错误
+func (gc *groupCommit) failed() error {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	return gc.err
+}
+
+// markSynced 记录写入序号 seq 之前的所有记录都已经持久化，并唤醒等待的写入和读取
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) markSynced(seq uint64) {
+	db.pruneUnsynced(seq)
+	db.groupCommit.markSynced(seq)
+}
+
+// recordWrite 在修改 key 的索引之前调用，记录事务冲突检测和持久化失败时回滚需要的信息
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) recordWrite(key []byte) {
+	db.txns.recordWrite(key)
+	if db.unsynced.tracking {
+		db.unsynced.writes = append(db.unsynced.writes, &unsyncedWrite{
+			key:    append([]byte(nil), key...),
+			oldPos: db.index.Get(key),
+		})
+	}
+}
+
+// finishUnsynced 写入完成之后记录本次写入对索引的修改需要等待的写入序号和修改之后的位置
+// 同一个 key 在一次写入中被修改多次时，修改之后的位置是下一次修改之前的位置
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) finishUnsynced() {
+	u := db.unsynced
+	u.tracking = false
+	next := make(map[string]*data.LogRecordPos)
+	for i := len(u.writes) - 1; i >= 0 && u.writes[i].seq == 0; i-- {
+		w := u.writes[i]
+		w.seq = db.writeSeq
+		if pos, ok := next[string(w.key)]; ok {
+			w.newPos = pos
+		} else {
+			w.newPos = db.index.Get(w.key)
+			u.keys[string(w.key)] = db.writeSeq
+		}
+		next[string(w.key)] = w.oldPos
+	}
+}
+
+// pruneUnsynced 写入序号 seq 之前的记录已经持久化，不再需要等待和回滚
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) pruneUnsynced(seq uint64) {
+	u := db.unsynced
+	i := 0
+	for ; i < len(u.writes) && u.writes[i].seq != 0 && u.writes[i].seq <= seq; i++ {
+		if key := string(u.writes[i].key); u.keys[key] <= seq {
+			delete(u.keys, key)
+		}
+	}
+	u.writes = u.writes[i:]
+}
+
+// rollbackUnsynced fsync 失败之后按照相反的顺序回滚所有没有持久化的写入对索引的修改，之后被其他写入覆盖的 key 保持不变
+// 记录依然保留在数据文件中，重新打开数据库之后可能依然可以读取到
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) rollbackUnsynced(err error) {
+	u := db.unsynced
+	for i := len(u.writes) - 1; i >= 0; i-- {
+		w := u.writes[i]
+		if !samePosition(db.index.Get(w.key), w.newPos) {
+			continue
+		}
+		db.txns.recordWrite(w.key)
+		if w.oldPos == nil {
+			db.index.Delete(w.key)
+		} else {
+			db.index.Put(w.key, w.oldPos)
+		}
+	}
+	u.writes = nil
+	u.keys = make(map[string]uint64)
+	// 在持有锁时记录错误，回滚之后不会再有新的写入
+	gc := db.groupCommit
+	gc.mu.Lock()
+	if gc.err == nil {
+		gc.err = err
+	}
+	gc.mu.Unlock()
+}
+
+// remapUnsynced merge 替换数据文件之后，将没有持久化的修改中指向被 merge 的文件的位置替换为 merge 之后的位置
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) remapUnsynced(nonMergeFileID uint32, positions map[string]*data.LogRecordPos) {
+	remap := func(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
+		if pos == nil || pos.Fid >= nonMergeFileID {
+			return pos
+		}
+		merged, ok := positions[string(key)]
+		if !ok {
+			return nil
+		}
+		newPos := *merged
+		newPos.Expire = pos.Expire
+		return &newPos
+	}
+	for _, w := range db.unsynced.writes {
+		w.oldPos = remap(w.key, w.oldPos)
+		w.newPos = remap(w.key, w.newPos)
+	}
+}
+
+// lockSynced 获取 DB 的锁，keys 中有还没有持久化的修改时先释放锁等待持久化完成，没有指定 key 时等待所有的修改
+// 持久化失败时修改已经回滚，重新获取锁之后读取的是修改之前的数据
+func (db *DB) lockSynced(exclusive bool, keys ...[]byte) {
+	for {
+		if exclusive {
+			db.mu.Lock()
+		} else {
+			db.mu.RLock()
+		}
+		seq := db.unsyncedSeq(keys)
+		if seq == 0 {
+			return
+		}
+		if exclusive {
+			db.mu.Unlock()
+		} else {
+			db.mu.RUnlock()
+		}
+		_ = db.waitForSync(seq)
+	}
+}
+
+// unsyncedSeq 返回 keys 上没有持久化的修改需要等待的写入序号，0 表示不需要等待
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) unsyncedSeq(keys [][]byte) uint64 {
+	u := db.unsynced
+	if len(u.keys) == 0 {
+		return 0
+	}
+	if len(keys) == 0 {
+		return u.writes[len(u.writes)-1].seq
+	}
+	var seq uint64
+	for _, key := range keys {
+		seq = max(seq, u.keys[string(key)])
+	}
+	return seq
+}
+
+// 判断两个位置是否指向同一条记录，并且过期时间相同
+func samePosition(a, b *data.LogRecordPos) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,188 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	db, err := Open(WithDirPath(dir), WithSyncWrite(true), WithMaxDataFileSize(64*1024))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	const goroutines, writes = 16, 100
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				key := utils.GetTestKey(g*writes + i)
+				assert.Nil(t, db.Put(key, key))
+				if i%10 == 0 {
+					wb := db.NewWriteBatch()
+					assert.Nil(t, wb.Delete(key))
+					assert.Nil(t, wb.Commit())
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// 每次写入返回之前都已经持久化
+	assert.Equal(t, db.writeSeq, db.groupCommit.synced)
+	assert.Equal(t, goroutines*writes*9/10, len(db.ListKeys()))
+
+	// 模拟一次正在进行的持久化，在此期间的写入会排队，之后只需要一次 fsync
+	db.groupCommit.mu.Lock()
+	db.groupCommit.syncing = true
+	syncs := db.groupCommit.syncs
+	db.groupCommit.mu.Unlock()
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := utils.GetTestKey(goroutines*writes + g)
+			assert.Nil(t, db.Put(key, key))
+		}(g)
+	}
+	for {
+		db.mu.RLock()
+		queued := db.index.Size() == int64(goroutines*writes*9/10+goroutines)
+		db.mu.RUnlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	db.groupCommit.mu.Lock()
+	db.groupCommit.syncing = false
+	db.groupCommit.cond.Broadcast()
+	db.groupCommit.mu.Unlock()
+	wg.Wait()
+	assert.Equal(t, syncs+1, db.groupCommit.syncs)
+	assert.Equal(t, db.writeSeq, db.groupCommit.synced)
+
+	// 没有需要持久化的写入时不会执行 fsync
+	syncs = db.groupCommit.syncs
+	ok, err := db.PutIfAbsent(utils.GetTestKey(1), nil)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, syncs, db.groupCommit.syncs)
+
+	assert.Nil(t, db.Close())
+	db2, err := Open(WithDirPath(dir))
+	assert.Nil(t, err)
+	assert.Equal(t, goroutines*writes*9/10+goroutines, len(db2.ListKeys()))
+	assert.Nil(t, db2.Close())
+}
+
+func TestDB_BytePerSync(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-byte-per-sync")
+	db, err := Open(WithDirPath(dir), WithBytePerSync(4*1024))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(1024)))
+	}
+	// 每累计写入 4KB 持久化一次
+	assert.GreaterOrEqual(t, db.groupCommit.syncs, uint64(20))
+	assert.Less(t, db.groupCommit.syncs, uint64(30))
+	assert.Greater(t, db.groupCommit.synced, uint64(0))
+
+	// 只设置了 BytePerSync 时，写入量没有达到阈值的 Put 不需要等待
+	syncs := db.groupCommit.syncs
+	assert.Nil(t, db.Put(utils.GetTestKey(1000), utils.GetTestValue(10)))
+	assert.Equal(t, syncs, db.groupCommit.syncs)
+}
+
+// 需要持久化的写入在持久化完成之前对读取不可见
+func TestDB_GroupCommitVisibility(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-visibility")
+	db, err := Open(WithDirPath(dir), WithSyncWrite(true))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("1")))
+
+	// 模拟一次正在进行的持久化，期间的写入已经更新了索引，但是还没有持久化
+	db.groupCommit.mu.Lock()
+	db.groupCommit.syncing = true
+	db.groupCommit.mu.Unlock()
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("2")))
+	}()
+	for {
+		db.mu.RLock()
+		pending := len(db.unsynced.keys) > 0
+		db.mu.RUnlock()
+		if pending {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	read := make(chan []byte)
+	go func() {
+		val, err := db.Get(utils.GetTestKey(1))
+		assert.Nil(t, err)
+		read <- val
+	}()
+	// 其他 key 的读取不需要等待
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	select {
+	case <-read:
+		t.Fatal("read a value before it was synced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	db.groupCommit.mu.Lock()
+	db.groupCommit.syncing = false
+	db.groupCommit.cond.Broadcast()
+	db.groupCommit.mu.Unlock()
+	assert.Equal(t, []byte("2"), <-read)
+	<-written
+	assert.Empty(t, db.unsynced.writes)
+}
+
+// 持久化失败时回滚索引的修改，之后的写入都返回错误
+func TestDB_GroupCommitSyncError(t *testing.T) {
+	ffs := newFaultFileSystem(fio.NewMemoryFileSystem())
+	dir := filepath.Join(os.TempDir(), "bitcask-go-group-commit-sync-error")
+	db, err := Open(WithDirPath(dir), WithFileSystem(ffs), WithSyncWrite(true))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(1), []byte("1")))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("2")))
+
+	ffs.inject(faultSyncError, 0)
+	wb := db.NewWriteBatch()
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), []byte("changed")))
+	assert.Nil(t, wb.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), []byte("3")))
+	assert.Equal(t, errInjectedFault, wb.Commit())
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+
+	// fsync 失败之后不能再写入
+	assert.Equal(t, errInjectedFault, db.Put(utils.GetTestKey(4), []byte("4")))
+	_, err = db.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
@@ -1,67 +1,191 @@
 package index
 
 import (
-	goart "github.com/plar/go-adaptive-radix-tree"
 	"github.com/rbongIO/bitcask-go/data"
 	"sync"
+	"sync/atomic"
 )
 
+// AdaptiveRadixTree ART 索引
+// 树的节点按照版本号写时复制，迭代器和快照直接引用当前的根节点，
+// 被引用期间的写入只拷贝从根节点到 key 的路径，没有被修改的子树继续共享
 type AdaptiveRadixTree struct {
-	tree goart.Tree
-	lock *sync.RWMutex
+	root    *artNode
+	size    int
+	gen     uint64 // 当前版本号，只有这个版本的节点可以直接修改
+	readers *int32 // 引用当前版本的迭代器和快照数量
+	release *int32 // 快照引用的版本，Close 时释放
+	lock    *sync.RWMutex
+}
+
+// ref 引用当前版本，之后的写入不会修改当前版本的节点
+// 对共享的 AdaptiveRadixTree 实例的访问必须先持有读锁
+func (art *AdaptiveRadixTree) ref() *int32 {
+	atomic.AddInt32(art.readers, 1)
+	return art.readers
+}
+
+// own 写入之前当前版本被引用时切换到新的版本，被引用的节点之后修改时会先拷贝
+// 对共享的 AdaptiveRadixTree 实例的访问必须先持有写锁
+func (art *AdaptiveRadixTree) own() {
+	if atomic.LoadInt32(art.readers) == 0 {
+		return
+	}
+	art.gen = nextARTGeneration()
+	art.readers = new(int32)
+}
+
+// writable 返回可以直接修改的节点，不是当前版本的节点会先拷贝
+func (art *AdaptiveRadixTree) writable(n *artNode) *artNode {
+	if n.gen == art.gen {
+		return n
+	}
+	return n.copy(art.gen)
 }
 
 func (art *AdaptiveRadixTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	oldPos, _ := art.tree.Insert(key, pos)
-	if oldPos == nil {
+	art.own()
+	var old *Item
+	art.root, old = art.insert(art.root, key, 0, &Item{key: key, pos: pos})
+	if old == nil {
+		art.size++
 		return nil
 	}
-	return oldPos.(*data.LogRecordPos)
+	return old.pos
+}
+
+// insert 将 item 插入到子树 n 中，depth 是 n 之前已经匹配的 key 的长度，返回修改之后的子树和被替换的元素
+func (art *AdaptiveRadixTree) insert(n *artNode, key []byte, depth int, item *Item) (*artNode, *Item) {
+	if n == nil {
+		return &artNode{gen: art.gen, prefix: key[depth:], leaf: item}, nil
+	}
+	p := len(commonPrefix(n.prefix, key[depth:]))
+	// key 和压缩路径不一致，在不一致的位置拆分出新的节点
+	if p < len(n.prefix) {
+		parent := &artNode{gen: art.gen, prefix: n.prefix[:p]}
+		b, rest := n.prefix[p], n.prefix[p+1:]
+		child := art.writable(n)
+		child.prefix = rest
+		parent.setChild(b, child)
+		if depth+p == len(key) {
+			parent.leaf = item
+		} else {
+			parent.setChild(key[depth+p], &artNode{gen: art.gen, prefix: key[depth+p+1:], leaf: item})
+		}
+		return parent, nil
+	}
+	n = art.writable(n)
+	depth += len(n.prefix)
+	if depth == len(key) {
+		old := n.leaf
+		n.leaf = item
+		return n, old
+	}
+	child, old := art.insert(n.child(key[depth]), key, depth+1, item)
+	n.setChild(key[depth], child)
+	return n, old
 }
 
 func (art *AdaptiveRadixTree) Close() error {
+	art.lock.Lock()
+	defer art.lock.Unlock()
+	if art.release != nil {
+		atomic.AddInt32(art.release, -1)
+		art.release = nil
+	}
 	return nil
 }
 
 func (art *AdaptiveRadixTree) Get(key []byte) *data.LogRecordPos {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	pos, found := art.tree.Search(key)
-	if !found {
+	item := art.root.search(key)
+	if item == nil {
 		return nil
 	}
-	return pos.(*data.LogRecordPos)
-
+	return item.pos
 }
 
 func (art *AdaptiveRadixTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 	art.lock.Lock()
 	defer art.lock.Unlock()
-	oldItem, deleted := art.tree.Delete(key)
-	if oldItem == nil {
-		return nil, deleted
+	if art.root.search(key) == nil {
+		return nil, false
+	}
+	art.own()
+	var old *Item
+	art.root, old = art.delete(art.root, key, 0)
+	art.size--
+	return old.pos, true
+}
+
+// delete 从子树 n 中删除 key，key 必须存在，返回修改之后的子树和被删除的元素
+// 删除之后没有元素的节点被移除，只剩一个子节点的节点和子节点合并
+func (art *AdaptiveRadixTree) delete(n *artNode, key []byte, depth int) (*artNode, *Item) {
+	n = art.writable(n)
+	depth += len(n.prefix)
+	var old *Item
+	if depth == len(key) {
+		old, n.leaf = n.leaf, nil
+	} else {
+		var child *artNode
+		child, old = art.delete(n.child(key[depth]), key, depth+1)
+		n.setChild(key[depth], child)
+	}
+	if n.leaf != nil {
+		return n, old
 	}
-	return oldItem.(*data.LogRecordPos), deleted
+	switch n.numChildren() {
+	case 0:
+		return nil, old
+	case 1:
+		b, child := n.onlyChild()
+		child = art.writable(child)
+		child.prefix = append(append(append([]byte(nil), n.prefix...), b), child.prefix...)
+		return child, old
+	}
+	return n, old
 }
 
 func (art *AdaptiveRadixTree) Iterator(reverse bool) Iterator {
+	return art.RangeIterator(IteratorOptions{Reverse: reverse})
+}
+
+// RangeIterator 遍历当前版本的树，创建迭代器不需要拷贝索引
+func (art *AdaptiveRadixTree) RangeIterator(opts IteratorOptions) Iterator {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return NewARTIterator(art.tree, reverse)
+	return newARTIterator(art.root, art.ref(), opts)
+}
+
+// Snapshot 和当前的 ART 共享同一个版本的节点，任意一方写入时只拷贝修改的路径
+// 快照 Close 之后释放引用，之后的写入可以直接修改当前版本的节点
+func (art *AdaptiveRadixTree) Snapshot() Indexer {
+	art.lock.RLock()
+	defer art.lock.RUnlock()
+	return &AdaptiveRadixTree{
+		root:    art.root,
+		size:    art.size,
+		gen:     nextARTGeneration(),
+		readers: new(int32),
+		release: art.ref(),
+		lock:    new(sync.RWMutex),
+	}
 }
 
 func (art *AdaptiveRadixTree) Size() int64 {
 	art.lock.RLock()
 	defer art.lock.RUnlock()
-	return int64(art.tree.Size())
+	return int64(art.size)
 }
 
 // NewAdaptiveRadixTree 初始化 ART
 func NewAdaptiveRadixTree() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree: goart.New(),
-		lock: new(sync.RWMutex),
+		gen:     nextARTGeneration(),
+		readers: new(int32),
+		lock:    new(sync.RWMutex),
 	}
 }
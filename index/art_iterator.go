@@ -1,77 +1,92 @@
 package index
 
 import (
-	"bytes"
-	goart "github.com/plar/go-adaptive-radix-tree"
 	"github.com/rbongIO/bitcask-go/data"
-	"sort"
+	"sync/atomic"
 )
 
 // ARTIterator ART 索引迭代器
+// 迭代器引用的版本在关闭之前不会被修改，游标沿着树的节点按需读取下一个 key，
+// 定位到上下界和 Seek 都只访问从根节点到目标 key 的路径，不拷贝范围内的元素
 type ARTIterator struct {
-	curIndex int     // 当前遍历的下标位置
-	reverse  bool    // 是否逆序遍历
-	values   []*Item // 存储所有的 key和索引信息
+	root *artNode
+	refs *int32 // 引用的版本，关闭时释放
+	opts IteratorOptions
+	iter *artCursor
+	cur  *Item // 当前位置，为空表示遍历结束
+}
+
+func newARTIterator(root *artNode, refs *int32, opts IteratorOptions) *ARTIterator {
+	ait := &ARTIterator{root: root, refs: refs, opts: opts, iter: newARTCursor(opts.Reverse)}
+	ait.Rewind()
+	return ait
 }
 
 func (ait *ARTIterator) Rewind() {
-	ait.curIndex = 0
+	switch {
+	case !ait.opts.Reverse:
+		ait.iter.seek(ait.root, ait.opts.LowerBound)
+	case len(ait.opts.UpperBound) == 0:
+		ait.iter.first(ait.root)
+	default:
+		ait.iter.seek(ait.root, ait.opts.UpperBound)
+	}
+	ait.advance()
 }
 
+// Seek 正序遍历时定位到第一个大于等于 key 的位置，逆序遍历时定位到最后一个小于等于 key 的位置
 func (ait *ARTIterator) Seek(key []byte) {
-	if ait.reverse {
-		ait.curIndex = sort.Search(len(ait.values), func(i int) bool {
-			return bytes.Compare(ait.values[i].key, key) <= 0
-		})
+	if ait.opts.Reverse && !ait.opts.belowUpper(key) {
+		ait.Rewind()
+		return
+	}
+	if !ait.opts.Reverse && !ait.opts.aboveLower(key) {
+		key = ait.opts.LowerBound
+	}
+	ait.iter.seek(ait.root, key)
+	ait.advance()
+}
+
+// advance 移动到下一个 key，超出遍历范围时遍历结束
+// 逆序遍历从上界开始时游标会先返回等于上界的 key，需要跳过
+func (ait *ARTIterator) advance() {
+	ait.cur = nil
+	for item := ait.iter.next(); item != nil; item = ait.iter.next() {
+		if ait.opts.Reverse && !ait.opts.belowUpper(item.key) {
+			continue
+		}
+		if ait.opts.aboveLower(item.key) && ait.opts.belowUpper(item.key) {
+			ait.cur = item
+		}
 		return
 	}
-	ait.curIndex = sort.Search(len(ait.values), func(i int) bool {
-		return bytes.Compare(ait.values[i].key, key) >= 0
-	})
 }
 
 func (ait *ARTIterator) Next() {
-	ait.curIndex++
+	if ait.cur != nil {
+		ait.advance()
+	}
 }
 
 func (ait *ARTIterator) Valid() bool {
-	return ait.curIndex < len(ait.values)
+	return ait.cur != nil
 }
 
 func (ait *ARTIterator) Key() []byte {
-	return ait.values[ait.curIndex].key
+	return ait.cur.key
 }
 
 func (ait *ARTIterator) Value() *data.LogRecordPos {
-	return ait.values[ait.curIndex].pos
+	return ait.cur.pos
 }
 
+// Close 释放对版本的引用，之后的写入不需要再拷贝
 func (ait *ARTIterator) Close() {
-	ait.values = nil
-}
-
-func NewARTIterator(tree goart.Tree, reverse bool) *ARTIterator {
-	var idx int
-	values := make([]*Item, tree.Size())
-	if reverse {
-		idx = tree.Size() - 1
-	}
-	saveValues := func(node goart.Node) bool {
-		item := &Item{
-			key: node.Key(),
-			pos: node.Value().(*data.LogRecordPos),
-		}
-		values[idx] = item
-		if reverse {
-			idx--
-		} else {
-			idx++
-		}
-		return true
-	}
-	tree.ForEach(saveValues)
-	return &ARTIterator{
-		reverse: reverse,
-		values:  values,
+	if ait.refs != nil {
+		atomic.AddInt32(ait.refs, -1)
+		ait.refs = nil
 	}
+	ait.root = nil
+	ait.iter = nil
+	ait.cur = nil
 }
@@ -0,0 +1,312 @@
+package index
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+const (
+	// artSortedMax 子节点不超过这个数量时按照字节顺序保存在数组中，超过之后使用 256 个槽位直接索引
+	artSortedMax = 16
+	// artFullMin 直接索引的节点删除子节点之后少于这个数量时转换回有序数组，和 artSortedMax 错开避免反复转换
+	artFullMin = 12
+)
+
+// artGeneration 全局递增的树版本号，不同的树和同一棵树的不同版本之间不会重复
+var artGeneration uint64
+
+func nextARTGeneration() uint64 {
+	return atomic.AddUint64(&artGeneration, 1)
+}
+
+// artNode ART 的节点
+// prefix 是压缩的路径，key 在这个节点结束时保存在 leaf 中，leaf 在子节点之前
+// gen 是创建节点时树的版本号，只有和树当前版本相同的节点可以直接修改，
+// 其他节点可能被迭代器和快照引用，修改之前需要拷贝，一次写入只拷贝从根节点到 key 的路径
+type artNode struct {
+	gen      uint64
+	prefix   []byte
+	leaf     *Item
+	keys     []byte     // 有序数组节点中子节点对应的字节，和 children 一一对应
+	children []*artNode // 有序数组节点中按字节顺序排列，直接索引的节点长度为 256
+	full     bool       // 是否是直接索引的节点
+	count    int        // 直接索引的节点中子节点的数量
+}
+
+// copy 拷贝节点用于修改，子节点依然共享
+func (n *artNode) copy(gen uint64) *artNode {
+	return &artNode{
+		gen:      gen,
+		prefix:   n.prefix,
+		leaf:     n.leaf,
+		keys:     append([]byte(nil), n.keys...),
+		children: append([]*artNode(nil), n.children...),
+		full:     n.full,
+		count:    n.count,
+	}
+}
+
+func (n *artNode) numChildren() int {
+	if n.full {
+		return n.count
+	}
+	return len(n.keys)
+}
+
+// child 返回字节 b 对应的子节点
+func (n *artNode) child(b byte) *artNode {
+	if n.full {
+		return n.children[b]
+	}
+	if i, found := n.sortedIndex(b); found {
+		return n.children[i]
+	}
+	return nil
+}
+
+// sortedIndex 在有序数组节点中查找字节 b 的位置，不存在时返回应该插入的位置
+func (n *artNode) sortedIndex(b byte) (int, bool) {
+	for i, k := range n.keys {
+		if k >= b {
+			return i, k == b
+		}
+	}
+	return len(n.keys), false
+}
+
+// setChild 设置字节 b 对应的子节点，c 为空表示删除，节点必须是当前版本的
+func (n *artNode) setChild(b byte, c *artNode) {
+	if n.full {
+		if n.children[b] == nil && c != nil {
+			n.count++
+		} else if n.children[b] != nil && c == nil {
+			n.count--
+		}
+		n.children[b] = c
+		if n.count < artFullMin {
+			n.shrink()
+		}
+		return
+	}
+	i, found := n.sortedIndex(b)
+	switch {
+	case found && c != nil:
+		n.children[i] = c
+	case found:
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.children = append(n.children[:i], n.children[i+1:]...)
+	case c != nil:
+		n.keys = append(n.keys[:i], append([]byte{b}, n.keys[i:]...)...)
+		n.children = append(n.children[:i], append([]*artNode{c}, n.children[i:]...)...)
+		if len(n.keys) > artSortedMax {
+			n.grow()
+		}
+	}
+}
+
+// grow 有序数组节点转换为直接索引的节点
+func (n *artNode) grow() {
+	children := make([]*artNode, 256)
+	for i, k := range n.keys {
+		children[k] = n.children[i]
+	}
+	n.full, n.count, n.keys, n.children = true, len(n.keys), nil, children
+}
+
+// shrink 直接索引的节点转换为有序数组节点
+func (n *artNode) shrink() {
+	keys := make([]byte, 0, n.count)
+	children := make([]*artNode, 0, n.count)
+	for b, c := range n.children {
+		if c != nil {
+			keys = append(keys, byte(b))
+			children = append(children, c)
+		}
+	}
+	n.full, n.count, n.keys, n.children = false, 0, keys, children
+}
+
+// nextChild 返回位置 from 以及之后的第一个子节点和它的位置，没有时返回 -1
+// 有序数组节点的位置是数组下标，直接索引的节点的位置是字节
+func (n *artNode) nextChild(from int) (int, *artNode) {
+	if !n.full {
+		if from < len(n.children) {
+			return from, n.children[from]
+		}
+		return -1, nil
+	}
+	for i := from; i < len(n.children); i++ {
+		if n.children[i] != nil {
+			return i, n.children[i]
+		}
+	}
+	return -1, nil
+}
+
+// prevChild 返回位置 from 以及之前的最后一个子节点和它的位置，没有时返回 -1
+func (n *artNode) prevChild(from int) (int, *artNode) {
+	if !n.full {
+		from = min(from, len(n.children)-1)
+		if from >= 0 {
+			return from, n.children[from]
+		}
+		return -1, nil
+	}
+	for i := min(from, len(n.children)-1); i >= 0; i-- {
+		if n.children[i] != nil {
+			return i, n.children[i]
+		}
+	}
+	return -1, nil
+}
+
+// childPos 返回字节 b 对应的子节点的位置，没有这个子节点时返回它应该插入的位置
+func (n *artNode) childPos(b byte) (int, bool) {
+	if n.full {
+		return int(b), n.children[b] != nil
+	}
+	return n.sortedIndex(b)
+}
+
+// onlyChild 返回唯一的子节点和它对应的字节
+func (n *artNode) onlyChild() (byte, *artNode) {
+	if !n.full {
+		return n.keys[0], n.children[0]
+	}
+	pos, c := n.nextChild(0)
+	return byte(pos), c
+}
+
+// search 查找 key 对应的元素
+func (n *artNode) search(key []byte) *Item {
+	depth := 0
+	for n != nil {
+		if !bytes.HasPrefix(key[depth:], n.prefix) {
+			return nil
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			return n.leaf
+		}
+		n = n.child(key[depth])
+		depth++
+	}
+	return nil
+}
+
+// artCursor 按照 key 的顺序或者逆序遍历树，遍历过程中只引用节点，不拷贝元素
+// 栈中保存从根节点到当前位置的路径，定位到某个 key 时只访问这条路径上的节点
+type artCursor struct {
+	stack   []artFrame
+	reverse bool
+}
+
+// artFrame 栈中一个节点的遍历状态
+// 正序遍历时先访问 leaf 再访问位置不小于 pos 的子节点，逆序遍历时先访问位置小于 pos 的子节点再访问 leaf
+type artFrame struct {
+	node *artNode
+	pos  int
+	leaf bool // 是否还需要访问节点自身的 leaf
+}
+
+func newARTCursor(reverse bool) *artCursor {
+	return &artCursor{reverse: reverse}
+}
+
+// push 将整棵子树加入遍历
+func (c *artCursor) push(n *artNode) {
+	frame := artFrame{node: n, leaf: n.leaf != nil}
+	if c.reverse {
+		frame.pos = len(n.children)
+	}
+	c.stack = append(c.stack, frame)
+}
+
+// first 定位到整棵树的第一个元素
+func (c *artCursor) first(root *artNode) {
+	c.stack = c.stack[:0]
+	if root != nil {
+		c.push(root)
+	}
+}
+
+// seek 正序遍历时定位到第一个大于等于 key 的元素，逆序遍历时定位到最后一个小于等于 key 的元素
+// 沿着 key 的路径向下查找，路径上的节点只保留 key 之后（逆序时之前）的子节点
+func (c *artCursor) seek(root *artNode, key []byte) {
+	c.stack = c.stack[:0]
+	depth := 0
+	for n := root; n != nil; {
+		rest := key[depth:]
+		p := len(commonPrefix(n.prefix, rest))
+		if p < len(n.prefix) {
+			// 压缩路径和 key 不一致，整棵子树都大于或者都小于 key
+			greater := p == len(rest) || n.prefix[p] > rest[p]
+			if greater != c.reverse {
+				c.push(n)
+			}
+			return
+		}
+		depth += len(n.prefix)
+		if depth == len(key) {
+			// leaf 等于 key，子节点都大于 key，逆序遍历时只剩下 leaf
+			c.stack = append(c.stack, artFrame{node: n, leaf: n.leaf != nil})
+			return
+		}
+		// leaf 是 key 的前缀，小于 key
+		pos, found := n.childPos(key[depth])
+		if c.reverse {
+			c.stack = append(c.stack, artFrame{node: n, pos: pos, leaf: n.leaf != nil})
+		} else if found {
+			c.stack = append(c.stack, artFrame{node: n, pos: pos + 1})
+		} else {
+			c.stack = append(c.stack, artFrame{node: n, pos: pos})
+		}
+		if !found {
+			return
+		}
+		n = n.child(key[depth])
+		depth++
+	}
+}
+
+// next 返回下一个元素，遍历结束时返回空
+func (c *artCursor) next() *Item {
+	for len(c.stack) > 0 {
+		top := &c.stack[len(c.stack)-1]
+		if top.leaf && !c.reverse {
+			top.leaf = false
+			return top.node.leaf
+		}
+		var pos int
+		var child *artNode
+		if c.reverse {
+			pos, child = top.node.prevChild(top.pos - 1)
+		} else {
+			pos, child = top.node.nextChild(top.pos)
+		}
+		if child == nil {
+			if top.leaf {
+				top.leaf = false
+				return top.node.leaf
+			}
+			c.stack = c.stack[:len(c.stack)-1]
+			continue
+		}
+		if c.reverse {
+			top.pos = pos
+		} else {
+			top.pos = pos + 1
+		}
+		c.push(child)
+	}
+	return nil
+}
+
+// commonPrefix 返回两个 key 的公共前缀
+func commonPrefix(a, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
@@ -3,6 +3,7 @@ package index
 import (
 	"github.com/rbongIO/bitcask-go/data"
 	"github.com/stretchr/testify/assert"
+	"math/rand"
 	"testing"
 )
 
@@ -88,3 +89,58 @@ func TestAdaptiveRadixTree_Iterator(t *testing.T) {
 		it.Next()
 	}
 }
+
+func TestAdaptiveRadixTree_Random(t *testing.T) {
+	art := NewAdaptiveRadixTree()
+	bt := NewBTree()
+	rnd := rand.New(rand.NewSource(1))
+	type snapshot struct {
+		art, bt Indexer
+	}
+	var snaps []snapshot
+	for i := 0; i < 20000; i++ {
+		// key 的长度不同，有的 key 是其他 key 的前缀，子节点的数量在有序数组和直接索引的阈值附近变化
+		key := make([]byte, 1+rnd.Intn(2))
+		for j := range key {
+			key[j] = byte('a' + rnd.Intn(20))
+		}
+		if rnd.Intn(2) == 0 {
+			key = append(key, "-tail"...)
+		}
+		// 后一半删除的比例更高，节点的子节点逐渐减少
+		deletes := 3
+		if i >= 10000 {
+			deletes = 7
+		}
+		switch op := rnd.Intn(10); {
+		case op == 0:
+			snaps = append(snaps, snapshot{art.Snapshot(), bt.Snapshot()})
+		case op == 1:
+			if len(snaps) > 0 {
+				assert.Nil(t, snaps[0].art.Close())
+				snaps = snaps[1:]
+			}
+		case op < 2+deletes:
+			artPos, ok := art.Delete(key)
+			btPos, _ := bt.Delete(key)
+			assert.Equal(t, btPos != nil, ok)
+			assert.Equal(t, btPos, artPos)
+		default:
+			pos := &data.LogRecordPos{Fid: uint32(i)}
+			assert.Equal(t, bt.Put(key, pos), art.Put(key, pos))
+		}
+	}
+	snaps = append(snaps, snapshot{art, bt})
+	for _, snap := range snaps {
+		assert.Equal(t, snap.bt.Size(), snap.art.Size())
+		it, bit := snap.art.Iterator(false), snap.bt.Iterator(false)
+		assert.Equal(t, iteratorKeys(bit), iteratorKeys(it))
+		it.Close()
+		bit.Close()
+		bit = snap.bt.Iterator(false)
+		for ; bit.Valid(); bit.Next() {
+			assert.Equal(t, bit.Value(), snap.art.Get(bit.Key()))
+		}
+		bit.Close()
+	}
+}
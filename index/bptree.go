@@ -1,6 +1,9 @@
 package index
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"github.com/rbongIO/bitcask-go/data"
 	bolt "go.etcd.io/bbolt"
 	"path/filepath"
@@ -10,34 +13,43 @@ const bptreeIndexFileName = "bptree-index"
 
 var indexBucketName = []byte("bitcask-index")
 
+// 加密索引的元信息，macKey 用当前的密钥加密之后保存
+var (
+	metaBucketName = []byte("bitcask-meta")
+	macKeyName     = []byte("index-mac-key")
+)
+
 // BPlusTree  BoltDB 索引
+// 设置了密钥时，bolt 中的 key 为原始 key 的 HMAC，value 为加密之后的原始 key 和位置信息
 type BPlusTree struct {
-	tree *bolt.DB
+	tree   *bolt.DB
+	cipher *data.Cipher
+	macKey []byte
 }
 
 func (bpt *BPlusTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
-	var oldItem []byte
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		oldItem = bucket.Get(key)
-		err := bucket.Put(key, pos.Marshal())
-		return err
+		indexKey := bpt.indexKey(key)
+		if oldItem := bucket.Get(indexKey); len(oldItem) != 0 {
+			_, oldPos = bpt.decodeItem(indexKey, oldItem)
+		}
+		return bucket.Put(indexKey, bpt.encodeItem(key, pos))
 	}); err != nil {
 		panic("failed to put value into bptree")
 	}
-	if len(oldItem) == 0 {
-		return nil
-	}
-	return data.DecodeLogRecordPos(oldItem)
+	return oldPos
 }
 
 func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 	var pos *data.LogRecordPos
 	if err := bpt.tree.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		val := bucket.Get(key)
+		indexKey := bpt.indexKey(key)
+		val := bucket.Get(indexKey)
 		if len(val) != 0 {
-			pos = data.DecodeLogRecordPos(val)
+			_, pos = bpt.decodeItem(indexKey, val)
 		}
 		return nil
 	}); err != nil {
@@ -47,25 +59,31 @@ func (bpt *BPlusTree) Get(key []byte) *data.LogRecordPos {
 }
 
 func (bpt *BPlusTree) Delete(key []byte) (*data.LogRecordPos, bool) {
-	//var ok bool
-	var oldItem []byte
+	var oldPos *data.LogRecordPos
 	if err := bpt.tree.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket(indexBucketName)
-		if oldItem = bucket.Get(key); len(oldItem) != 0 {
-			return bucket.Delete(key)
+		indexKey := bpt.indexKey(key)
+		if oldItem := bucket.Get(indexKey); len(oldItem) != 0 {
+			_, oldPos = bpt.decodeItem(indexKey, oldItem)
+			return bucket.Delete(indexKey)
 		}
 		return nil
 	}); err != nil {
 		panic("failed to delete value into bptree")
 	}
-	if len(oldItem) == 0 {
-		return nil, false
-	}
-	return data.DecodeLogRecordPos(oldItem), true
+	return oldPos, oldPos != nil
 }
 
 func (bpt *BPlusTree) Iterator(reverse bool) Iterator {
-	return newBptreeIterator(bpt.tree, reverse)
+	return bpt.RangeIterator(IteratorOptions{Reverse: reverse})
+}
+
+func (bpt *BPlusTree) RangeIterator(opts IteratorOptions) Iterator {
+	// 加密之后 bolt 中的顺序不是 key 的顺序，在只读事务中按批解密和排序
+	if bpt.cipher != nil {
+		return newEncryptedBptreeIterator(bpt, opts)
+	}
+	return newBptreeIterator(bpt.tree, opts)
 }
 
 func (bpt *BPlusTree) Size() int64 {
@@ -80,26 +98,211 @@ func (bpt *BPlusTree) Size() int64 {
 	return int64(size)
 }
 
+// Snapshot 将 B+ 树中的索引信息拷贝到内存中的 BTree
+func (bpt *BPlusTree) Snapshot() Indexer {
+	snapshot := NewBTree()
+	if err := bpt.tree.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+			key, pos := bpt.decodeItem(k, v)
+			snapshot.Put(key, pos)
+			return nil
+		})
+	}); err != nil {
+		panic("failed to snapshot bptree")
+	}
+	return snapshot
+}
+
+// ApplyMerge 在一个事务中将文件 id 小于 nonMergeFileID 的索引替换为 merge 之后的位置
+// 不在 positions 中的这部分 key 已经在 merge 时被丢弃，直接删除，返回被删除的索引位置
+// 重复执行的结果相同，事务提交之后会立即持久化
+func (bpt *BPlusTree) ApplyMerge(nonMergeFileID uint32, positions map[string]*data.LogRecordPos) ([]*data.LogRecordPos, error) {
+	var removed []*data.LogRecordPos
+	err := bpt.tree.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(indexBucketName)
+		// 遍历过程中不能修改 bucket，先找出需要更新的 key
+		type mergedItem struct {
+			indexKey []byte
+			key      []byte
+			pos      *data.LogRecordPos
+		}
+		var mergedItems []mergedItem
+		if err := bucket.ForEach(func(k, v []byte) error {
+			key, pos := bpt.decodeItem(k, v)
+			if pos.Fid < nonMergeFileID {
+				indexKey := make([]byte, len(k))
+				copy(indexKey, k)
+				mergedItems = append(mergedItems, mergedItem{indexKey: indexKey, key: key, pos: pos})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, item := range mergedItems {
+			if pos, ok := positions[string(item.key)]; ok {
+				// 重新写入时会使用当前的密钥加密，merge 期间修改的过期时间需要保留
+				newPos := *pos
+				newPos.Expire = item.pos.Expire
+				if err := bucket.Put(item.indexKey, bpt.encodeItem(item.key, &newPos)); err != nil {
+					return err
+				}
+				continue
+			}
+			removed = append(removed, item.pos)
+			if err := bucket.Delete(item.indexKey); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bpt.tree.NoSync {
+		if err := bpt.tree.Sync(); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
+
+// indexKey 返回 key 在 bolt 中对应的 key
+func (bpt *BPlusTree) indexKey(key []byte) []byte {
+	if bpt.cipher == nil {
+		return key
+	}
+	mac := hmac.New(sha256.New, bpt.macKey)
+	mac.Write(key)
+	return mac.Sum(nil)
+}
+
+// encodeItem 编码 bolt 中保存的 value
+func (bpt *BPlusTree) encodeItem(key []byte, pos *data.LogRecordPos) []byte {
+	if bpt.cipher == nil {
+		return pos.Marshal()
+	}
+	item, err := bpt.cipher.Seal(key, pos.Marshal(), nil)
+	if err != nil {
+		panic("failed to encrypt bptree item")
+	}
+	return item
+}
+
+// decodeItem 解码 bolt 中保存的 key 和 value，返回原始的 key 和位置信息
+// bolt 返回的数据只在事务内有效，返回的 key 是拷贝之后的
+func (bpt *BPlusTree) decodeItem(indexKey, item []byte) ([]byte, *data.LogRecordPos) {
+	if bpt.cipher == nil {
+		key := make([]byte, len(indexKey))
+		copy(key, indexKey)
+		return key, data.DecodeLogRecordPos(item)
+	}
+	key, pos, err := bpt.cipher.Open(item, nil)
+	if err != nil {
+		panic("failed to decrypt bptree item")
+	}
+	return key, data.DecodeLogRecordPos(pos)
+}
+
 // NewBPlusTree 创建一个新的 B+ 树索引
 func NewBPlusTree(dirPath string, syncWrite bool) *BPlusTree {
-	opts := bolt.DefaultOptions
-	opts.NoSync = syncWrite
-	bptree, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := OpenBPlusTree(dirPath, syncWrite, nil)
 	if err != nil {
 		panic(err)
 	}
+	return bptree
+}
+
+// OpenBPlusTree 打开 B+ 树索引，c 不为空时索引中的数据都会加密
+// 已有的未加密索引会被转换为加密的索引，使用轮换之前的密钥加密的 macKey 会使用当前的密钥重新加密
+func OpenBPlusTree(dirPath string, syncWrite bool, c *data.Cipher) (*BPlusTree, error) {
+	opts := bolt.DefaultOptions
+	// 不需要每次写入都持久化时才关闭 fsync
+	opts.NoSync = !syncWrite
+	tree, err := bolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	if err != nil {
+		return nil, err
+	}
+	bptree := &BPlusTree{tree: tree}
 	// 创建对应的 bucket
-	if err := bptree.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists(indexBucketName)
+	if err := tree.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(indexBucketName)
+		if err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucketName)
+		if c == nil {
+			if meta != nil && meta.Get(macKeyName) != nil {
+				return data.ErrEncryptionKeyRequired
+			}
+			return nil
+		}
+		if meta == nil {
+			if meta, err = tx.CreateBucket(metaBucketName); err != nil {
+				return err
+			}
+		}
+		return bptree.initCipher(bucket, meta, c)
+	}); err != nil {
+		_ = tree.Close()
+		return nil, err
+	}
+	return bptree, nil
+}
+
+// initCipher 读取或者生成 macKey
+// 对共享的 BPlusTree 实例的访问必须在 bolt 的写事务内
+func (bpt *BPlusTree) initCipher(bucket, meta *bolt.Bucket, c *data.Cipher) error {
+	if wrapped := meta.Get(macKeyName); wrapped != nil {
+		_, macKey, err := c.Open(wrapped, macKeyName)
+		if err != nil {
+			return err
+		}
+		bpt.cipher, bpt.macKey = c, macKey
+		if c.IsCurrent(wrapped) {
+			return nil
+		}
+		return bpt.saveMacKey(meta)
+	}
+
+	// 第一次使用密钥打开，生成 macKey 并加密已有的索引
+	bpt.macKey = make([]byte, sha256.Size)
+	if _, err := rand.Read(bpt.macKey); err != nil {
 		return err
+	}
+	var keys, items [][]byte
+	if err := bucket.ForEach(func(k, v []byte) error {
+		key, pos := bpt.decodeItem(k, v)
+		keys = append(keys, key)
+		items = append(items, pos.Marshal())
+		return nil
 	}); err != nil {
-		panic("failed to create bucket in bptree")
+		return err
 	}
-	return &BPlusTree{
-		tree: bptree,
+	bpt.cipher = c
+	for i, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		if err := bucket.Put(bpt.indexKey(key), bpt.encodeItem(key, data.DecodeLogRecordPos(items[i]))); err != nil {
+			return err
+		}
+	}
+	return bpt.saveMacKey(meta)
+}
+
+func (bpt *BPlusTree) saveMacKey(meta *bolt.Bucket) error {
+	wrapped, err := bpt.cipher.Seal(nil, bpt.macKey, macKeyName)
+	if err != nil {
+		return err
 	}
+	return meta.Put(macKeyName, wrapped)
 }
 
 func (bpt *BPlusTree) Close() error {
+	if bpt.tree.NoSync {
+		if err := bpt.tree.Sync(); err != nil {
+			return err
+		}
+	}
 	return bpt.tree.Close()
 }
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"bytes"
+	"container/heap"
 	"github.com/rbongIO/bitcask-go/data"
 	bolt "go.etcd.io/bbolt"
 )
@@ -8,29 +10,66 @@ import (
 type bptreeIterator struct {
 	tx       *bolt.Tx
 	cursor   *bolt.Cursor
-	reverse  bool
+	opts     IteratorOptions
 	curKey   []byte
 	curValue []byte
 }
 
 func (bpt *bptreeIterator) Rewind() {
-	if bpt.reverse {
-		bpt.curKey, bpt.curValue = bpt.cursor.Last()
+	if bpt.opts.Reverse {
+		if len(bpt.opts.UpperBound) == 0 {
+			bpt.curKey, bpt.curValue = bpt.cursor.Last()
+		} else {
+			bpt.seekPrev(bpt.opts.UpperBound, false)
+		}
 	} else {
-		bpt.curKey, bpt.curValue = bpt.cursor.First()
+		bpt.curKey, bpt.curValue = bpt.cursor.Seek(bpt.opts.LowerBound)
 	}
+	bpt.checkBounds()
 }
 
+// Seek 正序遍历时定位到第一个大于等于 key 的位置，逆序遍历时定位到最后一个小于等于 key 的位置
 func (bpt *bptreeIterator) Seek(key []byte) {
-	bpt.curKey, bpt.curValue = bpt.cursor.Seek(key)
+	if bpt.opts.Reverse {
+		if bpt.opts.belowUpper(key) {
+			bpt.seekPrev(key, true)
+		} else {
+			bpt.seekPrev(bpt.opts.UpperBound, false)
+		}
+	} else {
+		if !bpt.opts.aboveLower(key) {
+			key = bpt.opts.LowerBound
+		}
+		bpt.curKey, bpt.curValue = bpt.cursor.Seek(key)
+	}
+	bpt.checkBounds()
+}
+
+// seekPrev 定位到最后一个小于 key 的位置，inclusive 为 true 时包含 key 本身
+func (bpt *bptreeIterator) seekPrev(key []byte, inclusive bool) {
+	k, v := bpt.cursor.Seek(key)
+	if k == nil {
+		k, v = bpt.cursor.Last()
+	} else if c := bytes.Compare(k, key); c > 0 || (c == 0 && !inclusive) {
+		k, v = bpt.cursor.Prev()
+	}
+	bpt.curKey, bpt.curValue = k, v
 }
 
 func (bpt *bptreeIterator) Next() {
-	if bpt.reverse {
+	if bpt.opts.Reverse {
 		bpt.curKey, bpt.curValue = bpt.cursor.Prev()
 	} else {
 		bpt.curKey, bpt.curValue = bpt.cursor.Next()
 	}
+	bpt.checkBounds()
+}
+
+// checkBounds 超出遍历范围时迭代器失效
+func (bpt *bptreeIterator) checkBounds() {
+	if bpt.curKey != nil && (!bpt.opts.aboveLower(bpt.curKey) || !bpt.opts.belowUpper(bpt.curKey)) {
+		bpt.curKey, bpt.curValue = nil, nil
+	}
 }
 
 func (bpt *bptreeIterator) Valid() bool {
@@ -49,16 +88,150 @@ func (bpt *bptreeIterator) Close() {
 	_ = bpt.tx.Rollback()
 }
 
-func newBptreeIterator(tree *bolt.DB, reverse bool) *bptreeIterator {
+func newBptreeIterator(tree *bolt.DB, opts IteratorOptions) *bptreeIterator {
 	tx, err := tree.Begin(false)
 	if err != nil {
 		panic("failed to begin a transaction")
 	}
 	bptC := &bptreeIterator{
-		tx:      tx,
-		cursor:  tx.Bucket(indexBucketName).Cursor(),
-		reverse: reverse,
+		tx:     tx,
+		cursor: tx.Bucket(indexBucketName).Cursor(),
+		opts:   opts,
 	}
 	bptC.Rewind()
 	return bptC
 }
+
+// encryptedBptreeIteratorBatch 加密的 B+ 树索引迭代器第一批读取的 key 的数量
+const encryptedBptreeIteratorBatch = 64
+
+// encryptedBptreeIterator 加密的 B+ 树索引迭代器
+// bolt 中的 key 是原始 key 的 HMAC，顺序和原始 key 无关，迭代器在只读事务中按批读取：
+// 每一批遍历一次 bucket 并逐个解密，只保留当前位置之后范围内按遍历顺序最靠前的一批 key，
+// 每一批的数量是上一批的 4 倍，只遍历少量 key 时只占用一批的内存，完整遍历也只需要 O(log n) 次扫描
+type encryptedBptreeIterator struct {
+	bpt       *BPlusTree
+	tx        *bolt.Tx
+	opts      IteratorOptions
+	items     []*Item // 当前批次中的 key，按照遍历顺序排列
+	index     int     // 当前位置在 items 中的下标
+	batch     int     // 当前批次最多读取的 key 的数量
+	start     []byte  // 当前批次的起始位置，为空表示从范围的一端开始
+	inclusive bool    // 当前批次是否包含 start 本身
+	last      bool    // 当前批次之后范围内没有其他 key
+}
+
+func newEncryptedBptreeIterator(bpt *BPlusTree, opts IteratorOptions) *encryptedBptreeIterator {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		panic("failed to begin a transaction")
+	}
+	it := &encryptedBptreeIterator{bpt: bpt, tx: tx, opts: opts}
+	it.Rewind()
+	return it
+}
+
+func (it *encryptedBptreeIterator) Rewind() {
+	it.start, it.inclusive = nil, false
+	it.batch = encryptedBptreeIteratorBatch
+	it.load()
+}
+
+// Seek 正序遍历时定位到第一个大于等于 key 的位置，逆序遍历时定位到最后一个小于等于 key 的位置
+func (it *encryptedBptreeIterator) Seek(key []byte) {
+	it.start, it.inclusive = key, true
+	it.batch = encryptedBptreeIteratorBatch
+	it.load()
+}
+
+func (it *encryptedBptreeIterator) Next() {
+	if it.index >= len(it.items) {
+		return
+	}
+	it.index++
+	if it.index == len(it.items) && !it.last {
+		it.start, it.inclusive = it.items[it.index-1].key, false
+		it.batch *= 4
+		it.load()
+	}
+}
+
+// before 判断按照遍历顺序 a 是否在 b 之前
+func (it *encryptedBptreeIterator) before(a, b []byte) bool {
+	if it.opts.Reverse {
+		return bytes.Compare(a, b) > 0
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// afterStart 判断 key 是否在当前批次的起始位置之后
+func (it *encryptedBptreeIterator) afterStart(key []byte) bool {
+	if it.start == nil {
+		return true
+	}
+	if it.inclusive && bytes.Equal(key, it.start) {
+		return true
+	}
+	return it.before(it.start, key)
+}
+
+// load 遍历 bucket 读取下一批 key，堆顶是已经读取的 key 中按遍历顺序最靠后的
+func (it *encryptedBptreeIterator) load() {
+	h := &itemHeap{before: it.before}
+	total := 0
+	if err := it.tx.Bucket(indexBucketName).ForEach(func(k, v []byte) error {
+		key, pos := it.bpt.decodeItem(k, v)
+		if !it.opts.aboveLower(key) || !it.opts.belowUpper(key) || !it.afterStart(key) {
+			return nil
+		}
+		total++
+		if h.Len() < it.batch {
+			heap.Push(h, &Item{key: key, pos: pos})
+		} else if it.before(key, h.items[0].key) {
+			h.items[0] = &Item{key: key, pos: pos}
+			heap.Fix(h, 0)
+		}
+		return nil
+	}); err != nil {
+		panic("failed to iterate bptree")
+	}
+	it.items = make([]*Item, h.Len())
+	for i := len(it.items) - 1; i >= 0; i-- {
+		it.items[i] = heap.Pop(h).(*Item)
+	}
+	it.index = 0
+	it.last = total <= it.batch
+}
+
+func (it *encryptedBptreeIterator) Valid() bool {
+	return it.index < len(it.items)
+}
+
+func (it *encryptedBptreeIterator) Key() []byte {
+	return it.items[it.index].key
+}
+
+func (it *encryptedBptreeIterator) Value() *data.LogRecordPos {
+	return it.items[it.index].pos
+}
+
+func (it *encryptedBptreeIterator) Close() {
+	_ = it.tx.Rollback()
+	it.items = nil
+}
+
+// itemHeap 按照遍历顺序最靠后的元素在堆顶
+type itemHeap struct {
+	items  []*Item
+	before func(a, b []byte) bool
+}
+
+func (h *itemHeap) Len() int           { return len(h.items) }
+func (h *itemHeap) Less(i, j int) bool { return h.before(h.items[j].key, h.items[i].key) }
+func (h *itemHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *itemHeap) Push(x any)         { h.items = append(h.items, x.(*Item)) }
+func (h *itemHeap) Pop() any {
+	item := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return item
+}
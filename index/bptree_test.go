@@ -1,6 +1,7 @@
 package index
 
 import (
+	"fmt"
 	"github.com/rbongIO/bitcask-go/data"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -144,3 +145,86 @@ func TestBPlusTree_Iterator(t *testing.T) {
 	it.Close()
 	t.Log("reverse")
 }
+
+func TestBPlusTree_ApplyMerge(t *testing.T) {
+	tree := NewBPlusTree(os.TempDir(), false)
+	defer func() {
+		tree.Close()
+		os.Remove(filepath.Join(os.TempDir(), bptreeIndexFileName))
+	}()
+	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 100, Size: 10})
+	tree.Put([]byte("def"), &data.LogRecordPos{Fid: 2, Offset: 200, Size: 20})
+	tree.Put([]byte("hij"), &data.LogRecordPos{Fid: 5, Offset: 300, Size: 30})
+
+	positions := map[string]*data.LogRecordPos{
+		"abc": {Fid: 0, Offset: 0, Size: 10},
+		"hij": {Fid: 0, Offset: 10, Size: 30},
+	}
+	removed, err := tree.ApplyMerge(3, positions)
+	assert.Nil(t, err)
+	assert.Equal(t, []*data.LogRecordPos{{Fid: 2, Offset: 200, Size: 20}}, removed)
+	assert.Equal(t, positions["abc"], tree.Get([]byte("abc")))
+	assert.Nil(t, tree.Get([]byte("def")))
+	// merge 之后写入的 key 不受影响
+	assert.Equal(t, &data.LogRecordPos{Fid: 5, Offset: 300, Size: 30}, tree.Get([]byte("hij")))
+
+	// 重复执行结果相同
+	removed, err = tree.ApplyMerge(3, positions)
+	assert.Nil(t, err)
+	assert.Empty(t, removed)
+	assert.Equal(t, positions["abc"], tree.Get([]byte("abc")))
+}
+
+// 只有 syncWrite 为 true 时 bolt 才在每次提交事务时 fsync
+func TestNewBPlusTree_SyncWrite(t *testing.T) {
+	dir := t.TempDir()
+	tree := NewBPlusTree(dir, true)
+	assert.False(t, tree.tree.NoSync)
+	assert.Nil(t, tree.Close())
+
+	tree = NewBPlusTree(dir, false)
+	assert.True(t, tree.tree.NoSync)
+	// 关闭之前 fsync，之前写入的数据重新打开之后依然存在
+	tree.Put([]byte("abc"), &data.LogRecordPos{Fid: 1, Offset: 100})
+	assert.Nil(t, tree.Close())
+	tree = NewBPlusTree(dir, false)
+	defer tree.Close()
+	assert.Equal(t, &data.LogRecordPos{Fid: 1, Offset: 100}, tree.Get([]byte("abc")))
+}
+
+func TestBPlusTree_EncryptedIterator(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-bptree-encrypted")
+	defer os.RemoveAll(dir)
+	c, err := data.NewCipher([]byte("0123456789abcdef"))
+	assert.Nil(t, err)
+	tree, err := OpenBPlusTree(dir, false, c)
+	assert.Nil(t, err)
+	defer tree.Close()
+	bt := NewBTree()
+	// key 的数量超过前两批，遍历时需要读取多批
+	for i := 0; i < 500; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		tree.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		bt.Put(key, &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+	}
+
+	for _, opts := range []IteratorOptions{
+		{},
+		{Reverse: true},
+		{LowerBound: []byte("key-0100"), UpperBound: []byte("key-0110")},
+		{LowerBound: []byte("key-0100"), UpperBound: []byte("key-0400"), Reverse: true},
+	} {
+		it, want := tree.RangeIterator(opts), bt.RangeIterator(opts)
+		assert.Equal(t, iteratorKeys(want), iteratorKeys(it), opts)
+		want.Seek([]byte("key-0205"))
+		it.Seek([]byte("key-0205"))
+		assert.Equal(t, iteratorKeys(want), iteratorKeys(it), opts)
+		it.Rewind()
+		want.Rewind()
+		if want.Valid() {
+			assert.Equal(t, want.Value(), it.Value(), opts)
+		}
+		it.Close()
+		want.Close()
+	}
+}
@@ -36,7 +36,9 @@ func (bt *BTree) Put(key []byte, pos *data.LogRecordPos) *data.LogRecordPos {
 
 func (bt *BTree) Get(key []byte) *data.LogRecordPos {
 	it := &Item{key: key}
+	bt.lock.RLock()
 	btreeItem := bt.tree.Get(it)
+	bt.lock.RUnlock()
 	if btreeItem == nil {
 		return nil
 	}
@@ -56,18 +58,37 @@ func (bt *BTree) Delete(key []byte) (*data.LogRecordPos, bool) {
 }
 
 func (bt *BTree) Iterator(reverse bool) Iterator {
+	return bt.RangeIterator(IteratorOptions{Reverse: reverse})
+}
+
+// RangeIterator 遍历 btree 的写时复制副本，创建迭代器的开销和索引大小无关，也不会阻塞之后的写入
+func (bt *BTree) RangeIterator(opts IteratorOptions) Iterator {
 	if bt.tree == nil {
 		return nil
 	}
-	bt.lock.RLock()
-	defer bt.lock.RUnlock()
-	return NewBTreeIterator(bt.tree, reverse)
+	// Clone 会修改原来的 btree，需要持有写锁
+	bt.lock.Lock()
+	tree := bt.tree.Clone()
+	bt.lock.Unlock()
+	return NewBTreeIterator(tree, opts)
 }
 
 func (bt *BTree) Size() int64 {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return int64(bt.tree.Len())
 }
 
 func (bt *BTree) Close() error {
 	return nil
 }
+
+// Snapshot 利用 btree 的写时复制，快速得到当前索引的副本
+func (bt *BTree) Snapshot() Indexer {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTree{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
@@ -4,56 +4,97 @@ import (
 	"bytes"
 	"github.com/google/btree"
 	"github.com/rbongIO/bitcask-go/data"
-	"sort"
 )
 
+// btreeIteratorBatchSize 迭代器每次从 btree 中读取的元素数量
+const btreeIteratorBatchSize = 64
+
 // BTreeIterator BTree 索引迭代器
+// 遍历的是创建迭代器时 btree 的写时复制副本，每次只读取一批元素，之后对索引的修改不会影响迭代器
 type BTreeIterator struct {
-	curIndex int     // 当前遍历的下标位置
-	reverse  bool    // 是否逆序遍历
-	values   []*Item // 存储所有的 key和索引信息
+	tree      *btree.BTree // 创建迭代器时的 btree 副本
+	opts      IteratorOptions
+	curIndex  int     // 当前遍历的下标位置
+	values    []*Item // 当前批次的 key 和索引信息
+	exhausted bool    // 当前批次之后是否还有元素
 }
 
-func NewBTreeIterator(tree *btree.BTree, reverse bool) *BTreeIterator {
-	var idx int
-	values := make([]*Item, tree.Len())
-	// getValues 用于遍历 btree 中的所有元素，并将其存储到 values 中
-	getValues := func(it btree.Item) bool {
-		values[idx] = it.(*Item)
-		idx++
-		return true
-	}
-	if reverse {
-		tree.Descend(getValues)
-	} else {
-		tree.Ascend(getValues)
-	}
-
-	return &BTreeIterator{
-		curIndex: 0,
-		values:   values,
-		reverse:  reverse,
+// NewBTreeIterator 创建 BTree 的迭代器，tree 在迭代器关闭之前不能被修改
+func NewBTreeIterator(tree *btree.BTree, opts IteratorOptions) *BTreeIterator {
+	bti := &BTreeIterator{
+		tree:   tree,
+		opts:   opts,
+		values: make([]*Item, 0, btreeIteratorBatchSize),
 	}
+	bti.Rewind()
+	return bti
 }
 
 func (bti *BTreeIterator) Rewind() {
-	bti.curIndex = 0
+	if bti.opts.Reverse {
+		if len(bti.opts.UpperBound) == 0 {
+			bti.load(nil, true)
+		} else {
+			bti.load(bti.opts.UpperBound, false)
+		}
+		return
+	}
+	bti.load(bti.opts.LowerBound, true)
 }
 
+// Seek 正序遍历时定位到第一个大于等于 key 的位置，逆序遍历时定位到最后一个小于等于 key 的位置
 func (bti *BTreeIterator) Seek(key []byte) {
-	if bti.reverse {
-		bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-			return bytes.Compare(bti.values[i].key, key) <= 0
-		})
+	if bti.opts.Reverse {
+		if bti.opts.belowUpper(key) {
+			bti.load(key, true)
+		} else {
+			bti.Rewind()
+		}
 		return
 	}
-	bti.curIndex = sort.Search(len(bti.values), func(i int) bool {
-		return bytes.Compare(bti.values[i].key, key) >= 0
-	})
+	if !bti.opts.aboveLower(key) {
+		key = bti.opts.LowerBound
+	}
+	bti.load(key, true)
 }
 
 func (bti *BTreeIterator) Next() {
 	bti.curIndex++
+	if bti.curIndex == len(bti.values) && !bti.exhausted {
+		bti.load(bti.values[len(bti.values)-1].key, false)
+	}
+}
+
+// load 从 from 开始读取下一批元素，inclusive 表示是否包含 from 本身
+// 逆序遍历时 from 为空表示从最大的 key 开始
+func (bti *BTreeIterator) load(from []byte, inclusive bool) {
+	bti.values = bti.values[:0]
+	bti.curIndex = 0
+	bti.exhausted = true
+	visit := func(it btree.Item) bool {
+		item := it.(*Item)
+		if !inclusive && bytes.Equal(item.key, from) {
+			return true
+		}
+		// 从范围内的位置开始遍历，超出范围说明已经到达了另一端
+		if !bti.opts.aboveLower(item.key) || !bti.opts.belowUpper(item.key) {
+			return false
+		}
+		if len(bti.values) == btreeIteratorBatchSize {
+			bti.exhausted = false
+			return false
+		}
+		bti.values = append(bti.values, item)
+		return true
+	}
+	switch {
+	case !bti.opts.Reverse:
+		bti.tree.AscendGreaterOrEqual(&Item{key: from}, visit)
+	case from == nil:
+		bti.tree.Descend(visit)
+	default:
+		bti.tree.DescendLessOrEqual(&Item{key: from}, visit)
+	}
 }
 
 func (bti *BTreeIterator) Valid() bool {
@@ -69,5 +110,6 @@ func (bti *BTreeIterator) Value() *data.LogRecordPos {
 }
 
 func (bti *BTreeIterator) Close() {
+	bti.tree = nil
 	bti.values = nil
 }
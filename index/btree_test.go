@@ -101,7 +101,7 @@ func TestBTree_Get(t *testing.T) {
 func TestBTree_Delete(t *testing.T) {
 	bt := NewBTree()
 	putToBtree(bt)
-	pos := bt.Put(nil, &data.LogRecordPos{1, 100})
+	pos := bt.Put(nil, &data.LogRecordPos{Fid: 1, Offset: 100})
 	assert.Nil(t, pos)
 	logRec := bt.Get(nil)
 	t.Log(logRec)
@@ -109,3 +109,17 @@ func TestBTree_Delete(t *testing.T) {
 	assert.NotNil(t, pos)
 	assert.True(t, ok)
 }
+
+func TestBTree_Snapshot(t *testing.T) {
+	bt := NewBTree()
+	putToBtree(bt)
+	snap := bt.Snapshot()
+	assert.Equal(t, bt.Size(), snap.Size())
+
+	// 快照之后的修改不影响快照
+	bt.Put([]byte("abc"), &data.LogRecordPos{Fid: 9, Offset: 90})
+	bt.Put([]byte("new-key"), &data.LogRecordPos{Fid: 9, Offset: 100})
+	assert.Equal(t, bt.Size()-1, snap.Size())
+	assert.Nil(t, snap.Get([]byte("new-key")))
+	assert.NotEqual(t, uint32(9), snap.Get([]byte("abc")).Fid)
+}
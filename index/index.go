@@ -25,8 +25,12 @@ type Indexer interface {
 	Delete(key []byte) (*data.LogRecordPos, bool)
 
 	Iterator(reverse bool) Iterator
+	// RangeIterator 返回只遍历 [LowerBound, UpperBound) 范围内的 key 的迭代器
+	RangeIterator(opts IteratorOptions) Iterator
 	Size() int64
 	Close() error
+	// Snapshot 返回当前索引的只读副本，之后对索引的修改不会影响该副本
+	Snapshot() Indexer
 }
 
 type Item struct {
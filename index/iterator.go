@@ -1,6 +1,9 @@
 package index
 
-import "github.com/rbongIO/bitcask-go/data"
+import (
+	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
+)
 
 // Iterator 索引迭代器接口
 type Iterator interface {
@@ -19,3 +22,23 @@ type Iterator interface {
 	// Close 关闭迭代器，释放相应资源
 	Close()
 }
+
+// IteratorOptions 索引迭代器的配置项
+type IteratorOptions struct {
+	// Reverse 是否逆序遍历
+	Reverse bool
+	// LowerBound 遍历范围的下界（包含），为空表示没有下界
+	LowerBound []byte
+	// UpperBound 遍历范围的上界（不包含），为空表示没有上界
+	UpperBound []byte
+}
+
+// aboveLower 判断 key 是否不小于下界
+func (o IteratorOptions) aboveLower(key []byte) bool {
+	return bytes.Compare(key, o.LowerBound) >= 0
+}
+
+// belowUpper 判断 key 是否小于上界
+func (o IteratorOptions) belowUpper(key []byte) bool {
+	return len(o.UpperBound) == 0 || bytes.Compare(key, o.UpperBound) < 0
+}
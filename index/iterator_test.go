@@ -0,0 +1,216 @@
+package index
+
+import (
+	"fmt"
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func iteratorKeys(it Iterator) []string {
+	var keys []string
+	for ; it.Valid(); it.Next() {
+		keys = append(keys, string(it.Key()))
+	}
+	return keys
+}
+
+func TestRangeIterator(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-range-iterator")
+	defer os.RemoveAll(dir)
+	indexers := map[string]Indexer{
+		"btree":  NewBTree(),
+		"art":    NewAdaptiveRadixTree(),
+		"bptree": NewBPlusTree(dir, false),
+	}
+	for name, indexer := range indexers {
+		for i, key := range []string{"a", "b", "ba", "bb", "bc", "c", "ca", "d"} {
+			indexer.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		rangeKeys := func(opts IteratorOptions) []string {
+			it := indexer.RangeIterator(opts)
+			defer it.Close()
+			return iteratorKeys(it)
+		}
+		lower, upper := []byte("b"), []byte("c")
+		assert.Equal(t, []string{"b", "ba", "bb", "bc"}, rangeKeys(IteratorOptions{LowerBound: lower, UpperBound: upper}), name)
+		assert.Equal(t, []string{"bc", "bb", "ba", "b"}, rangeKeys(IteratorOptions{LowerBound: lower, UpperBound: upper, Reverse: true}), name)
+		assert.Equal(t, []string{"ba", "bb", "bc", "c", "ca", "d"}, rangeKeys(IteratorOptions{LowerBound: []byte("b0")}), name)
+		assert.Equal(t, []string{"d", "ca", "c", "bc", "bb", "ba"}, rangeKeys(IteratorOptions{LowerBound: []byte("b0"), Reverse: true}), name)
+		assert.Equal(t, []string{"a", "b", "ba"}, rangeKeys(IteratorOptions{UpperBound: []byte("bb")}), name)
+		assert.Equal(t, []string{"ba", "b", "a"}, rangeKeys(IteratorOptions{UpperBound: []byte("bb"), Reverse: true}), name)
+		assert.Empty(t, rangeKeys(IteratorOptions{LowerBound: upper, UpperBound: lower}), name)
+		assert.Empty(t, rangeKeys(IteratorOptions{LowerBound: upper, UpperBound: lower, Reverse: true}), name)
+
+		// Seek 不会超出遍历范围
+		it := indexer.RangeIterator(IteratorOptions{LowerBound: lower, UpperBound: upper})
+		it.Seek([]byte("a"))
+		assert.Equal(t, "b", string(it.Key()), name)
+		it.Seek([]byte("bb"))
+		assert.Equal(t, "bb", string(it.Key()), name)
+		it.Seek([]byte("bz"))
+		assert.False(t, it.Valid(), name)
+		it.Rewind()
+		assert.Equal(t, "b", string(it.Key()), name)
+		it.Close()
+
+		it = indexer.RangeIterator(IteratorOptions{LowerBound: lower, UpperBound: upper, Reverse: true})
+		it.Seek([]byte("z"))
+		assert.Equal(t, "bc", string(it.Key()), name)
+		it.Seek([]byte("bb0"))
+		assert.Equal(t, "bb", string(it.Key()), name)
+		it.Seek([]byte("a"))
+		assert.False(t, it.Valid(), name)
+		it.Rewind()
+		assert.Equal(t, "bc", string(it.Key()), name)
+		it.Close()
+
+		// 没有范围时逆序 Seek 定位到最后一个小于等于 key 的位置
+		it = indexer.Iterator(true)
+		it.Seek([]byte("bb0"))
+		assert.Equal(t, []string{"bb", "ba", "b", "a"}, iteratorKeys(it), name)
+		it.Close()
+		assert.Nil(t, indexer.Close())
+	}
+}
+
+func TestIterator_Consistent(t *testing.T) {
+	indexers := map[string]Indexer{
+		"btree": NewBTree(),
+		"art":   NewAdaptiveRadixTree(),
+	}
+	for name, indexer := range indexers {
+		// 超过 btree 迭代器一个批次的数量
+		var want []string
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("key-%04d", i)
+			want = append(want, key)
+			indexer.Put([]byte(key), &data.LogRecordPos{Fid: 1, Offset: int64(i)})
+		}
+		it := indexer.Iterator(false)
+		rit := indexer.Iterator(true)
+
+		// 创建迭代器之后的写入不影响迭代器
+		for i := 0; i < 200; i += 2 {
+			indexer.Delete([]byte(fmt.Sprintf("key-%04d", i)))
+		}
+		for i := 200; i < 300; i++ {
+			indexer.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 2})
+		}
+		assert.Equal(t, int64(200), indexer.Size(), name)
+
+		assert.Equal(t, want, iteratorKeys(it), name)
+		it.Seek([]byte("key-0150"))
+		assert.Equal(t, want[150:], iteratorKeys(it), name)
+		it.Seek([]byte("key-0010"))
+		assert.Equal(t, int64(10), it.Value().Offset, name)
+		it.Close()
+
+		var reversed []string
+		for i := len(want) - 1; i >= 0; i-- {
+			reversed = append(reversed, want[i])
+		}
+		assert.Equal(t, reversed, iteratorKeys(rit), name)
+		rit.Seek([]byte("key-0100"))
+		assert.Equal(t, reversed[99:], iteratorKeys(rit), name)
+		rit.Close()
+
+		it = indexer.Iterator(false)
+		assert.Equal(t, "key-0001", string(it.Key()), name)
+		it.Close()
+	}
+}
+
+func TestAdaptiveRadixTree_CopyOnWrite(t *testing.T) {
+	art := NewAdaptiveRadixTree()
+	for i := 0; i < 100; i++ {
+		art.Put([]byte(fmt.Sprintf("key-%04d", i)), &data.LogRecordPos{Fid: 1})
+	}
+	gen := art.gen
+
+	// 没有迭代器引用时直接修改当前版本
+	art.Put([]byte("key-0100"), &data.LogRecordPos{Fid: 1})
+	assert.Equal(t, gen, art.gen)
+
+	// 迭代器引用期间的写入切换到新的版本，只拷贝修改的路径
+	it := art.Iterator(false)
+	root := art.root
+	art.Put([]byte("key-0101"), &data.LogRecordPos{Fid: 1})
+	assert.NotEqual(t, gen, art.gen)
+	assert.NotSame(t, root, art.root)
+	assert.Equal(t, 101, len(iteratorKeys(it)))
+	copied, shared := 0, 0
+	var count func(n *artNode)
+	count = func(n *artNode) {
+		if n.gen == art.gen {
+			copied++
+		} else {
+			shared++
+		}
+		for pos, child := n.nextChild(0); child != nil; pos, child = n.nextChild(pos + 1) {
+			count(child)
+		}
+	}
+	count(art.root)
+	assert.LessOrEqual(t, copied, 4)
+	assert.Greater(t, shared, 10)
+	it.Close()
+	it.Close()
+
+	// 删除不存在的 key 不需要拷贝
+	gen = art.gen
+	it = art.Iterator(false)
+	_, ok := art.Delete([]byte("d"))
+	assert.False(t, ok)
+	assert.Equal(t, gen, art.gen)
+	it.Close()
+	art.Put([]byte("d"), &data.LogRecordPos{Fid: 1})
+	assert.Equal(t, gen, art.gen)
+	assert.Equal(t, int64(103), art.Size())
+
+	// 快照释放之后不再引用当前版本
+	snap := art.Snapshot()
+	art.Put([]byte("e"), &data.LogRecordPos{Fid: 1})
+	assert.NotEqual(t, gen, art.gen)
+	assert.Nil(t, snap.Get([]byte("e")))
+	assert.Nil(t, snap.Close())
+	gen = art.gen
+	art.Put([]byte("f"), &data.LogRecordPos{Fid: 1})
+	assert.Equal(t, gen, art.gen)
+}
+
+func TestAdaptiveRadixTree_RangeIteratorRandom(t *testing.T) {
+	art := NewAdaptiveRadixTree()
+	bt := NewBTree()
+	rnd := rand.New(rand.NewSource(1))
+	randomKey := func() []byte {
+		key := make([]byte, rnd.Intn(4))
+		for i := range key {
+			key[i] = byte('a' + rnd.Intn(20))
+		}
+		return key
+	}
+	for i := 0; i < 2000; i++ {
+		key := randomKey()
+		if len(key) == 0 {
+			continue
+		}
+		art.Put(key, &data.LogRecordPos{Fid: uint32(i)})
+		bt.Put(key, &data.LogRecordPos{Fid: uint32(i)})
+	}
+
+	// 上下界和 Seek 的位置不一定存在，也可能是其他 key 的前缀
+	for i := 0; i < 500; i++ {
+		opts := IteratorOptions{Reverse: rnd.Intn(2) == 0, LowerBound: randomKey(), UpperBound: randomKey()}
+		it, want := art.RangeIterator(opts), bt.RangeIterator(opts)
+		assert.Equal(t, iteratorKeys(want), iteratorKeys(it), opts)
+		seek := randomKey()
+		it.Seek(seek)
+		want.Seek(seek)
+		assert.Equal(t, iteratorKeys(want), iteratorKeys(it), opts, string(seek))
+		it.Close()
+		want.Close()
+	}
+}
@@ -2,12 +2,16 @@ package bitcask_go
 
 import (
 	"bytes"
+	"github.com/rbongIO/bitcask-go/data"
 	"github.com/rbongIO/bitcask-go/index"
+	"time"
 )
 
 type Iterator struct {
 	indexIter index.Iterator
 	db        *DB
+	snapshot  *Snapshot                 // 不为空时表示快照的迭代器
+	files     map[uint32]*data.DataFile // 创建迭代器时引用的数据文件，merge 或者快照释放之后依然可以读取
 	options   IteratorOptions
 }
 
@@ -17,16 +21,16 @@ func (db *DB) NewIterator(opts ...IteratorOption) *Iterator {
 	for _, opt := range opts {
 		opt(&options)
 	}
+	db.lockSynced(true)
 	it := &Iterator{
-		indexIter: db.index.Iterator(options.Reverse),
+		indexIter: db.index.RangeIterator(options.indexOptions()),
 		db:        db,
+		files:     db.pinFiles(),
 		options:   options,
 	}
+	db.mu.Unlock()
 
-	if options.Prefix != nil {
-		it.skipToNext()
-	}
-
+	it.skipToNext()
 	return it
 
 }
@@ -54,27 +58,49 @@ func (it *Iterator) Key() []byte {
 	return it.indexIter.Key()
 }
 
+// Value 读取当前 key 对应的数据
+// 迭代器引用的数据文件在 Close 之前不会被关闭，数据文件又是追加写入的，读取时不需要持有锁
 func (it *Iterator) Value() []byte {
 	pos := it.indexIter.Value()
-	it.db.mu.RLock()
-	defer it.db.mu.RUnlock()
-	val, _ := it.db.GetValueByPosition(pos)
+	val, _ := getValueFromDataFile(filesByID(it.files), pos)
 	return val
-
 }
 
 func (it *Iterator) Close() {
 	it.indexIter.Close()
+	if it.files != nil {
+		it.db.mu.Lock()
+		it.db.unpinFiles(it.files)
+		it.db.mu.Unlock()
+		it.files = nil
+	}
 }
 
+// skipToNext 跳过已经过期的 key，前缀和上下界由索引迭代器保证
 func (it *Iterator) skipToNext() {
-	if len(it.options.Prefix) == 0 {
-		return
+	now := time.Now().UnixNano()
+	if it.snapshot != nil {
+		now = it.snapshot.ts
 	}
-	for it.Valid() {
-		if bytes.HasPrefix(it.Key(), it.options.Prefix) {
-			break
+	for ; it.indexIter.Valid(); it.indexIter.Next() {
+		if it.indexIter.Value().IsExpired(now) {
+			continue
+		}
+		break
+	}
+}
+
+// indexOptions 将前缀和上下界转换为索引迭代器的遍历范围，前缀对应的范围和上下界取交集
+func (o IteratorOptions) indexOptions() index.IteratorOptions {
+	lower, upper := o.LowerBound, o.UpperBound
+	if len(o.Prefix) != 0 {
+		start, end := prefixRange(o.Prefix)
+		if bytes.Compare(start, lower) > 0 {
+			lower = start
+		}
+		if len(end) != 0 && (len(upper) == 0 || bytes.Compare(end, upper) < 0) {
+			upper = end
 		}
-		it.Next()
 	}
+	return index.IteratorOptions{Reverse: o.Reverse, LowerBound: lower, UpperBound: upper}
 }
@@ -27,3 +27,40 @@ func TestDB_NewIterator(t *testing.T) {
 		it2.Next()
 	}
 }
+
+func TestDB_IteratorBounds(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-iterator-bounds")
+		db, err := Open(WithDirPath(dir), WithIndexType(indexType))
+		assert.Nil(t, err)
+		for _, key := range []string{"a/1", "a/2", "b/1", "b/2", "b/3", "c/1"} {
+			assert.Nil(t, db.Put([]byte(key), []byte(key)))
+		}
+		keys := func(it *Iterator) []string {
+			defer it.Close()
+			var keys []string
+			for ; it.Valid(); it.Next() {
+				assert.Equal(t, it.Key(), it.Value())
+				keys = append(keys, string(it.Key()))
+			}
+			return keys
+		}
+		assert.Equal(t, []string{"a/2", "b/1", "b/2"}, keys(db.NewIterator(WithLowerBound([]byte("a/2")), WithUpperBound([]byte("b/3")))))
+		assert.Equal(t, []string{"b/2", "b/1", "a/2"}, keys(db.NewIterator(WithLowerBound([]byte("a/2")), WithUpperBound([]byte("b/3")), WithReverse(true))))
+		// 逆序遍历前缀时从前缀的末尾开始
+		assert.Equal(t, []string{"b/3", "b/2", "b/1"}, keys(db.NewIterator(WithPrefix([]byte("b/")), WithReverse(true))))
+		// 前缀和上下界取交集
+		assert.Equal(t, []string{"b/2", "b/3"}, keys(db.NewIterator(WithPrefix([]byte("b/")), WithLowerBound([]byte("b/2")), WithUpperBound([]byte("c")))))
+
+		it := db.NewIterator(WithPrefix([]byte("b/")), WithReverse(true))
+		it.Seek([]byte("b/2"))
+		assert.Equal(t, []string{"b/2", "b/1"}, keys(it))
+
+		snap := db.Snapshot()
+		assert.Nil(t, db.Delete([]byte("b/2")))
+		assert.Equal(t, []string{"b/3", "b/2", "b/1"}, keys(snap.NewIterator(WithPrefix([]byte("b/")), WithReverse(true))))
+		assert.Equal(t, []string{"b/3", "b/1"}, keys(db.NewIterator(WithPrefix([]byte("b/")), WithReverse(true))))
+		snap.Release()
+		destroyDB(db)
+	}
+}
@@ -0,0 +1,127 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// loadedFile 一个数据文件中按顺序读取到的所有记录，不包含 value
+// 多个数据文件由工作协程并发读取，再按照文件的顺序回放到内存索引中
+type loadedFile struct {
+	dataFile *data.DataFile
+	entries  []*data.FileHintEntry
+	offset   int64 // 读取结束的位置
+	fromHint bool  // 是否是从 hint 文件中读取的
+	err      error // 读取结束的原因，io.EOF 或者记录损坏时由 recoverDataFile 处理
+}
+
+// loadWorkers 返回打开数据库时并发读取数据文件的协程数量
+func (db *DB) loadWorkers() int {
+	if db.options.LoadWorkers > 0 {
+		return db.options.LoadWorkers
+	}
+	return runtime.NumCPU()
+}
+
+// readDataFiles 并发读取 dataFiles 中的记录，并按照文件的顺序依次调用 apply
+// 已经读取但还没有回放的文件数量有上限，避免占用过多内存
+// apply 返回错误时不再读取后面的文件，等待正在读取的协程退出之后返回该错误
+func (db *DB) readDataFiles(dataFiles []*data.DataFile, apply func(lf *loadedFile) error) error {
+	workers := min(db.loadWorkers(), len(dataFiles))
+	results := make([]chan *loadedFile, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *loadedFile, 1)
+	}
+	pending := make(chan struct{}, 2*workers)
+	jobs := make(chan int)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for i := range dataFiles {
+			select {
+			case pending <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// 最后一个文件是活跃文件，需要在回放时更新写入位置，不生成 hint 文件
+				results[i] <- db.readDataFileRecords(dataFiles[i], i == len(dataFiles)-1)
+			}
+		}()
+	}
+
+	for i := range dataFiles {
+		lf := <-results[i]
+		<-pending
+		if err := apply(lf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDataFileRecords 读取数据文件中的所有记录，有可以使用的 hint 文件时直接读取 hint 文件
+// 完整读取的旧数据文件补充生成 hint 文件，下次打开时可以直接使用
+func (db *DB) readDataFileRecords(dataFile *data.DataFile, isActive bool) *loadedFile {
+	if hint := db.readFileHint(dataFile); hint != nil {
+		return &loadedFile{dataFile: dataFile, entries: hint.Entries, offset: hint.DataSize, fromHint: true}
+	}
+	lf := &loadedFile{dataFile: dataFile}
+	for {
+		rec, size, err := dataFile.ReadLogRecordWithSize(lf.offset)
+		if err != nil {
+			lf.err = err
+			break
+		}
+		//构建内存索引并保存
+		logRecPos := &data.LogRecordPos{
+			Fid:    dataFile.FileID,
+			Offset: lf.offset,
+			Size:   uint32(size),
+			Expire: rec.Expire,
+		}
+		// 分块清单的位置信息包含所有分块的大小
+		if rec.Type == data.LogRecordChunkManifest {
+			manifest, err := data.DecodeChunkManifest(rec.Value)
+			if err != nil {
+				lf.err = err
+				break
+			}
+			logRecPos.Chunked = true
+			logRecPos.Size = manifest.ChunkedSize(size)
+		}
+		// key 引用了读取的 value，需要拷贝之后再保存，范围删除记录的 value 是范围的结束 key，其余记录不需要 value
+		entry := &data.FileHintEntry{Key: append([]byte(nil), rec.Key...), Type: rec.Type, Pos: logRecPos}
+		if rec.Type == data.LogRecordRangeDeleted {
+			entry.Value = append([]byte(nil), rec.Value...)
+		}
+		lf.entries = append(lf.entries, entry)
+		//更新 offset，继续读取下一个记录
+		lf.offset += size
+	}
+	if !isActive && lf.err == io.EOF {
+		if err := db.writeFileHint(dataFile, lf.offset, lf.entries); err != nil {
+			lf.err = err
+		}
+	}
+	return lf
+}
@@ -0,0 +1,59 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_ParallelLoad(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, ART} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-parallel-load")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(16 * 1024)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		// 同一个 key 在多个文件中被覆盖，事务的记录跨越多个文件
+		for round := 0; round < 5; round++ {
+			for i := 0; i < 200; i++ {
+				assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+			}
+			wb := db.NewWriteBatch(WithMaxBatchNum(1000))
+			for i := 100; i < 400; i++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.GetTestValue(64)))
+			}
+			assert.Nil(t, wb.Delete(utils.GetTestKey(round)))
+			assert.Nil(t, wb.Commit())
+		}
+		assert.Greater(t, len(db.olderFiles), 10)
+		expected := make(map[string][]byte)
+		assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+			expected[string(key)] = value
+			return true
+		}))
+		assert.Nil(t, db.Close())
+
+		// 单个协程从数据文件加载的结果作为基准
+		var reclaimSize int64 = -1
+		for _, workers := range []int{1, 4} {
+			for _, fileHints := range []bool{false, true} {
+				db, err = Open(append(opts, WithLoadWorkers(workers), WithFileHints(fileHints))...)
+				assert.Nil(t, err)
+				assert.Equal(t, len(expected), len(db.ListKeys()))
+				for key, value := range expected {
+					val, err := db.Get([]byte(key))
+					assert.Nil(t, err)
+					assert.Equal(t, value, val)
+				}
+				if reclaimSize < 0 {
+					reclaimSize = db.Stat().ReclaimableSize
+				}
+				assert.Equal(t, reclaimSize, db.Stat().ReclaimableSize)
+				assert.Nil(t, db.Close())
+			}
+		}
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		destroyDB(db)
+	}
+}
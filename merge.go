@@ -2,62 +2,100 @@ package bitcask_go
 
 import (
 	"github.com/rbongIO/bitcask-go/data"
-	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/rbongIO/bitcask-go/index"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	mergeFinishedKey = "MergeFinished"
+	mergedFileNumKey = "MergedFileNum"
 	mergeDirName     = "-merge"
 )
 
+// Merge 清理无效数据，生成 hint 文件
+// 只有轮转活跃文件和最后替换数据文件、更新索引时持有锁，重写数据文件的过程不会阻塞读写
 func (db *DB) Merge() error {
-	//如果数据库为空责直接返回
-	if db.activeFile == nil {
-		return nil
+	mergeFiles, nonMergeFileID, err := db.prepareMerge()
+	if err != nil {
+		return err
 	}
+	defer db.finishMerge()
+
+	mergePath := db.getMergePath()
+	// 如果目录存在，说明发生过 merge，将其删掉
+	if _, err := db.options.FileSystem.Stat(mergePath); err == nil {
+		if err := db.options.FileSystem.RemoveAll(mergePath); err != nil {
+			return err
+		}
+	}
+
+	// 创建 merge 目录
+	if err := db.options.FileSystem.MkdirAll(mergePath); err != nil {
+		return err
+	}
+	droppedKeys, err := db.rewriteMergeFiles(mergePath, mergeFiles, nonMergeFileID)
+	if err != nil {
+		return err
+	}
+	db.mergeStep("rewritten")
+
+	// 替换数据文件并更新内存索引
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.swapMergeFiles(mergePath, mergeFiles, nonMergeFileID, droppedKeys)
+}
+
+// prepareMerge 检查 merge 条件，将当前活跃文件转换为旧文件，并返回所有等待 merge 的文件
+func (db *DB) prepareMerge() ([]*data.DataFile, uint32, error) {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	if db.closed {
+		return nil, 0, ErrDatabaseClosed
+	}
 	//如果正在合并数据文件，则直接返回
 	if db.isMerging {
-		return ErrMergeIsProcessing
+		return nil, 0, ErrMergeIsProcessing
+	}
+	// 上一次 merge 替换文件失败时保留了 merge 目录，重新打开数据库之后才能完成替换
+	if db.mergeUnapplied {
+		return nil, 0, ErrMergeNotApplied
+	}
+	// PutReader 写入的分块在提交清单之前不会被索引引用，merge 会丢弃这些分块
+	if db.chunkWriters > 0 {
+		return nil, 0, ErrChunkedWriteInProgress
 	}
+	// 已经过期的 key 不再参与 merge，其占用的空间计入可回收空间
+	db.removeExpiredKeys()
 	//检查是否达到 merge 条件
-	totalSize, err := utils.DirSize(db.options.DirPath)
+	totalSize, err := db.dirSize()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	if db.options.DataFileMergeRatio > float32(db.reclaimSize)/float32(totalSize) {
-		return ErrMergeRatioUnreached
+	// 还有使用旧密钥加密的数据时需要使用新的密钥重新加密，不检查 merge 条件
+	rotating := len(db.oldKeyFiles) > 0
+	if !rotating && db.options.DataFileMergeRatio > float32(db.reclaimSize)/float32(totalSize) {
+		return nil, 0, ErrMergeRatioUnreached
 	}
 	// 价差剩余空间容量是否容纳产生的 merge 文件
-	availableDiskSpace, err := utils.AvailableSpace()
+	availableDiskSpace, err := db.options.FileSystem.AvailableSpace()
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 	if availableDiskSpace <= uint64(totalSize-db.reclaimSize) {
-		return ErrDiskSpaceNotEnough
+		return nil, 0, ErrDiskSpaceNotEnough
 	}
-	db.isMerging = true
-	defer func() {
-		db.isMerging = false
-	}()
 
-	// 持久化当前活跃文件
-	if err := db.Sync(); err != nil {
-		return err
-	}
-
-	// 将当前活跃文件保存为旧文件
-	db.olderFiles[db.activeFile.FileID] = db.activeFile
-	// 创建新的活跃文件
-	if err := db.setActiveDataFile(); err != nil {
-		return err
+	// 将当前活跃文件保存为旧文件，并创建新的活跃文件
+	if err := db.rotateActiveFile(); err != nil {
+		return nil, 0, err
 	}
 	nonMergeFileID := db.activeFile.FileID
 
@@ -66,35 +104,48 @@ func (db *DB) Merge() error {
 	for _, file := range db.olderFiles {
 		mergeFiles = append(mergeFiles, file)
 	}
-
 	// 对文件进行排序，从小到大
 	sort.Slice(mergeFiles, func(i, j int) bool {
 		return mergeFiles[i].FileID < mergeFiles[j].FileID
 	})
 
-	mergePath := db.getMergePath()
-	// 如果目录存在，说明发生过 merge，将其删掉
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
-			return err
-		}
-	}
+	db.isMerging = true
+	db.mergeWg.Add(1)
+	return mergeFiles, nonMergeFileID, nil
+}
 
-	// 创建 merge 目录
-	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
-		return err
+func (db *DB) finishMerge() {
+	db.mu.Lock()
+	db.isMerging = false
+	db.mu.Unlock()
+	db.mergeWg.Done()
+}
+
+// rewriteMergeFiles 将有效的数据重写到 merge 目录中，并生成 hint 文件和 merge 完成的标识文件
+// 这个过程不持有锁，等待 merge 的文件都是不可变的，返回 merge 过程中过期而被丢弃的 key
+func (db *DB) rewriteMergeFiles(mergePath string, mergeFiles []*data.DataFile, nonMergeFileID uint32) ([][]byte, error) {
+	// 打开一个新的临时 bitcask 实例，只用于写数据文件，不需要持久化的索引
+	// 重写的数据使用当前的压缩算法和密钥，merge 生成的文件的索引记录在 hint-index 中
+	opts := []OptionFunc{WithDirPath(mergePath), WithFileSystem(db.options.FileSystem), WithIndexType(Btree), WithFileHints(false),
+		WithMaxDataFileSize(db.options.MaxDataFileSize), WithSyncWrite(false), WithCompression(db.options.Compression)}
+	if db.options.EncryptionKey != nil {
+		opts = append(opts, WithEncryptionKey(db.options.EncryptionKey))
 	}
-	// 打开一个新的临时 bitcask 实例
-	mergeDB, err := Open(WithDirPath(mergePath), WithIndexType(db.options.IndexType),
-		WithMaxDataFileSize(db.options.MaxDataFileSize), WithSyncWrite(false))
+	mergeDB, err := Open(opts...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer mergeDB.Close()
 	//打开 hint 文件存储索引
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := db.openHintFile(mergePath)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer hintFile.Close()
+	var droppedKeys [][]byte
+	files := make(map[uint32]*data.DataFile, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		files[dataFile.FileID] = dataFile
 	}
 	// 将所有等待 merge 的文件添加到 mergeDB 中，进行重写
 	for _, dataFile := range mergeFiles {
@@ -102,52 +153,225 @@ func (db *DB) Merge() error {
 		for {
 			rec, size, err := dataFile.ReadLogRecordWithSize(offset)
 			if err != nil {
-				if err == io.EOF {
+				// 打开数据库时跳过的损坏数据不会被索引引用，直接忽略
+				if err == io.EOF || (db.options.SkipCorruptedRecords && data.IsCorruptedRecord(err)) {
 					break
 				}
-				return err
+				return nil, err
 			}
 			//解析到实际的 key
 			key, _ := parseLogRecordKey(rec.Key)
 			curPos := db.index.Get(key)
 			//和内存中的索引位置进行比较，如果有效则重写
 			if curPos != nil && curPos.Fid == dataFile.FileID && curPos.Offset == offset {
-				// 清楚事务标记
+				// merge 过程中过期的 key 直接丢弃，替换数据文件时再从索引中删除
+				if curPos.IsExpired(time.Now().UnixNano()) {
+					droppedKeys = append(droppedKeys, key)
+					offset += size
+					continue
+				}
+				// 清楚事务标记，过期时间可能被之后的 Expire 记录修改过，以索引中的为准
 				rec.Key = logRecordKeyWithSeqNum(key, nonTransactionSeqNum)
-				pos, err := mergeDB.appendLogRecord(rec)
+				rec.Expire = curPos.Expire
+				var pos *data.LogRecordPos
+				if rec.Type == data.LogRecordChunkManifest {
+					// 分块存储的数据需要连同所有分块一起重写
+					pos, err = rewriteChunkedRecord(mergeDB, filesByID(files), key, rec)
+				} else {
+					pos, err = mergeDB.appendLogRecord(rec)
+				}
 				if err != nil {
-					return err
+					return nil, err
 				}
 				// 写入位置索引到 hint 文件
 				if err := hintFile.WriteHintRecord(key, pos); err != nil {
-					return err
+					return nil, err
 				}
 			}
 			//读取吓一跳记录
 			offset += size
 		}
 	}
+	// merge 生成的文件会替换 nonMergeFileID 之前的文件，文件 id 不能和之后的文件冲突
+	mergedFileNum := mergeDB.activeFile.FileID + 1
+	if mergedFileNum > nonMergeFileID {
+		return nil, ErrMergeFileOverflow
+	}
 	// sync 保证持久化
 	if err := hintFile.Sync(); err != nil {
-		return err
+		return nil, err
 	}
-	hintFile.Close()
 	if err := mergeDB.Sync(); err != nil {
-		return err
+		return nil, err
 	}
 	// 标识 merge 完成
-	mergeFinFile, err := data.OpenMergeFinishedFile(mergePath)
+	mergeFinFile, err := data.OpenMergeFinishedFile(db.options.FileSystem, mergePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer mergeFinFile.Close()
 	mergeFinRec := &data.LogRecord{Key: []byte(mergeFinishedKey), Value: []byte(strconv.Itoa(int(nonMergeFileID)))}
 	encMergeRec, _ := data.EncodeLogRecord(mergeFinRec)
-	if err := mergeFinFile.Write(encMergeRec); err != nil {
-		return err
+	mergedNumRec := &data.LogRecord{Key: []byte(mergedFileNumKey), Value: []byte(strconv.Itoa(int(mergedFileNum)))}
+	encMergedNumRec, _ := data.EncodeLogRecord(mergedNumRec)
+	if err := mergeFinFile.Write(append(encMergeRec, encMergedNumRec...)); err != nil {
+		return nil, err
 	}
 	if err := mergeFinFile.Sync(); err != nil {
+		return nil, err
+	}
+	return droppedKeys, nil
+}
+
+// swapMergeFiles 将 merge 生成的文件替换到数据目录中，并更新内存中的数据文件和索引
+// 先移动并打开新的数据文件、更新 B+ 树索引，最后再替换内存中的数据文件和索引，
+// 之前的步骤失败时内存中的数据文件和索引保持不变，被覆盖的旧数据文件依然可以通过已经打开的文件读取，
+// merge 目录会被保留，重新打开数据库时继续完成替换
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) swapMergeFiles(mergePath string, mergeFiles []*data.DataFile, nonMergeFileID uint32, droppedKeys [][]byte) error {
+	mergedFileNum, err := db.getMergedFileNum(mergePath)
+	if err != nil {
+		return err
+	}
+	positions, err := db.readMergeHint(mergePath)
+	if err != nil {
+		return err
+	}
+	var mergedSize int64
+	for _, file := range mergeFiles {
+		size, err := file.Size()
+		if err != nil {
+			return err
+		}
+		mergedSize += size
+	}
+	db.mergeUnapplied = true
+	if err := db.renameMergeDataFiles(mergePath); err != nil {
+		return err
+	}
+	db.mergeStep("renamed")
+
+	mergedFiles := make(map[uint32]*data.DataFile, mergedFileNum)
+	closeMergedFiles := func() {
+		for _, dataFile := range mergedFiles {
+			_ = dataFile.Close()
+		}
+	}
+	for fid := uint32(0); fid < mergedFileNum; fid++ {
+		dataFile, err := db.openDataFile(db.options.DirPath, fid, db.olderFileIOType())
+		if err != nil {
+			closeMergedFiles()
+			return err
+		}
+		mergedFiles[fid] = dataFile
+		size, err := dataFile.Size()
+		if err != nil {
+			closeMergedFiles()
+			return err
+		}
+		dataFile.WriteOffset = size
+		mergedSize -= size
+	}
+	// B+ 树索引在一个事务中更新，失败时索引不会有任何改动
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		if err := db.applyMergeIndex(bpt, nonMergeFileID, positions); err != nil {
+			closeMergedFiles()
+			return err
+		}
+		db.mergeStep("index")
+	}
+
+	// 替换内存中的旧数据文件，仍被快照或迭代器引用的文件等释放之后再关闭
+	for _, file := range mergeFiles {
+		delete(db.olderFiles, file.FileID)
+		if db.pinnedFiles[file] == 0 {
+			_ = file.Close()
+		}
+	}
+	for fid, dataFile := range mergedFiles {
+		db.olderFiles[fid] = dataFile
+	}
+	if _, ok := db.index.(*index.BPlusTree); !ok {
+		db.updateIndexFromHint(nonMergeFileID, positions, droppedKeys)
+	}
+	db.remapUnsynced(nonMergeFileID, positions)
+	// merge 回收的空间不再可回收
+	db.reclaimSize = max(db.reclaimSize-mergedSize, 0)
+	// merge 之后的文件都使用当前的密钥加密
+	for fid := range db.oldKeyFiles {
+		if fid < nonMergeFileID {
+			delete(db.oldKeyFiles, fid)
+		}
+	}
+
+	// 内存中的数据文件和索引已经替换完成，之后的步骤失败时重新打开数据库会继续完成
+	if err := db.finishMergeFiles(mergePath, nonMergeFileID, mergedFileNum); err != nil {
 		return err
 	}
+	db.mergeUnapplied = false
+	db.mergeStep("applied")
+	_ = db.options.FileSystem.RemoveAll(mergePath)
+	return nil
+}
+
+// mergeStep 在 merge 替换文件的各个步骤之间调用 mergeCrashHook
+func (db *DB) mergeStep(step string) {
+	if db.mergeCrashHook != nil {
+		db.mergeCrashHook(step)
+	}
+}
+
+// readMergeHint 读取 merge 目录中 hint 文件记录的所有位置
+func (db *DB) readMergeHint(mergePath string) (map[string]*data.LogRecordPos, error) {
+	hintFile, err := db.openHintFile(mergePath)
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.Close()
+	positions := make(map[string]*data.LogRecordPos)
+	var offset int64
+	for {
+		rec, size, err := hintFile.ReadLogRecordWithSize(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		positions[string(rec.Key)] = data.DecodeLogRecordPos(rec.Value)
+		offset += size
+	}
+	return positions, nil
+}
+
+// updateIndexFromHint 根据 hint 文件中的位置更新内存索引
+// merge 期间被重新写入或删除的 key 不在 merge 的文件中，不需要更新，merge 期间修改的过期时间需要保留
+func (db *DB) updateIndexFromHint(nonMergeFileID uint32, positions map[string]*data.LogRecordPos, droppedKeys [][]byte) {
+	for key, pos := range positions {
+		if curPos := db.index.Get([]byte(key)); curPos != nil && curPos.Fid < nonMergeFileID {
+			newPos := *pos
+			newPos.Expire = curPos.Expire
+			db.index.Put([]byte(key), &newPos)
+		}
+	}
+	for _, key := range droppedKeys {
+		if curPos := db.index.Get(key); curPos != nil && curPos.Fid < nonMergeFileID {
+			db.index.Delete(key)
+			db.reclaimSize += int64(curPos.Size)
+		}
+	}
+}
+
+// applyMergeIndex 将 merge 生成的数据文件中的位置写入持久化的 B+ 树索引
+// 必须在移动数据文件之后、移走 hint 文件之前完成，崩溃之后重新打开数据库会再次执行
+func (db *DB) applyMergeIndex(bpt *index.BPlusTree, nonMergeFileID uint32, positions map[string]*data.LogRecordPos) error {
+	removed, err := bpt.ApplyMerge(nonMergeFileID, positions)
+	if err != nil {
+		return err
+	}
+	for _, pos := range removed {
+		db.reclaimSize += int64(pos.Size)
+	}
 	return nil
 }
 
@@ -161,73 +385,127 @@ func (db *DB) getMergePath() string {
 
 func (db *DB) loadMergeFiles() error {
 	mergePath := db.getMergePath()
-	if _, err := os.Stat(mergePath); os.IsNotExist(err) {
+	if _, err := db.options.FileSystem.Stat(mergePath); os.IsNotExist(err) {
 		return nil
 	}
-	defer func() {
-		_ = os.RemoveAll(mergePath)
-	}()
-	dirEntries, err := os.ReadDir(mergePath)
-	if err != nil {
-		return err
-	}
 	// 查找标识 merge 完成的文件，判断 merge 是否有效
-	var mergeFinished bool
-	var mergeFileNames []string
-	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedName {
-			mergeFinished = true
-			continue
-		}
-		if entry.Name() == data.SeqNumFileName {
-			continue
-		}
-		if entry.Name() == fileLockName {
-			continue
-		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
+	// 如果没有标识文件，或者标识文件没有持久化完整，说明 merge 没有完成，直接删除 merge 目录
+	if _, err := db.options.FileSystem.Stat(filepath.Join(mergePath, data.MergeFinishedName)); err != nil {
+		_ = db.options.FileSystem.RemoveAll(mergePath)
+		return nil
 	}
-	// 如果没有标识文件，说明 merge 没有完成，直接返回
-	if !mergeFinished {
+	if _, err := db.getMergedFileNum(mergePath); err != nil {
+		_ = db.options.FileSystem.RemoveAll(mergePath)
 		return nil
 	}
+	// 替换失败时保留 merge 目录，下次打开时继续完成替换
+	if err := db.applyMergeFiles(mergePath); err != nil {
+		return err
+	}
+	_ = db.options.FileSystem.RemoveAll(mergePath)
+	return nil
+}
+
+// applyMergeFiles 打开数据库时将 merge 目录中的文件替换到数据目录中，和 swapMergeFiles 的顺序相同
+// 每一步都可以重复执行，中途崩溃之后重新打开数据库会继续完成替换
+func (db *DB) applyMergeFiles(mergePath string) error {
 	nonMergeFileID, err := db.getNonMergeFileID(mergePath)
 	if err != nil {
 		return err
 	}
-	// 删除就得数据文件
-	var fileID uint32 = 0
-	for ; fileID < nonMergeFileID; fileID++ {
-		fileName := data.GetDataFileName(mergePath, fileID)
-		if _, err := os.Stat(fileName); err == nil {
-			err := os.Remove(fileName)
+	mergedFileNum, err := db.getMergedFileNum(mergePath)
+	if err != nil {
+		return err
+	}
+	if err := db.renameMergeDataFiles(mergePath); err != nil {
+		return err
+	}
+	// B+ 树索引是持久化的，hint 文件被移走说明索引已经更新过
+	if bpt, ok := db.index.(*index.BPlusTree); ok {
+		if _, err := db.options.FileSystem.Stat(filepath.Join(mergePath, data.HintFileName)); err == nil {
+			positions, err := db.readMergeHint(mergePath)
 			if err != nil {
 				return err
 			}
+			if err := db.applyMergeIndex(bpt, nonMergeFileID, positions); err != nil {
+				return err
+			}
 		}
 	}
-	// 将新的数据文件移动过来
-	for _, fileName := range mergeFileNames {
+	return db.finishMergeFiles(mergePath, nonMergeFileID, mergedFileNum)
+}
+
+// renameMergeDataFiles 将 merge 生成的数据文件移动到数据目录中，会覆盖同名的旧数据文件
+func (db *DB) renameMergeDataFiles(mergePath string) error {
+	dirEntries, err := db.options.FileSystem.ReadDir(mergePath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dirEntries {
+		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+			continue
+		}
 		// /tmp/bitcask-merge 00.data 11.data
 		// /tmp/bitcask 00.data 11.data
-		srcPath := filepath.Join(mergePath, fileName)
-		dstPath := filepath.Join(db.options.DirPath, fileName)
-		if err := os.Rename(srcPath, dstPath); err != nil {
+		srcPath := filepath.Join(mergePath, entry.Name())
+		dstPath := filepath.Join(db.options.DirPath, entry.Name())
+		if err := db.options.FileSystem.Rename(srcPath, dstPath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// finishMergeFiles 移动 hint 文件，删除被 merge 的旧文件，最后移动 merge 完成的标识文件
+func (db *DB) finishMergeFiles(mergePath string, nonMergeFileID, mergedFileNum uint32) error {
+	hintPath := filepath.Join(mergePath, data.HintFileName)
+	if _, err := db.options.FileSystem.Stat(hintPath); err == nil {
+		if err := db.options.FileSystem.Rename(hintPath, filepath.Join(db.options.DirPath, data.HintFileName)); err != nil {
+			return err
+		}
+	}
+	// 删除没有被覆盖的旧数据文件，merge 过的文件对应的 hint 文件都已经失效
+	for fileID := uint32(0); fileID < nonMergeFileID; fileID++ {
+		if err := data.RemoveFileHint(db.options.FileSystem, db.options.DirPath, fileID); err != nil {
+			return err
+		}
+		if fileID < mergedFileNum {
+			continue
+		}
+		fileName := data.GetDataFileName(db.options.DirPath, fileID)
+		if err := db.options.FileSystem.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// 最后移动 merge 完成的标识文件，加载索引时会跳过 merge 过的文件
+	return db.options.FileSystem.Rename(filepath.Join(mergePath, data.MergeFinishedName), filepath.Join(db.options.DirPath, data.MergeFinishedName))
+}
+
 func (db *DB) getNonMergeFileID(dirPath string) (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(dirPath)
+	return readMergeFinishedRecord(db.options.FileSystem, dirPath, 0)
+}
+
+// getMergedFileNum 获取 merge 生成的数据文件数量
+func (db *DB) getMergedFileNum(dirPath string) (uint32, error) {
+	return readMergeFinishedRecord(db.options.FileSystem, dirPath, 1)
+}
+
+// readMergeFinishedRecord 读取 merge 完成标识文件中的第 n 条记录
+func readMergeFinishedRecord(fs fio.FileSystem, dirPath string, n int) (uint32, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(fs, dirPath)
 	if err != nil {
 		return 0, err
 	}
 	defer mergeFinishedFile.Close()
-	rec, _, err := mergeFinishedFile.ReadLogRecordWithSize(0)
-	if err != nil {
-		return 0, err
+	var offset int64
+	var rec *data.LogRecord
+	for i := 0; i <= n; i++ {
+		var size int64
+		rec, size, err = mergeFinishedFile.ReadLogRecordWithSize(offset)
+		if err != nil {
+			return 0, err
+		}
+		offset += size
 	}
 	fileID, err := strconv.Atoi(string(rec.Value))
 	if err != nil {
@@ -0,0 +1,302 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDB_Merge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(1024*1024), WithSyncWrite(false), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.数据库为空时 merge
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 2.有重复写入和删除的数据
+	expected := make(map[string][]byte)
+	for i := 0; i < 20000; i++ {
+		val := utils.GetTestValue(128)
+		err := db.Put(utils.GetTestKey(i), val)
+		assert.Nil(t, err)
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 0; i < 10000; i++ {
+		val := utils.GetTestValue(128)
+		err := db.Put(utils.GetTestKey(i), val)
+		assert.Nil(t, err)
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 10000; i < 12000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	snap := db.Snapshot()
+	snapVal := expected[string(utils.GetTestKey(1))]
+
+	// 3.merge 过程中并发写入，merge 不能覆盖并发写入的数据
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			key := utils.GetTestKey(i % 15000)
+			mu.Lock()
+			if i%3 == 0 {
+				assert.Nil(t, db.Delete(key))
+				delete(expected, string(key))
+			} else {
+				val := utils.GetTestValue(64)
+				assert.Nil(t, db.Put(key, val))
+				expected[string(key)] = val
+			}
+			mu.Unlock()
+		}
+	}()
+	err = db.Merge()
+	close(done)
+	wg.Wait()
+	assert.Nil(t, err)
+
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, val := range expected {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, v)
+		}
+	}
+	check(db)
+
+	// 4.快照引用的文件在 merge 之后依然可以读取
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, snapVal, val)
+	snap.Release()
+
+	// 5.再次 merge 并重启之后数据依然正确
+	err = db.Merge()
+	assert.Nil(t, err)
+	check(db)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(1024*1024), WithSyncWrite(false))
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	check(db2)
+}
+
+func TestDB_MergeIsProcessing(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-processing")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(1024*1024), WithSyncWrite(false), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		assert.Nil(t, err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = db.Merge()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			assert.Equal(t, ErrMergeIsProcessing, err)
+		}
+	}
+	assert.Equal(t, 50000, len(db.ListKeys()))
+}
+
+// mergeCrashExitCode 子进程在 merge 的某个步骤中退出时使用的退出码
+const mergeCrashExitCode = 3
+
+// TestDB_MergeCrashHelper 在子进程中执行 merge，并在指定的步骤直接退出进程
+func TestDB_MergeCrashHelper(t *testing.T) {
+	dir, step := os.Getenv("BITCASK_MERGE_CRASH_DIR"), os.Getenv("BITCASK_MERGE_CRASH_STEP")
+	if dir == "" {
+		t.Skip("only run in the merge crash subprocess")
+	}
+	indexType, _ := strconv.Atoi(os.Getenv("BITCASK_MERGE_CRASH_INDEX"))
+	db, err := Open(WithDirPath(dir), WithIndexType(IndexerType(indexType)), WithMaxDataFileSize(64*1024),
+		WithSyncWrite(false), WithDataFileMergeRatio(0))
+	assert.Nil(t, err)
+	db.mergeCrashHook = func(s string) {
+		if s == step {
+			os.Exit(mergeCrashExitCode)
+		}
+	}
+	_ = db.Merge()
+	t.Fatalf("merge finished without reaching step %s", step)
+}
+
+func TestDB_MergeCrash(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		for _, step := range []string{"rewritten", "index", "renamed", "applied"} {
+			if step == "index" && indexType != BPTree {
+				continue
+			}
+			t.Run(strconv.Itoa(int(indexType))+"-"+step, func(t *testing.T) {
+				testMergeCrash(t, indexType, step)
+			})
+		}
+	}
+}
+
+func testMergeCrash(t *testing.T, indexType IndexerType, step string) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-crash")
+	opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(64 * 1024), WithSyncWrite(false)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	expected := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		val := utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 0; i < 1500; i++ {
+		val := utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 1500; i < 2000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Close())
+
+	// 在子进程中执行 merge，到达指定步骤时进程直接退出
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDB_MergeCrashHelper$")
+	cmd.Env = append(os.Environ(),
+		"BITCASK_MERGE_CRASH_DIR="+dir,
+		"BITCASK_MERGE_CRASH_STEP="+step,
+		"BITCASK_MERGE_CRASH_INDEX="+strconv.Itoa(int(indexType)))
+	err = cmd.Run()
+	exitErr, ok := err.(*exec.ExitError)
+	assert.True(t, ok)
+	if ok {
+		assert.Equal(t, mergeCrashExitCode, exitErr.ExitCode())
+	}
+
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, val := range expected {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, v)
+		}
+	}
+	// 重新打开之后数据依然正确
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	check(db)
+
+	// 崩溃之后可以再次 merge
+	db.options.DataFileMergeRatio = 0
+	assert.Nil(t, db.Merge())
+	check(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	check(db)
+}
+
+// 替换数据文件的过程中移动文件失败时，内存中的数据文件和索引保持不变，重新打开之后完成替换
+func TestDB_MergeRenameFailed(t *testing.T) {
+	for _, indexType := range []IndexerType{Btree, BPTree} {
+		t.Run(strconv.Itoa(int(indexType)), func(t *testing.T) {
+			testMergeRenameFailed(t, indexType)
+		})
+	}
+}
+
+func testMergeRenameFailed(t *testing.T, indexType IndexerType) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-rename")
+	opts := []OptionFunc{WithDirPath(dir), WithIndexType(indexType), WithMaxDataFileSize(64 * 1024),
+		WithSyncWrite(false), WithDataFileMergeRatio(0)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	expected := make(map[string][]byte)
+	for i := 0; i < 3000; i++ {
+		val := utils.GetTestValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), val))
+		expected[string(utils.GetTestKey(i))] = val
+	}
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(expected, string(utils.GetTestKey(i)))
+	}
+	check := func(db *DB) {
+		assert.Equal(t, len(expected), len(db.ListKeys()))
+		for key, val := range expected {
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, val, v)
+		}
+	}
+
+	// 把 merge 生成的最后一个数据文件换成非空的目录，前面的数据文件移动成功之后移动它会失败
+	mergePath := db.getMergePath()
+	var lastFile string
+	db.mergeCrashHook = func(step string) {
+		if step != "rewritten" {
+			return
+		}
+		entries, err := os.ReadDir(mergePath)
+		assert.Nil(t, err)
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+				lastFile = filepath.Join(mergePath, entry.Name())
+			}
+		}
+		assert.NotEqual(t, filepath.Join(mergePath, data.GetDataFileName("", 0)), lastFile)
+		assert.Nil(t, os.Rename(lastFile, lastFile+".bak"))
+		assert.Nil(t, os.MkdirAll(filepath.Join(lastFile, "dir"), os.ModePerm))
+	}
+	assert.NotNil(t, db.Merge())
+	check(db)
+	assert.Equal(t, ErrMergeNotApplied, db.Merge())
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("after merge")))
+	expected[string(utils.GetTestKey(0))] = []byte("after merge")
+	check(db)
+	assert.Nil(t, db.Close())
+
+	// 恢复被替换的文件之后重新打开，继续完成替换
+	assert.Nil(t, os.RemoveAll(lastFile))
+	assert.Nil(t, os.Rename(lastFile+".bak", lastFile))
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	check(db)
+	_, err = os.Stat(mergePath)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Merge())
+	check(db)
+}
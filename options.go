@@ -1,6 +1,10 @@
 package bitcask_go
 
-import "os"
+import (
+	"github.com/rbongIO/bitcask-go/fio"
+	"os"
+	"time"
+)
 
 type IndexerType = int8
 
@@ -10,16 +14,71 @@ const (
 	BPTree
 )
 
+type CompressionType = byte
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionFlate
+	// CompressionSnappy snappy 的 block 格式，和 github.com/golang/snappy 相同
+	CompressionSnappy
+)
+
+type IOType = byte
+
+const (
+	// IOTypeStandard 使用标准文件 IO 读写数据文件
+	IOTypeStandard IOType = iota
+	// IOTypeMMap 使用可读写的文件映射读写数据文件，活跃文件预先分配 MaxDataFileSize 大小的空间
+	IOTypeMMap
+)
+
 type Options struct {
 	DirPath         string // 数据存储目录
 	MaxDataFileSize int64  // 数据文件最大大小
-	SyncWrite       bool   // 同步选项
-	IndexType       IndexerType
+	SyncWrite       bool   // 同步选项，并发写入的持久化会合并为一次 fsync，写入在持久化完成之后才能被读取，fsync 失败之后拒绝所有的写入
+	// 索引类型
+	// ART 索引的迭代器和快照共享树的节点，引用期间的写入只拷贝从根节点到 key 的路径
+	IndexType IndexerType
 	// 累计写到多少字节后进行持久化
 	BytePerSync   uint64
 	MMapAtStartup bool
 	//达到多少比例后进行合并
 	DataFileMergeRatio float32
+	// 后台自动 merge 的检查间隔，0 表示不开启自动 merge
+	AutoMergeInterval time.Duration
+	// 两次自动 merge 之间的最小间隔
+	AutoMergeMinInterval time.Duration
+	// 数据文件数量达到多少后才进行自动 merge
+	AutoMergeMinFiles int
+	// 自动 merge 的静默时段 [start, end)，按小时计，该时段内不进行自动 merge
+	// start 和 end 相等表示没有静默时段
+	AutoMergeQuietHours [2]int
+	// 打开数据库时如果活跃文件末尾的记录不完整或已损坏，将文件截断到最后一条有效记录
+	// 末尾全部是 0 的空数据不是损坏的记录，不开启时也会被截断
+	TruncateTornTail bool
+	// 打开数据库时跳过旧数据文件中损坏的记录，损坏位置之后的数据都会被忽略
+	SkipCorruptedRecords bool
+	// 写入时 value 使用的压缩算法，修改之后已经写入的数据依然可以读取，merge 时会使用新的算法重写
+	Compression CompressionType
+	// 加密 key 和 value 使用的 AES 密钥，长度为 16、24 或 32 字节，为空表示不加密
+	// B+ 树索引加密之后 bolt 中的顺序不是 key 的顺序，迭代器每读取一批 key 都要解密一遍全部索引，完整遍历需要 O(log n) 遍
+	EncryptionKey []byte
+	// 轮换之前使用的密钥，只用于解密，merge 时所有数据都会使用 EncryptionKey 重新加密
+	// 打开数据库时会扫描数据文件，还有使用旧密钥加密的数据时 merge 不检查 DataFileMergeRatio
+	OldEncryptionKeys [][]byte
+	// Put 写入的 value 大于 ChunkSize 时拆分为多个分块存储，0 表示不拆分
+	// PutReader 总是分块写入，没有设置时使用 defaultChunkSize
+	ChunkSize int64
+	// 每个数据文件写满或者关闭数据库时生成对应的 hint 文件，打开数据库时从 hint 文件加载索引，不需要读取 value
+	FileHints bool
+	// 打开数据库时并发读取数据文件的协程数量，0 表示使用 CPU 核数
+	LoadWorkers int
+	// 读写数据文件使用的 IO 类型，使用文件映射时启动后不需要切换为标准 IO
+	IOType IOType
+	// 运行时保持旧数据文件的只读内存映射，活跃文件写满之后重新映射，GetView 读取旧数据文件时不需要拷贝
+	MMapOlderFiles bool
+	// 数据目录所在的文件系统，使用内存中的文件系统时所有数据都不会写入磁盘，不支持 B+ 树索引
+	FileSystem fio.FileSystem
 }
 
 type IteratorOptions struct {
@@ -27,6 +86,10 @@ type IteratorOptions struct {
 	Prefix []byte
 	// Reverse 是否逆序遍历，默认为 false
 	Reverse bool
+	// LowerBound 遍历范围的下界（包含），默认为空表示没有下界
+	LowerBound []byte
+	// UpperBound 遍历范围的上界（不包含），默认为空表示没有上界
+	UpperBound []byte
 }
 
 type WriteBatchOptions struct {
@@ -71,6 +134,20 @@ func WithReverse(reverse bool) IteratorOption {
 	}
 }
 
+// WithLowerBound 只遍历大于等于 lowerBound 的 key
+func WithLowerBound(lowerBound []byte) IteratorOption {
+	return func(o *IteratorOptions) {
+		o.LowerBound = lowerBound
+	}
+}
+
+// WithUpperBound 只遍历小于 upperBound 的 key
+func WithUpperBound(upperBound []byte) IteratorOption {
+	return func(o *IteratorOptions) {
+		o.UpperBound = upperBound
+	}
+}
+
 var DefaultOptions = Options{
 	DirPath:            os.TempDir(),
 	MaxDataFileSize:    256 * 1024 * 1024, // 256MB
@@ -79,6 +156,8 @@ var DefaultOptions = Options{
 	IndexType:          Btree,
 	MMapAtStartup:      true,
 	DataFileMergeRatio: 0.5,
+	FileHints:          true,
+	FileSystem:         fio.OSFileSystem,
 }
 
 func WithMMapAtStartup(mmapAtStartup bool) OptionFunc {
@@ -87,6 +166,50 @@ func WithMMapAtStartup(mmapAtStartup bool) OptionFunc {
 	}
 }
 
+func WithIOType(ioType IOType) OptionFunc {
+	if ioType > IOTypeMMap {
+		panic("invalid io type")
+	}
+	return func(o *Options) {
+		o.IOType = ioType
+	}
+}
+
+func WithMMapOlderFiles(mmapOlderFiles bool) OptionFunc {
+	return func(o *Options) {
+		o.MMapOlderFiles = mmapOlderFiles
+	}
+}
+
+func WithFileSystem(fs fio.FileSystem) OptionFunc {
+	if fs == nil {
+		panic("invalid file system")
+	}
+	return func(o *Options) {
+		o.FileSystem = fs
+	}
+}
+
+// WithInMemory 使用新的内存文件系统，数据文件、hint 文件、merge 目录和文件锁都只保存在内存中
+func WithInMemory() OptionFunc {
+	return WithFileSystem(fio.NewMemoryFileSystem())
+}
+
+func WithFileHints(fileHints bool) OptionFunc {
+	return func(o *Options) {
+		o.FileHints = fileHints
+	}
+}
+
+func WithLoadWorkers(workers int) OptionFunc {
+	if workers < 0 {
+		panic("invalid load workers")
+	}
+	return func(o *Options) {
+		o.LoadWorkers = workers
+	}
+}
+
 func WithDataFileMergeRatio(ratio float32) OptionFunc {
 	if ratio < 0 || ratio > 1 {
 		panic("invalid merge ratio")
@@ -96,6 +219,75 @@ func WithDataFileMergeRatio(ratio float32) OptionFunc {
 	}
 }
 
+func WithAutoMergeInterval(interval time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.AutoMergeInterval = interval
+	}
+}
+
+func WithAutoMergeMinInterval(minInterval time.Duration) OptionFunc {
+	return func(o *Options) {
+		o.AutoMergeMinInterval = minInterval
+	}
+}
+
+func WithAutoMergeMinFiles(minFiles int) OptionFunc {
+	return func(o *Options) {
+		o.AutoMergeMinFiles = minFiles
+	}
+}
+
+func WithAutoMergeQuietHours(start, end int) OptionFunc {
+	if start < 0 || start > 23 || end < 0 || end > 23 {
+		panic("invalid quiet hours")
+	}
+	return func(o *Options) {
+		o.AutoMergeQuietHours = [2]int{start, end}
+	}
+}
+
+func WithTruncateTornTail(truncate bool) OptionFunc {
+	return func(o *Options) {
+		o.TruncateTornTail = truncate
+	}
+}
+
+func WithSkipCorruptedRecords(skip bool) OptionFunc {
+	return func(o *Options) {
+		o.SkipCorruptedRecords = skip
+	}
+}
+
+func WithCompression(compression CompressionType) OptionFunc {
+	if compression > CompressionSnappy {
+		panic("invalid compression type")
+	}
+	return func(o *Options) {
+		o.Compression = compression
+	}
+}
+
+func WithEncryptionKey(key []byte, oldKeys ...[]byte) OptionFunc {
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		if len(k) != 16 && len(k) != 24 && len(k) != 32 {
+			panic("invalid encryption key")
+		}
+	}
+	return func(o *Options) {
+		o.EncryptionKey = key
+		o.OldEncryptionKeys = oldKeys
+	}
+}
+
+func WithChunkSize(chunkSize int64) OptionFunc {
+	if chunkSize < 0 {
+		panic("invalid chunk size")
+	}
+	return func(o *Options) {
+		o.ChunkSize = chunkSize
+	}
+}
+
 func WithBytePerSync(bytePerSync uint64) OptionFunc {
 	return func(o *Options) {
 		o.BytePerSync = bytePerSync
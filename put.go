@@ -1,16 +1,12 @@
 package bitcask_go
 
 import (
+	"bytes"
 	"github.com/rbongIO/bitcask-go/data"
 	"github.com/rbongIO/bitcask-go/fio"
+	"time"
 )
 
-func (db *DB) appendLogRecordWithLock(record *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	return db.appendLogRecord(record)
-}
-
 // appendLogRecord 将 LogRecord 追加写入到数据文件中
 func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error) {
 	//判断当前活跃数据文件是否存在，因为数据库在没有写入的时候是没有文件生成的
@@ -21,46 +17,82 @@ func (db *DB) appendLogRecord(record *data.LogRecord) (*data.LogRecordPos, error
 		}
 	}
 
-	// 将 logRecord 进行编码
-	encRecord, size := data.EncodeLogRecord(record)
+	// 将 logRecord 进行编码，value 按照配置进行压缩和加密
+	record.Compression = db.options.Compression
+	encRecord, size, err := data.EncodeLogRecordWithCipher(record, db.cipher)
+	if err != nil {
+		return nil, err
+	}
 	// 如果写入的数据已经到达了活跃文件的最大容量，则关闭活跃文件，并创建新的活跃文件
 	if db.activeFile.WriteOffset+size > db.options.MaxDataFileSize {
-		//先进行持久化，保证已有的记录已被持久化到磁盘当中
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-		//当前的活跃文件保存为旧的文件
-		db.olderFiles[db.activeFile.FileID] = db.activeFile
-		err := db.setActiveDataFile()
-		if err != nil {
+		if err := db.rotateActiveFile(); err != nil {
 			return nil, err
 		}
 	}
 	writeOffset := db.activeFile.WriteOffset
-	err := db.activeFile.Write(encRecord)
+	err = db.activeFile.Write(encRecord)
 	if err != nil {
 		return nil, err
 	}
+	// 是否需要持久化由调用方在释放锁之后通过 group commit 处理
 	db.bytesWrite += uint64(size)
-	//根据用户配置决定是否每次写入都进行持久化
-	var needSync = db.options.SyncWrite
-	if !needSync && db.options.BytePerSync > 0 && db.bytesWrite > db.options.BytePerSync {
-		needSync = true
-	}
-	if needSync {
-		if err := db.activeFile.Sync(); err != nil {
-			return nil, err
-		}
-		db.bytesWrite = 0
-	}
+	db.writeSeq++
 	pos := &data.LogRecordPos{
 		Fid:    db.activeFile.FileID,
 		Offset: writeOffset,
 		Size:   uint32(size),
+		Expire: record.Expire,
 	}
+	db.addFileHint(record, pos)
 	return pos, nil
 }
 
+// rotateActiveFile 将当前活跃文件保存为旧文件并写入它的 hint 文件，然后创建新的活跃文件
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) rotateActiveFile() error {
+	//先进行持久化，保证已有的记录已被持久化到磁盘当中
+	if err := db.activeFile.Sync(); err != nil {
+		return err
+	}
+	db.markSynced(db.writeSeq)
+	if err := db.writeActiveFileHint(); err != nil {
+		return err
+	}
+	// 释放文件映射预先分配的空间，旧文件的长度和写入的数据一致
+	if db.options.IOType == IOTypeMMap {
+		if err := db.activeFile.Truncate(db.activeFile.WriteOffset); err != nil {
+			return err
+		}
+	}
+	//当前的活跃文件保存为旧的文件
+	olderFile := db.activeFile
+	db.olderFiles[olderFile.FileID] = olderFile
+	db.activeHints = nil
+	if err := db.setActiveDataFile(); err != nil {
+		return err
+	}
+	if db.olderFileIOType() == fio.MemoryMapIO {
+		return db.remapOlderFile(olderFile)
+	}
+	return nil
+}
+
+// remapOlderFile 将写满的活跃文件重新以只读映射打开，替换 olderFiles 中的数据文件
+// 原来的数据文件被快照或迭代器引用时，在解除引用之后关闭
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) remapOlderFile(file *data.DataFile) error {
+	mapped, err := db.openDataFile(db.options.DirPath, file.FileID, fio.MemoryMapIO)
+	if err != nil {
+		return err
+	}
+	mapped.WriteOffset = file.WriteOffset
+	db.olderFiles[file.FileID] = mapped
+	if db.pinnedFiles[file] == 0 {
+		return file.Close()
+	}
+	return nil
+}
+
 // setActiveDataFile 设置当前活跃的数据文件
 // 对共享的 DB实例的访问必须先持有锁
 func (db *DB) setActiveDataFile() error {
@@ -69,10 +101,14 @@ func (db *DB) setActiveDataFile() error {
 		initialFileID = db.activeFile.FileID + 1
 	}
 	// 创建新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileID, fio.StandardFIO)
+	dataFile, err := db.openDataFile(db.options.DirPath, initialFileID, db.dataFileIOType())
 	if err != nil {
 		return err
 	}
+	if err := dataFile.Reserve(db.options.MaxDataFileSize); err != nil {
+		_ = dataFile.Close()
+		return err
+	}
 
 	db.activeFile = dataFile
 	return nil
@@ -80,25 +116,113 @@ func (db *DB) setActiveDataFile() error {
 
 // Put 写入 Key/Value, 如果 Key 已经存在，则覆盖
 func (db *DB) Put(key []byte, value []byte) error {
-	//不需要加锁，因为 appendLogRecord 方法中已经加锁
+	return db.PutWithTTL(key, value, 0)
+}
 
+// PutWithTTL 写入 Key/Value 并设置过期时间，ttl 为 0 表示永不过期
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	// 判断 Key 是否有效
 	if len(key) == 0 {
 		return ErrKeyIsEmpty
 	}
+	if ttl < 0 {
+		return ErrInvalidTTL
+	}
+	// 写入数据文件和更新内存索引需要在同一把锁内完成，
+	// 这样事务提交时看到的索引才和数据文件中的顺序一致
+	return db.update(false, func() error {
+		return db.putRecord(key, value, expireAt(ttl))
+	})
+}
+
+// PutIfAbsent 只有在 key 不存在（或已过期）时才写入，返回是否写入成功
+func (db *DB) PutIfAbsent(key []byte, value []byte) (bool, error) {
+	return db.PutIfAbsentWithTTL(key, value, 0)
+}
+
+// PutIfAbsentWithTTL 只有在 key 不存在（或已过期）时才写入并设置过期时间，ttl 为 0 表示永不过期
+func (db *DB) PutIfAbsentWithTTL(key []byte, value []byte, ttl time.Duration) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	if ttl < 0 {
+		return false, ErrInvalidTTL
+	}
+	var written bool
+	if err := db.update(false, func() error {
+		if pos := db.index.Get(key); pos != nil && !pos.IsExpired(time.Now().UnixNano()) {
+			return nil
+		}
+		written = true
+		return db.putRecord(key, value, expireAt(ttl))
+	}); err != nil {
+		return false, err
+	}
+	return written, nil
+}
+
+// CompareAndSwap 只有在 key 当前的值等于 oldValue 时才写入 newValue，返回是否写入成功
+// key 不存在时不会写入，写入之后保留 key 原有的过期时间
+func (db *DB) CompareAndSwap(key []byte, oldValue, newValue []byte) (bool, error) {
+	return db.compareAndSwap(key, oldValue, newValue, true, 0)
+}
+
+// CompareAndSwapWithTTL 和 CompareAndSwap 相同，写入之后使用新的过期时间，ttl 为 0 表示永不过期
+func (db *DB) CompareAndSwapWithTTL(key []byte, oldValue, newValue []byte, ttl time.Duration) (bool, error) {
+	if ttl < 0 {
+		return false, ErrInvalidTTL
+	}
+	return db.compareAndSwap(key, oldValue, newValue, false, expireAt(ttl))
+}
+
+// compareAndSwap keepTTL 为 true 时沿用 key 原有的过期时间，否则使用 expire
+func (db *DB) compareAndSwap(key []byte, oldValue, newValue []byte, keepTTL bool, expire int64) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrKeyIsEmpty
+	}
+	var swapped bool
+	if err := db.update(false, func() error {
+		value, err := db.getValue(key)
+		if err == ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, oldValue) {
+			return nil
+		}
+		if keepTTL {
+			expire = db.index.Get(key).Expire
+		}
+		swapped = true
+		return db.putRecord(key, newValue, expire)
+	}); err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// putRecord 写入一条普通记录并更新内存索引，超过 ChunkSize 的 value 分块写入
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) putRecord(key []byte, value []byte, expire int64) error {
+	if db.options.ChunkSize > 0 && int64(len(value)) > db.options.ChunkSize {
+		return db.putChunkedRecord(key, value, expire)
+	}
 	// 构造 LogRecord 结构体
 	record := &data.LogRecord{
-		Key:   logRecordKeyWithSeqNum(key, nonTransactionSeqNum),
-		Value: value,
-		Type:  data.LogRecordNormal,
+		Key:    logRecordKeyWithSeqNum(key, nonTransactionSeqNum),
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
 	}
 	// 将 LogRecord 追加写入到数据文件中
-	pos, err := db.appendLogRecordWithLock(record)
+	pos, err := db.appendLogRecord(record)
 	if err != nil {
 		return err
 	}
 	// 将 LogRecordPos 更新到内存索引中
-	// 更新索引时，索引内部也有锁，所以不用加锁
+	db.recordWrite(key)
 	if oldPos := db.index.Put(key, pos); oldPos != nil {
 		db.reclaimSize += int64(oldPos.Size)
 	}
@@ -58,6 +58,34 @@ func (rds *DataStructureType) HGet(key, filed []byte) ([]byte, error) {
 	return rds.db.Get(hk.marshal())
 }
 
+// HMGet 批量获取多个 filed 的值，不存在的 filed 对应的值为 nil
+func (rds *DataStructureType) HMGet(key []byte, fileds ...[]byte) ([][]byte, error) {
+	meta, err := rds.findMetadata(key, RHash)
+	if err != nil {
+		return nil, err
+	}
+	values := make([][]byte, len(fileds))
+	if meta.size == 0 {
+		return values, nil
+	}
+	keys := make([][]byte, len(fileds))
+	for i, filed := range fileds {
+		hk := &hashInternalKey{
+			key:     key,
+			version: meta.version,
+			filed:   filed,
+		}
+		keys[i] = hk.marshal()
+	}
+	values, errs := rds.db.MultiGet(keys)
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, bitcask.ErrKeyNotFound) {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
 func (rds *DataStructureType) HDel(key, filed []byte) (bool, error) {
 	meta, err := rds.findMetadata(key, RHash)
 	if err != nil {
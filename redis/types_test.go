@@ -127,6 +127,27 @@ func TestRedisDataStructure_HGet(t *testing.T) {
 	_, err = rds.HGet(utils.GetTestKey(1), []byte("field-not-exist"))
 	assert.Equal(t, bitcask.ErrKeyNotFound, err)
 }
+func TestRedisDataStructure_HMGet(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-redis-hmget")
+	rds, err := NewDataStructureType(bitcask.WithDirPath(dir))
+	assert.Nil(t, err)
+
+	values, err := rds.HMGet(utils.GetTestKey(1), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{nil}, values)
+
+	v1 := utils.RandomValue(100)
+	_, err = rds.HSet(utils.GetTestKey(1), []byte("field1"), v1)
+	assert.Nil(t, err)
+	v2 := utils.RandomValue(100)
+	_, err = rds.HSet(utils.GetTestKey(1), []byte("field2"), v2)
+	assert.Nil(t, err)
+
+	values, err = rds.HMGet(utils.GetTestKey(1), []byte("field2"), []byte("field-not-exist"), []byte("field1"))
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{v2, nil, v1}, values)
+}
+
 func TestRedisDataStructure_HDel(t *testing.T) {
 	dir, _ := os.MkdirTemp("", "bitcask-go-redis-hdel")
 	rds, err := NewDataStructureType(bitcask.WithDirPath(dir))
@@ -308,3 +329,60 @@ func TestDataStructureType_ZAdd(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 2.0, score1)
 }
+
+// 使用内存文件系统时各种数据结构的读写和磁盘上一致
+func TestDataStructureType_InMemory(t *testing.T) {
+	rds, err := NewDataStructureType(bitcask.WithInMemory())
+	assert.Nil(t, err)
+	defer rds.Close()
+
+	err = rds.Set(utils.GetTestKey(1), 0, utils.GetTestValue(24))
+	assert.Nil(t, err)
+	val, err := rds.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	typ, err := rds.Type(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, RString, typ)
+	assert.Nil(t, rds.Delete(utils.GetTestKey(1)))
+	_, err = rds.Get(utils.GetTestKey(1))
+	assert.Equal(t, bitcask.ErrKeyNotFound, err)
+
+	hashKey, field, fieldValue := utils.GetTestKey(2), []byte("field1"), utils.RandomValue(100)
+	ok, err := rds.HSet(hashKey, field, fieldValue)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	val, err = rds.HGet(hashKey, field)
+	assert.Nil(t, err)
+	assert.Equal(t, fieldValue, val)
+	ok, err = rds.HDel(hashKey, field)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	setKey, member := utils.GetTestKey(3), utils.RandomValue(100)
+	ok, err = rds.SAdd(setKey, member)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = rds.SIsMember(setKey, member)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	listKey, elem1, elem2 := utils.GetTestKey(4), utils.RandomValue(100), utils.RandomValue(100)
+	size, err := rds.LPush(listKey, elem1)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), size)
+	size, err = rds.RPush(listKey, elem2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), size)
+	val, err = rds.RPop(listKey)
+	assert.Nil(t, err)
+	assert.Equal(t, elem2, val)
+
+	zsetKey := utils.GetTestKey(5)
+	ok, err = rds.ZAdd(zsetKey, 1.5, member)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	score, err := rds.ZScore(zsetKey, member)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, score)
+}
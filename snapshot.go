@@ -0,0 +1,162 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/index"
+	"time"
+)
+
+// Snapshot 数据库某一时刻的只读视图
+// 数据文件是追加写入的，快照中的 LogRecordPos 在文件被删除之前始终可以读取，
+// 快照持有创建时所有数据文件的引用，在 Release 之前这些文件不会被 merge 关闭
+type Snapshot struct {
+	db       *DB
+	index    index.Indexer             // 创建快照时的索引副本
+	files    map[uint32]*data.DataFile // 创建快照时的所有数据文件
+	ts       int64                     // 创建快照的时间，用于判断 key 是否过期
+	released bool
+}
+
+// Snapshot 创建当前数据库的快照，使用完毕后需要调用 Release 释放
+func (db *DB) Snapshot() *Snapshot {
+	db.lockSynced(true)
+	defer db.mu.Unlock()
+
+	snap := &Snapshot{
+		db:    db,
+		index: db.index.Snapshot(),
+		files: db.pinFiles(),
+		ts:    time.Now().UnixNano(),
+	}
+	db.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// Get 读取快照中 key 对应的数据
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if s.released {
+		return nil, ErrSnapshotReleased
+	}
+	recordPos := s.index.Get(key)
+	if recordPos == nil || recordPos.IsExpired(s.ts) {
+		return nil, ErrKeyNotFound
+	}
+	return getValueFromDataFile(filesByID(s.files), recordPos)
+}
+
+// NewIterator 初始化快照的迭代器
+func (s *Snapshot) NewIterator(opts ...IteratorOption) *Iterator {
+	options := DefaultIteratorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	it := &Iterator{
+		indexIter: s.index.RangeIterator(options.indexOptions()),
+		db:        s.db,
+		snapshot:  s,
+		options:   options,
+	}
+	// 迭代器单独引用快照中的数据文件，快照释放之后迭代器读取数据不受影响
+	s.db.mu.Lock()
+	if !s.released {
+		it.files = s.files
+		s.db.pinFileSet(it.files)
+	}
+	s.db.mu.Unlock()
+	it.skipToNext()
+	return it
+}
+
+// Fold 遍历快照中所有的数据并执行用户指定的操作
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	if s.released {
+		return ErrSnapshotReleased
+	}
+
+	iterator := s.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 跳过已经过期的 key
+		if iterator.Value().IsExpired(s.ts) {
+			continue
+		}
+		val, err := getValueFromDataFile(filesByID(s.files), iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), val) {
+			break
+		}
+	}
+	return nil
+}
+
+// Release 释放快照，解除对数据文件和索引副本的引用
+func (s *Snapshot) Release() {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.release()
+}
+
+// 对共享的 DB实例的访问必须先持有锁
+func (s *Snapshot) release() {
+	if s.released {
+		return
+	}
+	s.released = true
+	s.db.unpinFiles(s.files)
+	_ = s.index.Close()
+	s.index = nil
+	s.files = nil
+	delete(s.db.snapshots, s)
+}
+
+// pinFiles 引用当前所有的数据文件，被引用的文件在 merge 之后不会立即关闭
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) pinFiles() map[uint32]*data.DataFile {
+	files := make(map[uint32]*data.DataFile, len(db.olderFiles)+1)
+	for fid, file := range db.olderFiles {
+		files[fid] = file
+	}
+	if db.activeFile != nil {
+		files[db.activeFile.FileID] = db.activeFile
+	}
+	db.pinFileSet(files)
+	return files
+}
+
+// pinFileSet 增加对给定数据文件的引用，需要和 unpinFiles 成对调用
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) pinFileSet(files map[uint32]*data.DataFile) {
+	for _, file := range files {
+		db.pinnedFiles[file]++
+	}
+}
+
+// unpinFiles 解除对数据文件的引用，关闭已经被 merge 替换且不再被引用的文件
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) unpinFiles(files map[uint32]*data.DataFile) {
+	for _, file := range files {
+		db.pinnedFiles[file]--
+		if db.pinnedFiles[file] > 0 {
+			continue
+		}
+		delete(db.pinnedFiles, file)
+		if db.isFileRetired(file) {
+			_ = file.Close()
+		}
+	}
+}
+
+// isFileRetired 判断数据文件是否已经被 merge 替换
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) isFileRetired(file *data.DataFile) bool {
+	return db.activeFile != file && db.olderFiles[file.FileID] != file
+}
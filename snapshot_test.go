@@ -0,0 +1,77 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	for _, typ := range []IndexerType{Btree, ART, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+		db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024), WithSyncWrite(false), WithIndexType(typ))
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		val1 := utils.GetTestValue(24)
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), val1)
+			assert.Nil(t, err)
+		}
+		snap := db.Snapshot()
+
+		// 创建快照之后的修改对快照不可见
+		for i := 0; i < 50; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		for i := 50; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+			assert.Nil(t, err)
+		}
+		wb := db.NewWriteBatch()
+		assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.GetTestValue(24)))
+		assert.Nil(t, wb.Commit())
+
+		_, err = db.Get(utils.GetTestKey(10))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := snap.Get(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val)
+		val, err = snap.Get(utils.GetTestKey(60))
+		assert.Nil(t, err)
+		assert.Equal(t, val1, val)
+		_, err = snap.Get(utils.GetTestKey(500))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		var count int
+		it := snap.NewIterator()
+		for it.Rewind(); it.Valid(); it.Next() {
+			assert.Equal(t, val1, it.Value())
+			count++
+		}
+		it.Close()
+		assert.Equal(t, 100, count)
+
+		count = 0
+		err = snap.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, val1, value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 100, count)
+
+		// 释放之后不能再读取
+		snap.Release()
+		_, err = snap.Get(utils.GetTestKey(10))
+		assert.Equal(t, ErrSnapshotReleased, err)
+
+		// 关闭数据库会释放所有快照
+		snap2 := db.Snapshot()
+		destroyDB(db)
+		_, err = snap2.Get(utils.GetTestKey(60))
+		assert.Equal(t, ErrSnapshotReleased, err)
+	}
+}
@@ -0,0 +1,80 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"time"
+)
+
+// Expire 为已存在的 key 重新设置过期时间，ttl 为 0 表示永不过期
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ttl < 0 {
+		return ErrInvalidTTL
+	}
+	return db.update(false, func() error {
+		oldPos := db.index.Get(key)
+		if oldPos == nil || oldPos.IsExpired(time.Now().UnixNano()) {
+			return ErrKeyNotFound
+		}
+		// 只追加一条不包含 value 的记录，value 依然从之前的位置读取
+		record := &data.LogRecord{
+			Key:    logRecordKeyWithSeqNum(key, nonTransactionSeqNum),
+			Type:   data.LogRecordExpire,
+			Expire: expireAt(ttl),
+		}
+		pos, err := db.appendLogRecord(record)
+		if err != nil {
+			return err
+		}
+		db.updateIndex(key, record, pos)
+		return nil
+	})
+}
+
+// TTL 返回 key 剩余的存活时间，永不过期的 key 返回 0
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+	db.lockSynced(false, key)
+	pos := db.index.Get(key)
+	db.mu.RUnlock()
+	now := time.Now().UnixNano()
+	if pos == nil || pos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if pos.Expire == 0 {
+		return 0, nil
+	}
+	return time.Duration(pos.Expire - now), nil
+}
+
+// 清理内存索引中已经过期的 key，并将其占用的空间计入可回收空间
+// 对共享的 DB实例的访问必须先持有锁
+func (db *DB) removeExpiredKeys() {
+	now := time.Now().UnixNano()
+	var expiredKeys [][]byte
+	iterator := db.index.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if iterator.Value().IsExpired(now) {
+			// B+ 树迭代器返回的 key 在迭代器关闭后失效，需要拷贝
+			expiredKeys = append(expiredKeys, append([]byte(nil), iterator.Key()...))
+		}
+	}
+	iterator.Close()
+	for _, key := range expiredKeys {
+		if oldPos, _ := db.index.Delete(key); oldPos != nil {
+			db.reclaimSize += int64(oldPos.Size)
+		}
+	}
+}
+
+// 根据 ttl 计算过期时间戳
+func expireAt(ttl time.Duration) int64 {
+	if ttl == 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
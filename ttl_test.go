@@ -0,0 +1,195 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_PutWithTTL(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-put-ttl")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.ttl 为负数
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.GetTestValue(24), -time.Second)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// 2.未过期之前可以正常读取
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.GetTestValue(24), 200*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.GetTestValue(24), 0)
+	assert.Nil(t, err)
+	val1, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val1)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, time.Duration(0))
+	ttl, err = db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	// 3.过期之后视为不存在
+	time.Sleep(300 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+
+	it := db.NewIterator()
+	var keys int
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Equal(t, utils.GetTestKey(2), it.Key())
+		keys++
+	}
+	it.Close()
+	assert.Equal(t, 1, keys)
+
+	err = db.Fold(func(key []byte, value []byte) bool {
+		assert.Equal(t, utils.GetTestKey(2), key)
+		return true
+	})
+	assert.Nil(t, err)
+
+	// 4.重启之后过期时间依然有效
+	err = db.PutWithTTL(utils.GetTestKey(3), utils.GetTestValue(24), time.Hour)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val3, err := db2.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.NotNil(t, val3)
+	ttl, err = db2.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Greater(t, ttl, 59*time.Minute)
+}
+
+func TestDB_Expire(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-expire")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1.key 不存在
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2.为已存在的 key 设置过期时间
+	val1 := utils.GetTestValue(24)
+	err = db.Put(utils.GetTestKey(1), val1)
+	assert.Nil(t, err)
+	err = db.Expire(utils.GetTestKey(1), 100*time.Millisecond)
+	assert.Nil(t, err)
+	val2, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val1, val2)
+
+	// 3.移除过期时间
+	err = db.Expire(utils.GetTestKey(1), 0)
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	val3, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val1, val3)
+
+	// 4.过期之后不能再设置
+	err = db.Expire(utils.GetTestKey(1), 100*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// 分块存储的大 value 修改过期时间时只追加一条不包含 value 的记录
+func TestDB_ExpireChunked(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-expire-chunked")
+	opts := []OptionFunc{WithDirPath(dir), WithSyncWrite(false), WithChunkSize(1024), WithDataFileMergeRatio(0)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	defer func() { destroyDB(db) }()
+
+	key, value := utils.GetTestKey(1), utils.GetTestValue(16*1024)
+	assert.Nil(t, db.Put(key, value))
+	assert.Nil(t, db.Put(utils.GetTestKey(2), utils.GetTestValue(24)))
+	offset := db.activeFile.WriteOffset
+	reclaimSize := db.Stat().ReclaimableSize
+	assert.Nil(t, db.Expire(key, time.Hour))
+	written := db.activeFile.WriteOffset - offset
+	assert.Less(t, written, int64(64))
+	// 只有新追加的记录可以回收，value 依然有效
+	assert.Equal(t, reclaimSize+written, db.Stat().ReclaimableSize)
+
+	check := func(db *DB) {
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+		ttl, err := db.TTL(key)
+		assert.Nil(t, err)
+		assert.Greater(t, ttl, 59*time.Minute)
+	}
+	check(db)
+
+	// 重新打开之后回放 Expire 记录
+	assert.Nil(t, db.Close())
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	check(db)
+
+	// merge 之后 value 连同新的过期时间一起重写
+	assert.Nil(t, db.Merge())
+	check(db)
+	assert.Nil(t, db.Close())
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestDB_MergeExpired(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-expired")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false), WithDataFileMergeRatio(0.3))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.GetTestValue(128), 100*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestValue(128))
+		assert.Nil(t, err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// 过期的数据计入可回收空间，达到 merge 比例，merge 之后被丢弃
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), db.Size())
+	assert.Equal(t, int64(0), db.Stat().ReclaimableSize)
+
+	// 重启之后加载 merge 的数据
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	assert.Equal(t, int64(1000), db2.Size())
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db2.Get(utils.GetTestKey(1001))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+}
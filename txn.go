@@ -0,0 +1,183 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"github.com/rbongIO/bitcask-go/index"
+	"sync"
+	"time"
+)
+
+// Txn 乐观读写事务
+// 事务会记录读取过的 key 和迭代器遍历的范围以及读取时的版本号，提交时如果其中任意一个 key
+// 在读取之后被修改过，或者遍历的范围中写入了新的 key，则提交失败并返回 ErrTxnConflict
+// 事务结束之前会保留其他写入修改过的 key，使用完毕后需要调用 Commit 或者 Rollback
+type Txn struct {
+	options       WriteBatchOptions
+	mu            *sync.Mutex
+	db            *DB
+	startVersion  uint64                     // 事务开始时的版本号
+	reads         map[string]uint64          // 读取过的 key 以及读取时的版本号
+	ranges        []txnRange                 // 迭代器遍历的范围
+	pendingWrites map[string]*data.LogRecord // 暂存用户写入的数据
+	closed        bool                       // 事务是否已经提交或回滚
+}
+
+// Begin 开启一个新的读写事务
+func (db *DB) Begin(opts ...WriteBatchOption) *Txn {
+	if db.options.IndexType == index.BPTree && !db.seqNumFileExists && !db.isInitial {
+		panic("cannot begin transaction,seq no file not exists")
+	}
+	options := DefaultWriteBatchOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	db.mu.Lock()
+	startVersion := db.txns.begin()
+	db.mu.Unlock()
+	return &Txn{
+		options:       options,
+		mu:            new(sync.Mutex),
+		db:            db,
+		startVersion:  startVersion,
+		reads:         make(map[string]uint64),
+		pendingWrites: make(map[string]*data.LogRecord),
+	}
+}
+
+// Get 读取数据，事务中尚未提交的写入对自身可见
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return nil, ErrTxnClosed
+	}
+	if rec, ok := txn.pendingWrites[string(key)]; ok {
+		if rec.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return rec.Value, nil
+	}
+
+	txn.db.lockSynced(false, key)
+	defer txn.db.mu.RUnlock()
+	recordPos := txn.db.index.Get(key)
+	txn.recordRead(key)
+	if recordPos == nil || recordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return txn.db.getValueByPosition(recordPos)
+}
+
+// Put 暂存写入的数据，提交时才会写入数据文件
+func (txn *Txn) Put(key, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:   key,
+		Value: value,
+	}
+	return nil
+}
+
+// Delete 暂存删除操作，提交时才会写入数据文件
+func (txn *Txn) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	txn.pendingWrites[string(key)] = &data.LogRecord{
+		Key:  key,
+		Type: data.LogRecordDeleted,
+	}
+	return nil
+}
+
+// Iterator 初始化事务的迭代器，迭代器的整个遍历范围都会记录为已读取，范围内的 key 被修改或者写入新的 key 都会导致冲突
+// 迭代器只能看到已经提交的数据，看不到事务中暂存的写入
+func (txn *Txn) Iterator(opts ...IteratorOption) *Iterator {
+	options := DefaultIteratorOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	indexOptions := options.indexOptions()
+	txn.mu.Lock()
+	if !txn.closed {
+		// 在创建迭代器之前获取版本号，期间的写入会被当作冲突
+		txn.db.mu.RLock()
+		txn.ranges = append(txn.ranges, txnRange{
+			lower:   append([]byte(nil), indexOptions.LowerBound...),
+			upper:   append([]byte(nil), indexOptions.UpperBound...),
+			version: txn.db.txns.version,
+		})
+		txn.db.mu.RUnlock()
+	}
+	txn.mu.Unlock()
+	return txn.db.NewIterator(opts...)
+}
+
+// Commit 提交事务，读取过的 key 被其他写入修改过时返回 ErrTxnConflict
+func (txn *Txn) Commit() error {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.closed {
+		return ErrTxnClosed
+	}
+	txn.closed = true
+	defer txn.finish()
+
+	if len(txn.pendingWrites) == 0 {
+		return nil
+	}
+	if uint(len(txn.pendingWrites)) > txn.options.MaxBatchNum {
+		return ErrBatchNumExceeded
+	}
+	// 加锁保证冲突检测和写入是一个原子操作
+	return txn.db.update(txn.options.SyncWrites, func() error {
+		if txn.db.txns.conflicts(txn.startVersion, txn.reads, txn.ranges) {
+			return ErrTxnConflict
+		}
+		return txn.db.commitPendingWrites(nil, txn.pendingWrites)
+	})
+}
+
+// Rollback 丢弃事务中暂存的所有写入
+func (txn *Txn) Rollback() {
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if !txn.closed {
+		txn.closed = true
+		txn.finish()
+	}
+	txn.reads = nil
+	txn.ranges = nil
+	txn.pendingWrites = nil
+}
+
+// 记录 key 第一次被读取时的版本号
+// 调用方需要持有事务的锁和 DB 的锁
+func (txn *Txn) recordRead(key []byte) {
+	if _, ok := txn.reads[string(key)]; ok {
+		return
+	}
+	txn.reads[string(key)] = txn.db.txns.version
+}
+
+// finish 注销已经结束的事务
+func (txn *Txn) finish() {
+	txn.db.mu.Lock()
+	txn.db.txns.finish(txn.startVersion)
+	txn.db.mu.Unlock()
+}
@@ -0,0 +1,209 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Begin(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("1"))
+	assert.Nil(t, err)
+
+	// 1.事务中的写入对自身可见，提交之前对外不可见
+	txn := db.Begin()
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+	assert.Nil(t, txn.Put(utils.GetTestKey(1), []byte("2")))
+	assert.Nil(t, txn.Delete(utils.GetTestKey(2)))
+	val, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+
+	assert.Nil(t, txn.Commit())
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+
+	// 2.提交之后不能再使用
+	assert.Equal(t, ErrTxnClosed, txn.Commit())
+	assert.Equal(t, ErrTxnClosed, txn.Put(utils.GetTestKey(1), []byte("3")))
+
+	// 3.回滚之后写入被丢弃
+	txn2 := db.Begin()
+	assert.Nil(t, txn2.Put(utils.GetTestKey(3), []byte("3")))
+	txn2.Rollback()
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 4.重启之后事务写入的数据依然存在
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	assert.Nil(t, err)
+	defer destroyDB(db2)
+	val, err = db2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+}
+
+func TestTxn_Conflict(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-conflict")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("1"))
+	assert.Nil(t, err)
+
+	// 1.两个事务同时读-改-写同一个 key，后提交的失败
+	txn1 := db.Begin()
+	txn2 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = txn2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, txn1.Put(utils.GetTestKey(1), []byte("txn1")))
+	assert.Nil(t, txn2.Put(utils.GetTestKey(1), []byte("txn2")))
+	assert.Nil(t, txn1.Commit())
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn1"), val)
+
+	// 2.读取时不存在的 key 在提交前被写入
+	txn3 := db.Begin()
+	_, err = txn3.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("2")))
+	assert.Nil(t, txn3.Put(utils.GetTestKey(2), []byte("txn3")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+
+	// 3.读取的 key 被删除
+	txn4 := db.Begin()
+	_, err = txn4.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Delete(utils.GetTestKey(2)))
+	assert.Nil(t, txn4.Put(utils.GetTestKey(3), []byte("txn4")))
+	assert.Equal(t, ErrTxnConflict, txn4.Commit())
+
+	// 4.迭代器遍历到的 key 被修改
+	for i := 10; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), []byte("v")))
+	}
+	txn5 := db.Begin()
+	it := txn5.Iterator(WithPrefix([]byte("bitcask-go-key_{1")))
+	for it.Rewind(); it.Valid(); it.Next() {
+		assert.Nil(t, txn5.Put(it.Key(), []byte("txn5")))
+	}
+	it.Close()
+	assert.Nil(t, db.Put(utils.GetTestKey(15), []byte("changed")))
+	assert.Equal(t, ErrTxnConflict, txn5.Commit())
+
+	// 5.没有冲突的事务正常提交
+	txn6 := db.Begin()
+	_, err = txn6.Get(utils.GetTestKey(15))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(16), []byte("other")))
+	assert.Nil(t, txn6.Put(utils.GetTestKey(15), []byte("txn6")))
+	assert.Nil(t, txn6.Commit())
+}
+
+func TestTxn_ConflictAfterMerge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-merge")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(32*1024), WithSyncWrite(false), WithDataFileMergeRatio(0))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(24)))
+	}
+	// 1.merge 只移动数据的位置，读取过的 key 没有被修改，提交成功
+	txn1 := db.Begin()
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, txn1.Put(utils.GetTestKey(1), []byte("txn1")))
+	assert.Nil(t, txn1.Commit())
+
+	// 2.读取之后被修改，再经过 merge，依然是冲突
+	txn2 := db.Begin()
+	_, err = txn2.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(2), []byte("changed")))
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, txn2.Put(utils.GetTestKey(2), []byte("txn2")))
+	assert.Equal(t, ErrTxnConflict, txn2.Commit())
+
+	// 3.只修改过期时间也是冲突
+	txn3 := db.Begin()
+	_, err = txn3.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Expire(utils.GetTestKey(3), time.Hour))
+	assert.Nil(t, txn3.Put(utils.GetTestKey(3), []byte("txn3")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+}
+
+func TestTxn_Phantom(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-txn-phantom")
+	db, err := Open(WithDirPath(dir), WithMaxDataFileSize(64*1024*1024), WithSyncWrite(false))
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put([]byte("a-1"), []byte("1")))
+	assert.Nil(t, db.Put([]byte("a-3"), []byte("3")))
+	assert.Nil(t, db.Put([]byte("b-1"), []byte("1")))
+
+	count := func(txn *Txn) int {
+		it := txn.Iterator(WithPrefix([]byte("a-")))
+		defer it.Close()
+		n := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			n++
+		}
+		return n
+	}
+
+	// 1.遍历的范围中写入了新的 key
+	txn1 := db.Begin()
+	assert.Equal(t, 2, count(txn1))
+	assert.Nil(t, db.Put([]byte("a-2"), []byte("2")))
+	assert.Nil(t, txn1.Put([]byte("count"), []byte("2")))
+	assert.Equal(t, ErrTxnConflict, txn1.Commit())
+
+	// 2.范围之外的写入不影响提交
+	txn2 := db.Begin()
+	assert.Equal(t, 3, count(txn2))
+	assert.Nil(t, db.Put([]byte("b-2"), []byte("2")))
+	assert.Nil(t, txn2.Put([]byte("count"), []byte("3")))
+	assert.Nil(t, txn2.Commit())
+
+	// 3.范围删除删掉了遍历过的 key
+	txn3 := db.Begin()
+	assert.Equal(t, 3, count(txn3))
+	assert.Nil(t, db.DeletePrefix([]byte("a-")))
+	assert.Nil(t, txn3.Put([]byte("count"), []byte("3")))
+	assert.Equal(t, ErrTxnConflict, txn3.Commit())
+
+	// 4.所有事务结束之后不再保留修改过的 key
+	txn4 := db.Begin()
+	assert.Nil(t, db.Put([]byte("c-1"), []byte("1")))
+	txn4.Rollback()
+	assert.Empty(t, db.txns.writes)
+	assert.Empty(t, db.txns.active)
+}
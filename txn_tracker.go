@@ -0,0 +1,86 @@
+package bitcask_go
+
+import "bytes"
+
+// txnTracker 记录读写事务开始之后其他写入修改过的 key，用于事务提交时的冲突检测
+// 每次修改 key 都会分配一个递增的版本号，事务读取时记录当时的版本号，
+// 提交时只要读取过的 key 或者遍历过的范围在之后被修改过就是冲突，merge 移动数据的位置不会改变版本号
+// 只有存在未结束的事务时才会保存修改过的 key，早于所有未结束事务的修改会被清理
+// 对共享的 DB实例的访问必须先持有锁
+type txnTracker struct {
+	version uint64         // 最近一次修改的版本号
+	active  map[uint64]int // 未结束的事务开始时的版本号 -> 事务数量
+	writes  []trackedWrite // 按照版本号递增排列的修改
+}
+
+type trackedWrite struct {
+	version uint64
+	key     []byte
+}
+
+// txnRange 事务的迭代器遍历的范围 [lower, upper)，upper 为空表示没有上界
+type txnRange struct {
+	lower, upper []byte
+	version      uint64 // 创建迭代器时的版本号
+}
+
+func newTxnTracker() *txnTracker {
+	return &txnTracker{active: make(map[uint64]int)}
+}
+
+// begin 登记一个新的事务，返回事务开始时的版本号
+func (t *txnTracker) begin() uint64 {
+	t.active[t.version]++
+	return t.version
+}
+
+// finish 事务提交或回滚之后注销，清理之后的事务不会再用到的修改
+func (t *txnTracker) finish(startVersion uint64) {
+	if t.active[startVersion]--; t.active[startVersion] <= 0 {
+		delete(t.active, startVersion)
+	}
+	if len(t.active) == 0 {
+		t.writes = nil
+		return
+	}
+	oldest := t.version
+	for v := range t.active {
+		oldest = min(oldest, v)
+	}
+	i := 0
+	for i < len(t.writes) && t.writes[i].version <= oldest {
+		i++
+	}
+	t.writes = t.writes[i:]
+}
+
+// recordWrite 记录 key 被修改，没有未结束的事务时只增加版本号
+func (t *txnTracker) recordWrite(key []byte) {
+	t.version++
+	if len(t.active) == 0 {
+		return
+	}
+	t.writes = append(t.writes, trackedWrite{version: t.version, key: append([]byte(nil), key...)})
+}
+
+// conflicts 判断事务读取之后，读取过的 key 或者遍历过的范围中是否有 key 被修改
+func (t *txnTracker) conflicts(startVersion uint64, reads map[string]uint64, ranges []txnRange) bool {
+	for _, w := range t.writes {
+		if w.version <= startVersion {
+			continue
+		}
+		if v, ok := reads[string(w.key)]; ok && w.version > v {
+			return true
+		}
+		for _, r := range ranges {
+			if w.version > r.version && r.contains(w.key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r txnRange) contains(key []byte) bool {
+	return bytes.Compare(key, r.lower) >= 0 && (len(r.upper) == 0 || bytes.Compare(key, r.upper) < 0)
+}
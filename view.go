@@ -0,0 +1,79 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/data"
+	"time"
+)
+
+// View 通过 GetView 读取的数据
+// 开启 MMapOlderFiles 时，旧数据文件中没有加密和压缩的 value 直接引用文件映射，读取时不需要拷贝
+// View 持有数据所在文件的引用，在 Release 之前即使文件被 merge 删除，映射依然有效
+// 还有没有释放的 View 时 Close 返回 ErrViewNotReleased
+type View struct {
+	db       *DB
+	value    []byte
+	files    map[uint32]*data.DataFile
+	released bool
+}
+
+// GetView 读取 key 对应的数据，返回的 View 使用完毕后需要调用 Release 释放
+// 活跃文件还在写入，其中的数据、分块存储的数据以及加密或压缩的数据依然会拷贝
+func (db *DB) GetView(key []byte) (*View, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+	// 引用数据文件需要持有写锁
+	db.lockSynced(true, key)
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	recordPos := db.index.Get(key)
+	if recordPos == nil || recordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	dataFile := db.dataFile(recordPos.Fid)
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+	var record *data.LogRecord
+	var err error
+	if dataFile == db.activeFile {
+		record, err = dataFile.ReadLogRecord(recordPos.Offset)
+	} else {
+		record, err = dataFile.ReadLogRecordView(recordPos.Offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, err := recordValue(db.dataFile, record)
+	if err != nil {
+		return nil, err
+	}
+	files := map[uint32]*data.DataFile{dataFile.FileID: dataFile}
+	db.pinFileSet(files)
+	db.views++
+	return &View{db: db, value: value, files: files}, nil
+}
+
+// Value 返回读取的数据，不能修改，Release 之后不能再使用
+func (v *View) Value() []byte {
+	if v.released {
+		return nil
+	}
+	return v.value
+}
+
+// Release 释放对数据文件的引用，可以重复调用
+func (v *View) Release() {
+	v.db.mu.Lock()
+	defer v.db.mu.Unlock()
+	if v.released {
+		return
+	}
+	v.released = true
+	v.db.views--
+	v.db.unpinFiles(v.files)
+	v.value = nil
+	v.files = nil
+}
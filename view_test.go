@@ -0,0 +1,105 @@
+package bitcask_go
+
+import (
+	"github.com/rbongIO/bitcask-go/fio"
+	"github.com/rbongIO/bitcask-go/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_MMapOlderFiles(t *testing.T) {
+	for _, typ := range []IndexerType{Btree, BPTree} {
+		dir, _ := os.MkdirTemp("", "bitcask-go-mmap-older")
+		opts := []OptionFunc{WithDirPath(dir), WithIndexType(typ), WithMaxDataFileSize(64 * 1024), WithMMapOlderFiles(true), WithDataFileMergeRatio(0)}
+		db, err := Open(opts...)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+		}
+		// 写满的活跃文件重新映射，活跃文件依然使用标准 IO
+		assert.Greater(t, len(db.olderFiles), 1)
+		for _, file := range db.olderFiles {
+			assert.IsType(t, &fio.MMap{}, file.IOManager)
+		}
+		assert.IsType(t, &fio.FileIO{}, db.activeFile.IOManager)
+
+		// 旧数据文件和活跃文件中的数据都可以通过 GetView 读取
+		for _, i := range []int{0, 999} {
+			expected, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			view, err := db.GetView(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, expected, view.Value())
+			view.Release()
+			view.Release()
+			assert.Nil(t, view.Value())
+		}
+		_, err = db.GetView(utils.GetTestKey(1000))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = db.GetView(nil)
+		assert.Equal(t, ErrKeyIsEmpty, err)
+
+		// merge 删除文件之后，未释放的 View 依然可以读取
+		key := utils.GetTestKey(1)
+		expected, err := db.Get(key)
+		assert.Nil(t, err)
+		view, err := db.GetView(key)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Merge())
+		assert.Equal(t, expected, view.Value())
+		view.Release()
+		for _, file := range db.olderFiles {
+			assert.IsType(t, &fio.MMap{}, file.IOManager)
+		}
+		val, err := db.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, val)
+		assert.Nil(t, db.Close())
+
+		// 重新打开之后旧数据文件保持映射
+		db, err = Open(opts...)
+		assert.Nil(t, err)
+		for _, file := range db.olderFiles {
+			assert.IsType(t, &fio.MMap{}, file.IOManager)
+		}
+		assert.IsType(t, &fio.FileIO{}, db.activeFile.IOManager)
+		view, err = db.GetView(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, view.Value())
+		view.Release()
+		destroyDB(db)
+	}
+}
+
+func TestDB_CloseWithView(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-close-view")
+	opts := []OptionFunc{WithDirPath(dir), WithMaxDataFileSize(64 * 1024), WithMMapOlderFiles(true)}
+	db, err := Open(opts...)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.GetTestValue(128)))
+	}
+	expected, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	view, err := db.GetView(utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	// 还有没有释放的 View 时拒绝关闭，映射依然有效
+	assert.Equal(t, ErrViewNotReleased, db.Close())
+	assert.Equal(t, expected, view.Value())
+	assert.Nil(t, db.Put(utils.GetTestKey(1000), []byte("value")))
+
+	view.Release()
+	assert.Nil(t, db.Close())
+	_, err = db.GetView(utils.GetTestKey(1))
+	assert.Equal(t, ErrDatabaseClosed, err)
+
+	// 拒绝关闭时没有释放文件锁，关闭之后可以重新打开
+	db, err = Open(opts...)
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value"), val)
+	destroyDB(db)
+}